@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "prmanager_http_request_duration_seconds",
+	Help:    "Time taken to handle API requests, by the route, method and status code of the request.",
+	Buckets: []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300},
+}, []string{"route", "method", "code"})
+
+// accessLogMiddleware is a middleware that logs every request once it was handled, along with the status code
+// and size of its response, the time it took, the client and the ID of the API key it was made with, and
+// records its duration in requestDuration. Requests of probes and scrapers are only logged at the debug level.
+func (r *Router) accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		w := &recordingWriter{ResponseWriter: writer}
+		next.ServeHTTP(w, request)
+		duration := time.Since(start)
+
+		status := w.status
+		if status == 0 {
+			// Handlers that return without writing anything implicitly respond with 200.
+			status = http.StatusOK
+		}
+		// The route is the pattern the request matched, so that the histogram isn't labelled by PR.
+		route := request.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		requestDuration.WithLabelValues(route, request.Method, strconv.Itoa(status)).Observe(duration.Seconds())
+
+		level := slog.LevelInfo
+		if route == "GET /readyz" || route == "GET /metrics" {
+			level = slog.LevelDebug
+		}
+		requestLogger(request).Log(context.Background(), level, "Handled request",
+			slog.String("route", route),
+			slog.Int("status", status),
+			slog.Duration("duration", duration),
+			slog.Int64("bytes", w.written),
+			slog.String("client", clientIP(request)),
+			slog.String("key_id", apiKeyID(request.Header.Get("X-API-Key"))),
+		)
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// aliasHost matches valid hosts of aliases: host names of at least two labels of lowercase letters, digits and
+// dashes.
+var aliasHost = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Alias is a human-friendly address players can join a pull request with, such as fall-damage.df-mc.dev, in
+// addition to the address matching Routes.PullRequests. Aliases are registered through the API and persisted
+// in the State, so they survive restarts.
+type Alias struct {
+	// Host is the address players join with.
+	Host string `json:"host"`
+	// PR is the number of the pull request, or the ID of a sandbox, that players joining with Host join.
+	PR string `json:"pr"`
+}
+
+// validate checks if the alias is well-formed.
+func (a Alias) validate() error {
+	if !aliasHost.MatchString(a.Host) || net.ParseIP(a.Host) != nil {
+		return fmt.Errorf("invalid host %q", a.Host)
+	}
+	if !validPullRequest(a.PR) {
+		return fmt.Errorf("invalid PR %q", a.PR)
+	}
+	return nil
+}
+
+// Aliases returns all aliases registered, sorted by their host.
+func (t *RoutingTable) Aliases() []Alias {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	aliases := make([]Alias, 0, len(t.aliases))
+	for host, pr := range t.aliases {
+		aliases = append(aliases, Alias{Host: host, PR: pr})
+	}
+	slices.SortFunc(aliases, func(a, b Alias) int {
+		return strings.Compare(a.Host, b.Host)
+	})
+	return aliases
+}
+
+// AliasesOf returns the hosts of all aliases of the given PR, sorted.
+func (t *RoutingTable) AliasesOf(pr string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var hosts []string
+	for host, target := range t.aliases {
+		if target == pr {
+			hosts = append(hosts, host)
+		}
+	}
+	slices.Sort(hosts)
+	return hosts
+}
+
+// RegisterAlias registers the alias passed, replacing any alias with the same host, and persists it in the
+// State.
+func (t *RoutingTable) RegisterAlias(alias Alias) error {
+	if err := alias.validate(); err != nil {
+		return err
+	}
+	return t.updateAliases(func(aliases map[string]string) {
+		aliases[alias.Host] = alias.PR
+	})
+}
+
+// RemoveAlias removes the alias with the host passed. If no such alias is registered, false is returned.
+func (t *RoutingTable) RemoveAlias(host string) (bool, error) {
+	found := false
+	err := t.updateAliases(func(aliases map[string]string) {
+		_, found = aliases[host]
+		delete(aliases, host)
+	})
+	return found, err
+}
+
+// updateAliases calls the function passed with the aliases persisted in the State, allowing them to be
+// modified, and updates the aliases routed accordingly.
+func (t *RoutingTable) updateAliases(f func(aliases map[string]string)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var aliases map[string]string
+	if err := t.state.Update(func(data *stateData) {
+		f(data.Aliases)
+		aliases = maps.Clone(data.Aliases)
+	}); err != nil {
+		return fmt.Errorf("save aliases: %w", err)
+	}
+	t.aliases = aliases
+	return nil
+}
+
+// RemoveAliasesOf removes all aliases of the given PR.
+func (t *RoutingTable) RemoveAliasesOf(pr string) error {
+	return t.updateAliases(func(aliases map[string]string) {
+		maps.DeleteFunc(aliases, func(_, target string) bool { return target == pr })
+	})
+}
+
+// aliasConflict returns why players joining with the host passed can't be routed by an alias, as they are
+// routed by a static route or backend, which take precedence over aliases, or the host is the address of a pull
+// request. An empty string is returned if the host may be used for an alias.
+func (t *RoutingTable) aliasConflict(host string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if slices.ContainsFunc(t.routes.Static, func(static StaticRoute) bool { return serverHost(static.Host) == host }) {
+		return "Host is routed by a static route"
+	}
+	if backend, ok := t.backend(host); ok {
+		return fmt.Sprintf("Host is routed by static backend %s", backend.Name)
+	}
+	if t.pattern.MatchString(host) {
+		return "Host is the address of a pull request"
+	}
+	return ""
+}
+
+// backendConflict returns the host of an alias the pattern of the static backend passed matches, which would
+// no longer route to its pull request, or false if it matches none.
+func (t *RoutingTable) backendConflict(backend StaticBackend) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, host := range slices.Sorted(maps.Keys(t.aliases)) {
+		if backend.matches(host) {
+			return host, true
+		}
+	}
+	return "", false
+}
+
+// aliasBackend is a Backend that removes the aliases of pull requests as they are deleted, so that they don't
+// route players to a pull request deployed with the same number later.
+type aliasBackend struct {
+	Backend
+	routes *RoutingTable
+}
+
+// DeleteServer ...
+func (b aliasBackend) DeleteServer(ctx context.Context, pr string) {
+	b.Backend.DeleteServer(ctx, pr)
+	if err := b.routes.RemoveAliasesOf(pr); err != nil {
+		slog.WarnContext(ctx, "Failed to remove aliases", slog.String("pr", pr), slog.Any("error", err))
+	}
+}
+
+// handleListAliases handles listing all aliases registered.
+func (r *Router) handleListAliases(writer http.ResponseWriter, _ *http.Request) {
+	writeJSON(writer, http.StatusOK, r.routes.Aliases())
+}
+
+// handlePutAlias handles registering an alias with the host in the path of the request for the pull request in
+// its body, replacing any alias previously registered with the host.
+func (r *Router) handlePutAlias(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	var alias Alias
+	if err := json.NewDecoder(request.Body).Decode(&alias); err != nil {
+		logger.Warn("Failed to decode alias", slog.Any("error", err))
+		http.Error(writer, "Failed to decode alias", http.StatusBadRequest)
+		return
+	}
+	alias.Host = serverHost(request.PathValue("host"))
+	if err := alias.validate(); err != nil {
+		logger.Warn("Invalid alias", slog.String("host", alias.Host), slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Invalid alias: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !pullRequestExists(alias.PR) {
+		logger.Warn("PR not found", "pr", alias.PR)
+		http.Error(writer, "PR not found", http.StatusNotFound)
+		return
+	}
+	// Aliases are only registered under the domain of pull requests, so that they can't take over the
+	// addresses of other servers.
+	if !strings.HasSuffix(alias.Host, "."+r.conf.DNS.Domain) {
+		http.Error(writer, fmt.Sprintf("Host must be a subdomain of %s", r.conf.DNS.Domain), http.StatusBadRequest)
+		return
+	}
+	if reason := r.routes.aliasConflict(alias.Host); reason != "" {
+		http.Error(writer, reason, http.StatusConflict)
+		return
+	}
+	if err := r.routes.RegisterAlias(alias); err != nil {
+		logger.Error("Failed to register alias", slog.String("host", alias.Host), slog.Any("error", err))
+		http.Error(writer, "Failed to register alias", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Registered alias", slog.String("host", alias.Host), slog.String("pr", alias.PR))
+	writeJSON(writer, http.StatusOK, alias)
+}
+
+// handleDeleteAlias handles removing the alias with the host in the path of the request.
+func (r *Router) handleDeleteAlias(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	host := serverHost(request.PathValue("host"))
+	found, err := r.routes.RemoveAlias(host)
+	if err != nil {
+		logger.Error("Failed to remove alias", slog.String("host", host), slog.Any("error", err))
+		http.Error(writer, "Failed to remove alias", http.StatusInternalServerError)
+		return
+	} else if !found {
+		http.Error(writer, "Alias not found", http.StatusNotFound)
+		return
+	}
+	logger.Info("Removed alias", slog.String("host", host))
+	writer.WriteHeader(http.StatusNoContent)
+}
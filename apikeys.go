@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// scopeAPI is the scope of API keys granting the same access as API_KEY.
+	scopeAPI = "api"
+	// scopeRead is the scope of API keys granting the same access as READ_API_KEY.
+	scopeRead = "read"
+	// scopeBackend is the scope of API keys used by backends, only granting access to fetching handoff tokens.
+	scopeBackend = "backend"
+)
+
+// APIKey is an API key created through the API. Only the hash of the key is stored, so the key itself can't be
+// recovered from the state.
+type APIKey struct {
+	// ID is the ID of the key, the same ID recorded as the deployer of pull requests deployed with it.
+	ID string `json:"id"`
+	// Name describes what the key is used by, such as ci.
+	Name string `json:"name"`
+	// Scope is the access the key grants: scopeAPI, scopeRead or scopeBackend.
+	Scope   string    `json:"scope"`
+	Created time.Time `json:"created"`
+	// Hash is the hex encoded SHA-256 hash of the key.
+	Hash string `json:"hash,omitempty"`
+}
+
+// newAPIKey generates a new random key with the name and scope passed. The key itself is returned along with
+// the APIKey holding its hash.
+func newAPIKey(name, scope string) (string, APIKey) {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	key := hex.EncodeToString(b)
+	sum := sha256.Sum256([]byte(key))
+	return key, APIKey{ID: apiKeyID(key), Name: name, Scope: scope, Created: time.Now(), Hash: hex.EncodeToString(sum[:])}
+}
+
+// storedKey checks if the key provided by a client is an API key created through the API with one of the
+// scopes passed.
+func (r *Router) storedKey(provided string, scopes []string) bool {
+	if provided == "" || len(scopes) == 0 {
+		return false
+	}
+	var key APIKey
+	var ok bool
+	r.state.View(func(data *stateData) {
+		key, ok = data.APIKeys[apiKeyID(provided)]
+	})
+	if !ok || !slices.Contains(scopes, key.Scope) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(provided))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(key.Hash)) == 1
+}
+
+// apiKeyRequest is the body of a request creating an API key.
+type apiKeyRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+// createdAPIKey is the response to creating or rotating an API key, the only time the key itself is returned.
+type createdAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// handleListAPIKeys handles listing the API keys created through the API, without their hashes.
+func (r *Router) handleListAPIKeys(writer http.ResponseWriter, _ *http.Request) {
+	var keys []APIKey
+	r.state.View(func(data *stateData) {
+		keys = make([]APIKey, 0, len(data.APIKeys))
+		for _, key := range data.APIKeys {
+			key.Hash = ""
+			keys = append(keys, key)
+		}
+	})
+	slices.SortFunc(keys, func(a, b APIKey) int { return a.Created.Compare(b.Created) })
+	writeJSON(writer, http.StatusOK, keys)
+}
+
+// handleCreateAPIKey handles creating an API key with the name and scope in the body of the request. The key is
+// only returned in the response.
+func (r *Router) handleCreateAPIKey(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	var req apiKeyRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		logger.Warn("Failed to decode API key", slog.Any("error", err))
+		http.Error(writer, "Failed to decode API key", http.StatusBadRequest)
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = scopeAPI
+	}
+	if req.Scope != scopeAPI && req.Scope != scopeRead && req.Scope != scopeBackend {
+		http.Error(writer, "Scope must be api, read or backend", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 64 {
+		http.Error(writer, "Name must be between 1 and 64 characters", http.StatusBadRequest)
+		return
+	}
+	key, stored := newAPIKey(req.Name, req.Scope)
+	if err := r.state.Update(func(data *stateData) {
+		data.APIKeys[stored.ID] = stored
+	}); err != nil {
+		logger.Error("Failed to save API key", slog.Any("error", err))
+		http.Error(writer, "Failed to save API key", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Created API key", "key_id", stored.ID, "name", stored.Name, "scope", stored.Scope)
+	stored.Hash = ""
+	writeJSON(writer, http.StatusCreated, createdAPIKey{APIKey: stored, Key: key})
+}
+
+// handleRotateAPIKey handles replacing the API key with the ID in the path of the request with a new key with
+// the same name and scope. The old key stops working immediately.
+func (r *Router) handleRotateAPIKey(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	id := request.PathValue("id")
+	var key string
+	var stored APIKey
+	var found bool
+	if err := r.state.Update(func(data *stateData) {
+		var old APIKey
+		if old, found = data.APIKeys[id]; !found {
+			return
+		}
+		delete(data.APIKeys, id)
+		key, stored = newAPIKey(old.Name, old.Scope)
+		data.APIKeys[stored.ID] = stored
+	}); err != nil {
+		logger.Error("Failed to save API key", slog.Any("error", err))
+		http.Error(writer, "Failed to save API key", http.StatusInternalServerError)
+		return
+	} else if !found {
+		http.Error(writer, "API key not found", http.StatusNotFound)
+		return
+	}
+	logger.Info("Rotated API key", "key_id", id, "new_key_id", stored.ID, "name", stored.Name)
+	stored.Hash = ""
+	writeJSON(writer, http.StatusCreated, createdAPIKey{APIKey: stored, Key: key})
+}
+
+// handleDeleteAPIKey handles revoking the API key with the ID in the path of the request.
+func (r *Router) handleDeleteAPIKey(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	id := request.PathValue("id")
+	var found bool
+	if err := r.state.Update(func(data *stateData) {
+		if _, found = data.APIKeys[id]; found {
+			delete(data.APIKeys, id)
+		}
+	}); err != nil {
+		logger.Error("Failed to remove API key", slog.Any("error", err))
+		http.Error(writer, "Failed to remove API key", http.StatusInternalServerError)
+		return
+	} else if !found {
+		http.Error(writer, "API key not found", http.StatusNotFound)
+		return
+	}
+	logger.Info("Revoked API key", "key_id", id)
+	writer.WriteHeader(http.StatusNoContent)
+}
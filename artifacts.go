@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// errArtifactNotFound is returned when downloading a binary that was not kept.
+var errArtifactNotFound = errors.New("binary not found")
+
+// Artifact is a binary uploaded for a pull request that is kept after its image was built, so that the exact
+// binary a server ran can be downloaded later.
+type Artifact struct {
+	// Build identifies the binary among those of the same pull request. It is the CI build number it was
+	// uploaded with or, if none was passed, derived from the time it was uploaded.
+	Build string `json:"build"`
+	// Uploaded is the time the binary was uploaded.
+	Uploaded time.Time `json:"uploaded"`
+	// Size is the size of the binary in bytes.
+	Size int64 `json:"size"`
+}
+
+// artifactBuildPattern matches build numbers that can be used as the name of the file of an artifact.
+var artifactBuildPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// artifactDir returns the directory the binaries kept of the given PR are stored in.
+func artifactDir(pr string) string {
+	return filepath.Join("artifacts", "pr-"+pr)
+}
+
+// keepBinary keeps the binary currently uploaded for the given PR as the artifact of the build passed. If the
+// build can't be used as a file name, such as when it is empty, an ID derived from the current time is used
+// instead. Only the keep most recent artifacts are retained, unless keep is zero.
+func keepBinary(pr, build string, keep int) (Artifact, error) {
+	if !artifactBuildPattern.MatchString(build) || build == "." || build == ".." {
+		build = time.Now().Format(snapshotIDFormat)
+	}
+	if err := os.MkdirAll(artifactDir(pr), 0755); err != nil {
+		return Artifact{}, fmt.Errorf("create artifact directory: %w", err)
+	}
+	path := filepath.Join(artifactDir(pr), build)
+	// A build uploaded again replaces the binary kept for it.
+	_ = os.Remove(path)
+	if err := copyFile(binaryPath(pr), path, 0755); err != nil {
+		return Artifact{}, fmt.Errorf("copy binary: %w", err)
+	}
+	// The binary may be a hard link, so its modification time is that of the upload rather than now.
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	info, err := os.Stat(path)
+	if err != nil {
+		return Artifact{}, fmt.Errorf("stat binary: %w", err)
+	}
+
+	artifacts, err := listArtifacts(pr)
+	if err != nil {
+		return Artifact{}, err
+	}
+	if keep > 0 && len(artifacts) > keep {
+		for _, a := range artifacts[:len(artifacts)-keep] {
+			_ = os.Remove(filepath.Join(artifactDir(pr), a.Build))
+		}
+	}
+	return Artifact{Build: build, Uploaded: now, Size: info.Size()}, nil
+}
+
+// listArtifacts returns the artifacts kept of the given PR, from oldest to newest.
+func listArtifacts(pr string) ([]Artifact, error) {
+	entries, err := os.ReadDir(artifactDir(pr))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Artifact{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	artifacts := make([]Artifact, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		artifacts = append(artifacts, Artifact{Build: entry.Name(), Uploaded: info.ModTime(), Size: info.Size()})
+	}
+	slices.SortFunc(artifacts, func(a, b Artifact) int {
+		return a.Uploaded.Compare(b.Uploaded)
+	})
+	return artifacts, nil
+}
+
+// artifactPath returns the path of the artifact of the given PR and build. If build is empty, the path of the
+// binary currently uploaded is returned. If there is no such binary, errArtifactNotFound is returned.
+func artifactPath(pr, build string) (string, error) {
+	path := binaryPath(pr)
+	if build != "" {
+		if !artifactBuildPattern.MatchString(build) || build == "." || build == ".." {
+			return "", errArtifactNotFound
+		}
+		path = filepath.Join(artifactDir(pr), build)
+	}
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return "", errArtifactNotFound
+	}
+	return path, nil
+}
+
+// maxBuildHistory is the number of builds recorded per pull request in its build history.
+const maxBuildHistory = 50
+
+// BuildRecord is a build of a pull request in its build history.
+type BuildRecord struct {
+	// Build is the CI build number the binary was uploaded with, if any.
+	Build string `json:"build,omitempty"`
+	// Commit is the commit SHA the binary was built from, if provided.
+	Commit string `json:"commit,omitempty"`
+	// Artifact is the build the binary is kept as, if it was kept.
+	Artifact string `json:"artifact,omitempty"`
+	// Size is the size of the binary in bytes.
+	Size int64 `json:"size"`
+	// SHA256 is the hex encoded SHA-256 hash of the binary.
+	SHA256 string `json:"sha256"`
+	// Uploaded is the time the binary was uploaded.
+	Uploaded time.Time `json:"uploaded"`
+	// Deployer is the ID of the API key the binary was uploaded with, if any.
+	Deployer string `json:"deployer,omitempty"`
+	// Profile is the name of the profile the image was built with.
+	Profile string `json:"profile,omitempty"`
+	// Image is the size and layers of the image built from the binary, if they could be determined.
+	Image *ImageReport `json:"image,omitempty"`
+}
+
+// recordBuild records the binary currently uploaded for the PR of the deployment passed in its build history,
+// along with the build it was kept as, if any.
+func (r *Router) recordBuild(deployment Deployment, artifact string) error {
+	path := binaryPath(deployment.PR)
+	size, sum, err := hashFile(path)
+	if err != nil {
+		return fmt.Errorf("hash binary: %w", err)
+	}
+	record := BuildRecord{
+		Build:    deployment.Build,
+		Commit:   deployment.Commit,
+		Artifact: artifact,
+		Size:     size,
+		SHA256:   sum,
+		Uploaded: deployment.Deployed,
+		Deployer: deployment.Deployer,
+		Profile:  deployment.Profile,
+	}
+	return r.state.Update(func(data *stateData) {
+		if report, ok := data.Images[deployment.PR]; ok {
+			record.Image = &report
+		}
+		builds := append(data.Builds[deployment.PR], record)
+		if len(builds) > maxBuildHistory {
+			builds = builds[len(builds)-maxBuildHistory:]
+		}
+		data.Builds[deployment.PR] = builds
+	})
+}
+
+// hashFile returns the size and hex encoded SHA-256 hash of the file at the path passed.
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// removeArtifacts removes all artifacts kept of the given PR.
+func removeArtifacts(pr string) {
+	_ = os.RemoveAll(artifactDir(pr))
+}
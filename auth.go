@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// keyEqual checks if the key provided by a client equals the key passed in constant time. Both keys are hashed
+// first, so that the time taken doesn't reveal the length of the key either.
+func keyEqual(provided, key string) bool {
+	a, b := sha256.Sum256([]byte(provided)), sha256.Sum256([]byte(key))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// authGuard counts the failed authentication attempts of every client, identified by its IP address, and bans
+// clients that fail too often for a while, so that API keys can't be brute-forced.
+type authGuard struct {
+	maxFailures int
+	ban         time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*authFailures
+	pruned  time.Time
+}
+
+// authFailures are the failed authentication attempts of a client.
+type authFailures struct {
+	count int
+	// last is the time of the last failed attempt. Attempts are forgotten once the ban duration passed since.
+	last   time.Time
+	banned time.Time
+}
+
+// newAuthGuard creates an authGuard banning clients for the duration passed once they made maxFailures failed
+// attempts, each within the ban duration of the previous one. If maxFailures is zero, clients are never banned.
+func newAuthGuard(maxFailures int, ban time.Duration) *authGuard {
+	return &authGuard{maxFailures: maxFailures, ban: ban, clients: make(map[string]*authFailures)}
+}
+
+// banned returns the time left until the ban of the client passed is lifted, or false if it isn't banned.
+func (g *authGuard) banned(client string) (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.clients[client]
+	if !ok {
+		return 0, false
+	}
+	left := time.Until(f.banned)
+	return left, left > 0
+}
+
+// fail records a failed authentication attempt of the client passed and reports if the client is now banned.
+func (g *authGuard) fail(client string) bool {
+	if g.maxFailures == 0 {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if now.Sub(g.pruned) > time.Minute {
+		for c, f := range g.clients {
+			if now.Sub(f.last) > g.ban && now.After(f.banned) {
+				delete(g.clients, c)
+			}
+		}
+		g.pruned = now
+	}
+	f, ok := g.clients[client]
+	if !ok || now.Sub(f.last) > g.ban {
+		f = &authFailures{}
+		g.clients[client] = f
+	}
+	f.count++
+	f.last = now
+	if f.count < g.maxFailures {
+		return false
+	}
+	f.count, f.banned = 0, now.Add(g.ban)
+	return true
+}
+
+// authorize checks if the request passed carries one of the keys passed, or an API key created through the API
+// with one of the scopes passed, in its X-API-Key header, answering it with 401 if it doesn't. Requests of
+// clients banned for failing too often are answered with 429 without checking their key. The key provided is
+// never logged.
+func (r *Router) authorize(writer http.ResponseWriter, request *http.Request, scopes []string, keys ...string) bool {
+	client := clientIP(request)
+	if left, ok := r.guard.banned(client); ok {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(left.Seconds())+1))
+		http.Error(writer, "Too many failed authentication attempts", http.StatusTooManyRequests)
+		return false
+	}
+	provided := request.Header.Get("X-API-Key")
+	for _, key := range keys {
+		// An empty key is never accepted, so that a key that isn't set doesn't disable authentication.
+		if key != "" && keyEqual(provided, key) {
+			return true
+		}
+	}
+	if r.storedKey(provided, scopes) {
+		return true
+	}
+	logger := requestLogger(request)
+	if r.guard.fail(client) {
+		logger.Warn("Banned client after too many failed authentication attempts", "client", client, slog.Duration("duration", r.guard.ban))
+	} else {
+		logger.Warn("Invalid API key", "client", client)
+	}
+	http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
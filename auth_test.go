@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyEqual(t *testing.T) {
+	tests := []struct {
+		provided, key string
+		equal         bool
+	}{
+		{"secret", "secret", true},
+		{"secret", "Secret", false},
+		{"secre", "secret", false},
+		{"secrets", "secret", false},
+		{"", "secret", false},
+	}
+	for _, tt := range tests {
+		if got := keyEqual(tt.provided, tt.key); got != tt.equal {
+			t.Errorf("keyEqual(%q, %q) = %v, want %v", tt.provided, tt.key, got, tt.equal)
+		}
+	}
+}
+
+func TestAuthGuard(t *testing.T) {
+	g := newAuthGuard(3, time.Minute)
+	for i := range 2 {
+		if g.fail("10.0.0.1") {
+			t.Fatalf("banned after %d failures, want 3", i+1)
+		}
+	}
+	if _, banned := g.banned("10.0.0.1"); banned {
+		t.Fatal("banned before reaching the maximum failures")
+	}
+	if !g.fail("10.0.0.1") {
+		t.Fatal("not banned after 3 failures")
+	}
+	if left, banned := g.banned("10.0.0.1"); !banned || left <= 0 || left > time.Minute {
+		t.Errorf("banned = %v with %v left, want banned for up to a minute", banned, left)
+	}
+	if _, banned := g.banned("10.0.0.2"); banned {
+		t.Error("other client is banned")
+	}
+
+	// Failures older than the ban duration are forgotten.
+	g = newAuthGuard(2, time.Minute)
+	g.fail("10.0.0.1")
+	g.clients["10.0.0.1"].last = time.Now().Add(-2 * time.Minute)
+	if g.fail("10.0.0.1") {
+		t.Error("banned after a failure that should have been forgotten")
+	}
+
+	g = newAuthGuard(0, time.Minute)
+	for range 100 {
+		if g.fail("10.0.0.1") {
+			t.Fatal("banned while bans are disabled")
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// apiTimeout is the time quick operations on the containers of pull requests, such as listing or pausing
+	// them, are given when they are not performed on behalf of an API request.
+	apiTimeout = time.Second * 30
+	// startTimeout is the time the server of a pull request is given to start when a player joins.
+	startTimeout = time.Minute * 2
+)
+
+// Backend manages the images and servers of pull requests. It is implemented by Cluster, which runs servers
+// in containers across one or more hosts, and by FakeBackend, which only simulates them in memory.
+type Backend interface {
+	// BuildImage builds the image of the given PR from its uploaded binary, recording the deployment passed.
+	BuildImage(ctx context.Context, pr string, deployment Deployment) error
+	// BuildBinary builds the binary of the given PR from the source in the directory passed with the
+	// SourceDockerfile of the profile passed, exporting the last stage of the build into the directory dest.
+	BuildBinary(ctx context.Context, pr string, profile ProfileConfig, source, dest string) error
+	// ImageReport returns the size and layers of the image of the given PR.
+	ImageReport(ctx context.Context, pr string) (ImageReport, error)
+	// Deployments returns the deployments of all pull requests that have an image, sorted by their number.
+	Deployments(ctx context.Context) ([]Deployment, error)
+	// Deployment returns the deployment of the given PR, or false if it has no image.
+	Deployment(ctx context.Context, pr string) (Deployment, bool, error)
+	// StartServer starts the server of the given PR and returns the public address and port it can be
+	// reached on. If the server could not be found after starting, false is returned.
+	StartServer(ctx context.Context, pr string) (string, uint16, bool, error)
+	// StopServer stops the server of the given PR.
+	StopServer(ctx context.Context, pr string) (StopResult, error)
+	// PauseServer pauses the server of the given PR, keeping it in memory so that it can be resumed quickly.
+	PauseServer(ctx context.Context, pr string) error
+	// UnpauseServer resumes the server of the given PR if it is paused.
+	UnpauseServer(ctx context.Context, pr string) error
+	// DeleteServer removes the server, image and data of the given PR.
+	DeleteServer(ctx context.Context, pr string)
+	// ServerAddress returns the public address and port of the server of the given PR, or false if the server
+	// is not running.
+	ServerAddress(ctx context.Context, pr string) (string, uint16, bool, error)
+	// Servers returns all servers that are currently running.
+	Servers(ctx context.Context) ([]Server, error)
+	// Stats returns the resource usage of the server of the given PR, or false if it is not running.
+	Stats(ctx context.Context, pr string, sample bool) (ContainerStats, bool, error)
+	// Attach opens an interactive connection to the console of the server of the given PR.
+	Attach(ctx context.Context, pr string) (io.ReadWriteCloser, error)
+	// Logs opens the current log file of the server of the given PR. An error satisfying
+	// errors.Is(err, os.ErrNotExist) is returned if the PR has no logs.
+	Logs(pr string) (io.ReadCloser, error)
+}
+
+// Logs opens the current log file of the server of the given PR. Logs are collected on the local host for
+// servers on every host, so they are always read from disk.
+func (c *Cluster) Logs(pr string) (io.ReadCloser, error) {
+	return os.Open(logPath(pr))
+}
+
+// FakeBackend is a Backend that keeps images and servers in memory without running any containers. Servers
+// started are assigned consecutive ports on a fixed address and never actually accept connections. It allows
+// the Router and Listener to be exercised without a container runtime.
+type FakeBackend struct {
+	address  string
+	nextPort uint16
+	shared   bool
+
+	mu      sync.Mutex
+	images  map[string]Deployment
+	servers map[string]Server
+	logs    map[string]*bytes.Buffer
+}
+
+// NewFakeBackend creates a new FakeBackend that reports servers on the address passed, assigning ports
+// starting from the port passed. If shared is true, every server is reported on the port passed instead, for
+// example so that players are all transferred to the same echo server.
+func NewFakeBackend(address string, port uint16, shared bool) *FakeBackend {
+	return &FakeBackend{
+		address:  address,
+		nextPort: port,
+		shared:   shared,
+
+		images:  make(map[string]Deployment),
+		servers: make(map[string]Server),
+		logs:    make(map[string]*bytes.Buffer),
+	}
+}
+
+// BuildImage ...
+func (f *FakeBackend) BuildImage(_ context.Context, pr string, deployment Deployment) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.images[pr] = deployment
+	delete(f.servers, pr)
+	f.logf(pr, "built image pr-%s", pr)
+	return nil
+}
+
+// BuildBinary exports the executable of prmanager itself as the binary, as it is a valid binary for the
+// architecture of the default profile.
+func (f *FakeBackend) BuildBinary(_ context.Context, pr string, _ ProfileConfig, _, dest string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.logf(pr, "built binary of pr-%s from source", pr)
+	f.mu.Unlock()
+	return copyFile(executable, filepath.Join(dest, "dragonfly"), 0755)
+}
+
+// ImageReport returns an empty report, as images of the FakeBackend have no layers.
+func (f *FakeBackend) ImageReport(_ context.Context, pr string) (ImageReport, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.images[pr]; !ok {
+		return ImageReport{}, fmt.Errorf("%w: no image for PR %s", errImageNotFound, pr)
+	}
+	return ImageReport{Layers: []ImageLayer{}}, nil
+}
+
+// Deployments ...
+func (f *FakeBackend) Deployments(context.Context) ([]Deployment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deployments := make([]Deployment, 0, len(f.images))
+	for _, deployment := range f.images {
+		deployments = append(deployments, deployment)
+	}
+	sortDeployments(deployments)
+	return deployments, nil
+}
+
+// Deployment ...
+func (f *FakeBackend) Deployment(_ context.Context, pr string) (Deployment, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deployment, ok := f.images[pr]
+	return deployment, ok, nil
+}
+
+// PullImage ...
+func (f *FakeBackend) PullImage(_ context.Context, ref string) error {
+	slog.Info("Fake backend: pulled image", slog.String("ref", ref))
+	return nil
+}
+
+// StartServer ...
+func (f *FakeBackend) StartServer(_ context.Context, pr string) (string, uint16, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.images[pr]; !ok {
+		return "", 0, false, fmt.Errorf("%w: no image for PR %s", errImageNotFound, pr)
+	}
+	if srv, ok := f.servers[pr]; ok {
+		return srv.Address, srv.Port, true, nil
+	}
+	srv := Server{PR: pr, Host: "fake", Address: f.address, PrivateAddress: f.address, Port: f.nextPort, Started: time.Now()}
+	if !f.shared {
+		f.nextPort++
+	}
+	f.servers[pr] = srv
+	f.logf(pr, "started server on %s:%d", srv.Address, srv.Port)
+	return srv.Address, srv.Port, true, nil
+}
+
+// StopServer ...
+func (f *FakeBackend) StopServer(_ context.Context, pr string) (StopResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.servers[pr]; !ok {
+		return StopNotRunning, nil
+	}
+	delete(f.servers, pr)
+	f.logf(pr, "stopped server")
+	return StopGraceful, nil
+}
+
+// PauseServer ...
+func (f *FakeBackend) PauseServer(_ context.Context, pr string) error {
+	return f.setPaused(pr, true)
+}
+
+// UnpauseServer ...
+func (f *FakeBackend) UnpauseServer(_ context.Context, pr string) error {
+	return f.setPaused(pr, false)
+}
+
+// setPaused marks the server of the given PR as paused or unpaused.
+func (f *FakeBackend) setPaused(pr string, paused bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	srv, ok := f.servers[pr]
+	if !ok {
+		return fmt.Errorf("server of PR %s: %w", pr, errContainerNotFound)
+	}
+	srv.Paused = paused
+	f.servers[pr] = srv
+	f.logf(pr, "set paused to %v", paused)
+	return nil
+}
+
+// DeleteServer ...
+func (f *FakeBackend) DeleteServer(_ context.Context, pr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.images, pr)
+	delete(f.servers, pr)
+	delete(f.logs, pr)
+	slog.Debug("Fake backend deleted server", slog.String("pr", pr))
+}
+
+// ServerAddress ...
+func (f *FakeBackend) ServerAddress(_ context.Context, pr string) (string, uint16, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	srv, ok := f.servers[pr]
+	return srv.Address, srv.Port, ok, nil
+}
+
+// Servers ...
+func (f *FakeBackend) Servers(context.Context) ([]Server, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	servers := make([]Server, 0, len(f.servers))
+	for _, srv := range f.servers {
+		servers = append(servers, srv)
+	}
+	return servers, nil
+}
+
+// Stats ...
+func (f *FakeBackend) Stats(_ context.Context, pr string, _ bool) (ContainerStats, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	srv, ok := f.servers[pr]
+	if !ok {
+		return ContainerStats{}, false, nil
+	}
+	return ContainerStats{CPUSeconds: time.Since(srv.Started).Seconds() / 100}, true, nil
+}
+
+// Logs ...
+func (f *FakeBackend) Logs(pr string) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	buf, ok := f.logs[pr]
+	if !ok {
+		return nil, fmt.Errorf("logs of PR %s: %w", pr, os.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(bytes.Clone(buf.Bytes()))), nil
+}
+
+// Attach ...
+func (f *FakeBackend) Attach(_ context.Context, pr string) (io.ReadWriteCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.servers[pr]; !ok {
+		return nil, fmt.Errorf("server of PR %s: %w", pr, errContainerNotFound)
+	}
+	// The fake console echoes back everything written to it.
+	r, w := io.Pipe()
+	return &console{Reader: r, Writer: w, close: func() error {
+		_ = w.Close()
+		return r.Close()
+	}}, nil
+}
+
+// logf appends a line to the fake logs of the given PR. f.mu must be held.
+func (f *FakeBackend) logf(pr, format string, a ...any) {
+	buf, ok := f.logs[pr]
+	if !ok {
+		buf = new(bytes.Buffer)
+		f.logs[pr] = buf
+	}
+	_, _ = fmt.Fprintf(buf, time.Now().Format(time.RFC3339)+" "+format+"\n", a...)
+	slog.Info("Fake backend: "+fmt.Sprintf(format, a...), slog.String("pr", pr))
+}
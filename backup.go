@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackupManager periodically archives the world directories of pull requests to S3-compatible object storage,
+// so that the worlds of interesting test sessions are kept after their pull request is deleted. Only the
+// newest backups of every pull request are retained.
+type BackupManager struct {
+	backend Backend
+	state   *State
+	conf    Config
+	client  *s3Client
+
+	prefix   string
+	interval time.Duration
+	keep     int
+
+	mu         sync.Mutex
+	lastBackup map[string]time.Time
+}
+
+// NewBackupManager creates a new BackupManager using the backup configuration passed. If no bucket is
+// configured, the BackupManager returned does nothing. The credentials for the bucket are read from the
+// BACKUP_ACCESS_KEY_ID and BACKUP_SECRET_ACCESS_KEY environment variables.
+func NewBackupManager(backend Backend, state *State, conf Config) (*BackupManager, error) {
+	b := &BackupManager{
+		backend: backend,
+		state:   state,
+		conf:    conf,
+
+		prefix:   conf.Backup.Prefix,
+		interval: conf.Backup.Interval,
+		keep:     conf.Backup.Keep,
+
+		lastBackup: make(map[string]time.Time),
+	}
+	if conf.Backup.Bucket == "" {
+		return b, nil
+	}
+	client, err := newS3Client(conf.Backup.Endpoint, conf.Backup.Bucket, conf.Backup.Region, os.Getenv("BACKUP_ACCESS_KEY_ID"), os.Getenv("BACKUP_SECRET_ACCESS_KEY"))
+	if err != nil {
+		return nil, fmt.Errorf("create s3 client: %w", err)
+	}
+	b.client = client
+	return b, nil
+}
+
+// Job returns the Job backing up the worlds of all pull requests that changed since their last backup every
+// interval. If backups are not configured, the job only runs when triggered, and does nothing.
+func (b *BackupManager) Job() Job {
+	job := Job{Name: "backups", Run: b.backupAll}
+	if b.client != nil {
+		job.Interval = b.interval
+	}
+	return job
+}
+
+// backupAll backs up the worlds of all known pull requests that were modified since their last backup. Pull
+// requests scheduled on remote hosts are skipped, as their worlds can't be backed up.
+func (b *BackupManager) backupAll(ctx context.Context) error {
+	if b.client == nil {
+		return nil
+	}
+	known, err := knownPullRequests()
+	if err != nil {
+		return fmt.Errorf("list pull requests: %w", err)
+	}
+	var failed int
+	for pr := range known {
+		if err := localWorld(b.state, b.conf, pr); err != nil {
+			slog.Debug("Skipped backing up world", "pr", pr, slog.Any("error", err))
+			continue
+		}
+		modified, err := lastModified(worldDir(pr))
+		if err != nil {
+			slog.Error("Failed to check world for changes", "pr", pr, slog.Any("error", err))
+			failed++
+			continue
+		}
+		b.mu.Lock()
+		last, ok := b.lastBackup[pr]
+		b.mu.Unlock()
+		if ok && !modified.After(last) {
+			continue
+		}
+		if err := b.Backup(ctx, pr); err != nil {
+			slog.Error("Failed to back up world", "pr", pr, slog.Any("error", err))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to back up %d of %d worlds", failed, len(known))
+	}
+	return nil
+}
+
+// Backup archives the world of the given PR and uploads it, after which backups exceeding the retention of the PR
+// are removed. If backups are not configured, Backup does nothing. The worlds of PRs scheduled on remote hosts
+// are kept in a named volume there rather than in their world directory, so they aren't backed up and an error
+// satisfying errors.Is(err, errWorldNotLocal) is returned.
+func (b *BackupManager) Backup(ctx context.Context, pr string) error {
+	if b.client == nil {
+		return nil
+	}
+	if err := localWorld(b.state, b.conf, pr); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp("", "prmanager-backup-*.tar.gz")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	started := time.Now()
+	err = withServerPaused(ctx, b.backend, pr, func() error {
+		if err := ensureDiskImageMounted(pr); err != nil {
+			return err
+		}
+		return writeArchive(tmp.Name(), worldDir(pr))
+	})
+	if err != nil {
+		return fmt.Errorf("archive world: %w", err)
+	}
+
+	dir := path.Join(strings.Trim(b.prefix, "/"), "pr-"+pr)
+	key := path.Join(dir, started.UTC().Format(snapshotIDFormat)+".tar.gz")
+	if err := b.client.PutFile(ctx, key, tmp.Name()); err != nil {
+		return fmt.Errorf("upload backup: %w", err)
+	}
+	b.mu.Lock()
+	b.lastBackup[pr] = started
+	b.mu.Unlock()
+	slog.Info("Backed up world", "pr", pr, "key", key)
+
+	if b.keep <= 0 {
+		return nil
+	}
+	keys, err := b.client.List(ctx, dir+"/")
+	if err != nil {
+		return fmt.Errorf("list backups: %w", err)
+	}
+	for len(keys) > b.keep {
+		if err := b.client.Delete(ctx, keys[0]); err != nil {
+			return fmt.Errorf("remove old backup: %w", err)
+		}
+		slog.Info("Removed old backup", "pr", pr, "key", keys[0])
+		keys = keys[1:]
+	}
+	return nil
+}
+
+// Forget drops the last backup time of the given PR, so that a new PR with the same number is backed up
+// regardless of when the old one was.
+func (b *BackupManager) Forget(pr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.lastBackup, pr)
+}
+
+// lastModified returns the latest modification time of any file in the directory dir.
+func lastModified(dir string) (time.Time, error) {
+	var latest time.Time
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest, err
+}
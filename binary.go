@@ -0,0 +1,76 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+)
+
+// elfMachines maps GOARCH values to the ELF machine binaries built for them have.
+var elfMachines = map[string]elf.Machine{
+	"amd64":   elf.EM_X86_64,
+	"arm64":   elf.EM_AARCH64,
+	"386":     elf.EM_386,
+	"arm":     elf.EM_ARM,
+	"riscv64": elf.EM_RISCV,
+	"ppc64le": elf.EM_PPC64,
+	"s390x":   elf.EM_S390,
+}
+
+// validateBinary checks that the file at the path passed is a complete Linux ELF executable for the
+// architecture passed, such as amd64. If it is not, an error satisfying errors.Is(err, errInvalidBinary) is
+// returned describing the problem.
+func validateBinary(path, arch string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%w: binary is empty", errInvalidBinary)
+	}
+	f, err := elf.Open(path)
+	if err != nil {
+		if hasELFMagic(path) {
+			return fmt.Errorf("%w: binary is truncated or corrupt: %v", errInvalidBinary, err)
+		}
+		return fmt.Errorf("%w: not an ELF binary, make sure it was built for Linux: %v", errInvalidBinary, err)
+	}
+	defer f.Close()
+
+	if f.OSABI != elf.ELFOSABI_NONE && f.OSABI != elf.ELFOSABI_LINUX {
+		return fmt.Errorf("%w: binary was built for %v rather than Linux", errInvalidBinary, f.OSABI)
+	}
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return fmt.Errorf("%w: binary is not an executable but %v", errInvalidBinary, f.Type)
+	}
+	if machine, ok := elfMachines[arch]; ok && f.Machine != machine {
+		return fmt.Errorf("%w: binary was built for %v rather than %s", errInvalidBinary, f.Machine, arch)
+	}
+	// A truncated upload still has a valid header, but its segments extend beyond the end of the file.
+	for _, prog := range f.Progs {
+		if prog.Off+prog.Filesz > uint64(info.Size()) {
+			return fmt.Errorf("%w: binary is truncated, expected at least %d bytes but got %d", errInvalidBinary, prog.Off+prog.Filesz, info.Size())
+		}
+	}
+	for _, section := range f.Sections {
+		if section.Type != elf.SHT_NOBITS && section.Offset+section.FileSize > uint64(info.Size()) {
+			return fmt.Errorf("%w: binary is truncated, expected at least %d bytes but got %d", errInvalidBinary, section.Offset+section.FileSize, info.Size())
+		}
+	}
+	return nil
+}
+
+// hasELFMagic checks if the file at the path passed starts with the magic number of ELF files.
+func hasELFMagic(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, len(elf.ELFMAG))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return string(magic) == elf.ELFMAG
+}
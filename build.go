@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// buildCacheInterval is how often the caches of the CacheDirs of profiles are pruned.
+const buildCacheInterval = time.Hour
+
+// cpuPeriod is the CFS period in microseconds the CPU limit of builds is enforced over.
+const cpuPeriod = 100000
+
+// buildContextDir returns the directory the build context of the image of the given PR is prepared in.
+func buildContextDir(pr string) string {
+	return filepath.Join("builds", "pr-"+pr)
+}
+
+// prepareBuildContext prepares a build context holding only the Dockerfile of the profile passed and the uploaded
+// binary of the given PR, named dragonfly, and returns the directory it is in. Building from a dedicated context
+// means the Dockerfile doesn't need to know where prmanager stores binaries, and no other files are sent to the
+// daemon. The provenance passed is copied to the root of the image by an instruction appended to the Dockerfile.
+func prepareBuildContext(pr string, profile ProfileConfig, provenance Provenance) (string, error) {
+	dir := buildContextDir(pr)
+	_ = os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("create build context: %w", err)
+	}
+	dockerfile, err := os.ReadFile(profile.Dockerfile)
+	if err != nil {
+		return "", fmt.Errorf("read Dockerfile: %w", err)
+	}
+	dockerfile = withCacheMounts(dockerfile, profile, pr)
+	dockerfile = fmt.Appendf(dockerfile, "\nCOPY %s /%s\n", provenanceFile, provenanceFile)
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), dockerfile, 0644); err != nil {
+		return "", fmt.Errorf("write Dockerfile: %w", err)
+	}
+	if err := copyFile(binaryPath(pr), filepath.Join(dir, "dragonfly"), 0755); err != nil {
+		return "", fmt.Errorf("copy binary: %w", err)
+	}
+	if err := writeProvenance(filepath.Join(dir, provenanceFile), provenance); err != nil {
+		return "", fmt.Errorf("write provenance: %w", err)
+	}
+	return dir, nil
+}
+
+// withCacheMounts returns the Dockerfile passed with the CacheDirs of the profile passed mounted as cache mounts
+// into every RUN instruction. The caches are identified by the profile, the given PR and the directory, so that
+// builds of the PR reuse them, but a PR can't place files in them that the builds of other PRs pick up.
+func withCacheMounts(dockerfile []byte, profile ProfileConfig, pr string) []byte {
+	if len(profile.CacheDirs) == 0 {
+		return dockerfile
+	}
+	var mounts strings.Builder
+	for _, dir := range profile.CacheDirs {
+		fmt.Fprintf(&mounts, "--mount=type=cache,id=prmanager-%s-pr-%s%s,target=%s ", profile.Name, pr, dir, dir)
+	}
+	lines := strings.Split(string(dockerfile), "\n")
+	continued := false
+	for i, line := range lines {
+		// Lines continuing an instruction may start with any word, so only the first line of one is considered.
+		trimmed := strings.TrimSpace(line)
+		if !continued && !strings.HasPrefix(trimmed, "#") {
+			if n := strings.IndexAny(trimmed, " \t"); n > 0 && strings.EqualFold(trimmed[:n], "RUN") {
+				lines[i] = trimmed[:n] + " " + mounts.String() + strings.TrimLeft(trimmed[n:], " \t")
+			}
+		}
+		continued = strings.HasSuffix(trimmed, "\\") || (continued && (trimmed == "" || strings.HasPrefix(trimmed, "#")))
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// removeBuildContext removes the build context of the given PR.
+func removeBuildContext(pr string) {
+	_ = os.RemoveAll(buildContextDir(pr))
+}
+
+// copyFile copies the file at src to dst, creating dst with the permissions passed. A hard link is created
+// instead where possible.
+func copyFile(src, dst string, perm os.FileMode) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// sandboxArgs returns the arguments of the build command that build an image of the profile passed in a
+// sandbox: without network access if the profile doesn't require it, and within the CPU and memory limits of
+// Images.BuildCPUs and Images.BuildMemory. BuildKit ignores resource limits passed to the build command, so
+// on Docker hosts the image is built in a dedicated builder container the limits are applied to instead,
+// which is created if it doesn't exist yet.
+func (d *Docker) sandboxArgs(ctx context.Context, profile ProfileConfig) ([]string, error) {
+	args := []string{"--network", "none"}
+	if profile.buildNetwork() {
+		args[1] = "default"
+	}
+	if !d.limited() {
+		return args, nil
+	}
+	cpus, memory := d.conf.Images.BuildCPUs, d.conf.Images.BuildMemory
+	if !d.buildx {
+		if cpus > 0 {
+			args = append(args, "--cpu-period", fmt.Sprint(cpuPeriod), "--cpu-quota", fmt.Sprint(int(cpus*cpuPeriod)))
+		}
+		if memory > 0 {
+			args = append(args, "--memory", fmt.Sprintf("%dm", memory))
+		}
+		return args, nil
+	}
+	if err := d.ensureBuilder(ctx); err != nil {
+		return nil, err
+	}
+	return append(args, "--builder", d.builderName()), nil
+}
+
+// limited returns if builds on the host are limited by Images.BuildCPUs or Images.BuildMemory.
+func (d *Docker) limited() bool {
+	return d.conf.Images.BuildCPUs > 0 || d.conf.Images.BuildMemory > 0
+}
+
+// builderName returns the name of the dedicated builder of the host. Builders are registered with the CLI
+// rather than the daemon, so the name of the host is included to keep those of different hosts apart.
+func (d *Docker) builderName() string {
+	return "prmanager-" + d.Name()
+}
+
+// ensureBuilder creates the dedicated builder of the host with the limits of the builds the first time it is
+// called. A builder left behind by a previous run is replaced, so that changes to the limits take effect, but
+// its build cache is kept.
+func (d *Docker) ensureBuilder(ctx context.Context) error {
+	d.builderMu.Lock()
+	defer d.builderMu.Unlock()
+	if d.builderReady {
+		return nil
+	}
+	name := d.builderName()
+	_ = d.command(ctx, "buildx", "rm", "--keep-state", name).Run()
+
+	args := []string{"buildx", "create", "--name", name, "--driver", "docker-container", "--bootstrap"}
+	if cpus := d.conf.Images.BuildCPUs; cpus > 0 {
+		args = append(args, "--driver-opt", fmt.Sprintf("cpu-period=%d", cpuPeriod), "--driver-opt", fmt.Sprintf("cpu-quota=%d", int(cpus*cpuPeriod)))
+	}
+	if memory := d.conf.Images.BuildMemory; memory > 0 {
+		// Swap is limited as well, as the memory limit could be sidestepped by swapping otherwise.
+		args = append(args, "--driver-opt", fmt.Sprintf("memory=%dm", memory), "--driver-opt", fmt.Sprintf("memory-swap=%dm", memory))
+	}
+	if out, err := d.command(ctx, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("create builder %s: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	slog.InfoContext(ctx, "Created builder", slog.String("host", d.Name()), slog.String("builder", name))
+	d.builderReady = true
+	return nil
+}
+
+// PruneBuildCache prunes the cache mounts of the builder images are built with down to Images.CacheSize,
+// removing the entries used least recently first. It does nothing if no profile has CacheDirs.
+func (d *Docker) PruneBuildCache(ctx context.Context) error {
+	if !slices.ContainsFunc(d.conf.Profiles, func(p ProfileConfig) bool { return len(p.CacheDirs) > 0 }) {
+		return nil
+	}
+	args := []string{"buildx", "prune", "--force", "--filter", "type=exec.cachemount", "--keep-storage", fmt.Sprintf("%dmb", d.conf.Images.CacheSize)}
+	if d.limited() {
+		if err := d.ensureBuilder(ctx); err != nil {
+			return err
+		}
+		args = append(args, "--builder", d.builderName())
+	}
+	out, err := d.command(ctx, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("prune build cache: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	slog.InfoContext(ctx, "Pruned build cache", slog.String("host", d.Name()), slog.String("output", lastLine(string(out))))
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestWithCacheMounts(t *testing.T) {
+	profile := ProfileConfig{Name: "go", CacheDirs: []string{"/root/.cache/go-build"}}
+	const mount = "--mount=type=cache,id=prmanager-go-pr-12/root/.cache/go-build,target=/root/.cache/go-build "
+	tests := []struct {
+		name, dockerfile, want string
+	}{
+		{"run", "FROM golang\nRUN go build .\n", "FROM golang\nRUN " + mount + "go build .\n"},
+		{"lowercase", "from golang\nrun go build .\n", "from golang\nrun " + mount + "go build .\n"},
+		{"indented", "FROM golang\n  RUN\tgo build .\n", "FROM golang\nRUN " + mount + "go build .\n"},
+		{"comment", "# RUN go build .\nCOPY . .\n", "# RUN go build .\nCOPY . .\n"},
+		{
+			"continued line starting with run",
+			"FROM golang\nCOPY a \\\n  b\nRUN echo \\\n  # comment\n  run this\n",
+			"FROM golang\nCOPY a \\\n  b\nRUN " + mount + "echo \\\n  # comment\n  run this\n",
+		},
+		{"empty continuation", "RUN a \\\n\n  RUN b\n", "RUN " + mount + "a \\\n\n  RUN b\n"},
+		{"word starting with run", "RUNNER x\n", "RUNNER x\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(withCacheMounts([]byte(tt.dockerfile), profile, "12")); got != tt.want {
+				t.Errorf("withCacheMounts(%q) = %q, want %q", tt.dockerfile, got, tt.want)
+			}
+		})
+	}
+	if got := string(withCacheMounts([]byte("RUN x\n"), ProfileConfig{Name: "go"}, "12")); got != "RUN x\n" {
+		t.Errorf("withCacheMounts without cache dirs = %q, want unchanged", got)
+	}
+}
+
+func TestSandboxArgs(t *testing.T) {
+	d := &Docker{conf: DefaultConfig(), buildx: true}
+	off := false
+	tests := []struct {
+		name    string
+		profile ProfileConfig
+		want    string
+	}{
+		{"default", ProfileConfig{}, "default"},
+		{"network disabled", ProfileConfig{BuildNetwork: &off}, "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Builds are only limited if configured, so no builder is needed by default.
+			args, err := d.sandboxArgs(t.Context(), tt.profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(args) != 2 || args[0] != "--network" || args[1] != tt.want {
+				t.Errorf("sandboxArgs = %q, want [--network %s]", args, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/sandertv/gophertunnel/minecraft/protocol/login"
+)
+
+// canarySandbox is the name of the sandbox the canary build of a pull request runs in.
+const canarySandbox = "canary"
+
+// Canary decides which players joining a pull request are routed to its canary build, a newer build of the
+// pull request running alongside the current one, so that the two can be compared before fully switching.
+type Canary struct {
+	// Percent is the percentage of players, between 0 and 100, routed to the canary build. Players are
+	// assigned by their XUID, so that the same player always joins the same build.
+	Percent int `json:"percent"`
+	// XUIDs are the XUIDs of players that are always routed to the canary build.
+	XUIDs []string `json:"xuids,omitempty"`
+}
+
+// canaryID returns the ID of the sandbox the canary build of the given PR runs in.
+func canaryID(pr string) string {
+	return sandboxID(pr, canarySandbox)
+}
+
+// selects checks if the player with the identity passed is routed to the canary build.
+func (c Canary) selects(identity login.IdentityData) bool {
+	if identity.XUID != "" && slices.Contains(c.XUIDs, identity.XUID) {
+		return true
+	}
+	// Players that didn't log in with Xbox Live have no XUID, so their identity is used instead.
+	key := identity.XUID
+	if key == "" {
+		key = identity.Identity
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32()%100) < c.Percent
+}
+
+// canary returns the ID of the server the player with the identity passed is routed to when joining the
+// given PR: that of its canary build if it has one and the player was selected for it, or the PR otherwise.
+func (l *Listener) canary(pr string, identity login.IdentityData) string {
+	var canary Canary
+	var ok bool
+	l.state.View(func(data *stateData) {
+		canary, ok = data.Canaries[pr]
+	})
+	if !ok || !pullRequestExists(canaryID(pr)) || !canary.selects(identity) {
+		return pr
+	}
+	return canaryID(pr)
+}
+
+// prepareCanary creates the sandbox of the canary build of the given PR if it doesn't exist yet, starting it
+// off with a copy of the world of the PR, so that both builds can be compared on the same world.
+func prepareCanary(ctx context.Context, backend Backend, pr string) error {
+	id := canaryID(pr)
+	if err := os.Mkdir(worldDir(id), 0755); errors.Is(err, os.ErrExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("create world directory: %w", err)
+	}
+	if err := cloneFiles(ctx, backend, pr, id); err != nil {
+		removeClone(id)
+		return err
+	}
+	return nil
+}
+
+// handlePutCanary handles setting which players joining a pull request are routed to its canary build, which
+// must have been uploaded first.
+func (r *Router) handlePutCanary(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	if basePullRequest(pr) != pr || !pullRequestExists(canaryID(pr)) {
+		logger.Warn("Canary not found", "pr", pr)
+		http.Error(writer, "Canary not found", http.StatusNotFound)
+		return
+	}
+	var canary Canary
+	if err := json.NewDecoder(request.Body).Decode(&canary); err != nil {
+		logger.Warn("Failed to decode canary", slog.Any("error", err))
+		http.Error(writer, "Failed to decode canary", http.StatusBadRequest)
+		return
+	}
+	if canary.Percent < 0 || canary.Percent > 100 {
+		logger.Warn("Invalid canary percentage", "pr", pr, "percent", canary.Percent)
+		http.Error(writer, "Canary percentage must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	if err := r.state.Update(func(data *stateData) {
+		data.Canaries[pr] = canary
+	}); err != nil {
+		logger.Error("Failed to save canary", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to save canary", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Updated canary", "pr", pr, "percent", canary.Percent, "xuids", len(canary.XUIDs))
+	writeJSON(writer, http.StatusOK, canary)
+}
+
+// handleDeleteCanary handles deleting the canary build of a pull request, after which all players joining the
+// pull request are routed to its current build again.
+func (r *Router) handleDeleteCanary(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	if basePullRequest(pr) != pr || !pullRequestExists(canaryID(pr)) {
+		logger.Warn("Canary not found", "pr", pr)
+		http.Error(writer, "Canary not found", http.StatusNotFound)
+		return
+	}
+	if err := r.state.Update(func(data *stateData) {
+		delete(data.Canaries, pr)
+	}); err != nil {
+		logger.Error("Failed to remove canary", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to remove canary", http.StatusInternalServerError)
+		return
+	}
+	// Like deleting a PR, deleting its canary continues even if the client disconnects.
+	deletePullRequest(context.WithoutCancel(request.Context()), r.backend, r.backups, canaryID(pr))
+	logger.Info("Deleted canary", "pr", pr)
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/sandertv/gophertunnel/minecraft/protocol/login"
+)
+
+func TestCanarySelects(t *testing.T) {
+	if (Canary{Percent: 0}).selects(login.IdentityData{XUID: "1"}) {
+		t.Error("player selected at 0 percent")
+	}
+	if !(Canary{Percent: 0, XUIDs: []string{"1"}}).selects(login.IdentityData{XUID: "1"}) {
+		t.Error("listed player not selected")
+	}
+	// Players without a XUID can't be listed, even if their identity equals a listed XUID.
+	if (Canary{Percent: 0, XUIDs: []string{"1"}}).selects(login.IdentityData{Identity: "1"}) {
+		t.Error("player without XUID selected by listed XUID")
+	}
+	if !(Canary{Percent: 100}).selects(login.IdentityData{Identity: "f5e2b8a4"}) {
+		t.Error("player not selected at 100 percent")
+	}
+
+	// Players are split close to the percentage configured, and always end up on the same build.
+	canary := Canary{Percent: 30}
+	selected := 0
+	for i := range 1000 {
+		identity := login.IdentityData{XUID: strconv.Itoa(2535400000000000 + i)}
+		if canary.selects(identity) {
+			selected++
+		}
+		if canary.selects(identity) != canary.selects(identity) {
+			t.Fatalf("player %s selected inconsistently", identity.XUID)
+		}
+	}
+	if selected < 200 || selected > 400 {
+		t.Errorf("%d of 1000 players selected at 30 percent", selected)
+	}
+}
+
+func TestPrepareCanary(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ctx := context.Background()
+	for _, dir := range []string{"binaries", worldDir("1")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(binaryPath("1"), []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(worldDir("1"), "level.dat"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backend := NewFakeBackend("127.0.0.1", 19132, false)
+	if err := backend.BuildImage(ctx, "1", Deployment{PR: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := backend.StartServer(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := prepareCanary(ctx, backend, "1"); err != nil {
+		t.Fatalf("prepare canary: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(worldDir(canaryID("1")), "level.dat")); err != nil || string(data) != "world" {
+		t.Errorf("world of canary = %q, %v, want copy of world", data, err)
+	}
+	if _, err := os.Stat(binaryPath(canaryID("1"))); err != nil {
+		t.Errorf("binary of canary: %v", err)
+	}
+	servers, _ := backend.Servers(ctx)
+	if len(servers) != 1 || servers[0].Paused {
+		t.Errorf("server of PR left paused after copying its world: %+v", servers)
+	}
+
+	// The world of an existing canary is kept as it is.
+	if err := os.WriteFile(filepath.Join(worldDir(canaryID("1")), "level.dat"), []byte("canary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareCanary(ctx, backend, "1"); err != nil {
+		t.Fatalf("prepare existing canary: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(worldDir(canaryID("1")), "level.dat")); string(data) != "canary" {
+		t.Errorf("world of existing canary was replaced with %q", data)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/volume"
+)
+
+// knownPullRequests returns the set of pull requests that are known on the host. A pull request is considered
+// known if its world directory exists, as this directory is created on upload and only removed on delete.
+func knownPullRequests() (map[string]bool, error) {
+	matches, err := filepath.Glob(filepath.Join("worlds", "pr-*"))
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, match := range matches {
+		pr, ok := parsePullRequestName(filepath.Base(match))
+		if !ok {
+			continue
+		}
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			known[pr] = true
+		}
+	}
+	return known, nil
+}
+
+// parsePullRequestName parses a name in the format of pr-<number>, pr-<number>-<sandbox> for a sandbox or
+// pr-<name> for an environment, and returns the ID following the prefix. If the name is not in the expected
+// format, false is returned.
+func parsePullRequestName(name string) (string, bool) {
+	pr, ok := strings.CutPrefix(name, "pr-")
+	if !ok {
+		return "", false
+	}
+	if !validPullRequest(pr) && !environmentNamePattern.MatchString(pr) {
+		return "", false
+	}
+	return pr, true
+}
+
+// cleanupOrphanedFiles reconciles the pull requests known against the binaries, disk images, snapshots,
+// artifacts, stacks and logs present on the local filesystem, which is shared by all hosts. Anything that no longer
+// belongs to a known pull request is removed, while known pull requests that are missing a binary are reported
+// so that they can be redeployed. It must only be run after the stacks of orphaned pull requests were brought
+// down on every host, as their compose files are removed.
+func cleanupOrphanedFiles() error {
+	known, err := knownPullRequests()
+	if err != nil {
+		return fmt.Errorf("list pull requests: %w", err)
+	}
+
+	binaries, _ := filepath.Glob("binaries/pr-*")
+	hasBinary := make(map[string]bool)
+	for _, path := range binaries {
+		pr, ok := parsePullRequestName(filepath.Base(path))
+		if !ok {
+			continue
+		}
+		if known[pr] {
+			hasBinary[pr] = true
+			continue
+		}
+		slog.Info("Removing orphaned binary", slog.String("pr", pr), slog.String("path", path))
+		_ = os.Remove(path)
+	}
+	diskImages, _ := filepath.Glob(filepath.Join("worlds", "pr-*.img"))
+	for _, path := range diskImages {
+		pr, ok := parsePullRequestName(strings.TrimSuffix(filepath.Base(path), ".img"))
+		if !ok || known[pr] {
+			continue
+		}
+		slog.Info("Removing orphaned disk image", slog.String("pr", pr), slog.String("path", path))
+		removeDiskImage(pr)
+	}
+
+	snapshots, _ := filepath.Glob("snapshots/pr-*")
+	for _, path := range snapshots {
+		pr, ok := parsePullRequestName(filepath.Base(path))
+		if !ok || known[pr] {
+			continue
+		}
+		slog.Info("Removing orphaned snapshots", slog.String("pr", pr), slog.String("path", path))
+		removeSnapshots(pr)
+	}
+	artifacts, _ := filepath.Glob("artifacts/pr-*")
+	for _, path := range artifacts {
+		pr, ok := parsePullRequestName(filepath.Base(path))
+		if !ok || known[pr] {
+			continue
+		}
+		slog.Info("Removing orphaned binaries", slog.String("pr", pr), slog.String("path", path))
+		removeArtifacts(pr)
+	}
+	provenance, _ := filepath.Glob("provenance/pr-*.json")
+	for _, path := range provenance {
+		pr, ok := parsePullRequestName(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if !ok || known[pr] {
+			continue
+		}
+		slog.Info("Removing orphaned provenance", slog.String("pr", pr), slog.String("path", path))
+		_ = os.Remove(path)
+	}
+	stacks, _ := filepath.Glob("stacks/pr-*")
+	for _, path := range stacks {
+		pr, ok := parsePullRequestName(filepath.Base(path))
+		if !ok || known[pr] {
+			continue
+		}
+		slog.Info("Removing orphaned stack", slog.String("pr", pr), slog.String("path", path))
+		_ = os.RemoveAll(path)
+	}
+	logs, _ := filepath.Glob("logs/pr-*")
+	for _, path := range logs {
+		pr, ok := parsePullRequestName(filepath.Base(path))
+		if !ok || known[pr] {
+			continue
+		}
+		slog.Info("Removing orphaned logs", slog.String("pr", pr), slog.String("path", path))
+		removeLogs(pr)
+	}
+
+	for pr := range known {
+		if !hasBinary[pr] {
+			slog.Warn("Pull request has no binary, it needs to be redeployed", slog.String("pr", pr))
+		}
+	}
+	return nil
+}
+
+// CleanupOrphans reconciles the pull requests known against the containers, images, volumes and stacks present
+// on the host. Anything that no longer belongs to a known pull request is removed, while known pull requests that are
+// missing an image are reported so that they can be redeployed. Files on the local filesystem are left to
+// cleanupOrphanedFiles, so that they are only cleaned up once for all hosts.
+func (d *Docker) CleanupOrphans(ctx context.Context) error {
+	known, err := knownPullRequests()
+	if err != nil {
+		return fmt.Errorf("list pull requests: %w", err)
+	}
+
+	// Bring down any stacks of pull requests that have since been deleted. Their compose files are removed by
+	// cleanupOrphanedFiles once this has been done on every host.
+	stacks, _ := filepath.Glob("stacks/pr-*")
+	for _, path := range stacks {
+		pr, ok := parsePullRequestName(filepath.Base(path))
+		if !ok || known[pr] {
+			continue
+		}
+		if err := d.compose(ctx, pr, "down", "-v", "--remove-orphans"); err != nil {
+			slog.WarnContext(ctx, "Failed to remove orphaned stack", slog.String("pr", pr), slog.String("host", d.Name()), slog.Any("error", err))
+		}
+	}
+
+	// Remove any containers still left over for pull requests that are no longer known.
+	containers, err := d.client.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", labelPR)),
+	})
+	if err != nil {
+		return fmt.Errorf("list containers: %w", err)
+	}
+	for _, c := range containers {
+		pr := c.Labels[labelPR]
+		if known[pr] {
+			continue
+		}
+		slog.Info("Removing orphaned container", slog.String("pr", pr), slog.String("id", c.ID))
+		if err := d.client.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
+			return fmt.Errorf("remove container %s: %w", c.ID, err)
+		}
+	}
+
+	// Remove any images of pull requests that are no longer known.
+	images, err := d.client.ImageList(ctx, image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", labelPR)),
+	})
+	if err != nil {
+		return fmt.Errorf("list images: %w", err)
+	}
+	hasImage := make(map[string]bool)
+	for _, img := range images {
+		deployment, ok := parseDeployment(img.Labels)
+		if !ok {
+			continue
+		}
+		if known[deployment.PR] && len(img.RepoTags) > 0 {
+			hasImage[deployment.PR] = true
+			continue
+		}
+		if known[deployment.PR] {
+			// Untagged images of known pull requests were replaced by a newer build and are left to be pruned.
+			continue
+		}
+		slog.Info("Removing orphaned image", slog.String("pr", deployment.PR), slog.String("id", img.ID))
+		if _, err := d.client.ImageRemove(ctx, img.ID, image.RemoveOptions{Force: true, PruneChildren: true}); err != nil {
+			slog.Warn("Failed to remove orphaned image", slog.String("id", img.ID), slog.Any("error", err))
+		}
+	}
+
+	// Remove the volumes holding the world data of pull requests that are no longer known.
+	volumes, err := d.client.VolumeList(ctx, volume.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", labelPR)),
+	})
+	if err != nil {
+		return fmt.Errorf("list volumes: %w", err)
+	}
+	for _, v := range volumes.Volumes {
+		pr := v.Labels[labelPR]
+		if known[pr] {
+			continue
+		}
+		slog.Info("Removing orphaned volume", slog.String("pr", pr), slog.String("volume", v.Name))
+		if err := d.client.VolumeRemove(ctx, v.Name, true); err != nil {
+			slog.Warn("Failed to remove orphaned volume", slog.String("volume", v.Name), slog.Any("error", err))
+		}
+	}
+
+	// Finally report any known pull requests that can't be started because parts of them are missing. We don't
+	// remove these, as their directories may still hold world data worth keeping.
+	for pr := range known {
+		if !hasImage[pr] {
+			slog.Warn("Pull request has no image, it needs to be redeployed", slog.String("pr", pr), slog.String("host", d.Name()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanupOrphanedFiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, dir := range []string{worldDir("1"), filepath.Dir(logPath("1")), filepath.Dir(logPath("2"))} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{logPath("1"), logPath("2"), filepath.Join("logs", "prmanager.log")} {
+		if err := os.WriteFile(path, []byte("log"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cleanupOrphanedFiles(); err != nil {
+		t.Fatal(err)
+	}
+	for path, kept := range map[string]bool{logPath("1"): true, logPath("2"): false, filepath.Join("logs", "prmanager.log"): true} {
+		if _, err := os.Stat(path); (err == nil) != kept {
+			t.Errorf("%s: kept = %v, want %v", path, err == nil, kept)
+		}
+	}
+}
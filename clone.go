@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// errSandboxExists is returned when cloning a pull request into a sandbox that already exists.
+var errSandboxExists = errors.New("sandbox already exists")
+
+// sandboxNamePattern matches the names sandboxes cloned from a pull request may be given. They become part of
+// the ID of the sandbox, so they are restricted to characters valid in host names and container names.
+var sandboxNamePattern = regexp.MustCompile(`^[a-z0-9]{1,32}$`)
+
+// sandboxID returns the ID of the sandbox with the name passed cloned from the given PR.
+func sandboxID(pr, name string) string {
+	return basePullRequest(pr) + "-" + name
+}
+
+// clonePullRequest clones the given PR into a new, independent environment with the ID of the deployment
+// passed. The binary, stack and world of the PR are copied, and an image is built for the clone with the
+// metadata of the deployment. If the server of the PR is running, it is paused while its world is copied. If
+// the clone already exists, an error satisfying errors.Is(err, errSandboxExists) is returned.
+func clonePullRequest(ctx context.Context, backend Backend, pr string, deployment Deployment) error {
+	to := deployment.PR
+	// Creating the world directory claims the ID, so that concurrent clones into it can't both succeed.
+	if err := os.Mkdir(worldDir(to), 0755); errors.Is(err, os.ErrExist) {
+		return errSandboxExists
+	} else if err != nil {
+		return fmt.Errorf("create world directory: %w", err)
+	}
+	if err := cloneFiles(ctx, backend, pr, to); err != nil {
+		removeClone(to)
+		return err
+	}
+	if err := backend.BuildImage(ctx, to, deployment); err != nil {
+		removeClone(to)
+		return err
+	}
+	return nil
+}
+
+// cloneFiles copies the binary, stack and world of the given PR to the clone with the ID passed, whose world
+// directory must already exist.
+func cloneFiles(ctx context.Context, backend Backend, pr, to string) error {
+	if err := copyFile(binaryPath(pr), binaryPath(to), 0755); err != nil {
+		return fmt.Errorf("copy binary: %w", err)
+	}
+	if hasStack(pr) {
+		if err := os.MkdirAll(filepath.Dir(stackPath(to)), 0755); err != nil {
+			return fmt.Errorf("create stack directory: %w", err)
+		}
+		if err := copyFile(stackPath(pr), stackPath(to), 0644); err != nil {
+			return fmt.Errorf("copy compose file: %w", err)
+		}
+	}
+	// If the world of the PR is stored on a disk image, the clone gets a disk image of its own, as the files
+	// would otherwise be hidden once one is mounted over its world directory.
+	if _, err := os.Stat(diskImagePath(pr)); err == nil {
+		if err := mountDiskImage(to); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "prmanager-clone-*.tar.gz")
+	if err != nil {
+		return fmt.Errorf("create archive: %w", err)
+	}
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+	err = withServerPaused(ctx, backend, pr, func() error {
+		if err := ensureDiskImageMounted(pr); err != nil {
+			return err
+		}
+		return writeArchive(tmp.Name(), worldDir(pr))
+	})
+	if err != nil {
+		return fmt.Errorf("copy world: %w", err)
+	}
+	if err := extractArchive(tmp.Name(), worldDir(to)); err != nil {
+		return fmt.Errorf("copy world: %w", err)
+	}
+	return nil
+}
+
+// removeClone removes the files of a clone that could not be completed.
+func removeClone(pr string) {
+	removeDiskImage(pr)
+	_ = os.RemoveAll(worldDir(pr))
+	_ = os.Remove(binaryPath(pr))
+	_ = os.Remove(provenancePath(pr))
+	_ = os.RemoveAll(filepath.Dir(stackPath(pr)))
+}
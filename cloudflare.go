@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// cloudflareAPI is the base URL of the Cloudflare API.
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflareClient is a dnsProvider managing the DNS records of a zone on Cloudflare, authenticating with an
+// API token that has the DNS:Edit permission for the zone.
+type cloudflareClient struct {
+	zone  string
+	token string
+	http  *http.Client
+}
+
+// newCloudflareClient creates a cloudflareClient for the zone with the ID passed.
+func newCloudflareClient(zone, token string) *cloudflareClient {
+	return &cloudflareClient{zone: zone, token: token, http: &http.Client{Timeout: time.Second * 30}}
+}
+
+// cloudflareRecord is a DNS record as represented by the Cloudflare API.
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	// Proxied is always false, as Cloudflare can't proxy the UDP traffic of Minecraft.
+	Proxied bool `json:"proxied"`
+}
+
+// upsert ...
+func (c *cloudflareClient) upsert(ctx context.Context, record dnsRecord) error {
+	existing, err := c.find(ctx, record.Name)
+	if err != nil {
+		return err
+	}
+	body := cloudflareRecord{Type: record.Type, Name: record.Name, Content: record.Value, TTL: record.TTL}
+	if len(existing) > 0 {
+		// Replacing the record rather than creating another one also changes its type if the target changed
+		// from an IP address to a host name, or the other way around.
+		return c.do(ctx, http.MethodPut, "/dns_records/"+existing[0].ID, nil, body, nil)
+	}
+	return c.do(ctx, http.MethodPost, "/dns_records", nil, body, nil)
+}
+
+// remove ...
+func (c *cloudflareClient) remove(ctx context.Context, record dnsRecord) error {
+	existing, err := c.find(ctx, record.Name)
+	if err != nil {
+		return err
+	}
+	for _, r := range existing {
+		if err := c.do(ctx, http.MethodDelete, "/dns_records/"+r.ID, nil, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find returns the A, AAAA and CNAME records with the name passed.
+func (c *cloudflareClient) find(ctx context.Context, name string) ([]cloudflareRecord, error) {
+	var records []cloudflareRecord
+	if err := c.do(ctx, http.MethodGet, "/dns_records", url.Values{"name": {name}}, nil, &records); err != nil {
+		return nil, err
+	}
+	managed := records[:0]
+	for _, r := range records {
+		if r.Type == "A" || r.Type == "AAAA" || r.Type == "CNAME" {
+			managed = append(managed, r)
+		}
+	}
+	return managed, nil
+}
+
+// do sends a request to the path passed, relative to the zone, encoding body as JSON if not nil, and decodes
+// the result of the response into v if v is not nil.
+func (c *cloudflareClient) do(ctx context.Context, method, path string, query url.Values, body, v any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+		r = bytes.NewReader(b)
+	}
+	u := cloudflareAPI + "/zones/" + url.PathEscape(c.zone) + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return fmt.Errorf("%s %s: %s: decode response: %w", method, path, resp.Status, err)
+	}
+	if !result.Success {
+		messages := make([]string, 0, len(result.Errors))
+		for _, e := range result.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.Join(messages, "; "))
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.Unmarshal(result.Result, v); err != nil {
+		return fmt.Errorf("decode result: %w", err)
+	}
+	return nil
+}
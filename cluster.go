@@ -0,0 +1,472 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// errNoHostAvailable is returned by Cluster.StartServer if every host is running its maximum number of servers.
+var errNoHostAvailable = errors.New("no host available")
+
+// Cluster manages the servers of pull requests across the Runtimes of one or more hosts. New servers are
+// scheduled onto the least loaded host, while a pull request sticks to the host it ran on before where possible,
+// so that its world data is kept. Hosts whose container daemon is unreachable are not scheduled onto.
+type Cluster struct {
+	hosts []Runtime
+	state *State
+
+	mu sync.Mutex
+	// outages maps the names of hosts whose container daemon did not respond to the last ping to the outage.
+	outages map[string]daemonOutage
+
+	startsMu sync.Mutex
+	// starts maps PRs whose server is being started to the start, so that concurrent starts share it.
+	starts map[string]*serverStart
+}
+
+// serverStart is a start of the server of a PR in progress. Its results are set once done is closed.
+type serverStart struct {
+	done    chan struct{}
+	address string
+	port    uint16
+	found   bool
+	err     error
+}
+
+// NewCluster creates a new Cluster of the Runtimes passed, storing scheduling decisions in the State.
+func NewCluster(hosts []Runtime, state *State) *Cluster {
+	return &Cluster{hosts: hosts, state: state, outages: make(map[string]daemonOutage), starts: make(map[string]*serverStart)}
+}
+
+// BuildImage builds the image of the given PR on every host, so that its server can be started on any of them.
+func (c *Cluster) BuildImage(ctx context.Context, pr string, deployment Deployment) error {
+	ctx, span := startSpan(ctx, "build image", pr, attribute.String("profile", deployment.Profile))
+	defer span.End()
+	for _, d := range c.hosts {
+		if err := c.reachable(d); err != nil {
+			return spanError(span, err)
+		}
+		if err := c.buildImage(ctx, d, pr, deployment); err != nil {
+			return spanError(span, fmt.Errorf("build on host %s: %w", d.Name(), err))
+		}
+	}
+	return nil
+}
+
+// buildImage builds the image of the given PR on the host of the Runtime passed.
+func (c *Cluster) buildImage(ctx context.Context, d Runtime, pr string, deployment Deployment) error {
+	ctx, span := startSpan(ctx, "build image on host", pr, attribute.String("host", d.Name()))
+	defer span.End()
+	return spanError(span, d.BuildImage(ctx, pr, deployment))
+}
+
+// BuildBinary builds the binary of the given PR from source on the first reachable host. Unlike images, the
+// binary is only needed once, as the images are then built from it on every host.
+func (c *Cluster) BuildBinary(ctx context.Context, pr string, profile ProfileConfig, source, dest string) error {
+	ctx, span := startSpan(ctx, "build binary", pr, attribute.String("profile", profile.Name))
+	defer span.End()
+	var err error
+	for _, d := range c.hosts {
+		if err = c.reachable(d); err == nil {
+			return spanError(span, d.BuildBinary(ctx, pr, profile, source, dest))
+		}
+	}
+	return spanError(span, err)
+}
+
+// PullImage pulls the image with the reference passed on every host.
+func (c *Cluster) PullImage(ctx context.Context, ref string) error {
+	ctx, span := startSpan(ctx, "pull image", "", attribute.String("image", ref))
+	defer span.End()
+	for _, d := range c.hosts {
+		if err := c.reachable(d); err != nil {
+			return spanError(span, err)
+		}
+		if err := d.PullImage(ctx, ref); err != nil {
+			return spanError(span, fmt.Errorf("pull on host %s: %w", d.Name(), err))
+		}
+	}
+	return nil
+}
+
+// Deployments returns the deployments of all pull requests, sorted by their number. If the image of a PR
+// differs between hosts, because a build failed halfway, the most recent deployment is returned. Hosts that are
+// unreachable are skipped, unless all of them are.
+func (c *Cluster) Deployments(ctx context.Context) ([]Deployment, error) {
+	latest := make(map[string]Deployment)
+	var unreachable error
+	skipped := 0
+	for _, d := range c.hosts {
+		if err := c.reachable(d); err != nil {
+			unreachable = cmp.Or(unreachable, err)
+			skipped++
+			continue
+		}
+		deployments, err := d.Deployments(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %w", d.Name(), err)
+		}
+		for _, deployment := range deployments {
+			if existing, ok := latest[deployment.PR]; !ok || deployment.Deployed.After(existing.Deployed) {
+				latest[deployment.PR] = deployment
+			}
+		}
+	}
+	if skipped > 0 && skipped == len(c.hosts) {
+		return nil, unreachable
+	}
+	deployments := slices.Collect(maps.Values(latest))
+	sortDeployments(deployments)
+	return deployments, nil
+}
+
+// Deployment returns the deployment of the given PR, read from its image on the host it last ran on or, if it
+// has none there, the first other host holding one.
+func (c *Cluster) Deployment(ctx context.Context, pr string) (Deployment, bool, error) {
+	for _, d := range c.ordered(pr) {
+		if err := c.reachable(d); err != nil {
+			return Deployment{}, false, err
+		}
+		deployment, found, err := d.Deployment(ctx, pr)
+		if err != nil {
+			return Deployment{}, false, fmt.Errorf("host %s: %w", d.Name(), err)
+		} else if found {
+			return deployment, true, nil
+		}
+	}
+	return Deployment{}, false, nil
+}
+
+// ServerAddress retrieves the public address and port of the server running for the given PR. If the server is
+// not running on any host, it returns false.
+func (c *Cluster) ServerAddress(ctx context.Context, pr string) (string, uint16, bool, error) {
+	for _, d := range c.ordered(pr) {
+		if err := c.reachable(d); err != nil {
+			return "", 0, false, err
+		}
+		port, found, err := d.ServerPort(ctx, pr)
+		if err != nil {
+			return "", 0, false, fmt.Errorf("host %s: %w", d.Name(), err)
+		} else if found {
+			return d.Host().PublicAddress, port, true, nil
+		}
+	}
+	return "", 0, false, nil
+}
+
+// StartServer schedules the server of the given PR onto a host and starts it, returning the public address
+// and port of the server. Only one start of the server of a PR runs at a time: calls made while it is in
+// progress, such as for players joining a stopped PR at the same time, wait for it and share its result, as
+// they would otherwise start a second container that removes the first. If the start is abandoned because the
+// context of the call that started it is cancelled, a waiting call starts the server itself.
+func (c *Cluster) StartServer(ctx context.Context, pr string) (string, uint16, bool, error) {
+	for {
+		c.startsMu.Lock()
+		start, ok := c.starts[pr]
+		if !ok {
+			start = &serverStart{done: make(chan struct{})}
+			c.starts[pr] = start
+			c.startsMu.Unlock()
+
+			start.address, start.port, start.found, start.err = c.startServer(ctx, pr)
+			c.startsMu.Lock()
+			delete(c.starts, pr)
+			c.startsMu.Unlock()
+			close(start.done)
+			return start.address, start.port, start.found, start.err
+		}
+		c.startsMu.Unlock()
+
+		select {
+		case <-start.done:
+		case <-ctx.Done():
+			return "", 0, false, ctx.Err()
+		}
+		if start.err == nil || (!errors.Is(start.err, context.Canceled) && !errors.Is(start.err, context.DeadlineExceeded)) {
+			return start.address, start.port, start.found, start.err
+		}
+	}
+}
+
+// startServer schedules the server of the given PR onto a host and starts it.
+func (c *Cluster) startServer(ctx context.Context, pr string) (string, uint16, bool, error) {
+	ctx, span := startSpan(ctx, "start server", pr)
+	defer span.End()
+	d, err := c.schedule(ctx, pr)
+	if err != nil {
+		return "", 0, false, spanError(span, err)
+	}
+	span.SetAttributes(attribute.String("host", d.Name()))
+	port, found, err := d.StartServer(ctx, pr)
+	if err != nil || !found {
+		return "", 0, found, spanError(span, err)
+	}
+	span.SetAttributes(attribute.Int("port", int(port)))
+	return d.Host().PublicAddress, port, true, nil
+}
+
+// schedule selects the host to start the server of the given PR on. The host the PR was last scheduled on is
+// preferred, as its world data lives there. Otherwise, the host running the fewest servers is selected.
+func (c *Cluster) schedule(ctx context.Context, pr string) (Runtime, error) {
+	ctx, span := startSpan(ctx, "schedule server", pr)
+	defer span.End()
+	// Hosts whose container daemon is unreachable are skipped, so that servers can still be started on the
+	// others. If all of them are unreachable, the error of the first is returned.
+	load := make(map[string]int, len(c.hosts))
+	var reachable []Runtime
+	var unreachable error
+	for _, d := range c.hosts {
+		if err := c.reachable(d); err != nil {
+			unreachable = cmp.Or(unreachable, err)
+			continue
+		}
+		servers, err := d.Servers(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %w", d.Name(), err)
+		}
+		load[d.Name()] = len(servers)
+		reachable = append(reachable, d)
+	}
+	if len(reachable) == 0 && unreachable != nil {
+		return nil, unreachable
+	}
+	available := func(d Runtime) bool {
+		return d.Host().MaxServers == 0 || load[d.Name()] < d.Host().MaxServers
+	}
+
+	var previous string
+	c.state.View(func(data *stateData) {
+		previous = data.Hosts[pr]
+	})
+	var selected Runtime
+	for _, d := range reachable {
+		if d.Name() == previous && available(d) {
+			selected = d
+			break
+		}
+		if available(d) && (selected == nil || load[d.Name()] < load[selected.Name()]) {
+			selected = d
+		}
+	}
+	if selected == nil {
+		return nil, errNoHostAvailable
+	}
+	if previous != "" && previous != selected.Name() {
+		slog.WarnContext(ctx, "Previous host of PR is unavailable, world data will not carry over", slog.String("pr", pr), slog.String("previous", previous), slog.String("host", selected.Name()))
+	}
+	if err := c.state.Update(func(data *stateData) {
+		data.Hosts[pr] = selected.Name()
+	}); err != nil {
+		return nil, fmt.Errorf("save host assignment: %w", err)
+	}
+	slog.InfoContext(ctx, "Scheduled PR onto host", slog.String("pr", pr), slog.String("host", selected.Name()), slog.Int("load", load[selected.Name()]))
+	return selected, nil
+}
+
+// ordered returns the hosts of the Cluster, with the host the given PR was last scheduled on first.
+func (c *Cluster) ordered(pr string) []Runtime {
+	var previous string
+	c.state.View(func(data *stateData) {
+		previous = data.Hosts[pr]
+	})
+	hosts := make([]Runtime, 0, len(c.hosts))
+	for _, d := range c.hosts {
+		if d.Name() == previous {
+			hosts = append([]Runtime{d}, hosts...)
+		} else {
+			hosts = append(hosts, d)
+		}
+	}
+	return hosts
+}
+
+// StopServer stops the server of the given PR on whichever host it is running.
+func (c *Cluster) StopServer(ctx context.Context, pr string) (StopResult, error) {
+	ctx, span := startSpan(ctx, "stop server", pr)
+	defer span.End()
+	for _, d := range c.ordered(pr) {
+		if err := c.reachable(d); err != nil {
+			return StopNotRunning, spanError(span, err)
+		}
+		result, err := d.StopServer(ctx, pr)
+		if err != nil {
+			return result, spanError(span, fmt.Errorf("host %s: %w", d.Name(), err))
+		} else if result != StopNotRunning {
+			span.SetAttributes(attribute.String("host", d.Name()), attribute.String("result", result.String()))
+			return result, nil
+		}
+	}
+	return StopNotRunning, nil
+}
+
+// PauseServer pauses the server of the given PR on whichever host it is running.
+func (c *Cluster) PauseServer(ctx context.Context, pr string) error {
+	ctx, span := startSpan(ctx, "pause server", pr)
+	defer span.End()
+	d, err := c.running(ctx, pr)
+	if err != nil {
+		return spanError(span, err)
+	}
+	return spanError(span, d.PauseServer(ctx, pr))
+}
+
+// UnpauseServer resumes the server of the given PR on whichever host it is running.
+func (c *Cluster) UnpauseServer(ctx context.Context, pr string) error {
+	ctx, span := startSpan(ctx, "unpause server", pr)
+	defer span.End()
+	d, err := c.running(ctx, pr)
+	if err != nil {
+		return spanError(span, err)
+	}
+	return spanError(span, d.UnpauseServer(ctx, pr))
+}
+
+// Attach attaches to the console of the server of the given PR on whichever host it is running.
+func (c *Cluster) Attach(ctx context.Context, pr string) (io.ReadWriteCloser, error) {
+	d, err := c.running(ctx, pr)
+	if err != nil {
+		return nil, err
+	}
+	return d.Attach(ctx, pr)
+}
+
+// running returns the Runtime of the host the server of the given PR is running on.
+func (c *Cluster) running(ctx context.Context, pr string) (Runtime, error) {
+	for _, d := range c.ordered(pr) {
+		if err := c.reachable(d); err != nil {
+			return nil, err
+		}
+		_, found, err := d.ServerPort(ctx, pr)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %w", d.Name(), err)
+		} else if found {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("server of PR %s: %w", pr, errContainerNotFound)
+}
+
+// DeleteServer removes the server, image and data of the given PR from every host.
+func (c *Cluster) DeleteServer(ctx context.Context, pr string) {
+	ctx, span := startSpan(ctx, "delete server", pr)
+	defer span.End()
+	for _, d := range c.hosts {
+		d.DeleteServer(ctx, pr)
+	}
+	if err := c.state.Update(func(data *stateData) {
+		delete(data.Hosts, pr)
+	}); err != nil {
+		slog.WarnContext(ctx, "Failed to release host assignment", slog.String("pr", pr), slog.Any("error", err))
+	}
+}
+
+// Servers returns all servers of pull requests that are currently running on any host. Hosts that are
+// unreachable are skipped, unless all of them are.
+func (c *Cluster) Servers(ctx context.Context) ([]Server, error) {
+	var servers []Server
+	var unreachable error
+	skipped := 0
+	for _, d := range c.hosts {
+		if err := c.reachable(d); err != nil {
+			unreachable = cmp.Or(unreachable, err)
+			skipped++
+			continue
+		}
+		s, err := d.Servers(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %w", d.Name(), err)
+		}
+		servers = append(servers, s...)
+	}
+	if skipped > 0 && skipped == len(c.hosts) {
+		return nil, unreachable
+	}
+	return servers, nil
+}
+
+// Stats retrieves the resource usage statistics of the server of the given PR from whichever host it is
+// running on.
+func (c *Cluster) Stats(ctx context.Context, pr string, sample bool) (ContainerStats, bool, error) {
+	for _, d := range c.ordered(pr) {
+		if err := c.reachable(d); err != nil {
+			return ContainerStats{}, false, err
+		}
+		stats, found, err := d.Stats(ctx, pr, sample)
+		if err != nil {
+			return stats, false, fmt.Errorf("host %s: %w", d.Name(), err)
+		} else if found {
+			return stats, true, nil
+		}
+	}
+	return ContainerStats{}, false, nil
+}
+
+// ClearContainers removes all containers belonging to pull requests on every host.
+func (c *Cluster) ClearContainers(ctx context.Context, removeImages bool) error {
+	for _, d := range c.hosts {
+		if err := d.ClearContainers(ctx, removeImages); err != nil {
+			return fmt.Errorf("host %s: %w", d.Name(), err)
+		}
+	}
+	return nil
+}
+
+// AdoptServers takes over the servers left running by a previous prmanager process on every host.
+func (c *Cluster) AdoptServers(ctx context.Context) error {
+	for _, d := range c.hosts {
+		if err := d.AdoptServers(ctx); err != nil {
+			return fmt.Errorf("host %s: %w", d.Name(), err)
+		}
+	}
+	return nil
+}
+
+// CleanupOrphans cleans up anything left behind by deleted pull requests on every host, followed by the files
+// they left behind on the local filesystem, which is only done once as it is shared by all hosts.
+func (c *Cluster) CleanupOrphans(ctx context.Context) error {
+	for _, d := range c.hosts {
+		if err := d.CleanupOrphans(ctx); err != nil {
+			return fmt.Errorf("host %s: %w", d.Name(), err)
+		}
+	}
+	return cleanupOrphanedFiles()
+}
+
+// PruneBuildCache prunes the caches of the CacheDirs of profiles on every host.
+func (c *Cluster) PruneBuildCache(ctx context.Context) error {
+	for _, d := range c.hosts {
+		if err := c.reachable(d); err != nil {
+			return err
+		}
+		if err := d.PruneBuildCache(ctx); err != nil {
+			return fmt.Errorf("host %s: %w", d.Name(), err)
+		}
+	}
+	return nil
+}
+
+// CleanupBuild cleans up anything left behind by an interrupted build of the image of the given PR on every host.
+func (c *Cluster) CleanupBuild(ctx context.Context, pr string) error {
+	for _, d := range c.hosts {
+		if err := d.CleanupBuild(ctx, pr); err != nil {
+			return fmt.Errorf("host %s: %w", d.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Close closes the connections to all hosts.
+func (c *Cluster) Close() {
+	for _, d := range c.hosts {
+		d.Close()
+	}
+}
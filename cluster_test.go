@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hostRuntime is a Runtime on a named host running the server of a single pull request, whose daemon can be
+// taken down.
+type hostRuntime struct {
+	Runtime
+	name string
+	pr   string
+	down bool
+}
+
+// Name ...
+func (r *hostRuntime) Name() string {
+	return r.name
+}
+
+// Ping ...
+func (r *hostRuntime) Ping(context.Context) error {
+	if r.down {
+		return fmt.Errorf("%w: connection refused", errDaemonUnreachable)
+	}
+	return nil
+}
+
+// Servers ...
+func (r *hostRuntime) Servers(context.Context) ([]Server, error) {
+	return []Server{{PR: r.pr, Host: r.name}}, nil
+}
+
+func TestClusterUnreachableHosts(t *testing.T) {
+	a, b := &hostRuntime{name: "a", pr: "1"}, &hostRuntime{name: "b", pr: "2"}
+	c := NewCluster([]Runtime{a, b}, nil)
+	if err := c.Ready(); err != nil {
+		t.Fatalf("cluster not ready: %v", err)
+	}
+
+	a.down = true
+	_ = c.ping(context.Background())
+	servers, err := c.Servers(context.Background())
+	if err != nil {
+		t.Fatalf("servers of reachable host not listed: %v", err)
+	}
+	if len(servers) != 1 || servers[0].PR != "2" {
+		t.Errorf("servers = %v, want only the server of host b", servers)
+	}
+	if err := c.Ready(); err != nil {
+		t.Errorf("cluster not ready with one host reachable: %v", err)
+	}
+	if err := c.AllReachable(); !errors.Is(err, errDaemonUnreachable) {
+		t.Errorf("AllReachable = %v, want %v", err, errDaemonUnreachable)
+	}
+
+	b.down = true
+	_ = c.ping(context.Background())
+	if _, err := c.Servers(context.Background()); !errors.Is(err, errDaemonUnreachable) {
+		t.Errorf("Servers = %v, want %v", err, errDaemonUnreachable)
+	}
+	if err := c.Ready(); !errors.Is(err, errDaemonUnreachable) {
+		t.Errorf("Ready = %v, want %v", err, errDaemonUnreachable)
+	}
+}
+
+// fakeRuntime is a Runtime starting the servers of a FakeBackend, counting the starts and holding each of them
+// until release is closed.
+type fakeRuntime struct {
+	Runtime
+	fake    *FakeBackend
+	starts  atomic.Int32
+	release chan struct{}
+}
+
+// Name ...
+func (r *fakeRuntime) Name() string {
+	return "fake"
+}
+
+// Host ...
+func (r *fakeRuntime) Host() HostConfig {
+	return HostConfig{Name: "fake", PublicAddress: "127.0.0.1"}
+}
+
+// Servers ...
+func (r *fakeRuntime) Servers(ctx context.Context) ([]Server, error) {
+	return r.fake.Servers(ctx)
+}
+
+// StartServer ...
+func (r *fakeRuntime) StartServer(ctx context.Context, pr string) (uint16, bool, error) {
+	r.starts.Add(1)
+	<-r.release
+	_, port, found, err := r.fake.StartServer(ctx, pr)
+	return port, found, err
+}
+
+func TestClusterStartServerConcurrently(t *testing.T) {
+	state, err := OpenState(filepath.Join(t.TempDir(), "state.json"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := NewFakeBackend("127.0.0.1", 19132, false)
+	if err := fake.BuildImage(context.Background(), "1", Deployment{PR: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	runtime := &fakeRuntime{fake: fake, release: make(chan struct{})}
+	c := NewCluster([]Runtime{runtime}, state)
+
+	// Two players join the stopped PR at the same time.
+	var wg sync.WaitGroup
+	ports := make([]uint16, 2)
+	for i := range ports {
+		wg.Go(func() {
+			_, port, found, err := c.StartServer(context.Background(), "1")
+			if err != nil || !found {
+				t.Errorf("start server: %v, %v", found, err)
+			}
+			ports[i] = port
+		})
+	}
+	// The second join must find the start of the first in progress rather than start the server too.
+	time.Sleep(time.Millisecond * 50)
+	close(runtime.release)
+	wg.Wait()
+
+	if n := runtime.starts.Load(); n != 1 {
+		t.Errorf("server started %d times, want once", n)
+	}
+	if ports[0] != ports[1] {
+		t.Errorf("joins got ports %v, want the same port", ports)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// command is a subcommand of prmanager, such as serve.
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
+
+// commands holds all subcommands of prmanager. The first is run if no subcommand is passed.
+var commands = []command{
+	{name: "serve", description: "Run prmanager, managing PR servers and serving players and the API.", run: runServe},
+	{name: "validate-config", description: "Check config.toml for errors without starting anything.", run: runValidateConfig},
+	{name: "cleanup", description: "Remove anything left behind by deleted PRs on every host.", run: runCleanup},
+	{name: "migrate-state", description: "Migrate state.json to the format of this version of prmanager.", run: runMigrateState},
+	{name: "migrate-data", description: "Move the files of PRs to the data directory layout of this version of prmanager.", run: runMigrateData},
+}
+
+func main() {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	slog.SetDefault(logger)
+
+	name, args := commands[0].name, []string(nil)
+	if len(os.Args) > 1 {
+		name, args = os.Args[1], os.Args[2:]
+	}
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		if err := enterDataDir(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			os.Exit(1)
+		}
+		if err := cmd.run(args); err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+	usage()
+	if name != "help" && name != "-h" && name != "--help" {
+		os.Exit(2)
+	}
+}
+
+// usage prints the subcommands of prmanager to stderr.
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: prmanager [command] [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.description)
+	}
+}
+
+// enterDataDir changes the working directory to the directory in PRMANAGER_DIR, creating it if it doesn't exist,
+// so that config.toml, state.json and the files of PRs are kept there rather than in the directory prmanager
+// was started in. This allows running prmanager as an unprivileged user owning only that directory.
+func enterDataDir() error {
+	dir := os.Getenv("PRMANAGER_DIR")
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create data directory: %w", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		return fmt.Errorf("enter data directory: %w", err)
+	}
+	return nil
+}
+
+// flags returns a FlagSet for the subcommand with the name passed.
+func flags(name string) *flag.FlagSet {
+	return flag.NewFlagSet("prmanager "+name, flag.ContinueOnError)
+}
+
+// runServe runs the serve subcommand.
+func runServe(args []string) error {
+	fs := flags("serve")
+	dryRun := fs.Bool("dry-run", false, "simulate Docker operations and transfer players to the dry-run echo server")
+	noAuth := fs.Bool("insecure-no-auth", false, "serve the API without authentication if API_KEY is not set")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	serve(*dryRun, *noAuth)
+	return nil
+}
+
+// runValidateConfig runs the validate-config subcommand, which reads config.toml and checks the Dockerfiles of
+// all profiles.
+func runValidateConfig(args []string) error {
+	if err := flags("validate-config").Parse(args); err != nil {
+		return err
+	}
+	// readConfig creates a default config if none exists, which is not what we want to validate.
+	if _, err := os.Stat("config.toml"); err != nil {
+		return err
+	}
+	conf, err := readConfig()
+	if err != nil {
+		return err
+	}
+	for _, profile := range conf.Profiles {
+		if _, err := baseImages(profile.Dockerfile); err != nil {
+			return fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+	}
+	fmt.Printf("config.toml is valid: %d host(s), %d profile(s), ports %d-%d\n", len(conf.Hosts), len(conf.Profiles), conf.Ports.Min, conf.Ports.Max)
+	return nil
+}
+
+// runCleanup runs the cleanup subcommand, which removes anything left behind by deleted PRs. With -containers,
+// the containers of all PRs are removed first, stopping their servers.
+func runCleanup(args []string) error {
+	fs := flags("cleanup")
+	containers := fs.Bool("containers", false, "also remove the containers of all PRs, stopping their servers")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	conf, err := readConfig()
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	state, err := OpenState(statePath, conf)
+	if err != nil {
+		return fmt.Errorf("open state: %w", err)
+	}
+	if err := setupDataLayout(); err != nil {
+		return fmt.Errorf("setup data layout: %w", err)
+	}
+	secrets, err := NewSecretStore(state)
+	if err != nil {
+		return fmt.Errorf("new secret store: %w", err)
+	}
+	git, err := NewGitCredentials(conf)
+	if err != nil {
+		return fmt.Errorf("new git credentials: %w", err)
+	}
+	cluster, err := newCluster(conf, state, secrets, git)
+	if err != nil {
+		return err
+	}
+	defer cluster.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if *containers {
+		if err := cluster.ClearContainers(ctx, false); err != nil {
+			return fmt.Errorf("clear containers: %w", err)
+		}
+	}
+	if err := cluster.CleanupOrphans(ctx); err != nil {
+		return fmt.Errorf("cleanup orphans: %w", err)
+	}
+	return state.Flush()
+}
+
+// runMigrateState runs the migrate-state subcommand, which migrates state.json to the current version.
+func runMigrateState(args []string) error {
+	if err := flags("migrate-state").Parse(args); err != nil {
+		return err
+	}
+	conf, err := readConfig()
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	from, err := MigrateState(statePath, conf)
+	if err != nil {
+		return err
+	}
+	if from == stateVersion {
+		fmt.Printf("state.json is already at version %d\n", stateVersion)
+		return nil
+	}
+	fmt.Printf("Migrated state.json from version %d to %d, the original was kept as state.json.bak\n", from, stateVersion)
+	return nil
+}
+
+// runMigrateData runs the migrate-data subcommand, which moves the worlds of PRs from the data directory itself
+// to the worlds directory. prmanager must be stopped while it runs.
+func runMigrateData(args []string) error {
+	if err := flags("migrate-data").Parse(args); err != nil {
+		return err
+	}
+	moved, err := migrateDataLayout()
+	if err != nil {
+		return err
+	}
+	if moved == 0 {
+		fmt.Println("The data directory is already in the current layout")
+		return nil
+	}
+	fmt.Printf("Moved %d world directories and disk images to worlds/\n", moved)
+	return nil
+}
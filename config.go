@@ -0,0 +1,708 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// Config holds the configuration of prmanager. It is read from config.toml in the working directory, which is
+// created with the default values if it does not yet exist.
+type Config struct {
+	// Hosts are the Docker hosts that servers of pull requests may be scheduled on. By default, only the local
+	// host is used.
+	Hosts []HostConfig
+	Ports struct {
+		// Min and Max are the inclusive bounds of the range of host ports that are assigned to the servers of
+		// pull requests.
+		Min, Max uint16
+		// Public specifies if the extra ports declared by pull requests are published on all interfaces of the
+		// host, so that they can be reached directly. Otherwise they are only reached through the API.
+		Public bool
+	}
+	Firewall struct {
+		// Mode is how the firewall of the local host is managed for the ports of servers. "open" opens the port
+		// of a server when it starts and closes it again when it stops, so that only the ports of running
+		// servers are reachable. "closed" keeps the whole port range closed to other hosts, for when players
+		// only reach servers through a proxy running on the host. If empty, the firewall is not managed.
+		Mode string
+		// Backend is the firewall managed, either "nftables" (the default) or "ufw".
+		Backend string
+	}
+	Health struct {
+		// Interval is how often the servers of pull requests are pinged to check if they are still responsive.
+		Interval time.Duration
+		// StartPeriod is the time a server is given to start up before its health is checked.
+		StartPeriod time.Duration
+		// Failures is the number of pings in a row a server must fail to be considered unhealthy.
+		Failures int
+		// AutoRestart specifies if servers that are unhealthy should automatically be restarted.
+		AutoRestart bool
+	}
+	Idle struct {
+		// PauseAfter is the time without players after which a server is paused. Paused servers keep their
+		// memory but use no CPU, and are resumed almost instantly when a player joins. If zero, servers are
+		// never paused.
+		PauseAfter time.Duration
+		// StopAfter is the time without players after which a server is stopped entirely.
+		StopAfter time.Duration
+	}
+	Authentication struct {
+		// Required specifies if players must log in with Xbox Live to join. It may be disabled for testing
+		// locally with unauthenticated clients, in which case the identity of players isn't verified.
+		Required bool
+	}
+	Handshake struct {
+		// LoginTimeout is the time a client is given to log in after connecting. Clients that haven't logged
+		// in by then, for example because their RakNet handshake hung, are disconnected.
+		LoginTimeout time.Duration
+		// StartGameTimeout is the time a client is given to spawn after logging in, before it is transferred.
+		StartGameTimeout time.Duration
+		// TransferTimeout is the time a client is given to disconnect after being transferred. Clients still
+		// connected after it are disconnected.
+		TransferTimeout time.Duration
+		// Protocols are the protocol versions accepted besides the current one.
+		Protocols []ProtocolConfig
+	}
+	Demand struct {
+		// Window is the time over which the joins of pull requests are counted to estimate their demand.
+		Window time.Duration
+		// WarmAbove is the number of joins per hour from which keeping the server of a pull request running is
+		// recommended.
+		WarmAbove float64
+		// EvictBelow is the number of joins per hour below which stopping the running server of a pull request
+		// is recommended.
+		EvictBelow float64
+	}
+	Handoff struct {
+		// TTL is the time handoff tokens issued to players as they are transferred are valid for.
+		TTL time.Duration
+	}
+	StubWorld struct {
+		// WorldName is the name of the world players spawn in before they are transferred, shown in the pause
+		// menu while they wait.
+		WorldName string
+		// Dimension is the dimension of the world, either "overworld", "nether" or "end".
+		Dimension string
+		// Position is the position players spawn at.
+		Position [3]float32
+		// ChunkRadius is the chunk radius players are told to load. The world has no chunks, so the smallest
+		// radius keeps clients from waiting on chunks that never arrive before they finish spawning.
+		ChunkRadius int32
+	}
+	Players struct {
+		// MaxPerServer is the maximum number of players that may be on the server of a pull request at the same
+		// time. Players joining a full server are turned away. It may be overridden per pull request on upload.
+		// If zero, the number of players is not limited.
+		MaxPerServer int
+	}
+	Stop struct {
+		// GracePeriod is the time a server is given to shut down after being interrupted. Servers that are
+		// still running after the grace period are killed.
+		GracePeriod time.Duration
+	}
+	Shutdown struct {
+		// Timeout is the time prmanager is given to shut down after receiving SIGINT or SIGTERM. In-flight API
+		// requests, such as builds, are aborted if they haven't completed before then.
+		Timeout time.Duration
+		// StopServers specifies if the servers of pull requests are stopped on shutdown. If false, they are
+		// left running.
+		StopServers bool
+	}
+	Logs struct {
+		// MaxSize is the size in megabytes a log file of a server may grow to before it is rotated.
+		MaxSize int
+		// MaxFiles is the number of rotated log files that are kept per pull request.
+		MaxFiles int
+		// MaxAge is the maximum age of rotated log files. Older files are removed.
+		MaxAge time.Duration
+	}
+	Logging struct {
+		// Format is the format prmanager logs in, either "text" or "json".
+		Format string
+		// Level is the minimum level of records that are logged, such as "debug", "info", "warn" or "error".
+		Level string
+		// Levels overrides the level for subsystems, such as the listener, docker or router, by their name.
+		Levels map[string]string
+		// Stdout specifies if logs are written to stdout.
+		Stdout bool
+		// File is the path of a file logs are written to, which is rotated using the same limits as the log
+		// files of servers. If empty, logs are not written to a file.
+		File string
+	}
+	Images struct {
+		// PullInterval is how often the base images of the Dockerfile are pulled again, so that updates to them
+		// are picked up. They are always pulled on startup. If zero, they are only pulled on startup.
+		PullInterval time.Duration
+		// RequeueInterrupted specifies if builds of images that were interrupted by prmanager stopping are
+		// started again once it starts. If false, they are reported as failed instead.
+		RequeueInterrupted bool
+		// BuildCPUs and BuildMemory limit the CPUs and the memory in megabytes that building an image may use,
+		// so that a pull request can't exhaust the host while it is built. On Docker hosts, images are built in
+		// a dedicated BuildKit builder container the limits are applied to, which requires buildx. If both are
+		// zero, the default, images are built with the default builder without limits.
+		BuildCPUs   float64
+		BuildMemory int
+		// CacheSize is the size in megabytes the caches of the CacheDirs of profiles may take up on every host
+		// before the entries used least recently are pruned.
+		CacheSize int
+		// MaxGrowth is the fraction by which the image of a pull request may be larger than the one built
+		// before it without a warning, catching assets included accidentally. If zero, no warnings are logged.
+		MaxGrowth float64
+	}
+	Git struct {
+		// Host is the host the token in GIT_TOKEN is sent to when fetching over HTTPS, such as github.com.
+		Host string
+		// User is the user name the token is sent with.
+		User string
+	}
+	Retention struct {
+		// Interval is how often the retention policy is evaluated.
+		Interval time.Duration
+		// MaxAge is the time after its last upload after which a pull request is deleted. If zero, pull
+		// requests are never deleted because of their age.
+		MaxAge time.Duration
+		// MaxIdle is the time without players joining after which a pull request is deleted. Pull requests
+		// nobody joined yet count as idle from their last upload. If zero, idle pull requests are kept.
+		MaxIdle time.Duration
+		// MaxPullRequests is the maximum number of pull requests that are deployed at the same time. If more
+		// are deployed, those that were used the least recently are deleted. If zero, the number is not
+		// limited.
+		MaxPullRequests int
+		// Pinned are the numbers of pull requests that are never deleted by the retention policy.
+		Pinned []string
+	}
+	Delete struct {
+		// GracePeriod is the time a pull request deleted through the API is kept, with its server stopped,
+		// before its image, binary and world are purged, so that it can be restored if it was deleted by
+		// accident. If zero, pull requests are purged right away.
+		GracePeriod time.Duration
+		// DrainTimeout is the longest a pull request deleted with players online is drained for before it is
+		// deleted anyway. While it is drained, no new players may join it.
+		DrainTimeout time.Duration
+		// DrainCommand is the console command that warns the players online on a server that is drained, in
+		// which {message} is replaced by the drain_warning message.
+		DrainCommand string
+	}
+	Disk struct {
+		// Paths are the paths whose volumes the free disk space is watched on, such as the working directory
+		// holding binaries and worlds and the data root of the container runtime. Paths that don't exist are
+		// skipped.
+		Paths []string
+		// MinFree is the disk space in megabytes that must be free on every volume watched for uploads to be
+		// accepted. If zero, uploads are never refused.
+		MinFree int
+	}
+	Artifacts struct {
+		// Keep is the number of uploaded binaries that are kept per pull request, so that the binary of an
+		// earlier build can still be downloaded. Older binaries are removed. If zero, all binaries are kept.
+		Keep int
+	}
+	Backup struct {
+		// Endpoint is the URL of the S3-compatible object storage that worlds are backed up to, such as
+		// https://s3.eu-central-1.amazonaws.com.
+		Endpoint string
+		// Bucket is the bucket backups are stored in. If empty, worlds are not backed up.
+		Bucket string
+		// Region is the region of the bucket.
+		Region string
+		// Prefix is prepended to the keys of all backups stored in the bucket.
+		Prefix string
+		// Interval is how often the worlds of pull requests that changed since their last backup are backed
+		// up. Worlds are always backed up when their pull request is deleted.
+		Interval time.Duration
+		// Keep is the number of backups that are retained per pull request. Older backups are removed. If
+		// zero, all backups are kept.
+		Keep int
+	}
+	Email struct {
+		// Host and Port are the address of the SMTP server emails are sent through, such as smtp.gmail.com
+		// and 587. If Host is empty, no emails are sent. The password is read from SMTP_PASSWORD.
+		Host string
+		Port int
+		// Username is the username used to authenticate with the SMTP server. If empty, no authentication is
+		// used.
+		Username string
+		// From is the address emails are sent from.
+		From string
+		// To are the addresses of the maintainers emails are sent to.
+		To []string
+		// BuildFailures is the number of builds of a pull request in a row that must fail for an email to be
+		// sent.
+		BuildFailures int
+		// Cooldown is the minimum time between two emails about the same problem.
+		Cooldown time.Duration
+	}
+	GitHub struct {
+		// Repository is the GitHub repository pull requests are opened on, such as df-mc/dragonfly. Players
+		// joining a PR are shown its title and author, fetched from GitHub. If empty, they are not fetched.
+		Repository string
+		// CacheTTL is the time the metadata of a pull request is cached for before it is fetched again.
+		CacheTTL time.Duration
+	}
+	API struct {
+		// Socket is the path of a Unix domain socket the API is served on in addition to port 8080, so that
+		// local tools and a reverse proxy can reach it without going through the network. If empty, no
+		// socket is created.
+		Socket string
+		// SocketMode is the octal file mode of the socket, such as 0660 to allow only the owner and group of
+		// prmanager to connect.
+		SocketMode string
+		// TrustedProxies are the reverse proxies, such as nginx or Cloudflare, trusted to pass the address of
+		// the client they forward a request for in the X-Forwarded-For header. Each is an IP address, a CIDR
+		// range or unix for clients of Socket. If empty, the address a request came from is used.
+		TrustedProxies []string
+		// AllowedOrigins are the origins of web pages allowed to call the API from a browser, such as
+		// https://status.df-mc.dev, or * for any origin. If empty, cross-origin requests are not allowed.
+		AllowedOrigins []string
+		// RateLimit is the number of requests per second a single client, identified by its IP address, may
+		// make to the API on average. If zero, requests are not limited.
+		RateLimit float64
+		// RateBurst is the number of requests a single client may make at once before it is limited.
+		RateBurst int
+		// MaxAuthFailures is the number of failed authentication attempts after which a client is banned for
+		// AuthBanDuration. Attempts are counted as long as each follows the previous within AuthBanDuration.
+		// If zero, clients are never banned.
+		MaxAuthFailures int
+		// AuthBanDuration is the time a client is banned for after too many failed authentication attempts.
+		AuthBanDuration time.Duration
+	}
+	Reconcile struct {
+		// Interval is how often the servers that should be running are compared with those actually running,
+		// restarting missing servers and stopping those of pull requests that are not deployed. If zero,
+		// servers are only reconciled when the job is triggered through the API.
+		Interval time.Duration
+	}
+	Jobs struct {
+		// Jitter is the maximum random delay added to the interval of every periodic job, as a fraction of the
+		// interval, so that jobs with the same interval don't all run at once.
+		Jitter float64
+	}
+	SelfCheck struct {
+		// Enabled specifies if prmanager checks on startup that players can reach the Minecraft listener and
+		// the replicas of static routes through their public addresses, failing readiness probes until they
+		// can. It is disabled by default, as hosts without NAT loopback can't reach their own public address.
+		Enabled bool
+		// Address is the public address the Minecraft listener is pinged at. If empty, the public address of
+		// the local host, or that of the first host if none is local, is used.
+		Address string
+		// Timeout is the time a ping may take before the address is considered unreachable.
+		Timeout time.Duration
+	}
+	DNS struct {
+		// Provider is the DNS provider the records players join with are managed through, either "cloudflare"
+		// or "route53". If empty, DNS records are not managed.
+		Provider string
+		// Zone is the ID of the zone records are managed in: the zone ID on Cloudflare or the ID of the hosted
+		// zone on Route53.
+		Zone string
+		// Domain is the base domain the addresses of pull requests are subdomains of, such as df-mc.dev.
+		Domain string
+		// Records is either "wildcard", managing a single *.<Domain> record, or "pr", managing a record for
+		// every pull request that is created when it is deployed and removed when it is deleted.
+		Records string
+		// Target is the address records point to. An IP address results in A or AAAA records, any other
+		// address in CNAME records. If empty, the public address of the local host is used.
+		Target string
+		// TTL is the time to live of the records.
+		TTL time.Duration
+	}
+	StatusPage struct {
+		// Enabled specifies if the public status page listing the previews of pull requests is served at
+		// /status. It does not require an API key.
+		Enabled bool
+		// JoinAddress is the address shown on the status page that players join a pull request with, in
+		// which {pr} is replaced by the number of the pull request.
+		JoinAddress string
+	}
+	// Routing are the routes players are transferred by based on the address they joined with. They may be
+	// replaced at runtime through the API until prmanager restarts.
+	Routing Routes
+	// Messages are the messages shown to players, such as when they are disconnected because their server
+	// could not be started.
+	Messages MessagesConfig
+	// Profiles are the image profiles pull requests may be built and run with. The first profile is used if
+	// none is specified on upload.
+	Profiles []ProfileConfig
+	// Environments are the permanent servers managed by prmanager alongside pull requests, such as the main
+	// and plots servers.
+	Environments []EnvironmentConfig
+	// Sidecars are containers started alongside the server of every pull request, such as metrics exporters.
+	// They are stopped and removed along with the server.
+	Sidecars []SidecarConfig
+	Tracing  struct {
+		// Endpoint is the host and port of the OTLP/HTTP endpoint spans are exported to, such as
+		// localhost:4318. If empty, tracing is disabled.
+		Endpoint string
+		// Insecure specifies if spans are exported over plain HTTP rather than HTTPS.
+		Insecure bool
+		// SampleRatio is the fraction of traces that are recorded, between 0 and 1.
+		SampleRatio float64
+	}
+	Signing struct {
+		// PublicKeys are the minisign public keys uploaded binaries must be signed with, such as the key of the
+		// CI pipeline. If empty, signatures are not verified.
+		PublicKeys []string
+	}
+	DryRun struct {
+		// Enabled specifies if Docker operations are only simulated and logged rather than executed, so that
+		// routing and configuration can be tested without Docker.
+		Enabled bool
+		// Address and Port are the address of the echo server players are transferred to in place of the
+		// servers of pull requests while in dry-run mode.
+		Address string
+		Port    uint16
+	}
+}
+
+// HostConfig is the configuration of a Docker host that servers of pull requests may be scheduled on.
+type HostConfig struct {
+	// Name is a unique name used to refer to the host.
+	Name string
+	// Runtime is the container runtime running on the host, either "docker" (the default) or "podman".
+	Runtime string
+	// Address is the address of the Docker daemon on the host, such as tcp://10.0.0.2:2375. If empty, the
+	// Docker daemon of the local host is used.
+	Address string
+	// PublicAddress is the address players are transferred to in order to reach servers on the host.
+	PublicAddress string
+	// PrivateAddress is the IP address of a remote host on a private network prmanager reaches it over, such as
+	// 10.0.0.2. Servers on the host are pinged over it. Unless Ports.Public is set, the extra ports of servers on
+	// the host are only published on it, and servers on remote hosts without one can't expose extra ports.
+	PrivateAddress string
+	// MaxServers is the maximum number of servers that may run on the host at the same time. If zero, the
+	// number of servers is not limited.
+	MaxServers int
+}
+
+// privateAddress returns the address prmanager reaches servers on the host over: the loopback address for the
+// local host, or otherwise its PrivateAddress. Remote hosts without a PrivateAddress are reached over their
+// PublicAddress, which requires their network to support NAT loopback.
+func (h HostConfig) privateAddress() string {
+	switch {
+	case h.Address == "":
+		return "127.0.0.1"
+	case h.PrivateAddress != "":
+		return h.PrivateAddress
+	}
+	return h.PublicAddress
+}
+
+// privateAddress returns the address prmanager reaches the servers of the host with the public address passed
+// over. The address passed is returned as is if no host has it as its PublicAddress.
+func privateAddress(conf Config, address string) string {
+	for _, host := range conf.Hosts {
+		if host.PublicAddress == address {
+			return host.privateAddress()
+		}
+	}
+	return address
+}
+
+// localPublicAddress returns the public address of the local host, or that of the first host if none of the
+// hosts configured is local.
+func localPublicAddress(conf Config) string {
+	for _, host := range conf.Hosts {
+		if host.Address == "" {
+			return host.PublicAddress
+		}
+	}
+	return conf.Hosts[0].PublicAddress
+}
+
+// DefaultConfig returns a Config filled out with the default values.
+func DefaultConfig() Config {
+	c := Config{}
+	c.Hosts = []HostConfig{{Name: "local", PublicAddress: "df-mc.dev"}}
+	c.Profiles = []ProfileConfig{defaultProfile()}
+	c.Routing = defaultRoutes()
+	c.Messages.Text = maps.Clone(defaultMessages)
+	c.Messages.Forms = true
+	c.Messages.Progress = true
+	c.Ports.Min = 20000
+	c.Ports.Max = 20500
+	c.Firewall.Backend = "nftables"
+	c.Health.Interval = time.Second * 30
+	c.Health.StartPeriod = time.Minute
+	c.Health.Failures = 3
+	c.Idle.StopAfter = time.Hour
+	c.Authentication.Required = true
+	c.Handshake.LoginTimeout = time.Second * 30
+	c.Handshake.StartGameTimeout = time.Second * 30
+	c.Handshake.TransferTimeout = time.Second * 10
+	c.Demand.Window = time.Hour * 24
+	c.Demand.WarmAbove = 2
+	c.Demand.EvictBelow = 0.25
+	c.Handoff.TTL = time.Second * 30
+	c.StubWorld.WorldName = "df-mc preview router"
+	c.StubWorld.Dimension = "overworld"
+	c.StubWorld.ChunkRadius = 1
+	c.Stop.GracePeriod = time.Second * 30
+	c.Shutdown.Timeout = time.Minute
+	c.Logs.MaxSize = 10
+	c.Logs.MaxFiles = 5
+	c.Logs.MaxAge = time.Hour * 24 * 14
+	c.Logging.Format = "text"
+	c.Logging.Level = "info"
+	c.Logging.Stdout = true
+	c.Images.PullInterval = time.Hour * 24
+	c.Images.RequeueInterrupted = true
+	c.Images.CacheSize = 10240
+	c.Images.MaxGrowth = 0.5
+	c.Git.Host = "github.com"
+	c.Git.User = "x-access-token"
+	c.Retention.Interval = time.Hour
+	c.Disk.Paths = []string{".", "/var/lib/docker", "/var/lib/containers"}
+	c.Disk.MinFree = 2048
+	c.Artifacts.Keep = 5
+	c.Backup.Region = "us-east-1"
+	c.Backup.Interval = time.Hour * 6
+	c.Backup.Keep = 10
+	c.DNS.Domain = "df-mc.dev"
+	c.DNS.Records = dnsWildcard
+	c.DNS.TTL = time.Minute * 5
+	c.Reconcile.Interval = time.Minute
+	c.Delete.GracePeriod = time.Hour * 24
+	c.Delete.DrainTimeout = time.Minute * 5
+	c.Delete.DrainCommand = "say {message}"
+	c.Jobs.Jitter = 0.1
+	c.SelfCheck.Timeout = time.Second * 5
+	c.Email.Port = 587
+	c.Email.BuildFailures = 3
+	c.Email.Cooldown = time.Hour
+	c.GitHub.Repository = "df-mc/dragonfly"
+	c.GitHub.CacheTTL = time.Minute * 10
+	c.API.SocketMode = "0660"
+	c.API.RateLimit = 10
+	c.API.RateBurst = 50
+	c.API.MaxAuthFailures = 10
+	c.API.AuthBanDuration = time.Minute * 15
+	c.StatusPage.Enabled = true
+	c.StatusPage.JoinAddress = "{pr}.df-mc.dev"
+	c.Tracing.SampleRatio = 1
+	c.DryRun.Address = "127.0.0.1"
+	c.DryRun.Port = 19133
+	return c
+}
+
+// parseFileMode parses an octal file mode, such as 0660, holding only permission bits.
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("file mode %s has bits other than permissions set", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// readConfig reads the configuration from the config.toml file, or creates the file with the default
+// configuration if it does not yet exist.
+func readConfig() (Config, error) {
+	c := DefaultConfig()
+	if _, err := os.Stat("config.toml"); os.IsNotExist(err) {
+		data, err := toml.Marshal(c)
+		if err != nil {
+			return c, fmt.Errorf("encode default config: %w", err)
+		}
+		if err := os.WriteFile("config.toml", data, 0644); err != nil {
+			return c, fmt.Errorf("create default config: %w", err)
+		}
+		return c, nil
+	}
+	data, err := os.ReadFile("config.toml")
+	if err != nil {
+		return c, fmt.Errorf("read config: %w", err)
+	}
+	if err := toml.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("decode config: %w", err)
+	}
+	if c.Ports.Min == 0 || c.Ports.Min > c.Ports.Max {
+		return c, fmt.Errorf("invalid port range %d-%d", c.Ports.Min, c.Ports.Max)
+	}
+	if c.Firewall.Mode != "" && c.Firewall.Mode != firewallOpen && c.Firewall.Mode != firewallClosed {
+		return c, fmt.Errorf("invalid firewall mode %q: must be open or closed", c.Firewall.Mode)
+	}
+	if c.Firewall.Backend != "nftables" && c.Firewall.Backend != "ufw" {
+		return c, fmt.Errorf("invalid firewall backend %q: must be nftables or ufw", c.Firewall.Backend)
+	}
+	if len(c.Hosts) == 0 {
+		return c, fmt.Errorf("at least one host must be configured")
+	}
+	names := make(map[string]bool, len(c.Hosts))
+	for _, host := range c.Hosts {
+		if host.Name == "" || host.PublicAddress == "" || names[host.Name] {
+			return c, fmt.Errorf("hosts must have a unique name and a public address")
+		}
+		names[host.Name] = true
+		if host.PrivateAddress != "" && net.ParseIP(host.PrivateAddress) == nil {
+			return c, fmt.Errorf("private address %q of host %s must be an IP address", host.PrivateAddress, host.Name)
+		}
+	}
+	if len(c.Profiles) == 0 {
+		return c, fmt.Errorf("at least one profile must be configured")
+	}
+	profiles := make(map[string]bool, len(c.Profiles))
+	for i, profile := range c.Profiles {
+		if profile.Name == "" || profiles[profile.Name] {
+			return c, fmt.Errorf("profiles must have a unique name")
+		}
+		profiles[profile.Name] = true
+		for _, dir := range profile.CacheDirs {
+			// The directories are passed in the options of a mount, which are separated by commas.
+			if !strings.HasPrefix(dir, "/") || strings.ContainsAny(dir, ", ") {
+				return c, fmt.Errorf("profile %s: cache directory %q must be an absolute path without commas or spaces", profile.Name, dir)
+			}
+		}
+		if profile.Repository != "" && profile.SourceDockerfile == "" {
+			return c, fmt.Errorf("profile %s: a repository requires a source Dockerfile", profile.Name)
+		}
+		c.Profiles[i] = profile.withDefaults()
+	}
+	environments := make(map[string]bool, len(c.Environments))
+	for _, env := range c.Environments {
+		if !environmentNamePattern.MatchString(env.Name) || environments[env.Name] {
+			return c, fmt.Errorf("environments must have a unique name of lowercase letters and digits starting with a letter")
+		}
+		environments[env.Name] = true
+		if env.Port == 0 || (env.Port >= c.Ports.Min && env.Port <= c.Ports.Max) {
+			return c, fmt.Errorf("environment %s must have a port outside the port range of pull requests", env.Name)
+		}
+		if _, ok := c.Profile(env.Profile); !ok {
+			return c, fmt.Errorf("environment %s has unknown profile %q", env.Name, env.Profile)
+		}
+		if _, err := time.Parse("15:04", env.RedeployAt); env.RedeployAt != "" && err != nil {
+			return c, fmt.Errorf("environment %s must be redeployed at a time of day such as 04:00", env.Name)
+		}
+	}
+	if _, err := c.Routing.validate(); err != nil {
+		return c, fmt.Errorf("routing: %w", err)
+	}
+	if err := c.Messages.validate(); err != nil {
+		return c, fmt.Errorf("messages: %w", err)
+	}
+	for _, sidecar := range c.Sidecars {
+		if sidecar.Name == "" || sidecar.Image == "" {
+			return c, fmt.Errorf("sidecars must have a name and image")
+		}
+	}
+	if c.Idle.StopAfter <= 0 || (c.Idle.PauseAfter > 0 && c.Idle.PauseAfter >= c.Idle.StopAfter) {
+		return c, fmt.Errorf("idle stop time must be positive and greater than the pause time")
+	}
+	if c.Git.Host == "" || strings.ContainsAny(c.Git.Host, "/ ") {
+		return c, fmt.Errorf("git host must be a host name")
+	}
+	if c.Images.BuildCPUs < 0 || c.Images.BuildMemory < 0 || c.Images.CacheSize < 0 || c.Images.MaxGrowth < 0 {
+		return c, fmt.Errorf("build limits, cache size and image growth must not be negative")
+	}
+	if c.Retention.Interval <= 0 || c.Retention.MaxAge < 0 || c.Retention.MaxIdle < 0 || c.Retention.MaxPullRequests < 0 {
+		return c, fmt.Errorf("retention interval must be positive and its limits must not be negative")
+	}
+	if c.DNS.Provider != "" && c.DNS.Provider != "cloudflare" && c.DNS.Provider != "route53" {
+		return c, fmt.Errorf("invalid DNS provider %q: must be cloudflare or route53", c.DNS.Provider)
+	}
+	if c.DNS.Provider != "" && (c.DNS.Zone == "" || c.DNS.Domain == "") {
+		return c, fmt.Errorf("DNS zone and domain must be set when a DNS provider is configured")
+	}
+	if c.DNS.Records != dnsWildcard && c.DNS.Records != dnsPerPR {
+		return c, fmt.Errorf("invalid DNS records %q: must be wildcard or pr", c.DNS.Records)
+	}
+	if c.DNS.TTL < time.Minute {
+		return c, fmt.Errorf("DNS TTL must be at least one minute")
+	}
+	if c.Reconcile.Interval < 0 {
+		return c, fmt.Errorf("reconcile interval must not be negative")
+	}
+	if c.Delete.GracePeriod < 0 {
+		return c, fmt.Errorf("delete grace period must not be negative")
+	}
+	if c.Delete.DrainTimeout <= 0 {
+		return c, fmt.Errorf("delete drain timeout must be positive")
+	}
+	if c.Jobs.Jitter < 0 || c.Jobs.Jitter > 1 {
+		return c, fmt.Errorf("job jitter must be between 0 and 1")
+	}
+	if c.SelfCheck.Enabled && c.SelfCheck.Timeout <= 0 {
+		return c, fmt.Errorf("self-check timeout must be positive")
+	}
+	if c.Disk.MinFree < 0 {
+		return c, fmt.Errorf("minimum free disk space must not be negative")
+	}
+	if c.Artifacts.Keep < 0 {
+		return c, fmt.Errorf("number of binaries kept must not be negative")
+	}
+	if c.Backup.Bucket != "" && c.Backup.Endpoint == "" {
+		return c, fmt.Errorf("backup endpoint must be set when a backup bucket is configured")
+	}
+	if c.Email.Host != "" && (c.Email.From == "" || len(c.Email.To) == 0 || c.Email.Port <= 0) {
+		return c, fmt.Errorf("email sender, recipients and port must be set when an SMTP host is configured")
+	}
+	if c.Email.BuildFailures <= 0 || c.Email.Cooldown < 0 {
+		return c, fmt.Errorf("email build failures must be positive and the cooldown must not be negative")
+	}
+	if c.Handshake.LoginTimeout <= 0 || c.Handshake.StartGameTimeout <= 0 || c.Handshake.TransferTimeout <= 0 {
+		return c, fmt.Errorf("handshake timeouts must be positive")
+	}
+	if err := validateProtocols(c.Handshake.Protocols); err != nil {
+		return c, fmt.Errorf("handshake: %w", err)
+	}
+	if _, ok := dimensions[c.StubWorld.Dimension]; !ok {
+		return c, fmt.Errorf("invalid stub world dimension %q: must be overworld, nether or end", c.StubWorld.Dimension)
+	}
+	if c.Demand.Window < time.Hour || c.Demand.EvictBelow < 0 || c.Demand.WarmAbove <= c.Demand.EvictBelow {
+		return c, fmt.Errorf("demand window must be at least an hour and warm threshold must be above the evict threshold")
+	}
+	if c.Handoff.TTL <= 0 {
+		return c, fmt.Errorf("handoff TTL must be positive")
+	}
+	if c.StubWorld.ChunkRadius < 1 {
+		return c, fmt.Errorf("stub world chunk radius must be at least 1")
+	}
+	if _, err := parseFileMode(c.API.SocketMode); err != nil {
+		return c, fmt.Errorf("API socket mode must be an octal file mode such as 0660")
+	}
+	if _, err := parseTrustedProxies(c.API.TrustedProxies); err != nil {
+		return c, fmt.Errorf("API: %w", err)
+	}
+	if c.API.RateLimit < 0 || (c.API.RateLimit > 0 && c.API.RateBurst <= 0) {
+		return c, fmt.Errorf("API rate limit must not be negative and its burst must be positive")
+	}
+	if c.API.MaxAuthFailures < 0 || (c.API.MaxAuthFailures > 0 && c.API.AuthBanDuration <= 0) {
+		return c, fmt.Errorf("maximum authentication failures must not be negative and the ban duration must be positive")
+	}
+	if c.Players.MaxPerServer < 0 {
+		return c, fmt.Errorf("maximum players per server must not be negative")
+	}
+	if c.Shutdown.Timeout <= 0 {
+		return c, fmt.Errorf("shutdown timeout must be positive")
+	}
+	if c.Logging.Format != "text" && c.Logging.Format != "json" {
+		return c, fmt.Errorf("log format must be text or json")
+	}
+	if !c.Logging.Stdout && c.Logging.File == "" {
+		return c, fmt.Errorf("logs must be written to stdout or a file")
+	}
+	if _, _, err := logLevels(c); err != nil {
+		return c, err
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return c, fmt.Errorf("tracing sample ratio must be between 0 and 1")
+	}
+	if _, err := parseMinisignKeys(c.Signing.PublicKeys); err != nil {
+		return c, fmt.Errorf("signing: %w", err)
+	}
+	if c.DryRun.Enabled && (c.DryRun.Address == "" || c.DryRun.Port == 0) {
+		return c, fmt.Errorf("dry-run address and port must be set when dry-run mode is enabled")
+	}
+	if c.Health.Interval <= 0 || c.Health.Failures <= 0 {
+		return c, fmt.Errorf("health interval and failures must be positive")
+	}
+	return c, nil
+}
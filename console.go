@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// console is an interactive connection to the console of a server. Reading from it returns the output of the
+// server, while anything written to it is passed to the standard input of the server.
+type console struct {
+	io.Reader
+	io.Writer
+	close func() error
+}
+
+// Close closes the connection to the console.
+func (c *console) Close() error {
+	return c.close()
+}
+
+// Attach attaches to the standard input and output of the server container of the given PR. Only output
+// written after attaching is returned, as earlier output is available from the log file of the PR.
+func (d *Docker) Attach(ctx context.Context, pr string) (io.ReadWriteCloser, error) {
+	resp, err := d.client.ContainerAttach(ctx, "pr-"+pr, container.AttachOptions{
+		Stream: true,
+		Stdin:  true,
+		Stdout: true,
+		Stderr: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("attach container: %w", dockerError(err))
+	}
+	// Containers are started without a TTY, so stdout and stderr are multiplexed in the stream.
+	r, w := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(w, w, resp.Reader)
+		_ = w.CloseWithError(err)
+	}()
+	return &console{Reader: r, Writer: resp.Conn, close: func() error {
+		resp.Close()
+		return r.Close()
+	}}, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// GitCredentials are the credentials private git repositories are fetched with when pull requests are built
+// from source: a token in the GIT_TOKEN environment variable, sent over HTTPS to Git.Host, and a deploy key
+// at the path in GIT_SSH_KEY, used over SSH. They are used both to fetch git refs uploaded for pull requests
+// and, if the SourceDockerfile of the profile asks for them, within the build to fetch private companion
+// repositories, such as Go modules. They are never passed as arguments or build arguments, so they don't end up
+// in logs, process lists or the layers of images.
+type GitCredentials struct {
+	host, user, token string
+	sshKey            string
+}
+
+// NewGitCredentials creates GitCredentials from the GIT_TOKEN and GIT_SSH_KEY environment variables, either of
+// which may be empty. An error is returned if GIT_SSH_KEY is set but no key exists at the path.
+func NewGitCredentials(conf Config) (*GitCredentials, error) {
+	g := &GitCredentials{host: conf.Git.Host, user: conf.Git.User, token: os.Getenv("GIT_TOKEN"), sshKey: os.Getenv("GIT_SSH_KEY")}
+	if g.sshKey != "" {
+		if _, err := os.Stat(g.sshKey); err != nil {
+			return nil, fmt.Errorf("GIT_SSH_KEY: %w", err)
+		}
+	}
+	return g, nil
+}
+
+// authorization returns the value of the Authorization header the token is sent with.
+func (g *GitCredentials) authorization() string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(g.user+":"+g.token))
+}
+
+// env returns the environment variables git commands are run with to authenticate with the credentials. The
+// token is passed through the config git reads from the environment rather than the remote URL, so that it
+// doesn't show up in the output of git.
+func (g *GitCredentials) env() []string {
+	// git must never wait for credentials to be typed in.
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+	if g.token != "" {
+		env = append(env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.https://"+g.host+"/.extraHeader", "GIT_CONFIG_VALUE_0=Authorization: "+g.authorization())
+	}
+	if g.sshKey != "" {
+		// GIT_SSH_COMMAND is run by a shell, so the path of the key is quoted.
+		key := "'" + strings.ReplaceAll(g.sshKey, "'", `'\''`) + "'"
+		env = append(env, "GIT_SSH_COMMAND=ssh -i "+key+" -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new")
+	}
+	return env
+}
+
+// buildArgs returns the arguments of the build command that make the credentials available to RUN
+// instructions mounting them: the token as a git config at the path passed, exposed as the gitconfig secret,
+// and the deploy key as the default SSH agent socket. Neither is kept in the image.
+func (g *GitCredentials) buildArgs(path string) ([]string, error) {
+	var args []string
+	if g.token != "" {
+		config := fmt.Sprintf("[http \"https://%s/\"]\n\textraHeader = Authorization: %s\n", g.host, g.authorization())
+		if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+			return nil, fmt.Errorf("write git config: %w", err)
+		}
+		args = append(args, "--secret", "id=gitconfig,src="+path)
+	}
+	if g.sshKey != "" {
+		args = append(args, "--ssh", "default="+g.sshKey)
+	}
+	return args, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// daemonInterval is how often the container daemons of all hosts are pinged.
+	daemonInterval = time.Second * 10
+	// daemonTimeout is the time a ping of a container daemon may take before it is considered unreachable.
+	daemonTimeout = time.Second * 5
+)
+
+// daemonUp is 1 for the hosts whose container daemon responded to the last ping and 0 for the others.
+var daemonUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "prmanager_daemon_up",
+	Help: "Whether the container daemon of a host responded to the last ping.",
+}, []string{"host"})
+
+// daemonOutage is an outage of the container daemon of a host, from the first ping that failed until one
+// succeeds again.
+type daemonOutage struct {
+	since time.Time
+	err   error
+}
+
+// Ping checks that the daemon can be reached. If it can't, the idle connections to it are closed, so that the
+// next request reconnects rather than reusing a connection to a daemon that has since restarted.
+func (d *Docker) Ping(ctx context.Context) error {
+	if _, err := d.client.Ping(ctx); err != nil {
+		d.client.HTTPClient().CloseIdleConnections()
+		if err = dockerError(err); !errors.Is(err, errDaemonUnreachable) {
+			err = fmt.Errorf("%w: %w", errDaemonUnreachable, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Job returns the Job pinging the container daemons of all hosts of the Cluster every daemonInterval.
+func (c *Cluster) Job() Job {
+	return Job{Name: "daemons", Interval: daemonInterval, Immediate: true, Run: c.ping}
+}
+
+// ping pings the container daemon of every host once, recording hosts that became unreachable or reachable
+// again.
+func (c *Cluster) ping(ctx context.Context) error {
+	var errs []error
+	for _, d := range c.hosts {
+		pingCtx, cancel := context.WithTimeout(ctx, daemonTimeout)
+		err := d.Ping(pingCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		c.mu.Lock()
+		outage, down := c.outages[d.Name()]
+		if err != nil && !down {
+			c.outages[d.Name()] = daemonOutage{since: time.Now(), err: err}
+		} else if err != nil {
+			c.outages[d.Name()] = daemonOutage{since: outage.since, err: err}
+		} else {
+			delete(c.outages, d.Name())
+		}
+		c.mu.Unlock()
+
+		switch {
+		case err != nil && !down:
+			slog.Error("Container daemon of host became unreachable", slog.String("host", d.Name()), slog.Any("error", err))
+		case err == nil && down:
+			slog.Info("Reconnected to container daemon of host", slog.String("host", d.Name()), slog.Duration("outage", time.Since(outage.since)))
+		}
+		if err != nil {
+			daemonUp.WithLabelValues(d.Name()).Set(0)
+			errs = append(errs, fmt.Errorf("host %s: %w", d.Name(), err))
+		} else {
+			daemonUp.WithLabelValues(d.Name()).Set(1)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reachable returns an error satisfying errors.Is(err, errDaemonUnreachable) if the last ping of the container
+// daemon of the host of the Runtime passed failed, so that operations on it fail right away with a clear error
+// rather than after timing out.
+func (c *Cluster) reachable(d Runtime) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if outage, down := c.outages[d.Name()]; down {
+		return fmt.Errorf("host %s: unreachable since %s: %w", d.Name(), outage.since.Format(time.RFC3339), outage.err)
+	}
+	return nil
+}
+
+// Ready returns an error if the container daemons of all hosts are unreachable, or nil if any of them responded
+// to the last ping. Servers are still started on the hosts that are reachable while others are not.
+func (c *Cluster) Ready() error {
+	if hosts := c.unreachable(); len(hosts) == len(c.hosts) {
+		return fmt.Errorf("%w: host(s) %s", errDaemonUnreachable, strings.Join(hosts, ", "))
+	}
+	return nil
+}
+
+// AllReachable returns an error if the container daemon of any host is unreachable, in which case the servers
+// and deployments listed by the Cluster miss those on it.
+func (c *Cluster) AllReachable() error {
+	if hosts := c.unreachable(); len(hosts) > 0 {
+		return fmt.Errorf("%w: host(s) %s", errDaemonUnreachable, strings.Join(hosts, ", "))
+	}
+	return nil
+}
+
+// unreachable returns the names of the hosts whose container daemon did not respond to the last ping.
+func (c *Cluster) unreachable() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var hosts []string
+	for _, d := range c.hosts {
+		if _, down := c.outages[d.Name()]; down {
+			hosts = append(hosts, d.Name())
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// startTime is the time prmanager was started at.
+var startTime = time.Now()
+
+// AddDebugState registers a function returning the state of a subsystem under the name passed, which is then
+// included in the dump of /debug/state. It must be called before Run.
+func (r *Router) AddDebugState(name string, f func(ctx context.Context) any) {
+	r.debugState[name] = f
+}
+
+// registerDebugRoutes registers the pprof and /debug/state endpoints wrapped in the admin middlewares passed,
+// which require the admin API key.
+func (r *Router) registerDebugRoutes(admin []middleware) {
+	r.handle("GET /debug/pprof/", pprof.Index, admin...)
+	r.handle("GET /debug/pprof/cmdline", pprof.Cmdline, admin...)
+	r.handle("GET /debug/pprof/profile", pprof.Profile, admin...)
+	r.handle("GET /debug/pprof/symbol", pprof.Symbol, admin...)
+	r.handle("GET /debug/pprof/trace", pprof.Trace, admin...)
+	r.handle("GET /debug/state", r.handleDebugState, admin...)
+}
+
+// adminKeyMiddleware is a middleware that checks for the admin API key in the request headers.
+func (r *Router) adminKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if r.authorize(writer, request, nil, r.adminKey) {
+			next.ServeHTTP(writer, request)
+		}
+	})
+}
+
+// buildState is the state of a build in progress, as it is included in /debug/state.
+type buildState struct {
+	PR      string    `json:"pr"`
+	Started time.Time `json:"started"`
+}
+
+// trackBuild records that an image is being built for the given PR until the function returned is called.
+func (r *Router) trackBuild(pr string) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.builds[pr] = time.Now()
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.builds, pr)
+	}
+}
+
+// handleDebugState dumps the runtime state of prmanager and its subsystems, such as the builds in progress and
+// the connections of the listener, as JSON.
+func (r *Router) handleDebugState(writer http.ResponseWriter, request *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	state := map[string]any{
+		"uptime":     time.Since(startTime).String(),
+		"goroutines": runtime.NumGoroutine(),
+		"memory": map[string]uint64{
+			"heap_alloc_bytes": mem.HeapAlloc,
+			"heap_sys_bytes":   mem.HeapSys,
+			"gc_cycles":        uint64(mem.NumGC),
+		},
+	}
+
+	r.mu.Lock()
+	builds := make([]buildState, 0, len(r.builds))
+	for pr, started := range r.builds {
+		builds = append(builds, buildState{PR: pr, Started: started})
+	}
+	r.mu.Unlock()
+	state["builds"] = builds
+
+	for name, f := range r.debugState {
+		state[name] = f(request.Context())
+	}
+	writeJSON(writer, http.StatusOK, state)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// demandWarm is the recommendation to keep the server of a pull request running, as players join it often.
+	demandWarm = "warm"
+	// demandEvict is the recommendation to stop the running server of a pull request, as players rarely join.
+	demandEvict = "evict"
+	// demandNone is the recommendation to leave the server of a pull request to the idle timeouts.
+	demandNone = "none"
+)
+
+var (
+	demandRateDesc = prometheus.NewDesc(
+		"prmanager_demand_joins_per_hour",
+		"Average number of joins per hour of a pull request over the demand window.",
+		[]string{"pr"}, nil,
+	)
+	demandRecommendationDesc = prometheus.NewDesc(
+		"prmanager_demand_recommendation",
+		"1 for the recommendation for the server of a pull request based on its demand: warm, evict or none.",
+		[]string{"pr", "recommendation"}, nil,
+	)
+)
+
+// DemandBucket is the number of joins of a pull request within an hour.
+type DemandBucket struct {
+	// Hour is the start of the hour.
+	Hour  time.Time `json:"hour"`
+	Joins int       `json:"joins"`
+}
+
+// recordDemand counts a join of the given PR at the time passed in its demand, dropping the buckets that fell
+// out of the window passed. It must be called within State.Update.
+func recordDemand(data *stateData, pr string, now time.Time, window time.Duration) {
+	hour := now.Truncate(time.Hour)
+	buckets := data.Demand[pr]
+	for len(buckets) > 0 && now.Sub(buckets[0].Hour) > window {
+		buckets = buckets[1:]
+	}
+	if n := len(buckets); n > 0 && buckets[n-1].Hour.Equal(hour) {
+		buckets[n-1].Joins++
+	} else {
+		buckets = append(buckets, DemandBucket{Hour: hour, Joins: 1})
+	}
+	data.Demand[pr] = buckets
+}
+
+// demandHint is the demand of a pull request and the recommendation for its server based on it.
+type demandHint struct {
+	PR string `json:"pr"`
+	// Joins is the number of joins within the window.
+	Joins        int        `json:"joins"`
+	JoinsPerHour float64    `json:"joins_per_hour"`
+	LastJoin     *time.Time `json:"last_join,omitempty"`
+	Running      bool       `json:"running"`
+	// Recommendation is warm, evict or none.
+	Recommendation string `json:"recommendation"`
+}
+
+// demandHints returns the demand of every deployed pull request besides environments, whose servers are kept
+// running anyway, along with a recommendation: servers of pull requests joined at least Demand.WarmAbove times
+// per hour are worth keeping warm, while running servers joined less than Demand.EvictBelow times per hour are
+// worth evicting.
+func demandHints(ctx context.Context, backend Backend, state *State, conf Config) ([]demandHint, error) {
+	deployments, err := backend.Deployments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	servers, err := backend.Servers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[string]bool, len(servers))
+	for _, srv := range servers {
+		running[srv.PR] = true
+	}
+
+	window := conf.Demand.Window
+	now := time.Now()
+	hints := make([]demandHint, 0, len(deployments))
+	state.View(func(data *stateData) {
+		for _, d := range deployments {
+			if _, ok := conf.Environment(d.PR); ok {
+				continue
+			}
+			hint := demandHint{PR: d.PR, Running: running[d.PR], Recommendation: demandNone}
+			if joined, ok := data.Joins[d.PR]; ok {
+				hint.LastJoin = &joined
+			}
+			for _, bucket := range data.Demand[d.PR] {
+				if now.Sub(bucket.Hour) <= window {
+					hint.Joins += bucket.Joins
+				}
+			}
+			// PRs deployed within the window are rated over the time since, so that a new PR isn't mistaken for
+			// one that is rarely joined.
+			span := min(window, now.Sub(d.Deployed))
+			hint.JoinsPerHour = float64(hint.Joins) / max(span.Hours(), 1)
+			switch {
+			case hint.JoinsPerHour >= conf.Demand.WarmAbove:
+				hint.Recommendation = demandWarm
+			case hint.Running && hint.JoinsPerHour < conf.Demand.EvictBelow:
+				hint.Recommendation = demandEvict
+			}
+			hints = append(hints, hint)
+		}
+	})
+	return hints, nil
+}
+
+// DemandCollector is a prometheus.Collector that collects the demand of all pull requests and the
+// recommendations based on it each time it is scraped.
+type DemandCollector struct {
+	backend Backend
+	state   *State
+	conf    Config
+}
+
+// NewDemandCollector creates a DemandCollector for the pull requests of the Backend passed, whose joins are
+// recorded in the State passed.
+func NewDemandCollector(backend Backend, state *State, conf Config) *DemandCollector {
+	return &DemandCollector{backend: backend, state: state, conf: conf}
+}
+
+// Describe ...
+func (c *DemandCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- demandRateDesc
+	ch <- demandRecommendationDesc
+}
+
+// Collect ...
+func (c *DemandCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	hints, err := demandHints(ctx, c.backend, c.state, c.conf)
+	if err != nil {
+		slog.Error("Failed to compute demand for metrics", slog.Any("error", err))
+		return
+	}
+	for _, hint := range hints {
+		ch <- prometheus.MustNewConstMetric(demandRateDesc, prometheus.GaugeValue, hint.JoinsPerHour, hint.PR)
+		ch <- prometheus.MustNewConstMetric(demandRecommendationDesc, prometheus.GaugeValue, 1, hint.PR, hint.Recommendation)
+	}
+}
+
+// handleGetDemand handles listing the demand of every pull request and the recommendations for their servers.
+func (r *Router) handleGetDemand(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	hints, err := demandHints(request.Context(), r.backend, r.state, r.conf)
+	if err != nil {
+		logger.Error("Failed to compute demand", slog.Any("error", err))
+		http.Error(writer, "Failed to compute demand", errorStatus(err))
+		return
+	}
+	writeJSON(writer, http.StatusOK, hints)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// labelPR is the label holding the number of the pull request an image or container belongs to.
+	labelPR = "pr"
+	// labelBuild is the label holding the CI build number the image of a pull request was built from.
+	labelBuild = "pr-build"
+	// labelCommit is the label holding the commit SHA the image of a pull request was built from.
+	labelCommit = "pr-commit"
+	// labelDeployed is the label holding the time the image of a pull request was deployed, in RFC 3339 format.
+	labelDeployed = "pr-deployed"
+	// labelProfile is the label holding the name of the profile the image of a pull request was built with.
+	labelProfile = "pr-profile"
+	// labelDeployer is the label holding the ID of the API key the image of a pull request was deployed with.
+	labelDeployer = "pr-deployer"
+	// labelMaxPlayers is the label holding the maximum number of players that may be on the server of a pull
+	// request at the same time, if it overrides the configured limit.
+	labelMaxPlayers = "pr-max-players"
+	// labelInstances is the label holding the number of additional instances of the server of a pull request.
+	labelInstances = "pr-instances"
+	// labelPorts is the label holding the extra TCP ports the server of a pull request exposes, separated by
+	// commas.
+	labelPorts = "pr-ports"
+	// labelTitle is the label holding the title of a pull request on GitHub at the time it was deployed.
+	labelTitle = "pr-title"
+	// labelAuthor is the label holding the GitHub login of the author of a pull request.
+	labelAuthor = "pr-author"
+)
+
+// Deployment holds the metadata of a deployed pull request. It is stored in the labels of the image of the pull
+// request, which are inherited by the containers created from it.
+type Deployment struct {
+	// PR is the number of the pull request.
+	PR string `json:"pr"`
+	// Build is the CI build number the binary of the pull request was built by, if provided.
+	Build string `json:"build,omitempty"`
+	// Commit is the commit SHA the binary of the pull request was built from, if provided.
+	Commit string `json:"commit,omitempty"`
+	// Deployed is the time the pull request was deployed.
+	Deployed time.Time `json:"deployed"`
+	// Deployer is the ID of the API key used to deploy the pull request, if any.
+	Deployer string `json:"deployer,omitempty"`
+	// Profile is the name of the profile the pull request was built with.
+	Profile string `json:"profile,omitempty"`
+	// MaxPlayers is the maximum number of players that may be on the server of the pull request at the same
+	// time. If zero, Players.MaxPerServer of the configuration applies.
+	MaxPlayers int `json:"max_players,omitempty"`
+	// Instances is the number of additional instances of the server of the pull request, each running in a
+	// sandbox of its own, for tests that need more than one server, such as of transfers.
+	Instances int `json:"instances,omitempty"`
+	// Ports are the extra TCP ports the server of the pull request exposes besides its game port, such as a
+	// debug HTTP or pprof port.
+	Ports []uint16 `json:"ports,omitempty"`
+	// Title is the title of the pull request on GitHub at the time it was deployed, if it could be fetched.
+	Title string `json:"title,omitempty"`
+	// Author is the GitHub login of the author of the pull request, if it could be fetched.
+	Author string `json:"author,omitempty"`
+}
+
+// Labels returns the labels that hold the metadata of the Deployment.
+func (d Deployment) Labels() map[string]string {
+	labels := map[string]string{
+		labelPR:       d.PR,
+		labelDeployed: d.Deployed.UTC().Format(time.RFC3339),
+	}
+	if d.Build != "" {
+		labels[labelBuild] = d.Build
+	}
+	if d.Commit != "" {
+		labels[labelCommit] = d.Commit
+	}
+	if d.Deployer != "" {
+		labels[labelDeployer] = d.Deployer
+	}
+	if d.Profile != "" {
+		labels[labelProfile] = d.Profile
+	}
+	if d.MaxPlayers > 0 {
+		labels[labelMaxPlayers] = strconv.Itoa(d.MaxPlayers)
+	}
+	if d.Instances > 0 {
+		labels[labelInstances] = strconv.Itoa(d.Instances)
+	}
+	if len(d.Ports) > 0 {
+		labels[labelPorts] = formatExtraPorts(d.Ports)
+	}
+	if d.Title != "" {
+		labels[labelTitle] = d.Title
+	}
+	if d.Author != "" {
+		labels[labelAuthor] = d.Author
+	}
+	return labels
+}
+
+// parseDeployment parses the Deployment from the labels of an image or container. If the labels don't belong
+// to a pull request or environment, false is returned.
+func parseDeployment(labels map[string]string) (Deployment, bool) {
+	pr, ok := labels[labelPR]
+	if !ok {
+		return Deployment{}, false
+	}
+	if !validPullRequest(pr) && !environmentNamePattern.MatchString(pr) {
+		return Deployment{}, false
+	}
+	deployed, _ := time.Parse(time.RFC3339, labels[labelDeployed])
+	maxPlayers, _ := strconv.Atoi(labels[labelMaxPlayers])
+	instances, _ := strconv.Atoi(labels[labelInstances])
+	var ports []uint16
+	if v := labels[labelPorts]; v != "" {
+		ports, _ = parseExtraPorts(v)
+	}
+	return Deployment{
+		PR:         pr,
+		Build:      labels[labelBuild],
+		Commit:     labels[labelCommit],
+		Deployed:   deployed,
+		Deployer:   labels[labelDeployer],
+		Profile:    labels[labelProfile],
+		MaxPlayers: maxPlayers,
+		Instances:  instances,
+		Ports:      ports,
+		Title:      labels[labelTitle],
+		Author:     labels[labelAuthor],
+	}, true
+}
+
+// sortDeployments sorts deployments by their pull request number. Sandboxes follow the pull request they
+// were cloned from, sorted by name, and environments come first.
+func sortDeployments(deployments []Deployment) {
+	slices.SortFunc(deployments, func(a, b Deployment) int {
+		x, _ := strconv.Atoi(basePullRequest(a.PR))
+		y, _ := strconv.Atoi(basePullRequest(b.PR))
+		return cmp.Or(cmp.Compare(x, y), cmp.Compare(a.PR, b.PR))
+	})
+}
+
+// pullRequestPattern matches the IDs of pull requests: either the number of a pull request or, for a sandbox
+// cloned from one, the number followed by a dash and the name of the sandbox.
+var pullRequestPattern = regexp.MustCompile(`^\d+(-[a-z0-9]{1,32})?$`)
+
+// validPullRequest checks if the ID passed is the number of a pull request or the ID of a sandbox of one.
+func validPullRequest(pr string) bool {
+	return pullRequestPattern.MatchString(pr)
+}
+
+// basePullRequest returns the number of the pull request the ID passed belongs to, which for a sandbox is the
+// pull request it was cloned from.
+func basePullRequest(pr string) string {
+	base, _, _ := strings.Cut(pr, "-")
+	return base
+}
+
+// apiKeyID returns an ID identifying the API key passed without revealing it. If the key is empty, the ID is
+// empty too.
+func apiKeyID(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
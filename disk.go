@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errInsufficientStorage is returned when a build is refused because too little disk space is free.
+var errInsufficientStorage = errors.New("insufficient disk space")
+
+// diskCheckInterval is how often the DiskGuard checks the free disk space to report changes.
+const diskCheckInterval = time.Minute
+
+var diskFreeDesc = prometheus.NewDesc(
+	"prmanager_disk_free_bytes",
+	"Disk space available on the volume holding a path watched by prmanager.",
+	[]string{"path"}, nil,
+)
+
+// DiskGuard watches the free disk space on the volumes holding the binaries and worlds of pull requests and
+// the data of the container runtime. Builds are refused while too little space is free on any of them, so that
+// they don't fail halfway when the disk fills up.
+type DiskGuard struct {
+	paths   []string
+	minFree uint64
+
+	// notifier is notified when a volume runs low on space.
+	notifier *Notifier
+
+	mu  sync.Mutex
+	low map[string]bool
+}
+
+// NewDiskGuard creates a DiskGuard for the paths and threshold in the disk configuration passed. Paths that
+// don't exist, such as the data root of a runtime that isn't installed, are skipped. The Notifier passed is
+// notified when a volume runs low on space.
+func NewDiskGuard(conf Config, notifier *Notifier) *DiskGuard {
+	g := &DiskGuard{minFree: uint64(conf.Disk.MinFree) << 20, notifier: notifier, low: make(map[string]bool)}
+	for _, path := range conf.Disk.Paths {
+		if _, err := os.Stat(path); err != nil {
+			slog.Debug("Not watching disk space of path", slog.String("path", path), slog.Any("error", err))
+			continue
+		}
+		g.paths = append(g.paths, path)
+	}
+	return g
+}
+
+// Job returns the Job checking the free disk space immediately and then every diskCheckInterval, logging when
+// a volume runs low on space and when it recovers. Low disk space is reported by Check rather than failing the
+// job.
+func (g *DiskGuard) Job() Job {
+	return Job{Name: "disk", Interval: diskCheckInterval, Immediate: true, Run: func(context.Context) error {
+		_ = g.Check()
+		return nil
+	}}
+}
+
+// Check returns an error satisfying errors.Is(err, errInsufficientStorage) if less than the minimum disk space
+// is free on the volume of any path watched. Paths whose free space can't be determined are not considered
+// low.
+func (g *DiskGuard) Check() error {
+	if g.minFree == 0 {
+		return nil
+	}
+	var errs []error
+	for _, path := range g.paths {
+		free, err := diskFree(path)
+		if err != nil {
+			slog.Warn("Failed to determine free disk space", slog.String("path", path), slog.Any("error", err))
+			continue
+		}
+		low := free < g.minFree
+		if low {
+			errs = append(errs, fmt.Errorf("%w: %d MB free on the volume of %s, at least %d MB required", errInsufficientStorage, free>>20, path, g.minFree>>20))
+		}
+		g.mu.Lock()
+		if low != g.low[path] {
+			if low {
+				slog.Error("Disk space is low, builds are refused", slog.String("path", path), slog.Uint64("free_mb", free>>20), slog.Uint64("min_free_mb", g.minFree>>20))
+				g.notifier.ResourceLimit("disk "+path, "Disk space is low", fmt.Sprintf("Only %d MB are free on the volume of %s, below the minimum of %d MB. Uploads and builds are refused until space is freed.\n", free>>20, path, g.minFree>>20))
+			} else {
+				slog.Info("Disk space has recovered, builds are accepted again", slog.String("path", path), slog.Uint64("free_mb", free>>20))
+			}
+			g.low[path] = low
+		}
+		g.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// Describe ...
+func (g *DiskGuard) Describe(ch chan<- *prometheus.Desc) {
+	ch <- diskFreeDesc
+}
+
+// Collect ...
+func (g *DiskGuard) Collect(ch chan<- prometheus.Metric) {
+	for _, path := range g.paths {
+		if free, err := diskFree(path); err == nil {
+			ch <- prometheus.MustNewConstMetric(diskFreeDesc, prometheus.GaugeValue, float64(free), path)
+		}
+	}
+}
+
+// diskFree returns the number of bytes available to unprivileged users on the volume holding the path passed.
+func diskFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+const (
+	// dnsWildcard is the DNS record mode in which a single wildcard record covers all pull requests.
+	dnsWildcard = "wildcard"
+	// dnsPerPR is the DNS record mode in which every pull request has a record of its own.
+	dnsPerPR = "pr"
+)
+
+// dnsRecord is a DNS record managed through a dnsProvider.
+type dnsRecord struct {
+	// Name is the fully qualified name of the record, such as 123.df-mc.dev, without a trailing dot.
+	Name string
+	// Type is the type of the record: A, AAAA or CNAME.
+	Type string
+	// Value is the address the record points to.
+	Value string
+	// TTL is the time to live of the record in seconds.
+	TTL int
+}
+
+// dnsProvider manages the DNS records of a zone through the API of a DNS provider.
+type dnsProvider interface {
+	// upsert creates the record passed, or updates the record with its name if one exists.
+	upsert(ctx context.Context, record dnsRecord) error
+	// remove removes the record passed. Removing a record that doesn't exist is not an error.
+	remove(ctx context.Context, record dnsRecord) error
+}
+
+// DNSManager keeps the DNS records players join pull requests with up to date through a dnsProvider: either a
+// single wildcard record for the base domain, or a record for every pull request deployed. Records are verified
+// on startup, so that they are created automatically when the base domain, target or provider changes.
+type DNSManager struct {
+	provider dnsProvider
+	routes   *RoutingTable
+
+	domain  string
+	records string
+	target  string
+	ttl     int
+}
+
+// NewDNSManager creates a DNSManager for the DNS configuration passed. Only the records of pull requests that
+// the RoutingTable passed resolves their addresses to are managed. The credentials of the provider are read
+// from CLOUDFLARE_API_TOKEN or DNS_ACCESS_KEY_ID and DNS_SECRET_ACCESS_KEY. If no provider is configured, the
+// DNSManager does nothing.
+func NewDNSManager(conf Config, routes *RoutingTable) (*DNSManager, error) {
+	m := &DNSManager{
+		routes:  routes,
+		domain:  strings.ToLower(strings.TrimSuffix(conf.DNS.Domain, ".")),
+		records: conf.DNS.Records,
+		target:  conf.DNS.Target,
+		ttl:     int(conf.DNS.TTL.Seconds()),
+	}
+	if m.target == "" {
+		m.target = localPublicAddress(conf)
+	}
+	switch conf.DNS.Provider {
+	case "cloudflare":
+		token := os.Getenv("CLOUDFLARE_API_TOKEN")
+		if token == "" {
+			return nil, fmt.Errorf("CLOUDFLARE_API_TOKEN must be set to manage DNS records on Cloudflare")
+		}
+		m.provider = newCloudflareClient(conf.DNS.Zone, token)
+	case "route53":
+		accessKey, secretKey := os.Getenv("DNS_ACCESS_KEY_ID"), os.Getenv("DNS_SECRET_ACCESS_KEY")
+		if accessKey == "" || secretKey == "" {
+			return nil, fmt.Errorf("DNS_ACCESS_KEY_ID and DNS_SECRET_ACCESS_KEY must be set to manage DNS records on Route53")
+		}
+		m.provider = newRoute53Client(conf.DNS.Zone, accessKey, secretKey)
+	}
+	return m, nil
+}
+
+// record returns the record with the name passed pointing to the target.
+func (m *DNSManager) record(name string) dnsRecord {
+	record := dnsRecord{Name: name, Type: "CNAME", Value: strings.TrimSuffix(m.target, "."), TTL: m.ttl}
+	if addr, err := netip.ParseAddr(m.target); err == nil {
+		record.Type = "A"
+		if addr.Is6() {
+			record.Type = "AAAA"
+		}
+	}
+	return record
+}
+
+// prRecord returns the record of the given PR, or false if PRs have no records of their own or the address of
+// the PR would not be routed to it.
+func (m *DNSManager) prRecord(pr string) (dnsRecord, bool) {
+	if m.provider == nil || m.records != dnsPerPR {
+		return dnsRecord{}, false
+	}
+	name := strings.ToLower(pr) + "." + m.domain
+	if r, ok := m.routes.Resolve(name); !ok || r.PR != pr {
+		return dnsRecord{}, false
+	}
+	return m.record(name), true
+}
+
+// Sync creates or updates the wildcard record, or the records of all PRs deployed on the Backend passed.
+func (m *DNSManager) Sync(ctx context.Context, backend Backend) {
+	if m.provider == nil {
+		return
+	}
+	if m.records == dnsWildcard {
+		m.upsert(ctx, m.record("*."+m.domain))
+		return
+	}
+	deployments, err := backend.Deployments(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list deployments to sync DNS records", slog.Any("error", err))
+		return
+	}
+	for _, deployment := range deployments {
+		if record, ok := m.prRecord(deployment.PR); ok {
+			m.upsert(ctx, record)
+		}
+	}
+	slog.InfoContext(ctx, "Synced DNS records", slog.String("domain", m.domain))
+}
+
+// Deployed creates the record of the given PR, if PRs have records of their own.
+func (m *DNSManager) Deployed(ctx context.Context, pr string) {
+	if record, ok := m.prRecord(pr); ok {
+		m.upsert(ctx, record)
+	}
+}
+
+// Deleted removes the record of the given PR, if PRs have records of their own.
+func (m *DNSManager) Deleted(ctx context.Context, pr string) {
+	record, ok := m.prRecord(pr)
+	if !ok {
+		return
+	}
+	if err := m.provider.remove(ctx, record); err != nil {
+		slog.ErrorContext(ctx, "Failed to remove DNS record", slog.String("name", record.Name), slog.Any("error", err))
+		return
+	}
+	slog.InfoContext(ctx, "Removed DNS record", slog.String("name", record.Name))
+}
+
+// upsert creates or updates the record passed, logging the result. Players can still join through other
+// records, so failures don't fail the operation that caused them.
+func (m *DNSManager) upsert(ctx context.Context, record dnsRecord) {
+	if err := m.provider.upsert(ctx, record); err != nil {
+		slog.ErrorContext(ctx, "Failed to update DNS record", slog.String("name", record.Name), slog.Any("error", err))
+		return
+	}
+	slog.InfoContext(ctx, "Updated DNS record", slog.String("name", record.Name), slog.String("type", record.Type), slog.String("value", record.Value))
+}
+
+// dnsBackend is a Backend that creates and removes the DNS records of pull requests as they are deployed and
+// deleted.
+type dnsBackend struct {
+	Backend
+	dns *DNSManager
+}
+
+// BuildImage ...
+func (b dnsBackend) BuildImage(ctx context.Context, pr string, deployment Deployment) error {
+	if err := b.Backend.BuildImage(ctx, pr, deployment); err != nil {
+		return err
+	}
+	b.dns.Deployed(ctx, pr)
+	return nil
+}
+
+// DeleteServer ...
+func (b dnsBackend) DeleteServer(ctx context.Context, pr string) {
+	b.Backend.DeleteServer(ctx, pr)
+	b.dns.Deleted(ctx, pr)
+}
@@ -3,63 +3,340 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	cerrdefs "github.com/containerd/errdefs"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	volumetypes "github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
 )
 
-// Docker is a struct that provides methods to interact with Docker running on the host.
+// Docker is a struct that provides methods to interact with Docker running on a single host, which may either
+// be the local host or a remote one.
 type Docker struct {
 	client *client.Client
+	conf   Config
+	host   HostConfig
+	ports  *PortAllocator
+	// secrets are injected into the servers and stacks of pull requests as environment variables.
+	secrets *SecretStore
+	// git holds the credentials made available to builds of binaries from source.
+	git *GitCredentials
+
+	// cli is the CLI used for operations that are not performed through the API, and hostFlag the flag used
+	// to point it at the address of a remote host.
+	cli, hostFlag string
+	// addr is the address of the daemon the CLI is pointed at, or empty to use the default daemon of the CLI.
+	addr string
+	// localData specifies if world data is bind mounted from the directory of the PR on the local host. If
+	// false, named volumes are used instead. diskImages specifies if the directory is a size-limited disk image
+	// mounted on it, which requires root.
+	localData, diskImages bool
+	// buildx specifies if resource limits of builds are enforced by building images in a dedicated builder
+	// created through buildx. If false, the limits are passed to the build command directly.
+	buildx bool
+
+	// builderMu guards builderReady, which is true once the dedicated builder was created by this process.
+	builderMu    sync.Mutex
+	builderReady bool
 }
 
-// NewDocker creates a new Docker client instance, returning an error if the client could not be created.
-func NewDocker() (*Docker, error) {
-	c, err := client.NewClientWithOpts()
-	if err != nil {
+// NewDocker creates a new Docker client instance for the host passed, using the configuration passed. Host ports
+// are assigned to servers using the PortAllocator passed and the secrets of the SecretStore passed are injected
+// into them, while the GitCredentials passed are made available to builds from source. If the host has no
+// address, the daemon in DOCKER_HOST is used, or the socket of rootless Docker when running as an unprivileged
+// user without access to the system daemon. An error is returned if the client could not be created.
+func NewDocker(conf Config, host HostConfig, ports *PortAllocator, secrets *SecretStore, git *GitCredentials) (*Docker, error) {
+	d := &Docker{conf: conf, host: host, ports: ports, secrets: secrets, git: git, cli: "docker", hostFlag: "-H", addr: host.Address, buildx: true}
+	if host.Address == "" {
+		d.addr = localDockerAddress()
+		// Mounting disk images requires root, so world data is stored in the PR directory directly otherwise.
+		d.localData, d.diskImages = true, os.Geteuid() == 0
+	}
+	if err := d.connect(d.addr); err != nil {
 		return nil, err
 	}
-	return &Docker{client: c}, nil
+	return d, nil
+}
+
+// localDockerAddress returns the address of the Docker daemon of the local host, or an empty string for the
+// default daemon. The socket of rootless Docker, $XDG_RUNTIME_DIR/docker.sock, is used when running as an
+// unprivileged user if it exists and neither DOCKER_HOST nor the system socket is available.
+func localDockerAddress() string {
+	if addr := os.Getenv("DOCKER_HOST"); addr != "" {
+		return addr
+	}
+	if os.Geteuid() == 0 || os.Getenv("XDG_RUNTIME_DIR") == "" {
+		return ""
+	}
+	// W_OK is 2: users in the docker group may write to the system socket.
+	if syscall.Access("/var/run/docker.sock", 2) == nil {
+		return ""
+	}
+	sock := filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), "docker.sock")
+	if _, err := os.Stat(sock); err != nil {
+		return ""
+	}
+	return "unix://" + sock
+}
+
+// connect creates the API client of the Docker instance, connecting to the daemon at the address passed, or
+// the default daemon of the local host if the address is empty.
+func (d *Docker) connect(addr string) error {
+	var opts []client.Opt
+	if addr != "" {
+		opts = append(opts, client.WithHost(addr))
+	}
+	c, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return err
+	}
+	d.client = c
+	return nil
+}
+
+// Name returns the name of the host the Docker instance manages.
+func (d *Docker) Name() string {
+	return d.host.Name
+}
+
+// Host returns the configuration of the host the Docker instance manages.
+func (d *Docker) Host() HostConfig {
+	return d.host
+}
+
+// command creates a CLI command with the arguments passed that targets the host of the Docker instance. The
+// command is killed if the context passed is cancelled.
+func (d *Docker) command(ctx context.Context, args ...string) *exec.Cmd {
+	if d.addr != "" {
+		args = append([]string{d.hostFlag, d.addr}, args...)
+	}
+	return exec.CommandContext(ctx, d.cli, args...)
 }
 
-// BuildImage attempts to build a new docker image for the PR, using the current directory as the build context.
-// It assumes that the Dockerfile is present, as well as the necessary files for the specific PR.
-func (d *Docker) BuildImage(pr string) error {
+// BuildImage attempts to build a new docker image for the PR from a build context holding only the Dockerfile of
+// the profile of the deployment and the uploaded binary of the PR. The metadata of the deployment is attached to
+// the image as labels, which containers of the image inherit. The build runs in the sandbox described by
+// sandboxArgs.
+func (d *Docker) BuildImage(ctx context.Context, pr string, deployment Deployment) error {
+	profile, ok := d.conf.Profile(deployment.Profile)
+	if !ok {
+		return fmt.Errorf("unknown profile %q", deployment.Profile)
+	}
+	provenance, err := newProvenance(deployment)
+	if err != nil {
+		return err
+	}
+	dir, err := prepareBuildContext(pr, profile, provenance)
+	if err != nil {
+		return err
+	}
+	defer removeBuildContext(pr)
+
+	// If the image is checked before it is used, it is built under a separate tag first, so that the image
+	// the server currently runs from is kept if the check fails.
 	name := "pr-" + pr
-	err := exec.Command("docker", "build", "--build-arg", "PR="+pr, "-t", name, ".").Run()
+	tag := name
+	if len(profile.VersionArgs) > 0 {
+		tag = name + ":candidate"
+	}
+	// Intermediate containers are removed even if the build fails, so that failed builds leave nothing behind.
+	args := []string{"build", "--force-rm", "--build-arg", "PR=" + pr, "-t", tag}
+	sandbox, err := d.sandboxArgs(ctx, profile)
 	if err != nil {
 		return err
 	}
-	_ = exec.Command("docker", "kill", "--signal=SIGINT", name, "&&", "docker", "wait", name).Run()
+	args = append(args, sandbox...)
+	if d.buildx && d.limited() {
+		// Images built by a builder container are only kept in its cache unless they are loaded into the daemon.
+		args = append(args, "--load")
+	}
+	for _, arg := range expandDeploymentAll(profile.BuildArgs, deployment) {
+		args = append(args, "--build-arg", arg)
+	}
+	for k, v := range deployment.Labels() {
+		args = append(args, "--label", k+"="+v)
+	}
+	slog.InfoContext(ctx, "Building image", slog.String("pr", pr), slog.String("host", d.Name()), slog.String("profile", profile.Name))
+	if out, err := d.command(ctx, append(args, dir)...).CombinedOutput(); err != nil {
+		return newBuildError(err, out)
+	}
+	if tag != name {
+		err := d.checkVersion(ctx, tag, profile)
+		if err == nil {
+			err = d.command(ctx, "tag", tag, name).Run()
+		}
+		_ = d.command(ctx, "image", "rm", tag).Run()
+		if err != nil {
+			return err
+		}
+	}
+	// Stop the server if it is running, so that the new image is used the next time it is started.
+	if _, err := d.StopServer(ctx, pr); err != nil {
+		slog.WarnContext(ctx, "Failed to stop server after build", slog.String("pr", pr), slog.Any("error", err))
+	}
+	// The provenance is also kept outside the world directory, which the server could write to, so that it can
+	// be read without inspecting the image and still be trusted.
+	if err := writeProvenance(provenancePath(pr), provenance); err != nil {
+		slog.WarnContext(ctx, "Failed to write provenance", slog.String("pr", pr), slog.Any("error", err))
+	}
+	return nil
+}
+
+// versionCheckTimeout is the time the entrypoint of an image is given to run with the version arguments of
+// its profile.
+const versionCheckTimeout = time.Second * 30
+
+// checkVersion runs the entrypoint of the image with the tag passed with the version arguments of the profile
+// in a throwaway container without network access. If it fails, an error satisfying
+// errors.Is(err, errInvalidBinary) is returned holding its output.
+func (d *Docker) checkVersion(ctx context.Context, tag string, profile ProfileConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, versionCheckTimeout)
+	defer cancel()
+	args := append([]string{"run", "--rm", "--network", "none", tag}, profile.VersionArgs...)
+	out, err := d.command(ctx, args...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %v", versionCheckTimeout)
+		}
+		return fmt.Errorf("%w: running it with %s failed: %v: %s", errInvalidBinary, strings.Join(profile.VersionArgs, " "), err, strings.TrimSpace(string(out)))
+	}
+	slog.InfoContext(ctx, "Checked binary version", slog.String("image", tag), slog.String("version", strings.TrimSpace(string(out))))
+	return nil
+}
+
+// PullImage pulls the image with the reference passed, so that it is available when building images.
+func (d *Docker) PullImage(ctx context.Context, ref string) error {
+	rc, err := d.client.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return dockerError(err)
+	}
+	defer rc.Close()
+	// The pull only completes once its progress has been read entirely.
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		return fmt.Errorf("read pull progress: %w", err)
+	}
 	return nil
 }
 
 // ServerPort retrieves the public port of the server running for the given PR. If the server is not running,
 // it returns false. If an error occurs while listing the containers, it returns the error.
-func (d *Docker) ServerPort(pr string) (uint16, bool, error) {
+func (d *Docker) ServerPort(ctx context.Context, pr string) (uint16, bool, error) {
 	opts := container.ListOptions{
-		Filters: filters.NewArgs(filters.Arg("label", "pr="+pr)),
+		Filters: filters.NewArgs(filters.Arg("label", labelPR+"="+pr)),
 	}
-	containers, err := d.client.ContainerList(context.Background(), opts)
+	containers, err := d.client.ContainerList(ctx, opts)
 	if err != nil {
-		return 0, false, fmt.Errorf("list containers: %w", err)
+		return 0, false, fmt.Errorf("list containers: %w", dockerError(err))
 	} else if len(containers) == 0 {
 		return 0, false, nil
 	}
-	port := containers[0].Ports[0].PublicPort
-	return port, true, nil
+	port, _, found := containerPorts(containers[0].Ports)
+	return port, found, nil
+}
+
+// Deployments returns the deployments of all pull requests that have an image on the host, read from the labels
+// of their images.
+func (d *Docker) Deployments(ctx context.Context) ([]Deployment, error) {
+	images, err := d.client.ImageList(ctx, image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", labelPR)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list images: %w", dockerError(err))
+	}
+	deployments := make([]Deployment, 0, len(images))
+	for _, img := range images {
+		if len(img.RepoTags) == 0 {
+			// Images that were replaced by a newer build lose their tag and no longer belong to a deployment.
+			continue
+		}
+		if deployment, ok := parseDeployment(img.Labels); ok {
+			deployments = append(deployments, deployment)
+		}
+	}
+	return deployments, nil
+}
+
+// Deployment returns the deployment of the given PR, read from the labels of its image, or false if it has no
+// image on the host.
+func (d *Docker) Deployment(ctx context.Context, pr string) (Deployment, bool, error) {
+	img, err := d.client.ImageInspect(ctx, "pr-"+pr)
+	if cerrdefs.IsNotFound(err) {
+		return Deployment{}, false, nil
+	} else if err != nil {
+		return Deployment{}, false, fmt.Errorf("inspect image: %w", dockerError(err))
+	} else if img.Config == nil {
+		return Deployment{}, false, nil
+	}
+	deployment, ok := parseDeployment(img.Config.Labels)
+	return deployment, ok, nil
+}
+
+// Server holds information about a running server of a pull request.
+type Server struct {
+	// PR is the number of the pull request the server is running for.
+	PR string
+	// Host is the name of the host the server is running on.
+	Host string
+	// Address is the public address of the host the server is running on, which players are transferred to.
+	Address string
+	// PrivateAddress is the address prmanager reaches the server over to ping it, as returned by
+	// HostConfig.privateAddress.
+	PrivateAddress string
+	// Port is the public port of the server on the host.
+	Port uint16
+	// Started is the time at which the container of the server was created.
+	Started time.Time
+	// Paused specifies if the server is currently paused because it was idle.
+	Paused bool
+	// Extra are the extra ports the server exposes besides its game port, as declared by the pull request.
+	Extra []ExtraPort
+}
+
+// Servers returns all servers of pull requests that are currently running.
+func (d *Docker) Servers(ctx context.Context) ([]Server, error) {
+	opts := container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", labelPR)),
+	}
+	containers, err := d.client.ContainerList(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("list containers: %w", dockerError(err))
+	}
+	servers := make([]Server, 0, len(containers))
+	for _, c := range containers {
+		port, extra, found := containerPorts(c.Ports)
+		if !found {
+			continue
+		}
+		servers = append(servers, Server{
+			PR:             c.Labels[labelPR],
+			Host:           d.host.Name,
+			Address:        d.host.PublicAddress,
+			PrivateAddress: d.host.privateAddress(),
+			Port:           port,
+			Extra:          extra,
+			Started:        time.Unix(c.Created, 0),
+			Paused:         c.State == container.StatePaused,
+		})
+	}
+	return servers, nil
 }
 
 // mountDiskImage creates a fixed-size ext4 disk image for the PR (if one doesn't already exist) and mounts
 // it at the PR directory. This limits the writable space available to the container.
 func mountDiskImage(pr string) error {
-	name := "pr-" + pr
-	imgPath := name + ".img"
+	name := worldDir(pr)
+	imgPath := diskImagePath(pr)
 
 	if _, err := os.Stat(imgPath); err != nil {
 		if err := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s", imgPath), "bs=1M", "count=256").Run(); err != nil {
@@ -80,41 +357,133 @@ func mountDiskImage(pr string) error {
 	return nil
 }
 
+// ensureDiskImageMounted mounts the disk image of the given PR at the PR directory if it exists and is not yet
+// mounted, so that the world data it holds can be accessed while the server is not running.
+func ensureDiskImageMounted(pr string) error {
+	name := worldDir(pr)
+	if _, err := os.Stat(diskImagePath(pr)); err != nil {
+		// The PR has no disk image, so the world data is stored directly in the directory.
+		return nil
+	}
+	if exec.Command("mountpoint", "-q", name).Run() == nil {
+		return nil
+	}
+	if err := exec.Command("mount", "-o", "loop", diskImagePath(pr), name).Run(); err != nil {
+		return fmt.Errorf("mount disk image: %w", err)
+	}
+	return nil
+}
+
 // unmountDiskImage unmounts the disk image for the given PR.
 func unmountDiskImage(pr string) {
-	_ = exec.Command("umount", "pr-"+pr).Run()
+	_ = exec.Command("umount", worldDir(pr)).Run()
+}
+
+// unmountDiskImage unmounts the disk image for the given PR if the Docker instance uses disk images.
+func (d *Docker) unmountDiskImage(pr string) {
+	if d.diskImages {
+		unmountDiskImage(pr)
+	}
 }
 
 // removeDiskImage unmounts and deletes the disk image file for the given PR.
 func removeDiskImage(pr string) {
 	unmountDiskImage(pr)
-	_ = os.Remove("pr-" + pr + ".img")
+	_ = os.Remove(diskImagePath(pr))
 }
 
 // unmountAllDiskImages finds and unmounts all PR disk images.
 func unmountAllDiskImages() {
-	matches, _ := filepath.Glob("pr-*.img")
+	matches, _ := filepath.Glob(filepath.Join("worlds", "pr-*.img"))
 	for _, img := range matches {
 		name := strings.TrimSuffix(img, ".img")
 		_ = exec.Command("umount", name).Run()
 	}
 }
 
-// StartServer attempts to start a server for the given PR. It runs a Docker container with the specified name
-// and random port mapping. If the server starts successfully, it retrieves the public port and returns it.
-// If the server fails to start, it returns an error.
-func (d *Docker) StartServer(pr string) (uint16, bool, error) {
+// StartServer attempts to start a server for the given PR. It runs a Docker container with the specified name as
+// described by the profile of the PR, and maps it to the host port assigned to the PR by the PortAllocator. If
+// the PR has a stack of auxiliary services, the stack is started first and the server joins its network. If the
+// server starts successfully, it retrieves the public port and returns it. If the server fails to start, it
+// returns an error.
+func (d *Docker) StartServer(ctx context.Context, pr string) (uint16, bool, error) {
 	name := "pr-" + pr
-	if err := mountDiskImage(pr); err != nil {
-		return 0, false, fmt.Errorf("mount disk image: %w", err)
+	// Without an image, running the container would try to pull it from a registry instead.
+	if _, err := d.client.ImageInspect(ctx, name); cerrdefs.IsNotFound(err) {
+		return 0, false, fmt.Errorf("%w: %s", errImageNotFound, name)
+	}
+	if port, running, err := d.claimName(ctx, pr); err != nil {
+		return 0, false, err
+	} else if running {
+		return port, true, nil
 	}
-	cmd := exec.Command("docker", "run", "-d", "--rm", "--name", name, "--label", "pr="+pr, "-v", "./"+name+":/"+name, "-p", "0:19132/udp", name)
-	err := cmd.Run()
+	profile, deployment := d.profile(ctx, pr)
+	hostPort, err := d.ports.Allocate(pr)
 	if err != nil {
-		unmountDiskImage(pr)
-		return 0, false, fmt.Errorf("run command '%s': %w", cmd.String(), err)
+		return 0, false, fmt.Errorf("allocate port: %w", err)
+	}
+	// Where possible, the world data is stored on a size-limited disk image on the local host. Remote hosts
+	// can't access local files, so a named volume is used instead.
+	dataPath := expand(profile.DataPath, pr)
+	volume := name + ":" + dataPath
+	if d.diskImages {
+		if err := mountDiskImage(pr); err != nil {
+			return 0, false, fmt.Errorf("mount disk image: %w", err)
+		}
+	}
+	if d.localData {
+		_ = os.MkdirAll(worldDir(pr), 0755)
+		volume = "./" + worldDir(pr) + ":" + dataPath
+	} else if _, err := d.client.VolumeCreate(ctx, volumetypes.CreateOptions{Name: name, Labels: map[string]string{labelPR: pr}}); err != nil {
+		// The volume is created up front rather than by docker run, so that it is labelled with the PR and
+		// removed by CleanupOrphans if the PR is deleted while the host is unreachable.
+		return 0, false, fmt.Errorf("create volume: %w", dockerError(err))
+	}
+	args := []string{"run", "-d", "-i", "--rm", "--name", name, "--label", labelPR + "=" + pr, "-v", volume, "-p", fmt.Sprintf("%d:%d/udp", hostPort, profile.Port)}
+	extra, err := d.extraPortArgs(deployment.Ports, d.conf.Ports.Public)
+	if err != nil {
+		d.unmountDiskImage(pr)
+		return 0, false, err
+	}
+	args = append(args, extra...)
+	if hasStack(pr) {
+		if err := d.startStack(ctx, pr); err != nil {
+			d.unmountDiskImage(pr)
+			return 0, false, fmt.Errorf("start stack: %w", err)
+		}
+		args = append(args, "--network", stackNetwork(pr))
+	}
+	for _, env := range expandDeploymentAll(profile.Env, deployment) {
+		args = append(args, "-e", env)
+	}
+	// Secrets are passed in an env file rather than the environment or arguments of the CLI, so that their
+	// values don't show up in the process list or in errors.
+	envFile, removeEnvFile, err := d.secrets.EnvFile(pr)
+	if err != nil {
+		d.unmountDiskImage(pr)
+		return 0, false, fmt.Errorf("inject secrets: %w", err)
+	}
+	defer removeEnvFile()
+	if envFile != "" {
+		args = append(args, "--env-file", envFile)
+	}
+	args = append(append(args, name), expandDeploymentAll(profile.Args, deployment)...)
+	cmd := d.command(ctx, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		d.unmountDiskImage(pr)
+		return 0, false, fmt.Errorf("run command '%s': %w: %s", cmd.String(), err, strings.TrimSpace(string(out)))
+	}
+	slog.InfoContext(ctx, "Started container", slog.String("pr", pr), slog.String("host", d.Name()), slog.Int("port", int(hostPort)))
+	if d.host.Address == "" {
+		d.ports.Open(ctx, pr, hostPort)
+	}
+	go d.collectLogs(pr, time.Time{})
+	if err := d.startSidecars(ctx, pr); err != nil {
+		_, _ = d.StopServer(ctx, pr)
+		return 0, false, fmt.Errorf("start sidecars: %w", err)
 	}
-	port, found, err := d.ServerPort(pr)
+
+	port, found, err := d.ServerPort(ctx, pr)
 	if err != nil {
 		return 0, false, fmt.Errorf("get server port: %w", err)
 	} else if !found {
@@ -123,35 +492,253 @@ func (d *Docker) StartServer(pr string) (uint16, bool, error) {
 	return port, true, nil
 }
 
-// DeleteServer stops and removes the Docker container for the given PR, as well as removing the associated image.
-func (d *Docker) DeleteServer(pr string) {
+// claimName makes sure the container name of the given PR is free before its server is started. Containers are
+// started with --rm, but one may still be left behind, for example if the daemon restarted while it was being
+// removed or it was created by hand for debugging. A leftover container of the PR that is still running is
+// reused, returning its port and true, and any other leftover of the PR is removed. A container holding the
+// name that doesn't belong to the PR is left alone and an error satisfying errors.Is(err, errNameConflict) is
+// returned.
+func (d *Docker) claimName(ctx context.Context, pr string) (uint16, bool, error) {
 	name := "pr-" + pr
-	_ = exec.Command("docker", "kill", "--signal=SIGINT", name).Run()
-	_ = exec.Command("docker", "wait", name).Run()
-	_ = exec.Command("docker", "image", "rm", name).Run()
-	removeDiskImage(pr)
+	c, err := d.client.ContainerInspect(ctx, name)
+	if cerrdefs.IsNotFound(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, fmt.Errorf("inspect container: %w", dockerError(err))
+	}
+	if c.Config == nil || c.Config.Labels[labelPR] != pr {
+		return 0, false, fmt.Errorf("%w: container %s on host %s was not created by prmanager for PR %s", errNameConflict, name, d.Name(), pr)
+	}
+	var status container.ContainerState
+	if c.State != nil {
+		status = c.State.Status
+	}
+	if status == container.StateRunning || status == container.StatePaused {
+		if port, found, err := d.ServerPort(ctx, pr); err != nil {
+			return 0, false, fmt.Errorf("get server port: %w", err)
+		} else if found {
+			slog.InfoContext(ctx, "Reusing container already running", slog.String("pr", pr), slog.String("host", d.Name()), slog.Int("port", int(port)))
+			if status == container.StatePaused {
+				if err := d.UnpauseServer(ctx, pr); err != nil {
+					return 0, false, err
+				}
+			}
+			return port, true, nil
+		}
+	}
+	slog.WarnContext(ctx, "Removing leftover container", slog.String("pr", pr), slog.String("host", d.Name()), slog.String("status", string(status)))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// The container may already be being removed, in which case removing it fails with a conflict, so its
+	// removal is waited for either way.
+	waitC, errC := d.client.ContainerWait(ctx, c.ID, container.WaitConditionRemoved)
+	if err := d.client.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil && !cerrdefs.IsNotFound(err) && !cerrdefs.IsConflict(err) {
+		return 0, false, fmt.Errorf("remove leftover container %s: %w", name, dockerError(err))
+	}
+	if !waitRemoved(waitC, errC, time.Second*10) {
+		return 0, false, fmt.Errorf("%w: leftover container %s on host %s was not removed", errNameConflict, name, d.Name())
+	}
+	return 0, false, nil
 }
 
-// StopServer stops the server for the given PR gracefully by sending a SIGINT signal to the Docker container.
-func (d *Docker) StopServer(pr string) {
+// PauseServer freezes all processes in the server container of the given PR, keeping it in memory so that it
+// can be resumed almost instantly using UnpauseServer.
+func (d *Docker) PauseServer(ctx context.Context, pr string) error {
+	if err := d.client.ContainerPause(ctx, "pr-"+pr); err != nil {
+		return fmt.Errorf("pause container: %w", dockerError(err))
+	}
+	return nil
+}
+
+// UnpauseServer resumes the server container of the given PR if it was paused. Calling it for a server that is
+// not paused has no effect.
+func (d *Docker) UnpauseServer(ctx context.Context, pr string) error {
+	err := d.client.ContainerUnpause(ctx, "pr-"+pr)
+	if err != nil && !cerrdefs.IsConflict(err) {
+		return fmt.Errorf("unpause container: %w", dockerError(err))
+	}
+	return nil
+}
+
+// DeleteServer stops and removes the Docker container for the given PR, as well as removing the associated image
+// and tearing down its stack.
+func (d *Docker) DeleteServer(ctx context.Context, pr string) {
 	name := "pr-" + pr
-	_ = exec.Command("docker", "kill", "--signal=SIGINT", name, "&&", "docker", "wait", name).Run()
+	if _, err := d.StopServer(ctx, pr); err != nil {
+		slog.WarnContext(ctx, "Failed to stop server", slog.String("pr", pr), slog.Any("error", err))
+	}
+	d.removeStack(ctx, pr)
+	_ = d.command(ctx, "image", "rm", name).Run()
+	if d.diskImages {
+		removeDiskImage(pr)
+	} else {
+		_ = d.command(ctx, "volume", "rm", name).Run()
+	}
+	if err := d.ports.Release(pr); err != nil {
+		slog.WarnContext(ctx, "Failed to release port", slog.String("pr", pr), slog.Any("error", err))
+	}
+	if err := d.secrets.Forget(pr); err != nil {
+		slog.WarnContext(ctx, "Failed to remove secrets", slog.String("pr", pr), slog.Any("error", err))
+	}
+}
+
+// StopResult describes the way in which a server was stopped by Docker.StopServer.
+type StopResult int
+
+const (
+	// StopNotRunning means the server was not running, so there was nothing to stop.
+	StopNotRunning StopResult = iota
+	// StopGraceful means the server shut down by itself within the grace period after being interrupted.
+	StopGraceful
+	// StopKilled means the server did not shut down within the grace period and had to be killed.
+	StopKilled
+)
+
+// String ...
+func (r StopResult) String() string {
+	switch r {
+	case StopNotRunning:
+		return "not running"
+	case StopGraceful:
+		return "graceful"
+	case StopKilled:
+		return "killed"
+	}
+	return "unknown"
+}
+
+// StopServer stops the server for the given PR, along with its sidecars and stack. It first sends a SIGINT signal
+// to the Docker container, giving Dragonfly the chance to save the world and shut down cleanly. If the container
+// has not exited after the configured grace period, it is killed with SIGKILL instead. The StopResult returned
+// reports which of these happened.
+func (d *Docker) StopServer(ctx context.Context, pr string) (StopResult, error) {
+	// Containers are started with --rm, so we wait for the container to be removed rather than just exited,
+	// making sure the name is free for the next start.
+	result, err := d.stopContainer(ctx, "pr-"+pr, container.WaitConditionRemoved)
+	if err != nil {
+		return result, err
+	}
+	if result != StopNotRunning {
+		slog.InfoContext(ctx, "Stopped server", slog.String("pr", pr), slog.String("result", result.String()))
+	}
+	// A container that wasn't running anymore may still have its sidecars and stack running.
+	d.stopDependencies(ctx, pr)
+	d.closePort(ctx, pr)
+	return result, nil
+}
+
+// stopContainer interrupts the container with the name or ID passed and waits for it to reach the wait
+// condition passed. If it doesn't within Stop.GracePeriod, it is killed. StopNotRunning is returned if the
+// container doesn't exist or isn't running.
+func (d *Docker) stopContainer(ctx context.Context, id string, condition container.WaitCondition) (StopResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The wait must be registered before sending the signal, or the container may be gone before we get to
+	// wait for it.
+	waitC, errC := d.client.ContainerWait(ctx, id, condition)
+	// Paused containers can't receive signals, so make sure the container isn't paused first.
+	_ = d.client.ContainerUnpause(ctx, id)
+	if err := d.client.ContainerKill(ctx, id, "SIGINT"); err != nil {
+		if cerrdefs.IsNotFound(err) || cerrdefs.IsConflict(err) {
+			return StopNotRunning, nil
+		}
+		return StopNotRunning, fmt.Errorf("interrupt container: %w", dockerError(err))
+	}
+	if waitRemoved(waitC, errC, d.conf.Stop.GracePeriod) {
+		return StopGraceful, nil
+	}
+	slog.WarnContext(ctx, "Container did not stop within grace period, killing it", slog.String("container", id), slog.Duration("grace_period", d.conf.Stop.GracePeriod))
+	if err := d.client.ContainerKill(ctx, id, "SIGKILL"); err != nil && !cerrdefs.IsNotFound(err) && !cerrdefs.IsConflict(err) {
+		return StopKilled, fmt.Errorf("kill container: %w", err)
+	}
+	if !waitRemoved(waitC, errC, time.Second*10) {
+		return StopKilled, fmt.Errorf("container did not stop after being killed")
+	}
+	return StopKilled, nil
+}
+
+// closePort closes the port of the given PR in the firewall if its server ran on the local host.
+func (d *Docker) closePort(ctx context.Context, pr string) {
+	if d.host.Address == "" {
+		d.ports.Close(ctx, pr)
+	}
+}
+
+// stopDependencies stops the sidecars and stack that run alongside the server of the given PR.
+func (d *Docker) stopDependencies(ctx context.Context, pr string) {
+	if err := d.removeSidecars(ctx, pr); err != nil {
+		slog.WarnContext(ctx, "Failed to remove sidecars", slog.String("pr", pr), slog.Any("error", err))
+	}
+	d.stopStack(ctx, pr)
 }
 
-// ClearContainers removes all Docker containers that are associated with pull requests.
-func (d *Docker) ClearContainers() error {
-	containers, err := d.client.ContainerList(context.Background(), container.ListOptions{All: true})
+// waitRemoved waits up to the timeout passed for a container wait to complete, returning true if it did.
+func waitRemoved(waitC <-chan container.WaitResponse, errC <-chan error, timeout time.Duration) bool {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-waitC:
+		return true
+	case err := <-errC:
+		// A not found error means the container was already removed before the wait started.
+		return cerrdefs.IsNotFound(err)
+	case <-t.C:
+		return false
+	}
+}
+
+// ClearContainers removes all Docker containers that are labelled as belonging to a pull request, including
+// stopped ones and sidecars. Running containers are interrupted and given Stop.GracePeriod to shut down
+// gracefully before they are killed and removed. If removeImages is true, the images the containers were created from are
+// removed as well.
+func (d *Docker) ClearContainers(ctx context.Context, removeImages bool) error {
+	containers, err := d.client.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", labelPR)),
+	})
 	if err != nil {
-		return fmt.Errorf("list containers: %w", err)
+		return fmt.Errorf("list containers: %w", dockerError(err))
 	}
 	for _, c := range containers {
-		if strings.HasPrefix(c.Image, "pr-") {
-			if err := d.client.ContainerKill(context.Background(), c.ID, "SIGINT"); err != nil {
-				return fmt.Errorf("remove container %s: %w", c.ID, err)
+		if c.State == container.StateRunning || c.State == container.StatePaused {
+			if _, err := d.stopContainer(ctx, c.ID, container.WaitConditionNotRunning); err != nil {
+				return fmt.Errorf("stop container %s: %w", c.ID, err)
+			}
+		}
+		// Containers are started with --rm, so they may already be removed (or being removed) by the time we
+		// get here.
+		err := d.client.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true})
+		if err != nil && !cerrdefs.IsNotFound(err) && !cerrdefs.IsConflict(err) {
+			return fmt.Errorf("remove container %s: %w", c.ID, err)
+		}
+		if removeImages {
+			if _, err := d.client.ImageRemove(ctx, c.Image, image.RemoveOptions{PruneChildren: true}); err != nil && !cerrdefs.IsNotFound(err) {
+				return fmt.Errorf("remove image %s: %w", c.Image, err)
 			}
 		}
 	}
-	unmountAllDiskImages()
+	if err := d.removeSidecars(ctx, ""); err != nil {
+		return err
+	}
+	if d.diskImages {
+		unmountAllDiskImages()
+	}
+	return nil
+}
+
+// AdoptServers resumes collecting the logs of servers left running by a previous prmanager process, only
+// collecting output written from now on, as the rest was collected by that process.
+func (d *Docker) AdoptServers(ctx context.Context) error {
+	servers, err := d.Servers(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, srv := range servers {
+		slog.Info("Adopting running server", slog.String("pr", srv.PR), slog.Int("port", int(srv.Port)))
+		go d.collectLogs(srv.PR, now)
+	}
 	return nil
 }
 
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// drainInterval is how often pull requests that are drained are checked for being empty.
+const drainInterval = time.Second * 10
+
+// Drain is the drain of a pull request that was deleted while players were online on its server, as persisted in
+// the State.
+type Drain struct {
+	// Until is the time the pull request is deleted at if players are still online.
+	Until time.Time `json:"until"`
+	// Purge specifies if the pull request is purged right away once drained, rather than kept for the grace
+	// period.
+	Purge bool `json:"purge,omitempty"`
+}
+
+// Drainer drains pull requests before deleting them, if players are online on their servers. The players are
+// warned in-game, no new players may join, and the pull request is deleted once its server is empty or the
+// drain timeout has passed, whichever comes first.
+type Drainer struct {
+	backend  Backend
+	purger   *Purger
+	health   *HealthChecker
+	state    *State
+	messages *Messages
+	timeout  time.Duration
+	command  string
+}
+
+// NewDrainer creates a Drainer deleting the pull requests drained using the Purger passed. The HealthChecker
+// passed is used to find out how many players are online.
+func NewDrainer(backend Backend, purger *Purger, health *HealthChecker, state *State, conf Config) *Drainer {
+	return &Drainer{
+		backend:  backend,
+		purger:   purger,
+		health:   health,
+		state:    state,
+		messages: NewMessages(conf.Messages),
+		timeout:  conf.Delete.DrainTimeout,
+		command:  conf.Delete.DrainCommand,
+	}
+}
+
+// Job returns the Job deleting the pull requests that are drained once they are empty or their drain timed out.
+func (d *Drainer) Job() Job {
+	return Job{Name: "drain", Interval: drainInterval, Run: d.drain}
+}
+
+// Drain starts draining the given PR before it is deleted, or purged if purge is true. If nobody is online on its
+// server, it is not drained and false is returned, in which case it should be deleted right away. Otherwise the
+// time it is deleted at if players are still online is returned.
+func (d *Drainer) Drain(ctx context.Context, pr string, purge bool) (time.Time, bool, error) {
+	occupied, err := d.occupied(ctx, pr)
+	if err != nil || !occupied {
+		return time.Time{}, false, err
+	}
+	until := time.Now().Add(d.timeout)
+	if err := d.state.Update(func(data *stateData) {
+		data.Draining[pr] = Drain{Until: until, Purge: purge}
+	}); err != nil {
+		return time.Time{}, false, fmt.Errorf("record drain: %w", err)
+	}
+	msg := d.messages.Text("", msgDrainWarning, "pr", pr, "duration", d.timeout.String())
+	if err := d.broadcast(ctx, pr, msg); err != nil {
+		slog.WarnContext(ctx, "Failed to warn players of drain", slog.String("pr", pr), slog.Any("error", err))
+	}
+	return until, true, nil
+}
+
+// occupied checks if players are online on the server of the given PR. A server running that hasn't responded
+// to a health check yet is assumed to be occupied.
+func (d *Drainer) occupied(ctx context.Context, pr string) (bool, error) {
+	_, _, running, err := d.backend.ServerAddress(ctx, pr)
+	if err != nil {
+		return false, fmt.Errorf("get server address: %w", err)
+	} else if !running {
+		return false, nil
+	}
+	online, ok := d.health.Players(pr)
+	return !ok || online > 0, nil
+}
+
+// broadcast runs the drain command on the console of the server of the given PR to show the message passed to
+// the players online.
+func (d *Drainer) broadcast(ctx context.Context, pr, msg string) error {
+	conn, err := d.backend.Attach(ctx, pr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// The output of the server is discarded, but must be read for the console to accept input.
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	_, err = io.WriteString(conn, strings.ReplaceAll(d.command, "{message}", msg)+"\n")
+	return err
+}
+
+// drain deletes every pull request that is drained whose server is empty or whose drain timed out.
+func (d *Drainer) drain(ctx context.Context) error {
+	var drains map[string]Drain
+	d.state.View(func(data *stateData) {
+		drains = maps.Clone(data.Draining)
+	})
+	var errs []error
+	for _, pr := range slices.Sorted(maps.Keys(drains)) {
+		drain := drains[pr]
+		if time.Now().Before(drain.Until) {
+			occupied, err := d.occupied(ctx, pr)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("check if %s is empty: %w", pr, err))
+				continue
+			} else if occupied {
+				continue
+			}
+		}
+		slog.Info("Deleting drained PR", slog.String("pr", pr), slog.Bool("timed_out", !time.Now().Before(drain.Until)))
+		if err := d.delete(ctx, pr, drain); err != nil {
+			errs = append(errs, fmt.Errorf("delete %s: %w", pr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// delete deletes the given PR once it is drained.
+func (d *Drainer) delete(ctx context.Context, pr string, drain Drain) error {
+	if drain.Purge {
+		return d.purger.Purge(ctx, pr)
+	}
+	// The PR is only no longer drained once it is marked deleted, so that no player may join in between.
+	if _, err := d.purger.Delete(ctx, pr); err != nil {
+		return err
+	}
+	return d.state.Update(func(data *stateData) {
+		delete(data.Draining, pr)
+	})
+}
+
+// drainingUntil returns the time the given PR is deleted at if it is drained, or false if it isn't drained.
+func drainingUntil(state *State, pr string) (time.Time, bool) {
+	var drain Drain
+	var ok bool
+	state.View(func(data *stateData) {
+		drain, ok = data.Draining[pr]
+	})
+	return drain.Until, ok
+}
+
+// drainResponse is the body of the response to deleting a pull request that is drained first.
+type drainResponse struct {
+	// DrainUntil is the time the pull request is deleted at if players are still online.
+	DrainUntil time.Time `json:"drain_until"`
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// errEnvironmentNotDeployed is returned when redeploying an environment that no binary was uploaded for yet.
+var errEnvironmentNotDeployed = errors.New("environment not deployed")
+
+// environmentCheckInterval is how often the Environments check that the servers of environments are running
+// and whether one of them is due to be redeployed.
+const environmentCheckInterval = time.Minute
+
+// environmentNamePattern matches the names of environments. Names start with a letter, so that they can't be
+// mistaken for the number of a pull request.
+var environmentNamePattern = regexp.MustCompile(`^[a-z][a-z0-9]{0,31}$`)
+
+// EnvironmentConfig is the configuration of a permanent environment managed by prmanager, such as the main or
+// plots server. Environments are built and run like pull requests, but on a fixed port, and they are kept
+// running rather than being stopped when idle or deleted by the retention policy.
+type EnvironmentConfig struct {
+	// Name is the name of the environment, such as main. The files and container of the environment are
+	// named like those of a pull request with the name in place of the number, e.g. pr-main.
+	Name string
+	// Port is the host port the server of the environment is published on, such as 19133. It must be
+	// outside the port range of pull requests.
+	Port uint16
+	// Profile is the name of the profile the environment is built and run with. If empty, the first profile
+	// is used.
+	Profile string
+	// RedeployAt is the local time of day, such as 04:00, at which the image of the environment is rebuilt
+	// from its current binary and its server restarted every day. If empty, it is only redeployed through
+	// the API.
+	RedeployAt string
+}
+
+// Environment returns the configuration of the environment with the name passed, or false if there is none.
+func (c Config) Environment(name string) (EnvironmentConfig, bool) {
+	for _, env := range c.Environments {
+		if env.Name == name {
+			return env, true
+		}
+	}
+	return EnvironmentConfig{}, false
+}
+
+// environmentPorts returns the fixed host ports of the environments configured, by their name.
+func environmentPorts(conf Config) map[string]uint16 {
+	ports := make(map[string]uint16, len(conf.Environments))
+	for _, env := range conf.Environments {
+		ports[env.Name] = env.Port
+	}
+	return ports
+}
+
+// nextRedeploy returns the next time after now that an environment redeployed daily at the time of day passed
+// is due, or the zero time if it is not redeployed on a schedule.
+func nextRedeploy(at string, now time.Time) time.Time {
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return time.Time{}
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// Environments keeps the servers of the permanent environments configured running and redeploys them on
+// their schedule.
+type Environments struct {
+	backend Backend
+	conf    Config
+
+	// deploying serialises deploys, so that a scheduled redeploy doesn't race with a binary being uploaded.
+	deploying sync.Mutex
+
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+// NewEnvironments creates Environments managing the environments in the configuration passed.
+func NewEnvironments(backend Backend, conf Config) *Environments {
+	e := &Environments{backend: backend, conf: conf, next: make(map[string]time.Time)}
+	now := time.Now()
+	for _, env := range conf.Environments {
+		e.next[env.Name] = nextRedeploy(env.RedeployAt, now)
+	}
+	return e
+}
+
+// Job returns the Job checking the environments immediately and then every environmentCheckInterval,
+// starting servers that are not running and redeploying environments that are due. If no environments are
+// configured, the job only runs when triggered, and does nothing.
+func (e *Environments) Job() Job {
+	job := Job{Name: "environments", Run: e.check}
+	if len(e.conf.Environments) > 0 {
+		job.Interval, job.Immediate = environmentCheckInterval, true
+	}
+	return job
+}
+
+// check redeploys the environments that are due and starts the servers of deployed environments that are not
+// running.
+func (e *Environments) check(ctx context.Context) error {
+	if len(e.conf.Environments) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for _, env := range e.conf.Environments {
+		e.mu.Lock()
+		due := !e.next[env.Name].IsZero() && !now.Before(e.next[env.Name])
+		if due {
+			e.next[env.Name] = nextRedeploy(env.RedeployAt, now)
+		}
+		e.mu.Unlock()
+		if due {
+			slog.Info("Redeploying environment on schedule", slog.String("environment", env.Name))
+			if err := e.Redeploy(ctx, env.Name); err != nil && !errors.Is(err, errEnvironmentNotDeployed) {
+				slog.Error("Failed to redeploy environment", slog.String("environment", env.Name), slog.Any("error", err))
+			}
+		}
+	}
+
+	// Servers are not started while an environment is being deployed, which stops and starts its server itself.
+	if !e.deploying.TryLock() {
+		return nil
+	}
+	defer e.deploying.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, startTimeout)
+	defer cancel()
+	statuses, err := e.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("get status of environments: %w", err)
+	}
+	for _, status := range statuses {
+		if status.Deployment == nil || status.Running {
+			continue
+		}
+		slog.Info("Starting server of environment", slog.String("environment", status.Name))
+		if _, _, _, err := e.backend.StartServer(ctx, status.Name); err != nil {
+			slog.Error("Failed to start server of environment", slog.String("environment", status.Name), slog.Any("error", err))
+		}
+	}
+	return nil
+}
+
+// Deploy builds the image of the environment with the name passed from its uploaded binary, recording the
+// deployment passed, and restarts its server with the new image.
+func (e *Environments) Deploy(ctx context.Context, name string, deployment Deployment) error {
+	e.deploying.Lock()
+	defer e.deploying.Unlock()
+	deployment.PR = name
+	// Building the image stops the server, so that it is started with the new image.
+	if err := e.backend.BuildImage(ctx, name, deployment); err != nil {
+		return err
+	}
+	if _, _, _, err := e.backend.StartServer(ctx, name); err != nil {
+		return fmt.Errorf("start server: %w", err)
+	}
+	return nil
+}
+
+// Redeploy rebuilds the image of the environment with the name passed from its current binary, so that it
+// picks up changes to the base image and profile, and restarts its server. If no binary was uploaded for the
+// environment yet, errEnvironmentNotDeployed is returned.
+func (e *Environments) Redeploy(ctx context.Context, name string) error {
+	deployment, ok, err := e.deployment(ctx, name)
+	if err != nil {
+		return err
+	} else if !ok {
+		return errEnvironmentNotDeployed
+	}
+	deployment.Deployed = time.Now()
+	return e.Deploy(ctx, name, deployment)
+}
+
+// deployment returns the current deployment of the environment with the name passed, or false if it has none.
+func (e *Environments) deployment(ctx context.Context, name string) (Deployment, bool, error) {
+	deployments, err := e.backend.Deployments(ctx)
+	if err != nil {
+		return Deployment{}, false, fmt.Errorf("list deployments: %w", err)
+	}
+	i := slices.IndexFunc(deployments, func(d Deployment) bool { return d.PR == name })
+	if i == -1 {
+		return Deployment{}, false, nil
+	}
+	return deployments[i], true, nil
+}
+
+// environmentStatus is the status of an environment as returned by the API.
+type environmentStatus struct {
+	Name       string      `json:"name"`
+	Port       uint16      `json:"port"`
+	Running    bool        `json:"running"`
+	Deployment *Deployment `json:"deployment,omitempty"`
+	// NextRedeploy is the next time the environment is redeployed on its schedule, if it has one.
+	NextRedeploy *time.Time `json:"next_redeploy,omitempty"`
+}
+
+// Status returns the status of every environment configured, in the order they are configured in.
+func (e *Environments) Status(ctx context.Context) ([]environmentStatus, error) {
+	deployments, err := e.backend.Deployments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list deployments: %w", err)
+	}
+	servers, err := e.backend.Servers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list servers: %w", err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	statuses := make([]environmentStatus, 0, len(e.conf.Environments))
+	for _, env := range e.conf.Environments {
+		status := environmentStatus{Name: env.Name, Port: env.Port}
+		if i := slices.IndexFunc(deployments, func(d Deployment) bool { return d.PR == env.Name }); i != -1 {
+			status.Deployment = &deployments[i]
+		}
+		status.Running = slices.ContainsFunc(servers, func(srv Server) bool { return srv.PR == env.Name })
+		if next := e.next[env.Name]; !next.IsZero() {
+			status.NextRedeploy = &next
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// handleListEnvironments handles listing the status of the environments configured.
+func (r *Router) handleListEnvironments(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	statuses, err := r.envs.Status(request.Context())
+	if err != nil {
+		logger.Error("Failed to get status of environments", slog.Any("error", err))
+		http.Error(writer, "Failed to get status of environments", errorStatus(err))
+		return
+	}
+	writeJSON(writer, http.StatusOK, statuses)
+}
+
+// handleDeployEnvironment handles uploading a new binary for an environment. The image of the environment is
+// built from it like that of a pull request and its server is restarted with the new image.
+func (r *Router) handleDeployEnvironment(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	name := request.PathValue("name")
+	env, ok := r.conf.Environment(name)
+	if !ok {
+		logger.Warn("Environment not found", "environment", name)
+		http.Error(writer, "Environment not found", http.StatusNotFound)
+		return
+	}
+	if !r.parseUpload(writer, request, logger) {
+		return
+	}
+	// The profile was validated when reading the config.
+	profile, _ := r.conf.Profile(env.Profile)
+	file, _, err := request.FormFile("binary")
+	if err != nil {
+		logger.Warn("Failed to get file from form", slog.Any("error", err))
+		http.Error(writer, "Failed to get file from form", http.StatusBadRequest)
+		return
+	}
+	signature, ok := r.uploadSignature(writer, request, logger)
+	if !ok {
+		return
+	}
+	if err = uploadBinary(name, file, profile, signature, r.signingKeys); err != nil {
+		logger.Error("Failed to upload binary", "environment", name, slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Failed to upload binary: %v", err), errorStatus(err))
+		return
+	}
+	deployment := Deployment{
+		PR:       name,
+		Profile:  profile.Name,
+		Build:    request.FormValue("build"),
+		Commit:   request.FormValue("commit"),
+		Deployed: time.Now(),
+		Deployer: apiKeyID(request.Header.Get("X-API-Key")),
+	}
+	ctx, cancel := r.buildContext(request)
+	defer cancel()
+	if err := r.deployUpload(ctx, logger, deployment, false, r.envs.Deploy); err != nil {
+		logger.Error("Failed to deploy environment", "environment", name, slog.Any("error", err))
+		http.Error(writer, buildErrorMessage("Failed to deploy environment", err), errorStatus(err))
+		return
+	}
+	logger.Info("Successfully deployed environment", "environment", name)
+	writer.WriteHeader(http.StatusCreated)
+}
+
+// handleRedeployEnvironment handles rebuilding the image of an environment from its current binary and
+// restarting its server, as is otherwise done on its schedule.
+func (r *Router) handleRedeployEnvironment(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	name := request.PathValue("name")
+	if _, ok := r.conf.Environment(name); !ok {
+		logger.Warn("Environment not found", "environment", name)
+		http.Error(writer, "Environment not found", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := r.buildContext(request)
+	defer cancel()
+	done := r.trackBuild(name)
+	err := r.envs.Redeploy(ctx, name)
+	done()
+	if errors.Is(err, errEnvironmentNotDeployed) {
+		logger.Warn("Environment not deployed", "environment", name)
+		http.Error(writer, "Environment not deployed", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logger.Error("Failed to redeploy environment", "environment", name, slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Failed to redeploy environment: %v", err), errorStatus(err))
+		return
+	}
+	logger.Info("Redeployed environment", "environment", name)
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/client"
+)
+
+var (
+	// errBuildFailed is returned when building the image of a pull request failed. The error is a *buildError
+	// holding the tail of the build log.
+	errBuildFailed = errors.New("build failed")
+	// errContainerNotFound is returned when an operation targets the container of a pull request that is not
+	// running.
+	errContainerNotFound = errors.New("container not found")
+	// errImageNotFound is returned when starting the server of a pull request whose world is kept but whose
+	// image no longer exists, for example because it was removed by pruning images on the host.
+	errImageNotFound = errors.New("image not found")
+	// errNameConflict is returned when the server of a pull request can't be started because a container that
+	// wasn't created by prmanager for it holds its name.
+	errNameConflict = errors.New("container name in use")
+	// errPortUnavailable is returned by PortAllocator.Allocate if every port in the range is taken.
+	errPortUnavailable = errors.New("no ports available")
+	// errDaemonUnreachable is returned when the container daemon of a host could not be connected to.
+	errDaemonUnreachable = errors.New("container daemon unreachable")
+	// errInvalidBinary is returned when an uploaded binary can't be run by the servers of a profile, for
+	// example because it was built for another operating system or was truncated.
+	errInvalidBinary = errors.New("invalid binary")
+	// errInvalidSource is returned when the source a pull request is built from can't be used, for example
+	// because its tarball is corrupt or its git ref doesn't exist.
+	errInvalidSource = errors.New("invalid source")
+	// errInvalidSignature is returned when an uploaded binary lacks a valid signature by one of the configured
+	// signing keys.
+	errInvalidSignature = errors.New("invalid signature")
+	// errWorldNotLocal is returned when the world directory of a pull request is needed while its world is kept
+	// in a named volume on the remote host it is scheduled on.
+	errWorldNotLocal = errors.New("world is not stored on the local host")
+	// errSecretsDisabled is returned when a secret is set or injected while no SECRETS_KEY is configured to
+	// encrypt it with.
+	errSecretsDisabled = errors.New("secrets are disabled: SECRETS_KEY is not set")
+)
+
+// buildLogLines is the number of lines at the end of the build log that are kept in a buildError.
+const buildLogLines = 20
+
+// buildError is returned when building the image of a pull request failed. It satisfies
+// errors.Is(err, errBuildFailed).
+type buildError struct {
+	err error
+	log string
+}
+
+// newBuildError creates a buildError from the error and the combined output of the build.
+func newBuildError(err error, out []byte) *buildError {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) > buildLogLines {
+		lines = lines[len(lines)-buildLogLines:]
+	}
+	return &buildError{err: err, log: strings.Join(lines, "\n")}
+}
+
+// Error ...
+func (e *buildError) Error() string {
+	return fmt.Sprintf("%v: %v", errBuildFailed, e.err)
+}
+
+// Unwrap ...
+func (e *buildError) Unwrap() []error {
+	return []error{errBuildFailed, e.err}
+}
+
+// buildErrorMessage returns the message a request failing with the error passed is answered with: the prefix
+// and the error, followed by the tail of the build log if a build failed.
+func buildErrorMessage(prefix string, err error) string {
+	msg := fmt.Sprintf("%s: %v", prefix, err)
+	if buildErr := (*buildError)(nil); errors.As(err, &buildErr) {
+		msg += "\n\n" + buildErr.log
+	}
+	return msg
+}
+
+// dockerError translates an error returned by the Docker client so that it satisfies errors.Is with
+// errDaemonUnreachable or errContainerNotFound where applicable.
+func dockerError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case client.IsErrConnectionFailed(err):
+		return fmt.Errorf("%w: %w", errDaemonUnreachable, err)
+	case cerrdefs.IsNotFound(err):
+		return fmt.Errorf("%w: %w", errContainerNotFound, err)
+	}
+	return err
+}
+
+// errorStatus returns the HTTP status code an API request that failed with the error passed should be
+// answered with.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errBuildFailed), errors.Is(err, errInvalidBinary), errors.Is(err, errInvalidSource),
+		errors.Is(err, errInvalidStack):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errInvalidSignature):
+		return http.StatusForbidden
+	case errors.Is(err, errContainerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errImageNotFound):
+		return http.StatusGone
+	case errors.Is(err, errNameConflict), errors.Is(err, errSandboxExists), errors.Is(err, errWorldNotLocal):
+		return http.StatusConflict
+	case errors.Is(err, errPortUnavailable), errors.Is(err, errNoHostAvailable), errors.Is(err, errSecretsDisabled):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errDaemonUnreachable):
+		return http.StatusBadGateway
+	case errors.Is(err, errInsufficientStorage):
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// playerMessage returns the ID of the message that players are disconnected with when their server could not
+// be started or found because of the error passed. If the error is not one players can act on, fallback is
+// returned.
+func playerMessage(err error, fallback string) string {
+	switch {
+	case errors.Is(err, errPortUnavailable), errors.Is(err, errNoHostAvailable):
+		return msgTooManyServers
+	case errors.Is(err, errDaemonUnreachable):
+		return msgHostUnreachable
+	case errors.Is(err, errBuildFailed), errors.Is(err, errInvalidBinary):
+		return msgBuildFailed
+	case errors.Is(err, errContainerNotFound):
+		return msgServerStopped
+	case errors.Is(err, errImageNotFound):
+		return msgBuildExpired
+	}
+	return fallback
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBuildErrorMessage(t *testing.T) {
+	build := fmt.Errorf("host local: %w", newBuildError(errors.New("exit status 1"), []byte("step 1\nstep 2 failed\n")))
+	if got, want := buildErrorMessage("Failed to build image", build), "Failed to build image: host local: build failed: exit status 1\n\nstep 1\nstep 2 failed"; got != want {
+		t.Errorf("buildErrorMessage = %q, want %q", got, want)
+	}
+	if got, want := buildErrorMessage("Failed to upload binary", errors.New("invalid ELF")), "Failed to upload binary: invalid ELF"; got != want {
+		t.Errorf("buildErrorMessage = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// eventDeployRequested is published when a binary is uploaded for a pull request, before its image is built.
+	eventDeployRequested = "deploy_requested"
+	// eventBuildFinished is published when building the image of a pull request succeeded or failed.
+	eventBuildFinished = "build_finished"
+	// eventImageGrew is published when the image built for a pull request is larger than the one built before it
+	// by more than Images.MaxGrowth.
+	eventImageGrew = "image_grew"
+	// eventServerStarted is published when starting the server of a pull request succeeded or failed.
+	eventServerStarted = "server_started"
+	// eventServerStopped is published when the server of a pull request was stopped.
+	eventServerStopped = "server_stopped"
+	// eventServerDeleted is published when the server, image and data of a pull request were deleted.
+	eventServerDeleted = "server_deleted"
+	// eventPlayerJoined is published when a player joined a pull request and is transferred to its server.
+	eventPlayerJoined = "player_joined"
+)
+
+// Event is something that happened to a pull request, published on an EventBus.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	PR   string    `json:"pr"`
+	// Build is the build number of the deployment a deploy was requested or an image was built for, if any.
+	Build string `json:"build,omitempty"`
+	// Player is the display name of the player that joined.
+	Player string `json:"player,omitempty"`
+	// Err is the error a build or start failed with, or nil if it succeeded. Error holds its message, as Err is
+	// only available to subscribers in the same process.
+	Err   error  `json:"-"`
+	Error string `json:"error,omitempty"`
+}
+
+var (
+	eventsPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prmanager_events_total",
+		Help: "Number of events published, by their type and whether the operation they report failed.",
+	}, []string{"type", "result"})
+	eventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prmanager_events_dropped_total",
+		Help: "Number of events dropped because a subscriber didn't keep up with them, by the subscriber.",
+	}, []string{"subscriber"})
+)
+
+// subscription is a subscriber of an EventBus.
+type subscription struct {
+	name string
+	ch   chan Event
+}
+
+// EventBus passes events of pull requests, such as builds finishing and players joining, from the subsystems
+// causing them to those reacting to them, such as notifications, metrics and the event stream of the API.
+// This way publishers don't need to know about every subsystem interested in what they do.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers []*subscription
+	closed      bool
+}
+
+// NewEventBus creates an EventBus without any subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Publish passes the event to all subscribers, setting its time and error message. Publish never blocks: if
+// the buffer of a subscriber is full, the event is dropped for that subscriber.
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Err != nil {
+		e.Error = e.Err.Error()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	for _, sub := range b.subscribers {
+		select {
+		case sub.ch <- e:
+		default:
+			eventsDropped.WithLabelValues(sub.name).Inc()
+			slog.Warn("Dropped event for subscriber that isn't keeping up", slog.String("subscriber", sub.name), slog.String("type", e.Type), slog.String("pr", e.PR))
+		}
+	}
+}
+
+// Subscribe returns a channel that receives all events published from now on, buffering up to size events,
+// and a function that ends the subscription. The name passed identifies the subscriber in logs and metrics.
+// The channel is closed when the subscription is ended or the EventBus is closed.
+func (b *EventBus) Subscribe(name string, size int) (<-chan Event, func()) {
+	sub := &subscription{name: name, ch: make(chan Event, size)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	b.subscribers = append(b.subscribers, sub)
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if i := slices.Index(b.subscribers, sub); i != -1 {
+				b.subscribers = slices.Delete(b.subscribers, i, i+1)
+				close(sub.ch)
+			}
+		})
+	}
+}
+
+// Close ends all subscriptions. Events published after are dropped.
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, sub := range b.subscribers {
+		close(sub.ch)
+	}
+	b.subscribers = nil
+}
+
+// countEvents counts the events received from the channel passed in the prmanager_events_total metric until
+// it is closed.
+func countEvents(events <-chan Event) {
+	for e := range events {
+		result := "succeeded"
+		if e.Err != nil {
+			result = "failed"
+		}
+		eventsPublished.WithLabelValues(e.Type, result).Inc()
+	}
+}
+
+// eventBackend is a Backend that publishes events when images are built and servers are started, stopped and
+// deleted.
+type eventBackend struct {
+	Backend
+	events *EventBus
+}
+
+// BuildImage ...
+func (b eventBackend) BuildImage(ctx context.Context, pr string, deployment Deployment) error {
+	err := b.Backend.BuildImage(ctx, pr, deployment)
+	b.events.Publish(Event{Type: eventBuildFinished, PR: pr, Build: deployment.Build, Err: err})
+	return err
+}
+
+// StartServer ...
+func (b eventBackend) StartServer(ctx context.Context, pr string) (string, uint16, bool, error) {
+	addr, port, ok, err := b.Backend.StartServer(ctx, pr)
+	b.events.Publish(Event{Type: eventServerStarted, PR: pr, Err: err})
+	return addr, port, ok, err
+}
+
+// StopServer ...
+func (b eventBackend) StopServer(ctx context.Context, pr string) (StopResult, error) {
+	res, err := b.Backend.StopServer(ctx, pr)
+	if err == nil {
+		b.events.Publish(Event{Type: eventServerStopped, PR: pr})
+	}
+	return res, err
+}
+
+// DeleteServer ...
+func (b eventBackend) DeleteServer(ctx context.Context, pr string) {
+	b.Backend.DeleteServer(ctx, pr)
+	b.events.Publish(Event{Type: eventServerDeleted, PR: pr})
+}
+
+// handleEvents handles streaming the events of all pull requests as server-sent events, from the time of the
+// request until the client disconnects or prmanager shuts down.
+func (r *Router) handleEvents(writer http.ResponseWriter, request *http.Request) {
+	events, unsubscribe := r.events.Subscribe("stream", 64)
+	defer unsubscribe()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+	// The middlewares wrapping the writer pass flushes on, so events are sent as soon as they are written.
+	rc := http.NewResponseController(writer)
+	_ = rc.Flush()
+
+	// A comment is sent periodically, so that proxies don't close the stream while no events happen.
+	t := time.NewTicker(time.Second * 30)
+	defer t.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		case <-t.C:
+			if _, err := fmt.Fprint(writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-request.Context().Done():
+			return
+		case <-r.streams.Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// maxExtraPorts is the maximum number of extra ports the server of a pull request may expose.
+const maxExtraPorts = 4
+
+// ExtraPort is an extra TCP port exposed by the server of a pull request besides its game port, such as a
+// debug HTTP or pprof port, published on a port of the host chosen by the container daemon.
+type ExtraPort struct {
+	// Port is the port within the container.
+	Port uint16
+	// HostPort is the port on the host the port is published on.
+	HostPort uint16
+	// IP is the address of the host the port is published on if it isn't published on all of its interfaces,
+	// such as its loopback interface.
+	IP string
+	// Public specifies if the port is published on all interfaces of the host.
+	Public bool
+}
+
+// parseExtraPorts parses a comma separated list of TCP ports, such as 6060,8081, as declared by pull requests.
+func parseExtraPorts(s string) ([]uint16, error) {
+	var ports []uint16
+	for field := range strings.SplitSeq(s, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(field), 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid port %q", field)
+		}
+		if !slices.Contains(ports, uint16(n)) {
+			ports = append(ports, uint16(n))
+		}
+	}
+	if len(ports) > maxExtraPorts {
+		return nil, fmt.Errorf("at most %d ports may be exposed", maxExtraPorts)
+	}
+	return ports, nil
+}
+
+// formatExtraPorts formats the ports passed as a comma separated list, the inverse of parseExtraPorts.
+func formatExtraPorts(ports []uint16) string {
+	fields := make([]string, len(ports))
+	for i, port := range ports {
+		fields[i] = strconv.Itoa(int(port))
+	}
+	return strings.Join(fields, ",")
+}
+
+// extraPortArgs returns the arguments of docker run publishing the extra ports passed on ports of the host
+// chosen by the daemon. Unless public is true, ports of servers on the local host are only published on its
+// loopback interface, so that they can only be reached through the API. Remote hosts can't be reached over
+// their loopback interface, so their ports are published on their PrivateAddress instead, and an error is
+// returned if they have none.
+func (d *Docker) extraPortArgs(ports []uint16, public bool) ([]string, error) {
+	ip := "127.0.0.1"
+	switch {
+	case len(ports) == 0 || public:
+		ip = ""
+	case d.host.Address != "":
+		if d.host.PrivateAddress == "" {
+			return nil, fmt.Errorf("host %s has no private address to publish extra ports on and Ports.Public is not set", d.Name())
+		}
+		ip = d.host.PrivateAddress
+	}
+	var args []string
+	for _, port := range ports {
+		if ip == "" {
+			args = append(args, "-p", fmt.Sprintf("%d/tcp", port))
+		} else {
+			args = append(args, "-p", fmt.Sprintf("%s::%d/tcp", bracketIP(ip), port))
+		}
+	}
+	return args, nil
+}
+
+// bracketIP returns the IP address passed enclosed in brackets if it is an IPv6 address, as docker run expects
+// in published ports.
+func bracketIP(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "[" + ip + "]"
+	}
+	return ip
+}
+
+// containerPorts returns the host port the game port of a container is published on, which is its only UDP
+// port, and the extra ports it publishes. Ports published on both IPv4 and IPv6 are only returned once.
+func containerPorts(published []container.Port) (uint16, []ExtraPort, bool) {
+	var game uint16
+	var found bool
+	var extra []ExtraPort
+	for _, p := range published {
+		if p.PublicPort == 0 {
+			continue
+		}
+		if p.Type == "udp" {
+			game, found = p.PublicPort, true
+			continue
+		}
+		if slices.ContainsFunc(extra, func(e ExtraPort) bool { return e.Port == p.PrivatePort }) {
+			continue
+		}
+		port := ExtraPort{Port: p.PrivatePort, HostPort: p.PublicPort}
+		if ip := net.ParseIP(p.IP); ip == nil || ip.IsUnspecified() {
+			port.Public = true
+		} else {
+			port.IP = p.IP
+		}
+		extra = append(extra, port)
+	}
+	slices.SortFunc(extra, func(a, b ExtraPort) int { return int(a.Port) - int(b.Port) })
+	return game, extra, found
+}
+
+// extraPortStatus is an extra port of the server of a pull request as returned by the API.
+type extraPortStatus struct {
+	Port uint16 `json:"port"`
+	// Address is the address the port is reached at directly, if it is published on all interfaces.
+	Address string `json:"address,omitempty"`
+	// Proxy is the path of the API the port is reached at through prmanager.
+	Proxy string `json:"proxy"`
+}
+
+// extraPortStatuses returns the statuses of the extra ports of the server passed.
+func extraPortStatuses(srv Server) []extraPortStatus {
+	statuses := make([]extraPortStatus, 0, len(srv.Extra))
+	for _, port := range srv.Extra {
+		status := extraPortStatus{Port: port.Port, Proxy: fmt.Sprintf("/pullrequest/%s/ports/%d/", srv.PR, port.Port)}
+		if port.Public {
+			status.Address = net.JoinHostPort(srv.Address, strconv.Itoa(int(port.HostPort)))
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// handleProxyPortRoot handles requests to an extra port without a trailing slash by redirecting them to the root
+// of the port, so that relative links of pages served by the port resolve beneath it. The redirect keeps the
+// method and body of the request, and is relative, so that it works behind a reverse proxy serving the API
+// under a prefix too.
+func (r *Router) handleProxyPortRoot(writer http.ResponseWriter, request *http.Request) {
+	port, err := strconv.ParseUint(request.PathValue("port"), 10, 16)
+	if err != nil {
+		http.Error(writer, "Invalid port", http.StatusBadRequest)
+		return
+	}
+	target := strconv.FormatUint(port, 10) + "/"
+	if request.URL.RawQuery != "" {
+		target += "?" + request.URL.RawQuery
+	}
+	writer.Header().Set("Location", target)
+	writer.WriteHeader(http.StatusPermanentRedirect)
+}
+
+// handleProxyPort handles proxying a request to an extra port exposed by the running server of a pull request,
+// so that ports such as pprof can be reached by anyone holding an API key without being published publicly.
+// The API key of the request is not passed on.
+func (r *Router) handleProxyPort(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	port, err := strconv.ParseUint(request.PathValue("port"), 10, 16)
+	if err != nil {
+		http.Error(writer, "Invalid port", http.StatusBadRequest)
+		return
+	}
+	servers, err := r.backend.Servers(request.Context())
+	if err != nil {
+		logger.Error("Failed to list servers", slog.Any("error", err))
+		http.Error(writer, "Failed to list servers", errorStatus(err))
+		return
+	}
+	i := slices.IndexFunc(servers, func(srv Server) bool { return srv.PR == pr })
+	if i == -1 {
+		http.Error(writer, "Server not running", http.StatusNotFound)
+		return
+	}
+	srv := servers[i]
+	j := slices.IndexFunc(srv.Extra, func(p ExtraPort) bool { return p.Port == uint16(port) })
+	if j == -1 {
+		http.Error(writer, "Port not exposed", http.StatusNotFound)
+		return
+	}
+	// Ports that aren't public are reached at the address they are published on, such as the loopback interface
+	// of the local host or the private address of a remote host.
+	host := srv.Extra[j].IP
+	if srv.Extra[j].Public {
+		host = srv.Address
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(srv.Extra[j].HostPort)))
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(out *httputil.ProxyRequest) {
+			out.Out.URL.Scheme, out.Out.URL.Host, out.Out.Host = "http", target, target
+			out.Out.URL.Path, out.Out.URL.RawPath = "/"+request.PathValue("path"), ""
+			out.Out.Header.Del("X-API-Key")
+			out.Out.Header.Del("Authorization")
+		},
+		ErrorHandler: func(writer http.ResponseWriter, _ *http.Request, err error) {
+			logger.Warn("Failed to proxy request to port", "pr", pr, "port", port, slog.Any("error", err))
+			http.Error(writer, "Port unreachable", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(writer, request)
+}
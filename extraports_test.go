@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestParseExtraPorts(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  []uint16
+		valid bool
+	}{
+		{"6060", []uint16{6060}, true},
+		{"6060, 8081", []uint16{6060, 8081}, true},
+		{"6060,6060", []uint16{6060}, true},
+		{"1,2,3,4", []uint16{1, 2, 3, 4}, true},
+		{"1,2,3,4,5", nil, false},
+		{"0", nil, false},
+		{"65536", nil, false},
+		{"-1", nil, false},
+		{"http", nil, false},
+		{"6060,", nil, false},
+		{"", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parseExtraPorts(tt.in)
+		if (err == nil) != tt.valid {
+			t.Errorf("parseExtraPorts(%q): got %v, want valid %v", tt.in, err, tt.valid)
+			continue
+		}
+		if tt.valid && !slices.Equal(got, tt.want) {
+			t.Errorf("parseExtraPorts(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		if tt.valid && formatExtraPorts(got) != formatExtraPorts(tt.want) {
+			t.Errorf("formatExtraPorts(%v) = %q", got, formatExtraPorts(got))
+		}
+	}
+}
+
+func TestContainerPorts(t *testing.T) {
+	game, extra, ok := containerPorts([]container.Port{
+		{IP: "0.0.0.0", PrivatePort: 19132, PublicPort: 20000, Type: "udp"},
+		{IP: "::", PrivatePort: 19132, PublicPort: 20000, Type: "udp"},
+		{IP: "127.0.0.1", PrivatePort: 8081, PublicPort: 32769, Type: "tcp"},
+		{IP: "0.0.0.0", PrivatePort: 6060, PublicPort: 32768, Type: "tcp"},
+		{IP: "::", PrivatePort: 6060, PublicPort: 32768, Type: "tcp"},
+		{PrivatePort: 9000, Type: "tcp"},
+	})
+	if !ok || game != 20000 {
+		t.Errorf("game port = %d, %v, want 20000", game, ok)
+	}
+	want := []ExtraPort{{Port: 6060, HostPort: 32768, Public: true}, {Port: 8081, HostPort: 32769, IP: "127.0.0.1"}}
+	if !slices.Equal(extra, want) {
+		t.Errorf("extra ports = %+v, want %+v", extra, want)
+	}
+	if _, _, ok := containerPorts([]container.Port{{PrivatePort: 19132, Type: "udp"}}); ok {
+		t.Error("unpublished game port found")
+	}
+}
+
+func TestHandleProxyPortRoot(t *testing.T) {
+	r := &Router{mux: http.NewServeMux()}
+	r.handle("/pullrequest/{pr}/ports/{port}", r.handleProxyPortRoot)
+	tests := []struct {
+		path     string
+		status   int
+		location string
+	}{
+		{"/pullrequest/1/ports/6060", http.StatusPermanentRedirect, "6060/"},
+		{"/pullrequest/1/ports/6060?seconds=5", http.StatusPermanentRedirect, "6060/?seconds=5"},
+		{"/pullrequest/1/ports/pprof", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		r.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.path, nil))
+		if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+			t.Errorf("%s: %d %q, want %d %q", tt.path, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+}
+
+func TestExtraPortArgs(t *testing.T) {
+	ports := []uint16{6060}
+	tests := []struct {
+		name   string
+		host   HostConfig
+		public bool
+		want   string
+	}{
+		{"local", HostConfig{Name: "local"}, false, "127.0.0.1::6060/tcp"},
+		{"local public", HostConfig{Name: "local"}, true, "6060/tcp"},
+		{"remote public", HostConfig{Name: "b", Address: "tcp://10.0.0.2:2375"}, true, "6060/tcp"},
+		{"remote private", HostConfig{Name: "b", Address: "tcp://10.0.0.2:2375", PrivateAddress: "10.0.0.2"}, false, "10.0.0.2::6060/tcp"},
+		{"remote private IPv6", HostConfig{Name: "b", Address: "tcp://10.0.0.2:2375", PrivateAddress: "fd00::2"}, false, "[fd00::2]::6060/tcp"},
+		{"remote", HostConfig{Name: "b", Address: "tcp://10.0.0.2:2375"}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := (&Docker{host: tt.host}).extraPortArgs(ports, tt.public)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("extra ports published on remote host without private address: %q", args)
+				}
+				return
+			}
+			if err != nil || !slices.Equal(args, []string{"-p", tt.want}) {
+				t.Errorf("extraPortArgs = %q, %v, want [-p %s]", args, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// firewallOpen is the firewall mode in which the port of a server is opened while it runs.
+	firewallOpen = "open"
+	// firewallClosed is the firewall mode in which the port range of servers is kept closed to other hosts.
+	firewallClosed = "closed"
+)
+
+// Firewall manages the rules of the firewall of the local host for the ports assigned to servers, using either
+// nftables or ufw. Firewalls of remote hosts are not managed.
+type Firewall struct {
+	mode, backend string
+	min, max      uint16
+}
+
+// NewFirewall creates a Firewall for the port range and firewall configuration passed. If no firewall mode is
+// configured, the Firewall does nothing.
+func NewFirewall(conf Config) *Firewall {
+	return &Firewall{mode: conf.Firewall.Mode, backend: conf.Firewall.Backend, min: conf.Ports.Min, max: conf.Ports.Max}
+}
+
+// Setup installs the rules closing the port range to other hosts. With nftables, the rules are kept in a table
+// of their own named prmanager, which is recreated with no ports open. If prmanager replaced a previous process,
+// the rules are left as they are, so that the servers taken over stay reachable. Managing the firewall requires
+// root, so an error is returned if a firewall mode is configured while running as an unprivileged user.
+func (f *Firewall) Setup(ctx context.Context) error {
+	if f.mode == "" || upgraded() {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("firewall mode %s requires running as root: remove Firewall.Mode to run unprivileged", f.mode)
+	}
+	switch f.backend {
+	case "ufw":
+		if f.mode != firewallClosed {
+			// Ports are closed by the default policy of ufw unless allowed.
+			return nil
+		}
+		return f.run(ctx, "", "ufw", "deny", fmt.Sprintf("%d:%d/udp", f.min, f.max))
+	default:
+		// Traffic is filtered before Docker translates the destination to the address of the container, so that
+		// the rule matches the host port. Only packets from other hosts are dropped, so that a proxy on the host
+		// can always reach the servers.
+		ruleset := fmt.Sprintf(`table inet prmanager
+delete table inet prmanager
+table inet prmanager {
+	set open {
+		type inet_service
+	}
+	chain ports {
+		type filter hook prerouting priority -150; policy accept;
+		iif "lo" accept
+		udp dport %d-%d udp dport != @open drop
+	}
+}
+`, f.min, f.max)
+		return f.run(ctx, ruleset, "nft", "-f", "-")
+	}
+}
+
+// Open opens the port passed to other hosts. It does nothing unless the firewall mode is open.
+func (f *Firewall) Open(ctx context.Context, port uint16) error {
+	if f.mode != firewallOpen {
+		return nil
+	}
+	if f.backend == "ufw" {
+		return f.run(ctx, "", "ufw", "allow", strconv.Itoa(int(port))+"/udp")
+	}
+	return f.run(ctx, "", "nft", "add", "element", "inet", "prmanager", "open", "{ "+strconv.Itoa(int(port))+" }")
+}
+
+// Close closes the port passed to other hosts again after it was opened using Open. Closing a port that isn't
+// open has no effect.
+func (f *Firewall) Close(ctx context.Context, port uint16) error {
+	if f.mode != firewallOpen {
+		return nil
+	}
+	if f.backend == "ufw" {
+		return f.run(ctx, "", "ufw", "delete", "allow", strconv.Itoa(int(port))+"/udp")
+	}
+	err := f.run(ctx, "", "nft", "delete", "element", "inet", "prmanager", "open", "{ "+strconv.Itoa(int(port))+" }")
+	if err != nil && strings.Contains(err.Error(), "No such file or directory") {
+		// The port was not open.
+		return nil
+	}
+	return err
+}
+
+// run runs the firewall command passed, writing stdin to its standard input if not empty.
+func (f *Firewall) run(ctx context.Context, stdin string, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("run command '%s': %w: %s", cmd.String(), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
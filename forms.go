@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+)
+
+// formTimeout is the time a player is given to close the form shown before they are disconnected.
+const formTimeout = time.Minute
+
+// failureFormID is the ID of the form shown to players before they are disconnected.
+const failureFormID = 1
+
+// menuForm is a simple form, as it is encoded in a packet.ModalFormRequest, with a list of buttons. The form
+// shown before players are disconnected has a single button that closes it.
+type menuForm struct {
+	Type    string       `json:"type"`
+	Title   string       `json:"title"`
+	Content string       `json:"content"`
+	Buttons []formButton `json:"buttons"`
+}
+
+// formButton is a button of a menuForm.
+type formButton struct {
+	Text string `json:"text"`
+}
+
+// fail disconnects the connection passed with the message with the ID passed, like disconnect. If forms are
+// enabled, the message is first shown in a form along with the status of the given PR, if any, the time
+// servers usually take to start and a hint to retry. The player is disconnected once they close the form, or
+// right away if the client can't show it.
+func (l *Listener) fail(ctx context.Context, c *minecraft.Conn, pr, id string, values ...string) {
+	if l.conf.Messages.Forms {
+		l.showFailureForm(ctx, c, pr, id, values...)
+	}
+	l.disconnect(c, id, values...)
+}
+
+// showFailureForm shows the form describing a failure to the player and waits until they close it.
+func (l *Listener) showFailureForm(ctx context.Context, c *minecraft.Conn, pr, id string, values ...string) {
+	lang := c.ClientData().LanguageCode
+	values = append(values, "address", serverHost(c.ClientData().ServerAddress), "pr", pr)
+
+	lines := []string{l.messages.Text(lang, id, values...)}
+	if pr != "" {
+		if deployment, ok := l.deployment(ctx, pr); ok {
+			commit := deployment.Commit
+			if commit == "" {
+				commit = "unknown"
+			}
+			lines = append(lines, l.messages.Text(lang, msgFormDeployment, append(values, "commit", commit, "deployed", deployment.Deployed.Format(time.DateTime))...))
+		}
+		if estimate := l.startEstimate(); estimate > 0 {
+			lines = append(lines, l.messages.Text(lang, msgFormEstimate, append(values, "duration", estimate.String())...))
+		}
+	}
+	lines = append(lines, l.messages.Text(lang, msgFormRetry, values...))
+
+	data, _ := json.Marshal(menuForm{
+		Type:    "form",
+		Title:   l.messages.Text(lang, msgFormTitle, values...),
+		Content: strings.Join(lines, "\n\n"),
+		Buttons: []formButton{{Text: l.messages.Text(lang, msgFormButton, values...)}},
+	})
+	if err := c.WritePacket(&packet.ModalFormRequest{FormID: failureFormID, FormData: data}); err != nil {
+		return
+	}
+
+	// The form is closed when the player presses the button, closes it or the client reports it can't show it.
+	// Packets are read until then, which is bounded by the timeout so a client ignoring it can't stall.
+	stop := time.AfterFunc(formTimeout, func() { _ = c.Close() })
+	defer stop.Stop()
+	for {
+		pk, err := c.ReadPacket()
+		if err != nil {
+			return
+		}
+		if resp, ok := pk.(*packet.ModalFormResponse); ok && resp.FormID == failureFormID {
+			return
+		}
+	}
+}
+
+// deployment returns the deployment of the given PR, or false if it has none or could not be listed.
+func (l *Listener) deployment(ctx context.Context, pr string) (Deployment, bool) {
+	// The context of the join may already have expired if starting the server timed out.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), apiTimeout)
+	defer cancel()
+	deployment, ok, err := l.backend.Deployment(ctx, pr)
+	if err != nil {
+		return Deployment{}, false
+	}
+	return deployment, ok
+}
+
+// recordStart records the time it took to start the server of a PR, used to estimate the time future starts
+// take. The estimate is a moving average, so that it follows changes such as a slower host.
+func (l *Listener) recordStart(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.startAverage == 0 {
+		l.startAverage = d
+		return
+	}
+	l.startAverage = (l.startAverage*4 + d) / 5
+}
+
+// startEstimate returns the time servers usually take to start, rounded to seconds, or zero if no server was
+// started yet.
+func (l *Listener) startEstimate() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.startAverage.Round(time.Second)
+}
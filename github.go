@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// gitHubTimeout is the time metadata of a pull request may take to be fetched from GitHub. It is short, as
+// players wait while it is fetched.
+const gitHubTimeout = time.Second * 3
+
+// pullRequestInfo is the metadata of a pull request on GitHub.
+type pullRequestInfo struct {
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	// Head is the commit SHA of the head of the pull request.
+	Head string `json:"head"`
+}
+
+// cachedInfo is metadata of a pull request cached by a gitHubClient, along with when it was fetched. If it
+// could not be fetched, ok is false.
+type cachedInfo struct {
+	info    pullRequestInfo
+	ok      bool
+	fetched time.Time
+}
+
+// gitHubClient fetches the metadata of pull requests from the GitHub API and caches it, so that joining a PR
+// doesn't query GitHub every time.
+type gitHubClient struct {
+	repository string
+	token      string
+	ttl        time.Duration
+	http       *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedInfo
+}
+
+// newGitHubClient creates a gitHubClient for the repository configured. The token in the GITHUB_TOKEN
+// environment variable, if any, is used to authenticate, which raises the rate limit and allows access to
+// private repositories.
+func newGitHubClient(conf Config) *gitHubClient {
+	return &gitHubClient{
+		repository: conf.GitHub.Repository,
+		token:      os.Getenv("GITHUB_TOKEN"),
+		ttl:        conf.GitHub.CacheTTL,
+		http:       &http.Client{Timeout: gitHubTimeout},
+		cache:      make(map[string]cachedInfo),
+	}
+}
+
+// PullRequest returns the metadata of the given PR, or false if no repository is configured or it could not
+// be fetched. Failures are cached as well, so that GitHub being unreachable doesn't slow down every join. For a
+// sandbox, the metadata of the pull request it was cloned from is returned.
+func (c *gitHubClient) PullRequest(ctx context.Context, pr string) (pullRequestInfo, bool) {
+	if c.repository == "" {
+		return pullRequestInfo{}, false
+	}
+	pr = basePullRequest(pr)
+	c.mu.Lock()
+	cached, ok := c.cache[pr]
+	c.mu.Unlock()
+	if ok && time.Since(cached.fetched) < c.ttl {
+		return cached.info, cached.ok
+	}
+
+	info, err := c.fetch(ctx, pr)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to fetch pull request from GitHub", slog.String("pr", pr), slog.Any("error", err))
+	}
+	c.mu.Lock()
+	c.cache[pr] = cachedInfo{info: info, ok: err == nil, fetched: time.Now()}
+	c.mu.Unlock()
+	return info, err == nil
+}
+
+// fetch fetches the metadata of the given PR from the GitHub API.
+func (c *gitHubClient) fetch(ctx context.Context, pr string) (pullRequestInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, gitHubTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://api.github.com/repos/%s/pulls/%s", c.repository, pr), nil)
+	if err != nil {
+		return pullRequestInfo{}, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return pullRequestInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return pullRequestInfo{}, fmt.Errorf("GET %s: %s", req.URL.Path, resp.Status)
+	}
+	var body struct {
+		Title string `json:"title"`
+		User  struct {
+			Login string `json:"login"`
+		} `json:"user"`
+		Head struct {
+			SHA string `json:"sha"`
+		} `json:"head"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return pullRequestInfo{}, fmt.Errorf("decode response: %w", err)
+	}
+	return pullRequestInfo{Title: body.Title, Author: body.User.Login, Head: body.Head.SHA}, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// HandoffClaims are the claims of a handoff token: who the player transferred is and where the Listener
+// routed them. They are only vouched for by prmanager signing them.
+type HandoffClaims struct {
+	XUID        string `json:"xuid"`
+	DisplayName string `json:"display_name"`
+	// Address is the address the player joined prmanager with.
+	Address string `json:"address"`
+	// PR is the pull request the player was routed to, or empty for a static route.
+	PR string `json:"pr,omitempty"`
+	// Target is the address and port the player was transferred to.
+	Target string `json:"target"`
+	// Audience is the backend the token is meant for: pr-<number> for the server of a pull request, or Target
+	// otherwise. Backends reject tokens meant for others, so that a token can't be replayed to another backend.
+	Audience string `json:"aud"`
+	Issued   int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+// handoff is a handoff token issued, kept until it expires.
+type handoff struct {
+	token   string
+	expires time.Time
+}
+
+// Handoffs issues short-lived handoff tokens to players as they are transferred, signed with the Ed25519 key
+// in the HANDOFF_KEY environment variable. Backends fetch the token of a player joining them by their XUID and
+// verify it with the public key, so that they can trust the access control of prmanager, such as canary
+// routing, without deciding it again. Transfers carry no data besides the address, so tokens are passed
+// through the API rather than through the client.
+type Handoffs struct {
+	// key signs tokens. It is nil if no HANDOFF_KEY is set, in which case no tokens are issued.
+	key ed25519.PrivateKey
+	ttl time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]handoff
+}
+
+// NewHandoffs creates Handoffs issuing tokens valid for Handoff.TTL. HANDOFF_KEY must hold the 32 hex encoded
+// bytes of the seed of an Ed25519 key, such as generated by `openssl rand -hex 32`, or be empty to disable
+// handoff tokens.
+func NewHandoffs(conf Config) (*Handoffs, error) {
+	h := &Handoffs{ttl: conf.Handoff.TTL, tokens: make(map[string]handoff)}
+	env := os.Getenv("HANDOFF_KEY")
+	if env == "" {
+		return h, nil
+	}
+	seed, err := hex.DecodeString(env)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("HANDOFF_KEY must be 32 hex encoded bytes")
+	}
+	h.key = ed25519.NewKeyFromSeed(seed)
+	return h, nil
+}
+
+// Enabled returns if handoff tokens are issued.
+func (h *Handoffs) Enabled() bool {
+	return h.key != nil
+}
+
+// Issue signs a token with the claims passed, setting its audience and the times it was issued and expires at,
+// and keeps it as the token of the player until it expires, replacing any previous one. Tokens are only issued
+// to players with an XUID, as backends couldn't tell them apart otherwise.
+func (h *Handoffs) Issue(claims HandoffClaims) {
+	if h.key == nil || claims.XUID == "" {
+		return
+	}
+	now := time.Now()
+	claims.Audience = claims.Target
+	if claims.PR != "" {
+		claims.Audience = "pr-" + claims.PR
+	}
+	claims.Issued, claims.Expires = now.Unix(), now.Add(h.ttl).Unix()
+	payload, _ := json.Marshal(claims)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	token := encoded + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(h.key, []byte(encoded)))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for xuid, issued := range h.tokens {
+		if now.After(issued.expires) {
+			delete(h.tokens, xuid)
+		}
+	}
+	h.tokens[claims.XUID] = handoff{token: token, expires: now.Add(h.ttl)}
+}
+
+// Token returns the token last issued to the player with the XUID passed and when it expires, or false if none
+// was issued or it expired.
+func (h *Handoffs) Token(xuid string) (string, time.Time, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	issued, ok := h.tokens[xuid]
+	if !ok || time.Now().After(issued.expires) {
+		return "", time.Time{}, false
+	}
+	return issued.token, issued.expires, true
+}
+
+// handoffResponse is the body of the response to fetching the handoff token of a player.
+type handoffResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// handleGetHandoff handles fetching the handoff token last issued to the player with the XUID in the path of
+// the request. XUIDs are public, so it requires a key: anyone fetching a token could otherwise present it to
+// the backend it is meant for as the player until it expires.
+func (r *Router) handleGetHandoff(writer http.ResponseWriter, request *http.Request) {
+	if !r.handoffs.Enabled() {
+		http.Error(writer, "Handoff tokens are disabled", http.StatusServiceUnavailable)
+		return
+	}
+	token, expires, ok := r.handoffs.Token(request.PathValue("xuid"))
+	if !ok {
+		http.Error(writer, "No handoff token", http.StatusNotFound)
+		return
+	}
+	writeJSON(writer, http.StatusOK, handoffResponse{Token: token, Expires: expires})
+}
+
+// handleGetHandoffKey handles fetching the public key handoff tokens are verified with.
+func (r *Router) handleGetHandoffKey(writer http.ResponseWriter, _ *http.Request) {
+	if !r.handoffs.Enabled() {
+		http.Error(writer, "Handoff tokens are disabled", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(writer, http.StatusOK, map[string]string{"key": hex.EncodeToString(r.handoffs.key.Public().(ed25519.PublicKey))})
+}
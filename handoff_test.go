@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandoffsIssue(t *testing.T) {
+	t.Setenv("HANDOFF_KEY", strings.Repeat("ab", ed25519.SeedSize))
+	var conf Config
+	conf.Handoff.TTL = time.Minute
+	h, err := NewHandoffs(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		claims   HandoffClaims
+		audience string
+	}{
+		"pull request": {claims: HandoffClaims{XUID: "1", PR: "12", Target: "df-mc.dev:40000"}, audience: "pr-12"},
+		"static route": {claims: HandoffClaims{XUID: "2", Target: "df-mc.dev:19133"}, audience: "df-mc.dev:19133"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			h.Issue(tc.claims)
+			token, _, ok := h.Token(tc.claims.XUID)
+			if !ok {
+				t.Fatal("no token issued")
+			}
+			payload, signature, _ := strings.Cut(token, ".")
+			sig, err := base64.RawURLEncoding.DecodeString(signature)
+			if err != nil || !ed25519.Verify(h.key.Public().(ed25519.PublicKey), []byte(payload), sig) {
+				t.Fatal("invalid signature")
+			}
+			data, err := base64.RawURLEncoding.DecodeString(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var claims HandoffClaims
+			if err := json.Unmarshal(data, &claims); err != nil {
+				t.Fatal(err)
+			}
+			if claims.Audience != tc.audience {
+				t.Errorf("aud = %q, want %q", claims.Audience, tc.audience)
+			}
+		})
+	}
+	h.Issue(HandoffClaims{Target: "df-mc.dev:19133"})
+	if _, _, ok := h.Token(""); ok {
+		t.Error("token issued to player without XUID")
+	}
+}
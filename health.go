@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// healthStarting is the health of a server that is still within its start period.
+	healthStarting = "starting"
+	// healthHealthy is the health of a server that responded to its last ping, or has failed fewer pings in a
+	// row than the configured threshold.
+	healthHealthy = "healthy"
+	// healthUnhealthy is the health of a server that has failed to respond to too many pings in a row.
+	healthUnhealthy = "unhealthy"
+	// healthPaused is the health of a server that was paused because it was idle. Paused servers can't respond
+	// to pings, so they are not checked.
+	healthPaused = "paused"
+)
+
+// HealthChecker periodically pings the servers of pull requests over RakNet to check if they are still
+// responsive. Servers that fail too many pings in a row are marked unhealthy and, if configured, restarted.
+type HealthChecker struct {
+	backend Backend
+
+	interval    time.Duration
+	startPeriod time.Duration
+	failures    int
+	autoRestart bool
+
+	mu      sync.Mutex
+	health  map[string]string
+	failed  map[string]int
+	latency map[string]serverLatency
+	players map[string]int
+}
+
+// NewHealthChecker creates a new HealthChecker using the health check configuration passed.
+func NewHealthChecker(backend Backend, conf Config) *HealthChecker {
+	return &HealthChecker{
+		backend: backend,
+
+		interval:    conf.Health.Interval,
+		startPeriod: conf.Health.StartPeriod,
+		failures:    conf.Health.Failures,
+		autoRestart: conf.Health.AutoRestart,
+
+		health:  make(map[string]string),
+		failed:  make(map[string]int),
+		latency: make(map[string]serverLatency),
+		players: make(map[string]int),
+	}
+}
+
+// Job returns the Job checking the health of all running servers every interval.
+func (h *HealthChecker) Job() Job {
+	return Job{Name: "health", Interval: h.interval, Run: h.check}
+}
+
+// Health returns the health of the server of the given PR. If the server is not running or has not been
+// checked yet, an empty string is returned.
+func (h *HealthChecker) Health(pr string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.health[pr]
+}
+
+// serverLatency is the latency of the server of a pull request, as measured by the time its health checks took.
+// Because the pings are sent from prmanager, it reflects the load of the server and its host, rather than the
+// connection of any player.
+type serverLatency struct {
+	// RTT is the round-trip time of the last ping.
+	RTT time.Duration
+	// Jitter is the smoothed variation between the round-trip times of consecutive pings, computed as
+	// described in RFC 3550.
+	Jitter time.Duration
+}
+
+// Latency returns the latency of the server of the given PR, or false if it has not responded to a ping yet.
+func (h *HealthChecker) Latency(pr string) (serverLatency, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l, ok := h.latency[pr]
+	return l, ok
+}
+
+// Players returns the number of players online on the server of the given PR as of its last health check, or
+// false if it has not responded to a ping yet.
+func (h *HealthChecker) Players(pr string) (int, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	online, ok := h.players[pr]
+	return online, ok
+}
+
+// record records the round-trip time rtt of a ping to the server of the given PR. h.mu must be held.
+func (h *HealthChecker) record(pr string, rtt time.Duration) {
+	l, ok := h.latency[pr]
+	if ok {
+		l.Jitter += ((rtt - l.RTT).Abs() - l.Jitter) / 16
+	}
+	l.RTT = rtt
+	h.latency[pr] = l
+}
+
+// check pings every running server once and updates their health accordingly.
+func (h *HealthChecker) check(ctx context.Context) error {
+	listCtx, cancel := context.WithTimeout(ctx, apiTimeout)
+	servers, err := h.backend.Servers(listCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("list servers: %w", err)
+	}
+
+	health := make(map[string]string, len(servers))
+	var unhealthy []string
+	for _, srv := range servers {
+		if srv.Paused {
+			health[srv.PR] = healthPaused
+			continue
+		}
+		if time.Since(srv.Started) < h.startPeriod {
+			health[srv.PR] = healthStarting
+			continue
+		}
+		start := time.Now()
+		online, err := pingServer(fmt.Sprintf("%s:%d", srv.PrivateAddress, srv.Port), time.Second*5)
+		rtt := time.Since(start)
+
+		h.mu.Lock()
+		if err != nil {
+			h.failed[srv.PR]++
+			slog.Debug("Server failed health check", slog.String("pr", srv.PR), slog.Int("failures", h.failed[srv.PR]), slog.Any("error", err))
+		} else {
+			delete(h.failed, srv.PR)
+			h.record(srv.PR, rtt)
+			h.players[srv.PR] = online
+		}
+		if h.failed[srv.PR] >= h.failures {
+			health[srv.PR] = healthUnhealthy
+			unhealthy = append(unhealthy, srv.PR)
+		} else {
+			health[srv.PR] = healthHealthy
+		}
+		h.mu.Unlock()
+	}
+
+	h.mu.Lock()
+	for pr := range h.failed {
+		if _, ok := health[pr]; !ok {
+			// The server is no longer running, so there's no need to keep track of its failures.
+			delete(h.failed, pr)
+		}
+	}
+	for pr := range h.latency {
+		if health[pr] != healthHealthy && health[pr] != healthUnhealthy {
+			// The latency of servers that are no longer checked would be outdated.
+			delete(h.latency, pr)
+			delete(h.players, pr)
+		}
+	}
+	h.health = health
+	h.mu.Unlock()
+
+	for _, pr := range unhealthy {
+		slog.Warn("Server is unhealthy", slog.String("pr", pr))
+		if h.autoRestart {
+			h.restart(ctx, pr)
+		}
+	}
+	return nil
+}
+
+// restart restarts the unhealthy server of the given PR.
+func (h *HealthChecker) restart(ctx context.Context, pr string) {
+	slog.Info("Restarting unhealthy server", slog.String("pr", pr))
+	// Stopping is bounded by the grace period, so it only needs to be cancelled when prmanager shuts down.
+	if _, err := h.backend.StopServer(ctx, pr); err != nil {
+		slog.Error("Failed to stop unhealthy server", slog.String("pr", pr), slog.Any("error", err))
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, startTimeout)
+	defer cancel()
+	if _, _, _, err := h.backend.StartServer(ctx, pr); err != nil {
+		slog.Error("Failed to restart unhealthy server", slog.String("pr", pr), slog.Any("error", err))
+		return
+	}
+	h.mu.Lock()
+	delete(h.failed, pr)
+	h.health[pr] = healthStarting
+	h.mu.Unlock()
+}
+
+var (
+	serverRTTDesc = prometheus.NewDesc(
+		"prmanager_server_ping_rtt_seconds",
+		"Round-trip time of the last health check ping to the server of a pull request.",
+		[]string{"pr"}, nil,
+	)
+	serverJitterDesc = prometheus.NewDesc(
+		"prmanager_server_ping_jitter_seconds",
+		"Smoothed variation of the round-trip times of health check pings to the server of a pull request.",
+		[]string{"pr"}, nil,
+	)
+)
+
+// Describe ...
+func (h *HealthChecker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- serverRTTDesc
+	ch <- serverJitterDesc
+}
+
+// Collect ...
+func (h *HealthChecker) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for pr, l := range h.latency {
+		ch <- prometheus.MustNewConstMetric(serverRTTDesc, prometheus.GaugeValue, l.RTT.Seconds(), pr)
+		ch <- prometheus.MustNewConstMetric(serverJitterDesc, prometheus.GaugeValue, l.Jitter.Seconds(), pr)
+	}
+}
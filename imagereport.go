@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// maxLayerCommand is the length the instruction a layer was created by is cut off at in an ImageReport.
+const maxLayerCommand = 200
+
+// ImageReport is the size of the image of a pull request and the layers it is made up of, recorded after every
+// build so that an image growing because of accidentally included assets is noticed.
+type ImageReport struct {
+	// Size is the size of the image in bytes, including its base image.
+	Size int64 `json:"size"`
+	// Layers are the layers of the image that take up space, from the base image up.
+	Layers []ImageLayer `json:"layers"`
+}
+
+// ImageLayer is a layer of an image.
+type ImageLayer struct {
+	// CreatedBy is the instruction that created the layer, such as COPY dragonfly /dragonfly.
+	CreatedBy string `json:"created_by"`
+	Size      int64  `json:"size"`
+}
+
+// ImageReport returns the size and layers of the image of the given PR.
+func (d *Docker) ImageReport(ctx context.Context, pr string) (ImageReport, error) {
+	img, err := d.client.ImageInspect(ctx, "pr-"+pr)
+	if err != nil {
+		return ImageReport{}, fmt.Errorf("inspect image: %w", dockerError(err))
+	}
+	history, err := d.client.ImageHistory(ctx, "pr-"+pr)
+	if err != nil {
+		return ImageReport{}, fmt.Errorf("image history: %w", dockerError(err))
+	}
+	report := ImageReport{Size: img.Size}
+	// The history lists the most recent layer first.
+	for _, item := range slices.Backward(history) {
+		if item.Size == 0 {
+			continue
+		}
+		command := strings.TrimSpace(strings.TrimPrefix(item.CreatedBy, "/bin/sh -c #(nop)"))
+		if len(command) > maxLayerCommand {
+			command = command[:maxLayerCommand] + "…"
+		}
+		report.Layers = append(report.Layers, ImageLayer{CreatedBy: command, Size: item.Size})
+	}
+	return report, nil
+}
+
+// ImageReport returns the size and layers of the image of the given PR on the first reachable host. Images
+// are built from the same binary and Dockerfile on every host, so their size only differs by their base image.
+func (c *Cluster) ImageReport(ctx context.Context, pr string) (ImageReport, error) {
+	var err error
+	for _, d := range c.hosts {
+		if err = c.reachable(d); err == nil {
+			return d.ImageReport(ctx, pr)
+		}
+	}
+	return ImageReport{}, err
+}
+
+// imageReportingBackend is a Backend that records an ImageReport of the image of a pull request after every
+// build, which is included in its build history, and warns if the image grew by more than Images.MaxGrowth
+// compared to the image built before it.
+type imageReportingBackend struct {
+	Backend
+	state  *State
+	conf   Config
+	events *EventBus
+}
+
+// BuildImage ...
+func (b imageReportingBackend) BuildImage(ctx context.Context, pr string, deployment Deployment) error {
+	if err := b.Backend.BuildImage(ctx, pr, deployment); err != nil {
+		return err
+	}
+	report, reportErr := b.Backend.ImageReport(ctx, pr)
+	var previous ImageReport
+	var known bool
+	if err := b.state.Update(func(data *stateData) {
+		previous, known = data.Images[pr]
+		// A report that couldn't be made is forgotten, so that the report of an earlier image isn't recorded
+		// with this build.
+		if reportErr != nil {
+			delete(data.Images, pr)
+		} else {
+			data.Images[pr] = report
+		}
+	}); err != nil {
+		slog.WarnContext(ctx, "Failed to record image report", slog.String("pr", pr), slog.Any("error", err))
+	}
+	if reportErr != nil {
+		slog.WarnContext(ctx, "Failed to report image size", slog.String("pr", pr), slog.Any("error", reportErr))
+		return nil
+	}
+	if growth := b.conf.Images.MaxGrowth; known && growth > 0 && previous.Size > 0 && float64(report.Size) > float64(previous.Size)*(1+growth) {
+		slog.WarnContext(ctx, "Image grew unexpectedly", slog.String("pr", pr), slog.String("build", deployment.Build), slog.Int64("size", report.Size), slog.Int64("previous_size", previous.Size))
+		b.events.Publish(Event{Type: eventImageGrew, PR: pr, Build: deployment.Build})
+	}
+	return nil
+}
+
+// DeleteServer ...
+func (b imageReportingBackend) DeleteServer(ctx context.Context, pr string) {
+	b.Backend.DeleteServer(ctx, pr)
+	if err := b.state.Update(func(data *stateData) {
+		delete(data.Images, pr)
+	}); err != nil {
+		slog.WarnContext(ctx, "Failed to remove image report", slog.String("pr", pr), slog.Any("error", err))
+	}
+}
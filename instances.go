@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// maxInstances is the maximum number of instances a pull request may be uploaded with.
+const maxInstances = 8
+
+// instanceName returns the name of the sandbox the instance with the index passed runs in: a for the first, b for
+// the second and so on.
+func instanceName(i int) string {
+	return string(rune('a' + i))
+}
+
+// isInstanceName checks if the sandbox name passed is reserved for an instance.
+func isInstanceName(name string) bool {
+	return len(name) == 1 && name[0] >= 'a' && name[0] < 'a'+maxInstances
+}
+
+// instances returns the IDs of the sandboxes of the instances of the given PR that exist.
+func instances(pr string) []string {
+	if basePullRequest(pr) != pr {
+		return nil
+	}
+	var ids []string
+	for i := range maxInstances {
+		if id := sandboxID(pr, instanceName(i)); pullRequestExists(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// deployInstances deploys the instances of the deployment passed after its image was built: additional servers
+// of the PR running the same build, for features such as transfers that need more than one server to test.
+// Every instance is a sandbox of the PR, joined at <pr>-a, <pr>-b and so on, that starts off with a copy of the
+// world of the PR and keeps its own world across uploads. previous is the number of instances the previous
+// deployment of the PR was recorded with: instances beyond deployment.Instances among those are deleted, while
+// sandboxes holding the name of an instance that weren't created as one, such as those cloned before the names
+// were reserved, are left alone and an error satisfying errors.Is(err, errSandboxExists) is returned.
+func (r *Router) deployInstances(ctx context.Context, deployment Deployment, previous int) error {
+	pr := deployment.PR
+	for i := range maxInstances {
+		id := sandboxID(pr, instanceName(i))
+		if i < deployment.Instances && i >= previous && pullRequestExists(id) {
+			return fmt.Errorf("%w: sandbox %s was not created as an instance", errSandboxExists, id)
+		}
+		if i >= deployment.Instances {
+			if i < previous && pullRequestExists(id) {
+				slog.InfoContext(ctx, "Deleting instance", slog.String("pr", pr), slog.String("instance", id))
+				deletePullRequest(ctx, r.backend, r.backups, id)
+			}
+			continue
+		}
+		if err := prepareInstance(ctx, r.backend, pr, id); err != nil {
+			return fmt.Errorf("prepare instance %s: %w", id, err)
+		}
+		instance := deployment
+		instance.PR, instance.Instances = id, 0
+		done := r.trackBuild(id)
+		err := r.backend.BuildImage(ctx, id, instance)
+		done()
+		if err != nil {
+			return fmt.Errorf("build instance %s: %w", id, err)
+		}
+		// An instance of a PR that was deleted but not purged yet is deployed again along with it.
+		if err := r.purger.forget(id); err != nil {
+			slog.WarnContext(ctx, "Failed to forget deleted instance", slog.String("instance", id), slog.Any("error", err))
+		}
+	}
+	return nil
+}
+
+// prepareInstance creates the sandbox of the instance with the ID passed of the given PR if it doesn't exist yet,
+// cloning the PR into it, or otherwise replaces its binary and stack with those of the PR, keeping its world.
+func prepareInstance(ctx context.Context, backend Backend, pr, id string) error {
+	if err := os.Mkdir(worldDir(id), 0755); err == nil {
+		if err := cloneFiles(ctx, backend, pr, id); err != nil {
+			removeClone(id)
+			return err
+		}
+		return nil
+	} else if !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("create world directory: %w", err)
+	}
+	if err := copyFile(binaryPath(pr), binaryPath(id), 0755); err != nil {
+		return fmt.Errorf("copy binary: %w", err)
+	}
+	if !hasStack(pr) {
+		_ = os.RemoveAll(filepath.Dir(stackPath(id)))
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(stackPath(id)), 0755); err != nil {
+		return fmt.Errorf("create stack directory: %w", err)
+	}
+	if err := copyFile(stackPath(pr), stackPath(id), 0644); err != nil {
+		return fmt.Errorf("copy compose file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestDeployInstancesLeavesSandboxes(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ctx := context.Background()
+	// A sandbox named like an instance, cloned before the names of instances were reserved.
+	if err := os.MkdirAll(worldDir("1-a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	r := &Router{backend: NewFakeBackend("127.0.0.1", 19132, false)}
+
+	// Deploying without instances doesn't delete it, as the previous deployment had no instances.
+	if err := r.deployInstances(ctx, Deployment{PR: "1"}, 0); err != nil {
+		t.Fatalf("deploy without instances: %v", err)
+	}
+	if !pullRequestExists("1-a") {
+		t.Fatal("sandbox not created as instance deleted")
+	}
+	// Deploying with instances doesn't take it over either.
+	if err := r.deployInstances(ctx, Deployment{PR: "1", Instances: 1}, 0); !errors.Is(err, errSandboxExists) {
+		t.Errorf("deploy with instances = %v, want %v", err, errSandboxExists)
+	}
+	if !pullRequestExists("1-a") {
+		t.Error("sandbox not created as instance deleted")
+	}
+}
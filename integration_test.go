@@ -0,0 +1,333 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sandertv/go-raknet"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+)
+
+// The integration test is only compiled with the integration build tag, as it needs a Docker daemon and a
+// server binary, which -binary must point to:
+//
+//	go test -tags integration -run TestIntegration . -args -binary ./dragonfly
+var (
+	integrationBinary     = flag.String("binary", "", "path of the server binary to deploy, which must listen on port 19132")
+	integrationDockerfile = flag.String("dockerfile", "Dockerfile", "path of the Dockerfile to build the image of the PR from")
+	integrationDryRun     = flag.Bool("dry-run", false, "simulate Docker operations, only checking the API and routing")
+)
+
+// integrationPR is the number of the pull request deployed by the integration test. The client joins it on
+// 127.0.0.254, as the address players join with must resolve and the Docker host may not have DNS set up.
+const integrationPR = "254"
+
+// TestIntegration runs prmanager in a temporary working directory against the Docker daemon of the local host
+// (or the one DOCKER_HOST points to), uploads the binary passed as a PR through the API, joins the PR with an
+// unauthenticated client and checks that the client is transferred to the server of the PR, which must then
+// respond to pings. The PR is deleted afterwards.
+func TestIntegration(t *testing.T) {
+	if *integrationBinary == "" {
+		t.Skip("-binary is not set")
+	}
+	// Paths are resolved before moving to the temporary working directory.
+	binaryPath, err := filepath.Abs(*integrationBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dockerfilePath, err := filepath.Abs(*integrationDockerfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+	if err := setupDataLayout(); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := DefaultConfig()
+	conf.Hosts[0].PublicAddress = "127.0.0.1"
+	conf.Profiles[0].Dockerfile = dockerfilePath
+	conf.Routing.PullRequests = `^127\.0\.0\.(\d+)$`
+	conf.DryRun.Enabled = *integrationDryRun
+	// The integration PR doesn't exist on GitHub.
+	conf.GitHub.Repository = ""
+	// The client joining the PR doesn't log in with Xbox Live.
+	conf.Authentication.Required = false
+
+	h, err := newIntegrationHarness(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.close)
+
+	// The steps build on each other, so the test stops at the first one failing.
+	ctx := t.Context()
+	steps := []struct {
+		name string
+		run  func(ctx context.Context) error
+	}{
+		{name: "upload", run: func(ctx context.Context) error { return h.upload(ctx, binaryPath) }},
+		{name: "join", run: h.join},
+		{name: "delete", run: h.delete},
+	}
+	for _, step := range steps {
+		ok := t.Run(step.name, func(t *testing.T) {
+			if err := step.run(ctx); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if !ok {
+			t.FailNow()
+		}
+	}
+}
+
+// integrationHarness runs the Router and Listener of prmanager on random local ports for the integration
+// test.
+type integrationHarness struct {
+	conf     Config
+	backend  Backend
+	cluster  *Cluster
+	router   *Router
+	listener *Listener
+
+	apiAddr, minecraftAddr string
+	apiKey                 string
+}
+
+// newIntegrationHarness sets up the Backend, Router and Listener for the configuration passed and starts
+// serving API requests and players. Containers of other PRs on the host are left alone.
+func newIntegrationHarness(conf Config) (*integrationHarness, error) {
+	state, err := OpenState(statePath, conf)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := NewSecretStore(state)
+	if err != nil {
+		return nil, err
+	}
+	git, err := NewGitCredentials(conf)
+	if err != nil {
+		return nil, err
+	}
+	h := &integrationHarness{conf: conf, apiKey: newRequestID()}
+	var puller imagePuller
+	if conf.DryRun.Enabled {
+		fake := NewFakeBackend(conf.DryRun.Address, conf.DryRun.Port, true)
+		h.backend, puller = fake, fake
+	} else {
+		if h.cluster, err = newCluster(conf, state, secrets, git); err != nil {
+			return nil, err
+		}
+		h.backend, puller = h.cluster, h.cluster
+	}
+	backups, err := NewBackupManager(h.backend, state, conf)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := NewRoutingTable(conf.Routing, state)
+	if err != nil {
+		return nil, err
+	}
+	handoffs, err := NewHandoffs(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	apiListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		_ = apiListener.Close()
+		return nil, err
+	}
+	h.apiAddr, h.minecraftAddr = apiListener.Addr().String(), conn.LocalAddr().String()
+
+	events := NewEventBus()
+	health, purger := NewHealthChecker(h.backend, conf), NewPurger(h.backend, backups, state, conf)
+	h.listener = NewListener(h.backend, conf, state, routes, events, handoffs)
+	h.router = NewRouter(conf, RouterDeps{
+		Backend:   h.backend,
+		State:     state,
+		Health:    health,
+		Backups:   backups,
+		Prereqs:   NewPrerequisites(puller, conf),
+		Disk:      NewDiskGuard(conf, NewNotifier(conf)),
+		Routes:    routes,
+		Envs:      NewEnvironments(h.backend, conf),
+		Secrets:   secrets,
+		Scheduler: NewScheduler(conf),
+		Events:    events,
+		Purger:    purger,
+		Drainer:   NewDrainer(h.backend, purger, health, state, conf),
+		Handoffs:  handoffs,
+		Git:       git,
+
+		APIKey: h.apiKey,
+	})
+	go func() {
+		if err := h.router.Run(apiListener); err != nil {
+			slog.Error("API server failed", slog.Any("error", err))
+		}
+	}()
+	go func() {
+		if err := h.listener.Listen(conn); err != nil {
+			slog.Error("Listener failed", slog.Any("error", err))
+		}
+	}()
+	return h, nil
+}
+
+// upload uploads the binary at the path passed as the integration PR, which builds its image.
+func (h *integrationHarness) upload(ctx context.Context, path string) error {
+	binary, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	_ = form.WriteField("pr", integrationPR)
+	_ = form.WriteField("commit", "integration")
+	w, _ := form.CreateFormFile("binary", "dragonfly")
+	_, _ = w.Write(binary)
+	_ = form.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+h.apiAddr+"/pullrequest", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return h.do(req, http.StatusCreated)
+}
+
+// join joins the integration PR with an unauthenticated client and checks that the client is transferred to
+// the server of the PR. Unless in dry-run mode, the server must then respond to pings.
+func (h *integrationHarness) join(ctx context.Context) error {
+	conn, err := minecraft.Dialer{}.DialContextNetwork(ctx, redirectNetwork{addr: h.minecraftAddr}, "127.0.0."+integrationPR+":19132")
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.DoSpawnContext(ctx); err != nil {
+		return fmt.Errorf("spawn: %w", err)
+	}
+
+	var transfer *packet.Transfer
+	for transfer == nil {
+		pk, err := conn.ReadPacket()
+		if err != nil {
+			return fmt.Errorf("read packet before transfer: %w", err)
+		}
+		transfer, _ = pk.(*packet.Transfer)
+	}
+	addr, port, found, err := h.backend.ServerAddress(ctx, integrationPR)
+	if err != nil {
+		return fmt.Errorf("get server address: %w", err)
+	} else if !found {
+		return errors.New("server is not running after transfer")
+	} else if transfer.Address != addr || transfer.Port != port {
+		return fmt.Errorf("transferred to %s:%d rather than %s:%d", transfer.Address, transfer.Port, addr, port)
+	}
+	slog.Info("Transferred to server of PR", slog.String("address", transfer.Address), slog.Int("port", int(transfer.Port)))
+	if h.conf.DryRun.Enabled {
+		return nil
+	}
+
+	// The server may still be starting up when the client is transferred.
+	target := fmt.Sprintf("%s:%d", transfer.Address, transfer.Port)
+	for {
+		if _, err = pingServer(target, time.Second); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("server never responded to pings: %w", err)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// delete purges the integration PR through the API, skipping the grace period, and checks that its server is
+// no longer running.
+func (h *integrationHarness) delete(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, "http://"+h.apiAddr+"/pullrequest/"+integrationPR+"?purge=true", nil)
+	if err != nil {
+		return err
+	}
+	if err := h.do(req, http.StatusNoContent); err != nil {
+		return err
+	}
+	if _, _, found, err := h.backend.ServerAddress(ctx, integrationPR); err != nil {
+		return fmt.Errorf("get server address: %w", err)
+	} else if found {
+		return errors.New("server is still running after delete")
+	}
+	return nil
+}
+
+// do sends the API request passed, returning an error if it is not answered with the status code passed.
+func (h *integrationHarness) do(req *http.Request, code int) error {
+	req.Header.Set("X-API-Key", h.apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != code {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: got status %d rather than %d: %s", req.Method, req.URL.Path, resp.StatusCode, code, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// close stops the Router and Listener and removes anything left behind by the integration PR, for example if
+// the test failed before deleting it.
+func (h *integrationHarness) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	h.listener.Close()
+	_ = h.router.Shutdown(ctx)
+	if h.cluster != nil {
+		h.cluster.DeleteServer(ctx, integrationPR)
+		h.cluster.Close()
+	}
+}
+
+// redirectNetwork is a minecraft.Network that dials and pings a fixed address over RakNet, regardless of the
+// address passed. It allows the client to join with the address of a PR, which is sent in its ClientData,
+// without that address resolving.
+type redirectNetwork struct {
+	addr string
+}
+
+// DialContext ...
+func (n redirectNetwork) DialContext(ctx context.Context, _ string) (net.Conn, error) {
+	return raknet.DialContext(ctx, n.addr)
+}
+
+// PingContext ...
+func (n redirectNetwork) PingContext(ctx context.Context, _ string) ([]byte, error) {
+	return raknet.PingContext(ctx, n.addr)
+}
+
+// Listen ...
+func (n redirectNetwork) Listen(address string) (minecraft.NetworkListener, error) {
+	return raknet.Listen(address)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The files prmanager keeps on disk are laid out in its data directory, which is PRMANAGER_DIR or the working
+// directory, as follows, where <pr> is the ID of a PR:
+//
+//	config.toml                  the configuration
+//	state.json                   the state persisted across restarts
+//	worlds/pr-<pr>/              the world data of a PR, which exists for as long as the PR does
+//	worlds/pr-<pr>.img           the disk image mounted at the world directory, if disk images are used
+//	binaries/pr-<pr>             the binary of a PR
+//	artifacts/pr-<pr>/           the binaries kept of previous builds of a PR
+//	provenance/pr-<pr>.json      the provenance of the current image of a PR
+//	builds/pr-<pr>/              the build context of the image of a PR while it is built
+//	snapshots/pr-<pr>/           the snapshots of the world of a PR
+//	stacks/pr-<pr>/compose.yml   the auxiliary services of a PR
+//	logs/pr-<pr>/server.log      the logs of the server of a PR
+//
+// Before the worlds directory was introduced, world directories and disk images were kept in the data directory
+// itself. migrateDataLayout moves them to where they are kept now, which setupDataLayout does on startup.
+
+// statePath is the path of the file the State is persisted in.
+const statePath = "state.json"
+
+// worldDir returns the directory holding the world data of the given PR.
+func worldDir(pr string) string {
+	return filepath.Join("worlds", "pr-"+pr)
+}
+
+// diskImagePath returns the path of the disk image mounted at the world directory of the given PR.
+func diskImagePath(pr string) string {
+	return worldDir(pr) + ".img"
+}
+
+// localWorld returns an error satisfying errors.Is(err, errWorldNotLocal) if the given PR is scheduled on a
+// remote host, whose servers keep their world in a named volume on the host rather than in the world directory.
+func localWorld(state *State, conf Config, pr string) error {
+	var name string
+	state.View(func(data *stateData) {
+		name = data.Hosts[pr]
+	})
+	for _, host := range conf.Hosts {
+		if host.Name == name && host.Address != "" {
+			return fmt.Errorf("%w: PR is scheduled on host %s", errWorldNotLocal, name)
+		}
+	}
+	return nil
+}
+
+// binaryPath returns the path of the binary uploaded for the given PR.
+func binaryPath(pr string) string {
+	return filepath.Join("binaries", "pr-"+pr)
+}
+
+// legacyWorlds returns the world directories and disk images of PRs kept in the data directory itself, as in
+// versions of prmanager preceding the worlds directory.
+func legacyWorlds() []string {
+	var paths []string
+	matches, _ := filepath.Glob("pr-*")
+	for _, match := range matches {
+		if _, ok := parsePullRequestName(strings.TrimSuffix(match, ".img")); !ok {
+			continue
+		}
+		if info, err := os.Stat(match); err == nil && (info.IsDir() || strings.HasSuffix(match, ".img")) {
+			paths = append(paths, match)
+		}
+	}
+	return paths
+}
+
+// setupDataLayout creates the directories of the layout that files are written to directly, such as the worlds
+// directory. Worlds still in the layout of a previous version are migrated first, as PRs would otherwise be
+// considered deleted and their files removed.
+func setupDataLayout() error {
+	moved, err := migrateDataLayout()
+	if err != nil {
+		return fmt.Errorf("migrate worlds to the worlds directory: %w", err)
+	} else if moved > 0 {
+		slog.Info("Moved worlds in the layout of a previous version to the worlds directory", slog.Int("paths", moved))
+	}
+	for _, dir := range []string{"worlds", "binaries"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("create %s directory: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// migrateDataLayout moves the world directories and disk images kept in the data directory itself into the
+// worlds directory, unmounting disk images first. It returns the number of paths moved. The servers of PRs must
+// not be running, as they would lose their world data.
+func migrateDataLayout() (int, error) {
+	paths := legacyWorlds()
+	if len(paths) == 0 {
+		return 0, nil
+	}
+	if err := os.MkdirAll("worlds", 0755); err != nil {
+		return 0, fmt.Errorf("create worlds directory: %w", err)
+	}
+	moved := 0
+	for _, path := range paths {
+		if strayProvenance(path) {
+			// A bug in a previous version wrote the provenance of images to a directory of this name, which
+			// holds nothing else.
+			if err := os.RemoveAll(path); err != nil {
+				return moved, fmt.Errorf("remove %s: %w", path, err)
+			}
+			continue
+		}
+		to := filepath.Join("worlds", path)
+		if _, err := os.Stat(to); err == nil {
+			return moved, fmt.Errorf("move %s: %s already exists", path, to)
+		}
+		// A directory a disk image is mounted at can't be moved, so the image is unmounted first. It is
+		// mounted again at its new location when needed.
+		if !strings.HasSuffix(path, ".img") && exec.Command("mountpoint", "-q", path).Run() == nil {
+			if out, err := exec.Command("umount", path).CombinedOutput(); err != nil {
+				return moved, fmt.Errorf("unmount %s: %w: %s", path, err, strings.TrimSpace(string(out)))
+			}
+		}
+		if err := os.Rename(path, to); err != nil {
+			return moved, fmt.Errorf("move world: %w", err)
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// strayProvenance checks if the path passed is a directory holding only a provenance file.
+func strayProvenance(path string) bool {
+	entries, err := os.ReadDir(path)
+	return err == nil && len(entries) == 1 && entries[0].Name() == provenanceFile
+}
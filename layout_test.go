@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetupDataLayoutMigrates(t *testing.T) {
+	t.Chdir(t.TempDir())
+	files := map[string]string{
+		"pr-1/level.dat":         "world",
+		"pr-2/" + provenanceFile: "{}",
+		"pr-3.img":               "image",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := setupDataLayout(); err != nil {
+		t.Fatalf("setup data layout: %v", err)
+	}
+	for _, path := range []string{"worlds/pr-1/level.dat", "worlds/pr-3.img", "binaries"} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s missing after migration: %v", path, err)
+		}
+	}
+	// Directories only holding a provenance file are left over by a bug and removed rather than moved.
+	for _, path := range []string{"pr-1", "pr-2", "pr-3.img", "worlds/pr-2"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after migration", path)
+		}
+	}
+	if err := setupDataLayout(); err != nil {
+		t.Fatalf("setup migrated data layout: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Lifecycle coordinates the shutdown of the subsystems of prmanager. Subsystems register a shutdown hook when
+// they are started, and the hooks are run in reverse order of registration when prmanager shuts down, so that
+// a subsystem is only shut down after everything started after it, which may depend on it.
+type Lifecycle struct {
+	timeout time.Duration
+	hooks   []shutdownHook
+}
+
+// shutdownHook is a function registered to run when prmanager shuts down.
+type shutdownHook struct {
+	name string
+	f    func(ctx context.Context) error
+}
+
+// NewLifecycle creates a new Lifecycle that gives all shutdown hooks together the timeout passed to complete.
+func NewLifecycle(timeout time.Duration) *Lifecycle {
+	return &Lifecycle{timeout: timeout}
+}
+
+// OnShutdown registers a function to run when prmanager shuts down. The context passed to it expires when the
+// shutdown deadline is reached.
+func (l *Lifecycle) OnShutdown(name string, f func(ctx context.Context) error) {
+	l.hooks = append(l.hooks, shutdownHook{name: name, f: f})
+}
+
+// Shutdown runs all shutdown hooks in reverse order of registration. It returns an error if the hooks did not
+// complete within the timeout, in which case the hooks still running are abandoned.
+func (l *Lifecycle) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := len(l.hooks) - 1; i >= 0; i-- {
+			hook := l.hooks[i]
+			slog.Info("Shutting down", slog.String("subsystem", hook.name))
+			if err := hook.f(ctx); err != nil {
+				slog.Error("Failed to shut down", slog.String("subsystem", hook.name), slog.Any("error", err))
+			}
+		}
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("shutdown did not complete within %v", l.timeout)
+	}
+}
+
+// closer adapts a Close method to a shutdown hook.
+func closer(f func()) func(context.Context) error {
+	return func(context.Context) error {
+		f()
+		return nil
+	}
+}
@@ -1,174 +1,669 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"net"
 	"os"
-	"regexp"
-	"strings"
+	"slices"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/go-gl/mathgl/mgl32"
 	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
 	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
-	"github.com/sandertv/gophertunnel/minecraft/text"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Listener wraps a minecraft.Listener that accepts connections before transferring them to a new destination
 // server based on the address that was used to join.
 type Listener struct {
-	docker   *Docker
+	backend  Backend
+	conf     Config
+	state    *State
+	routes   *RoutingTable
+	events   *EventBus
+	handoffs *Handoffs
+	messages *Messages
+	github   *gitHubClient
+	logins   *loginGuard
 	listener *minecraft.Listener
 
+	mu              sync.Mutex
 	lastConnections map[string]time.Time
-	killChan        chan struct{}
+	paused          map[string]bool
+	// pausing holds a channel for every PR whose server is being paused or resumed, which is closed once done.
+	pausing  map[string]chan struct{}
+	sessions map[*minecraft.Conn]session
+	// startAverage is the moving average of the time servers took to start.
+	startAverage time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// session is a connection that is being handled by the Listener, before it is transferred.
+type session struct {
+	XUID          string    `json:"xuid"`
+	DisplayName   string    `json:"display_name"`
+	ServerAddress string    `json:"server_address"`
+	Accepted      time.Time `json:"accepted"`
+	// Authenticated specifies if the identity of the player was verified with Xbox Live, which is the case if
+	// Authentication.Required is set and the player has an XUID. If not, their XUID and name are as the client
+	// claims them to be.
+	Authenticated bool `json:"authenticated"`
 }
 
-// NewListener creates a new Listener using the provided Docker instance.
-func NewListener(docker *Docker) *Listener {
+// NewListener creates a new Listener that starts servers using the provided Backend and routes players using
+// the RoutingTable passed. The time players last joined every PR is recorded in the State passed, and joins are
+// published on the EventBus passed. Players transferred are issued handoff tokens by the Handoffs passed.
+func NewListener(backend Backend, conf Config, state *State, routes *RoutingTable, events *EventBus, handoffs *Handoffs) *Listener {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Listener{
-		docker: docker,
+		backend:  backend,
+		conf:     conf,
+		state:    state,
+		routes:   routes,
+		events:   events,
+		handoffs: handoffs,
+
+		messages: NewMessages(conf.Messages),
+		github:   newGitHubClient(conf),
+		logins:   newLoginGuard(conf.Handshake.LoginTimeout),
 
 		lastConnections: make(map[string]time.Time),
+		paused:          make(map[string]bool),
+		pausing:         make(map[string]chan struct{}),
+		sessions:        make(map[*minecraft.Conn]session),
+
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
-// Listen starts listening for clients to accept and handle once they have joined.
-func (l *Listener) Listen(addr string) error {
-	slog.Info("Starting Minecraft listener", "addr", addr)
-	listener, err := minecraft.Listen("raknet", addr)
+// Listen starts accepting clients on the packet connection passed and handles them once they have joined. An
+// error is returned if the listener could not be started. If the listener closes without Close being called,
+// for example because the socket was closed when its network interface went down, the address of the packet
+// connection is bound again, backing off between attempts, until it succeeds or Close is called.
+func (l *Listener) Listen(conn net.PacketConn) error {
+	addr := conn.LocalAddr().String()
+	listener, err := l.listen(conn)
 	if err != nil {
 		return err
 	}
+	var backoff time.Duration
+	for {
+		started := time.Now()
+		err := l.accept(listener)
+		if l.ctx.Err() != nil {
+			return nil
+		}
+		if time.Since(started) > maxAcceptBackoff {
+			// The listener ran fine for a while, so it is bound again right away.
+			backoff = 0
+		}
+		slog.Error("Minecraft listener closed unexpectedly, binding again", slog.String("addr", addr), slog.Any("error", err))
+		for {
+			if !l.sleep(backoff) {
+				return nil
+			}
+			backoff = nextBackoff(backoff)
+			if listener, err = l.rebind(addr); err == nil {
+				break
+			}
+			slog.Error("Failed to bind Minecraft listener", slog.String("addr", addr), slog.Duration("backoff", backoff), slog.Any("error", err))
+		}
+	}
+}
+
+// rebind binds the UDP address passed again and starts a minecraft.Listener on it.
+func (l *Listener) rebind(addr string) (*minecraft.Listener, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := l.listen(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// maxAcceptBackoff is the maximum time waited between attempts to accept connections or to bind the listener
+// again after failures.
+const maxAcceptBackoff = time.Second * 30
+
+// nextBackoff returns the time to wait after the next failure in a row, which doubles every time, starting
+// from a second, up to maxAcceptBackoff.
+func nextBackoff(backoff time.Duration) time.Duration {
+	return min(max(backoff*2, time.Second), maxAcceptBackoff)
+}
+
+// sleep waits for the duration passed, returning false if the Listener was closed in the meantime.
+func (l *Listener) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-l.ctx.Done():
+		return false
+	}
+}
+
+// listen starts a minecraft.Listener on the packet connection passed.
+func (l *Listener) listen(conn net.PacketConn) (*minecraft.Listener, error) {
+	slog.Info("Starting Minecraft listener", "addr", conn.LocalAddr(), "authentication_required", l.conf.Authentication.Required)
+	if !l.conf.Authentication.Required {
+		slog.Warn("Xbox Live authentication is disabled, the identity of players is not verified")
+	}
+	listener, err := minecraft.ListenConfig{
+		AuthenticationDisabled: !l.conf.Authentication.Required,
+		AcceptedProtocols:      acceptedProtocols(l.conf.Handshake.Protocols),
+	}.ListenNetwork(packetNetwork{conn: conn, logins: l.logins}, conn.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ctx.Err() != nil {
+		// Close was called while the listener was started.
+		_ = listener.Close()
+		return nil, net.ErrClosed
+	}
 	l.listener = listener
+	return listener, nil
+}
 
+// accept accepts connections from the minecraft.Listener passed and handles each of them in its own
+// goroutine, so that a player waiting for their server to start doesn't hold up others. Temporary errors are
+// retried with a backoff. The error that closed the listener is returned.
+func (l *Listener) accept(listener *minecraft.Listener) error {
+	var backoff time.Duration
 	for {
 		c, err := listener.Accept()
 		if err != nil {
-			if l.listener == nil {
-				return nil
+			var netErr net.Error
+			if errors.Is(err, net.ErrClosed) || !errors.As(err, &netErr) || !netErr.Timeout() {
+				_ = listener.Close()
+				return err
+			}
+			backoff = nextBackoff(backoff)
+			slog.Warn("Failed to accept connection", slog.Duration("backoff", backoff), slog.Any("error", err))
+			if !l.sleep(backoff) {
+				return net.ErrClosed
 			}
-			fmt.Println("Error accepting connection:", err)
 			continue
 		}
-		l.handleConnection(c.(*minecraft.Conn))
+		backoff = 0
+		l.logins.done(c.RemoteAddr())
+		go l.handleConnection(c.(*minecraft.Conn))
 	}
 }
 
 // handleConnection handles a new connection to the Listener. It reads the client's server address and
 // determines the correct port to redirect the client to.
 func (l *Listener) handleConnection(c *minecraft.Conn) {
-	logger := slog.Default().With(slog.Group(
+	id := newRequestID()
+	// The identity of a player is only verified if they logged in with Xbox Live, which gives them an XUID.
+	authenticated := l.conf.Authentication.Required && c.IdentityData().XUID != ""
+	logger := slog.Default().With(requestIDAttr(id), slog.Group(
 		"connection",
 		slog.String("xuid", c.IdentityData().XUID),
 		slog.String("identity", c.IdentityData().Identity),
 		slog.String("display_name", c.IdentityData().DisplayName),
 		slog.String("server_address", c.ClientData().ServerAddress),
+		slog.Int("protocol", int(c.Proto().ID())),
+		slog.Bool("authenticated", authenticated),
 	))
 	logger.Info("Accepted connection")
+	ctx, span := startSpan(withRequestID(l.ctx, id), "handle connection", "", attribute.String("server_address", c.ClientData().ServerAddress), attribute.String("request_id", id))
+	defer span.End()
+	accepted := time.Now()
+	l.mu.Lock()
+	l.sessions[c] = session{
+		XUID:          c.IdentityData().XUID,
+		Authenticated: authenticated,
+		DisplayName:   c.IdentityData().DisplayName,
+		ServerAddress: c.ClientData().ServerAddress,
+		Accepted:      accepted,
+	}
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		delete(l.sessions, c)
+		l.mu.Unlock()
+	}()
 
-	// Although it takes some time, we need to let the client fully connect before we can transfer them.
-	err := c.StartGame(minecraft.GameData{})
+	// Although it takes some time, we need to let the client fully connect before we can transfer them, as
+	// clients ignore transfers until they spawned.
+	_, startGameSpan := startSpan(ctx, "start game", "")
+	err := spanError(startGameSpan, c.StartGameTimeout(l.stubWorld(c), l.conf.Handshake.StartGameTimeout))
+	startGameSpan.End()
+	observePhase(phaseStartGame, accepted)
 	if err != nil {
+		_ = spanError(span, err)
 		logger.Error("Failed to start game", slog.Any("error", err))
-		_ = l.listener.Disconnect(c, text.Colourf("<red>Failed to start game</red>"))
+		l.disconnect(c, msgStartGameFailed)
 		return
 	}
 
-	// Try and find the correct port to redirect the client to. It can either be a fixed port for the main and
-	// plots server, or it can be a pull request that is running on a random port.
-	var targetPort uint16
-	addr := strings.Split(c.ClientData().ServerAddress, ":")[0]
-	switch addr {
-	case "df-mc.dev", "188.166.78.44":
-		targetPort = 19133
-	case "plots.df-mc.dev":
-		targetPort = 19134
-	default:
-		// Assuming the address is in the format of a pull request, e.g., "123.df-mc.dev".
-		var regex = `^(\d+)\.df-mc\.dev$`
-		if matches := regexp.MustCompile(regex).FindStringSubmatch(addr); len(matches) > 1 {
-			// Check if the pull request exists on the host.
-			pr := matches[1]
-			if _, err = os.Stat("pr-" + pr); err != nil {
-				logger.Error("Pull request directory does not exist", slog.String("pr", pr), slog.Any("error", err))
-				_ = l.listener.Disconnect(c, text.Colourf("<red>Invalid or outdated pull request</red>"))
-				return
-			}
+	// Try and find the correct port to redirect the client to. It can either be a static route, such as the
+	// main and plots server, or it can be a pull request that is running on a random port.
+	addr := serverHost(c.ClientData().ServerAddress)
+	dest, ok := l.routes.Resolve(addr)
+	if !ok {
+		// Server address does not match any route.
+		logger.Info("Invalid server address", slog.String("address", addr))
+		l.fail(ctx, c, "", msgInvalidAddress)
+		return
+	}
+	if dest.Select {
+		// Players joining directly pick the pull request to join themselves.
+		pr, ok := l.selectPullRequest(ctx, c, logger)
+		if !ok {
+			return
+		}
+		dest = route{PR: pr}
+	}
+	targetAddress, targetPort := dest.Address, dest.Port
+	// startKind is the kind of start the transfer is recorded as in the metrics.
+	startKind := "static"
+	// routed is the PR the player is routed to, which may be its canary build rather than the one resolved.
+	var routed string
+	if pr := dest.PR; pr != "" {
+		// Some of the players joining a PR may be routed to its canary build instead.
+		if pr = l.canary(pr, c.IdentityData()); pr != dest.PR {
+			logger.Info("Routing player to canary build", slog.String("pr", dest.PR))
+		}
+		// Check if the pull request exists on the host.
+		span.SetAttributes(attribute.String("pr", pr))
+		if _, err = os.Stat(worldDir(pr)); err != nil {
+			logger.Error("Pull request directory does not exist", slog.String("pr", pr), slog.Any("error", err))
+			l.fail(ctx, c, "", msgInvalidPullRequest, "pr", pr)
+			return
+		}
+		// Deleted PRs are kept for a grace period, during which their servers must not be started.
+		if _, deleted := deletedAt(l.state, pr); deleted {
+			logger.Info("Pull request was deleted", slog.String("pr", pr))
+			l.fail(ctx, c, "", msgPullRequestDeleted, "pr", pr)
+			return
+		}
+		// PRs drained before they are deleted wait for the players online to leave, so no new players may join.
+		if _, draining := drainingUntil(l.state, pr); draining {
+			logger.Info("Pull request is being drained", slog.String("pr", pr))
+			l.fail(ctx, c, "", msgDraining, "pr", pr)
+			return
+		}
+		phaseStart := time.Now()
+		l.announce(ctx, c, pr)
+		observePhase(phaseMetadata, phaseStart)
+
+		// Starting the server is abandoned if it takes too long, the player leaves or prmanager shuts down.
+		ctx, cancel := context.WithTimeout(ctx, startTimeout)
+		defer cancel()
+		stop := context.AfterFunc(c.Context(), cancel)
+		defer stop()
 
-			// Try obtaining the server port for the pull request if the server is already running.
-			port, found, err := l.docker.ServerPort(pr)
+		// Try obtaining the server port for the pull request if the server is already running.
+		phaseStart = time.Now()
+		address, port, found, err := l.backend.ServerAddress(ctx, pr)
+		observePhase(phasePortLookup, phaseStart)
+		if err != nil {
+			_ = spanError(span, err)
+			logger.Error("Failed to get server port", slog.String("pr", pr), slog.Any("error", err))
+			l.fail(ctx, c, pr, playerMessage(err, msgGetPortFailed))
+			return
+		} else if !found {
+			// The server is not running, so we need to start it. The player is shown the progress meanwhile.
+			startKind = "cold"
+			start := time.Now()
+			progress := l.showProgress(c, pr, msgProgressStarting)
+			address, port, found, err = l.backend.StartServer(ctx, pr)
+			observePhase(phaseContainerStart, start)
 			if err != nil {
-				logger.Error("Failed to get server port", slog.String("pr", pr), slog.Any("error", err))
-				_ = l.listener.Disconnect(c, text.Colourf("<red>Failed to get server port</red>"))
+				progress.stop(false)
+				_ = spanError(span, err)
+				logger.Error("Failed to start server", slog.String("pr", pr), slog.Any("error", err))
+				l.fail(ctx, c, pr, playerMessage(err, msgStartFailed))
 				return
 			} else if !found {
-				// The server is not running, so we need to start it.
-				port, found, err = l.docker.StartServer(pr)
-				if err != nil {
-					logger.Error("Failed to start server", slog.String("pr", pr), slog.Any("error", err))
-					_ = l.listener.Disconnect(c, text.Colourf("<red>Failed to start server</red>"))
-					return
-				} else if !found {
-					logger.Info("Server not found for PR", slog.String("pr", pr))
-					_ = l.listener.Disconnect(c, text.Colourf("<red>Server not found for PR %s</red>", pr))
-					return
-				}
-				slog.Info("Started server for PR", slog.String("pr", pr), slog.Int("port", int(port)))
-			} else {
-				slog.Info("Found existing server for PR", slog.String("pr", pr), slog.Int("port", int(port)))
+				progress.stop(false)
+				logger.Info("Server not found for PR", slog.String("pr", pr))
+				l.fail(ctx, c, pr, msgServerNotFound)
+				return
+			}
+			// The container running doesn't mean the server accepts players yet, so the player is only
+			// transferred once it responds to pings. Servers simulated in dry-run mode never respond.
+			progress.set(msgProgressWaiting)
+			phaseStart = time.Now()
+			if !l.conf.DryRun.Enabled && !waitReady(ctx, privateAddress(l.conf, address), port) {
+				logger.Warn("Server did not respond to pings in time, transferring anyway", slog.String("pr", pr))
 			}
-			targetPort = port
-			l.lastConnections[pr] = time.Now()
+			observePhase(phaseReadinessWait, phaseStart)
+			progress.stop(true)
+			l.recordStart(time.Since(start))
+			logger.Info("Started server for PR", slog.String("pr", pr), slog.Int("port", int(port)))
 		} else {
-			// Server address is not in the expected format.
-			logger.Info("Invalid server address", slog.String("address", addr))
-			_ = l.listener.Disconnect(c, text.Colourf("<red>Invalid server address: %s</red>", addr))
-			return
+			startKind = "warm"
+			logger.Info("Found existing server for PR", slog.String("pr", pr), slog.Int("port", int(port)))
+			phaseStart = time.Now()
+			err := l.resume(ctx, pr)
+			observePhase(phaseResume, phaseStart)
+			if err != nil {
+				_ = spanError(span, err)
+				logger.Error("Failed to resume server", slog.String("pr", pr), slog.Any("error", err))
+				l.fail(ctx, c, pr, playerMessage(err, msgResumeFailed))
+				return
+			}
+			// Servers that were just started are empty, so only running servers can be full.
+			if limit, full := l.full(ctx, pr, address, port); full {
+				logger.Info("Server of PR is full", slog.String("pr", pr), slog.Int("max_players", limit))
+				l.fail(ctx, c, pr, msgServerFull, "max", strconv.Itoa(limit))
+				return
+			}
 		}
+		targetAddress, targetPort, routed = address, port, pr
+		l.mu.Lock()
+		l.lastConnections[pr] = time.Now()
+		l.mu.Unlock()
+		// The time of the join is persisted, so that the retention policy knows which PRs are still used.
+		if err := l.state.Update(func(data *stateData) {
+			data.Joins[pr] = time.Now()
+			recordDemand(data, pr, time.Now(), l.conf.Demand.Window)
+		}); err != nil {
+			logger.Warn("Failed to record join", slog.String("pr", pr), slog.Any("error", err))
+		}
+		l.events.Publish(Event{Type: eventPlayerJoined, PR: pr, Player: c.IdentityData().DisplayName})
 	}
 	if targetPort == 0 {
 		// Should not be possible but just in case the port is not set for some reason.
 		logger.Error("Failed to determine target port")
-		_ = l.listener.Disconnect(c, text.Colourf("<red>Failed to determine target port</red>"))
+		l.fail(ctx, c, "", msgNoTargetPort)
 		return
 	}
 
+	// The backend may fetch a token telling it who the player is and where they were routed, so that it can
+	// trust the routing decision.
+	l.handoffs.Issue(HandoffClaims{
+		XUID:        c.IdentityData().XUID,
+		DisplayName: c.IdentityData().DisplayName,
+		Address:     addr,
+		PR:          routed,
+		Target:      net.JoinHostPort(targetAddress, strconv.Itoa(int(targetPort))),
+	})
+
 	// Finally redirect the connection to the target port.
-	logger.Info("Redirecting connection", slog.Int("target_port", int(targetPort)))
-	_ = c.WritePacket(&packet.Transfer{
-		Address: "df-mc.dev",
+	logger.Info("Redirecting connection", slog.String("target_address", targetAddress), slog.Int("target_port", int(targetPort)), slog.Duration("latency", c.Latency()))
+	span.SetAttributes(attribute.String("target_address", targetAddress), attribute.Int("target_port", int(targetPort)))
+	_, transferSpan := startSpan(ctx, "transfer", "")
+	err = spanError(transferSpan, c.WritePacket(&packet.Transfer{
+		Address: targetAddress,
 		Port:    targetPort,
-	})
+	}))
+	transferSpan.End()
+	if err == nil {
+		transferDuration.WithLabelValues(startKind).Observe(time.Since(accepted).Seconds())
+		clientLatency.Observe(c.Latency().Seconds())
+	}
+
+	// Clients disconnect by themselves once transferred. Those that don't are disconnected after a while, so
+	// that they don't linger.
+	select {
+	case <-c.Context().Done():
+	case <-time.After(l.conf.Handshake.TransferTimeout):
+		logger.Warn("Client did not disconnect after transfer")
+		_ = c.Close()
+	case <-l.ctx.Done():
+		_ = c.Close()
+	}
+}
+
+// dimensions maps the names of dimensions to their IDs in the protocol.
+var dimensions = map[string]int32{"overworld": 0, "nether": 1, "end": 2}
+
+// stubWorld returns the game data of the empty world the player of the connection passed spawns in before they
+// are transferred, as configured. The world is of the version of the client, which may be older than the
+// current one.
+func (l *Listener) stubWorld(c *minecraft.Conn) minecraft.GameData {
+	conf := l.conf.StubWorld
+	return minecraft.GameData{
+		WorldName:       conf.WorldName,
+		BaseGameVersion: c.Proto().Ver(),
+		Dimension:       dimensions[conf.Dimension],
+		PlayerPosition:  mgl32.Vec3(conf.Position),
+		WorldSpawn:      protocol.BlockPos{int32(conf.Position[0]), int32(conf.Position[1]), int32(conf.Position[2])},
+		ChunkRadius:     conf.ChunkRadius,
+	}
+}
+
+// disconnect disconnects the connection passed with the message with the ID passed, in the language of the
+// player. The values passed are pairs of the names and values of placeholders in the message, in addition to
+// the address the player joined with.
+func (l *Listener) disconnect(c *minecraft.Conn, id string, values ...string) {
+	addr := serverHost(c.ClientData().ServerAddress)
+	_ = c.WritePacket(&packet.Disconnect{Message: l.messages.Text(c.ClientData().LanguageCode, id, append(values, "address", addr)...)})
+	_ = c.Close()
+}
+
+// announce tells the player which PR they are connecting to in a toast, along with its title and author on
+// GitHub if they could be fetched, so that they can confirm they are joining the right one.
+func (l *Listener) announce(ctx context.Context, c *minecraft.Conn, pr string) {
+	lang := c.ClientData().LanguageCode
+	toast := &packet.ToastRequest{Title: l.messages.Text(lang, msgConnectingTitle, "pr", pr)}
+	if info, ok := l.github.PullRequest(ctx, pr); ok {
+		toast.Message = l.messages.Text(lang, msgConnectingDetails, "pr", pr, "title", info.Title, "author", info.Author)
+	}
+	_ = c.WritePacket(toast)
+}
+
+// full checks if the running server of the given PR at the address and port passed has reached its player limit,
+// which is that of its deployment or otherwise Players.MaxPerServer. The limit is returned along with it. The
+// players on the server are counted by pinging it over the private address of its host, so players that were just
+// transferred may not be counted yet. If the server can't be pinged, it is not considered full.
+func (l *Listener) full(ctx context.Context, pr, address string, port uint16) (int, bool) {
+	limit := l.conf.Players.MaxPerServer
+	if deployment, ok := l.deployment(ctx, pr); ok && deployment.MaxPlayers > 0 {
+		limit = deployment.MaxPlayers
+	}
+	if limit == 0 {
+		return 0, false
+	}
+	online, err := pingServer(fmt.Sprintf("%s:%d", privateAddress(l.conf, address), port), time.Second*5)
+	if err != nil {
+		slog.DebugContext(ctx, "Failed to ping server to count players", slog.String("pr", pr), slog.Any("error", err))
+		return limit, false
+	}
+	return limit, online >= limit
 }
 
-// KillInactiveServers periodically checks for inactive servers and stops them if they have not been connected
-// to for more than an hour.
-func (l *Listener) KillInactiveServers() {
-	t := time.NewTicker(time.Minute * 5)
+// resume unpauses the server of the given PR if it was paused for being idle. If the server is being paused or
+// resumed, resume waits for that to finish first. The join is recorded right away, so that the server isn't
+// paused again before the player is transferred.
+func (l *Listener) resume(ctx context.Context, pr string) error {
 	for {
-		select {
-		case <-t.C:
-			for pr, lastConn := range l.lastConnections {
-				if time.Since(lastConn) > time.Hour {
-					slog.Info("Killing inactive server", slog.String("pr", pr))
-					l.docker.StopServer(pr)
-					delete(l.lastConnections, pr)
-				}
+		l.mu.Lock()
+		if done, ok := l.pausing[pr]; ok {
+			l.mu.Unlock()
+			select {
+			case <-done:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-		case <-l.killChan:
-			t.Stop()
-			return
 		}
+		l.lastConnections[pr] = time.Now()
+		if !l.paused[pr] {
+			l.mu.Unlock()
+			return nil
+		}
+		done := make(chan struct{})
+		l.pausing[pr] = done
+		l.mu.Unlock()
+
+		err := l.backend.UnpauseServer(ctx, pr)
+		l.mu.Lock()
+		delete(l.pausing, pr)
+		if err == nil {
+			delete(l.paused, pr)
+		}
+		l.mu.Unlock()
+		close(done)
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Resumed paused server", slog.String("pr", pr))
+		return nil
+	}
+}
+
+// IdleJob returns the Job periodically checking for servers without players. Servers that have been idle for
+// longer than the configured pause time are paused, and servers that have been idle for longer than the
+// configured stop time are stopped. The job runs immediately, so that servers taken over from a previous
+// prmanager process are tracked right away and paused ones are resumed when players join.
+func (l *Listener) IdleJob() Job {
+	interval := time.Minute
+	if l.conf.Idle.PauseAfter > 0 && l.conf.Idle.PauseAfter < interval*2 {
+		interval = l.conf.Idle.PauseAfter / 2
 	}
+	return Job{Name: "idle", Interval: interval, Immediate: true, Run: l.handleIdleServers}
 }
 
-// Close closes the listener and stops accepting new connections.
+// handleIdleServers pauses or stops all servers that have been idle for too long.
+func (l *Listener) handleIdleServers(ctx context.Context) error {
+	listCtx, cancel := context.WithTimeout(ctx, apiTimeout)
+	servers, err := l.backend.Servers(listCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("list servers: %w", err)
+	}
+	// A server counts as active for as long as players are online, not just when they join. Servers we have
+	// not seen before, for example because they were restarted, are tracked from now on.
+	running := make(map[string]bool, len(servers))
+	for _, srv := range servers {
+		if _, ok := l.conf.Environment(srv.PR); ok {
+			// Environments are kept running regardless of whether players are online.
+			continue
+		}
+		running[srv.PR] = true
+		online := 0
+		if !srv.Paused {
+			online, _ = pingServer(fmt.Sprintf("%s:%d", srv.PrivateAddress, srv.Port), time.Second*5)
+		}
+		l.mu.Lock()
+		if srv.Paused {
+			l.paused[srv.PR] = true
+		}
+		if _, ok := l.lastConnections[srv.PR]; ok && online == 0 {
+			l.mu.Unlock()
+			continue
+		}
+		l.lastConnections[srv.PR] = time.Now()
+		l.mu.Unlock()
+	}
+
+	// Decide what to do with every server first, so that the lock isn't held while stopping servers.
+	var stop, pause []string
+	l.mu.Lock()
+	for pr, lastConn := range l.lastConnections {
+		idle := time.Since(lastConn)
+		switch {
+		case !running[pr]:
+			delete(l.lastConnections, pr)
+			delete(l.paused, pr)
+		case idle > l.conf.Idle.StopAfter:
+			stop = append(stop, pr)
+		case l.conf.Idle.PauseAfter > 0 && idle > l.conf.Idle.PauseAfter && !l.paused[pr]:
+			pause = append(pause, pr)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, pr := range stop {
+		slog.Info("Stopping inactive server", slog.String("pr", pr))
+		if _, err := l.backend.StopServer(ctx, pr); err != nil {
+			slog.Error("Failed to stop inactive server", slog.String("pr", pr), slog.Any("error", err))
+			continue
+		}
+		l.mu.Lock()
+		delete(l.lastConnections, pr)
+		delete(l.paused, pr)
+		l.mu.Unlock()
+	}
+	for _, pr := range pause {
+		l.pause(ctx, pr)
+	}
+	return nil
+}
+
+// pause pauses the idle server of the given PR. The server is marked as being paused while the lock isn't held,
+// so that a player joining in the meantime waits in resume for it to be paused and then resumes it, rather than
+// being transferred to a server that is about to be paused.
+func (l *Listener) pause(ctx context.Context, pr string) {
+	l.mu.Lock()
+	if _, ok := l.pausing[pr]; ok || l.paused[pr] {
+		l.mu.Unlock()
+		return
+	}
+	if lastConn, ok := l.lastConnections[pr]; !ok || time.Since(lastConn) <= l.conf.Idle.PauseAfter {
+		// A player joined since we last checked.
+		l.mu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	l.pausing[pr] = done
+	l.mu.Unlock()
+
+	slog.Info("Pausing idle server", slog.String("pr", pr))
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	err := l.backend.PauseServer(ctx, pr)
+	l.mu.Lock()
+	delete(l.pausing, pr)
+	if err == nil {
+		l.paused[pr] = true
+	}
+	l.mu.Unlock()
+	close(done)
+	if err != nil {
+		slog.Error("Failed to pause idle server", slog.String("pr", pr), slog.Any("error", err))
+	}
+}
+
+// DebugState returns the routes of the Listener, the sessions it is handling and the activity of the servers
+// it tracks, for inclusion in the debug state of the Router.
+func (l *Listener) DebugState(ctx context.Context) any {
+	routes := l.routes.debugRoutes(ctx, l.backend)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sessions := make([]session, 0, len(l.sessions))
+	for _, s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	return map[string]any{
+		"routes":           routes,
+		"sessions":         sessions,
+		"last_connections": maps.Clone(l.lastConnections),
+		"paused":           slices.Sorted(maps.Keys(l.paused)),
+	}
+}
+
+// Close closes the listener and stops accepting new connections. Servers that are still being started for
+// players are abandoned.
 func (l *Listener) Close() {
+	// The context is cancelled first, so that Listen doesn't bind the listener again once it is closed.
+	l.cancel()
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	if l.listener != nil {
 		_ = l.listener.Close()
 		l.listener = nil
 	}
-	if l.killChan != nil {
-		close(l.killChan)
-	}
 }
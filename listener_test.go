@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sandertv/go-raknet"
+)
+
+func TestListenerFull(t *testing.T) {
+	server, err := raknet.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.PongData([]byte("MCPE;Dragonfly;800;1.21.80;3;10;"))
+	_, portStr, _ := net.SplitHostPort(server.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	backend := NewFakeBackend("127.0.0.1", 19132, false)
+	_ = backend.BuildImage(context.Background(), "1", Deployment{PR: "1"})
+	_ = backend.BuildImage(context.Background(), "2", Deployment{PR: "2", MaxPlayers: 3})
+	_ = backend.BuildImage(context.Background(), "3", Deployment{PR: "3", MaxPlayers: 5})
+
+	tests := []struct {
+		pr           string
+		maxPerServer int
+		limit        int
+		full         bool
+	}{
+		{pr: "1", maxPerServer: 0, limit: 0, full: false},
+		{pr: "1", maxPerServer: 3, limit: 3, full: true},
+		{pr: "1", maxPerServer: 4, limit: 4, full: false},
+		{pr: "2", maxPerServer: 0, limit: 3, full: true},
+		{pr: "3", maxPerServer: 2, limit: 5, full: false},
+		{pr: "4", maxPerServer: 0, limit: 0, full: false},
+	}
+	for _, test := range tests {
+		l := &Listener{backend: backend}
+		l.conf.Players.MaxPerServer = test.maxPerServer
+		limit, full := l.full(context.Background(), test.pr, "127.0.0.1", uint16(port))
+		if limit != test.limit || full != test.full {
+			t.Errorf("PR %s with MaxPerServer %d: got (%d, %v), expected (%d, %v)", test.pr, test.maxPerServer, limit, full, test.limit, test.full)
+		}
+	}
+}
+
+// pausingBackend is a Backend pausing the servers of a FakeBackend only once release is closed.
+type pausingBackend struct {
+	*FakeBackend
+	release chan struct{}
+}
+
+// PauseServer ...
+func (b *pausingBackend) PauseServer(ctx context.Context, pr string) error {
+	<-b.release
+	return b.FakeBackend.PauseServer(ctx, pr)
+}
+
+func TestListenerResumeWhilePausing(t *testing.T) {
+	fake := NewFakeBackend("127.0.0.1", 19132, false)
+	_ = fake.BuildImage(context.Background(), "1", Deployment{PR: "1"})
+	if _, _, _, err := fake.StartServer(context.Background(), "1"); err != nil {
+		t.Fatal(err)
+	}
+	backend := &pausingBackend{FakeBackend: fake, release: make(chan struct{})}
+	l := &Listener{
+		backend:         backend,
+		lastConnections: map[string]time.Time{"1": time.Now().Add(-time.Hour)},
+		paused:          make(map[string]bool),
+		pausing:         make(map[string]chan struct{}),
+	}
+	l.conf.Idle.PauseAfter = time.Minute
+
+	paused := make(chan struct{})
+	go func() {
+		l.pause(context.Background(), "1")
+		close(paused)
+	}()
+	for {
+		l.mu.Lock()
+		_, pausing := l.pausing["1"]
+		l.mu.Unlock()
+		if pausing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A player joins while the server is being paused, which must wait for the pause to finish.
+	resumed := make(chan error)
+	go func() {
+		resumed <- l.resume(context.Background(), "1")
+	}()
+	select {
+	case err := <-resumed:
+		t.Fatalf("resume returned before the server was paused: %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+	close(backend.release)
+	<-paused
+	if err := <-resumed; err != nil {
+		t.Fatal(err)
+	}
+
+	servers, _ := fake.Servers(context.Background())
+	if len(servers) != 1 || servers[0].Paused {
+		t.Fatalf("expected server to be resumed, got %+v", servers)
+	}
+	if l.paused["1"] {
+		t.Fatal("expected server not to be marked as paused")
+	}
+}
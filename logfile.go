@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatingFile is an io.WriteCloser that writes to a file on disk, rotating it once it grows beyond a maximum
+// size. Rotated files are renamed to include the time of rotation, and old rotated files are removed once
+// there are more than a maximum number of them or once they exceed a maximum age.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	maxAge   time.Duration
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// openRotatingFile opens the file at the path passed for appending, creating it and its parent directories if
+// they do not yet exist. A maxSize, maxFiles or maxAge of zero disables the respective limit.
+func openRotatingFile(path string, maxSize int64, maxFiles int, maxAge time.Duration) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("create log directory: %w", err)
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles, maxAge: maxAge}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.prune()
+	return r, nil
+}
+
+// Write writes the data passed to the file, rotating it first if the write would make it exceed the maximum
+// size.
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the file currently being written to.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// open opens the file at r.path for appending. r.mu must be held or r must not yet be shared.
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("stat log file: %w", err)
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// rotate closes the current file, renames it to include the current time and opens a new file in its place.
+// r.mu must be held.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return fmt.Errorf("close log file: %w", err)
+	}
+	ext := filepath.Ext(r.path)
+	rotated := strings.TrimSuffix(r.path, ext) + "-" + time.Now().Format("20060102-150405.000") + ext
+	if err := os.Rename(r.path, rotated); err != nil {
+		return fmt.Errorf("rotate log file: %w", err)
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// prune removes rotated files beyond the maximum count or older than the maximum age.
+func (r *rotatingFile) prune() {
+	ext := filepath.Ext(r.path)
+	rotated, _ := filepath.Glob(strings.TrimSuffix(r.path, ext) + "-*" + ext)
+	// The rotation time is part of the name, so sorting by name sorts the files from oldest to newest.
+	slices.Sort(rotated)
+	for i, path := range rotated {
+		if r.maxFiles > 0 && len(rotated)-i > r.maxFiles {
+			_ = os.Remove(path)
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && r.maxAge > 0 && time.Since(info.ModTime()) > r.maxAge {
+			_ = os.Remove(path)
+		}
+	}
+}
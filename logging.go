@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"unicode"
+)
+
+// setupLogging replaces the default logger with one configured by the logging configuration passed. The
+// function returned closes the log file, if any.
+func setupLogging(conf Config) (func(), error) {
+	level, levels, err := logLevels(conf)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		writers []io.Writer
+		closer  = func() {}
+	)
+	if conf.Logging.Stdout {
+		writers = append(writers, os.Stdout)
+	}
+	if conf.Logging.File != "" {
+		f, err := openRotatingFile(conf.Logging.File, int64(conf.Logs.MaxSize)<<20, conf.Logs.MaxFiles, conf.Logs.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("open log file: %w", err)
+		}
+		writers = append(writers, f)
+		closer = func() { _ = f.Close() }
+	}
+
+	// Records are filtered by the subsystemHandler, so the underlying handler accepts all of them.
+	opts := &slog.HandlerOptions{Level: slog.Level(-8)}
+	var handler slog.Handler
+	if conf.Logging.Format == "json" {
+		handler = slog.NewJSONHandler(io.MultiWriter(writers...), opts)
+	} else {
+		handler = slog.NewTextHandler(io.MultiWriter(writers...), opts)
+	}
+	slog.SetDefault(slog.New(newSubsystemHandler(handler, level, levels)))
+	return closer, nil
+}
+
+// logLevels parses the default log level and the levels of subsystems in the configuration passed.
+func logLevels(conf Config) (slog.Level, map[string]slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(conf.Logging.Level)); err != nil {
+		return level, nil, fmt.Errorf("parse log level %q: %w", conf.Logging.Level, err)
+	}
+	levels := make(map[string]slog.Level, len(conf.Logging.Levels))
+	for name, s := range conf.Logging.Levels {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(s)); err != nil {
+			return level, nil, fmt.Errorf("parse log level %q of %s: %w", s, name, err)
+		}
+		levels[strings.ToLower(name)] = l
+	}
+	return level, levels, nil
+}
+
+// subsystemHandler is a slog.Handler that filters records by level, using the level configured for the
+// subsystem that logged a record if there is one. The subsystem of a record is the type of the method it was
+// logged from, such as listener for the methods of Listener.
+type subsystemHandler struct {
+	handler slog.Handler
+	level   slog.Level
+	levels  map[string]slog.Level
+	// min is the lowest level of any subsystem, below which records can be dropped without finding their
+	// subsystem.
+	min slog.Level
+}
+
+// newSubsystemHandler creates a subsystemHandler passing records on to the handler passed.
+func newSubsystemHandler(handler slog.Handler, level slog.Level, levels map[string]slog.Level) *subsystemHandler {
+	h := &subsystemHandler{handler: handler, level: level, levels: levels, min: level}
+	for _, l := range levels {
+		h.min = min(h.min, l)
+	}
+	return h
+}
+
+// Enabled ...
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.min
+}
+
+// Handle ...
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	level := h.level
+	if len(h.levels) > 0 {
+		if l, ok := h.levels[subsystem(r.PC)]; ok {
+			level = l
+		}
+	}
+	if r.Level < level {
+		return nil
+	}
+	// Records logged with the context of a request are tagged with its ID.
+	if id := requestID(ctx); id != "" {
+		r = r.Clone()
+		r.AddAttrs(requestIDAttr(id))
+	}
+	return h.handler.Handle(ctx, r)
+}
+
+// WithAttrs ...
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &subsystemHandler{handler: h.handler.WithAttrs(attrs), level: h.level, levels: h.levels, min: h.min}
+}
+
+// WithGroup ...
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return &subsystemHandler{handler: h.handler.WithGroup(name), level: h.level, levels: h.levels, min: h.min}
+}
+
+// subsystem returns the lowercase name of the type of the method at the program counter passed, such as
+// listener for main.(*Listener).Listen and any closures within it. If the program counter is not in a method,
+// an empty string is returned.
+func subsystem(pc uintptr) string {
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	name := frame.Function
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	// Strip the package name, which is main, or the import path of the package in tests.
+	_, name, ok := strings.Cut(name, ".")
+	if !ok {
+		return ""
+	}
+	if rest, ok := strings.CutPrefix(name, "(*"); ok {
+		typ, _, _ := strings.Cut(rest, ")")
+		return strings.ToLower(typ)
+	}
+	// Methods with value receivers are named main.Type.Method, while functions are named main.function.
+	typ, _, found := strings.Cut(name, ".")
+	if !found || typ == "" || !unicode.IsUpper(rune(typ[0])) {
+		return ""
+	}
+	return strings.ToLower(typ)
+}
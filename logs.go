@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// logPath returns the path of the current log file of the server of the given PR.
+func logPath(pr string) string {
+	return filepath.Join("logs", "pr-"+pr, "server.log")
+}
+
+// removeLogs removes the log files of the server of the given PR.
+func removeLogs(pr string) {
+	_ = os.RemoveAll(filepath.Dir(logPath(pr)))
+}
+
+// collectLogs follows the output of the server container of the given PR since the time passed and writes it
+// to the log file of the PR until the container exits. Because containers are started with --rm, this is the
+// only way for their logs to outlive them. A zero time collects all output of the container.
+func (d *Docker) collectLogs(pr string, since time.Time) {
+	if err := d.followLogs(pr, since); err != nil {
+		slog.Error("Failed to collect server logs", slog.String("pr", pr), slog.Any("error", err))
+	}
+}
+
+// followLogs follows the output of the server container of the given PR since the time passed, writing it to
+// its log file.
+func (d *Docker) followLogs(pr string, since time.Time) error {
+	f, err := openRotatingFile(logPath(pr), int64(d.conf.Logs.MaxSize)<<20, d.conf.Logs.MaxFiles, d.conf.Logs.MaxAge)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Logs are followed for as long as the container runs, regardless of what caused it to be started.
+	opts := container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Timestamps: true,
+	}
+	if !since.IsZero() {
+		opts.Since = since.Format(time.RFC3339Nano)
+	}
+	rc, err := d.client.ContainerLogs(context.Background(), "pr-"+pr, opts)
+	if err != nil {
+		return fmt.Errorf("container logs: %w", err)
+	}
+	defer rc.Close()
+
+	// Containers are started without a TTY, so stdout and stderr are multiplexed in the stream.
+	if _, err := stdcopy.StdCopy(f, f, rc); err != nil {
+		return fmt.Errorf("copy logs: %w", err)
+	}
+	return nil
+}
@@ -1,47 +1,380 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-func main() {
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
-	slog.SetDefault(logger)
+// serve runs prmanager until it receives a shutdown signal, managing the servers of pull requests and
+// listening for players and API requests. If dryRun is true, dry-run mode is enabled regardless of the config.
+func serve(dryRun, noAuth bool) {
+	// Read the configuration and the state persisted by previous runs.
+	conf, err := readConfig()
+	if err != nil {
+		panic(fmt.Errorf("read config: %w", err))
+	}
+	conf.DryRun.Enabled = conf.DryRun.Enabled || dryRun
+	state, err := OpenState(statePath, conf)
+	if err != nil {
+		panic(fmt.Errorf("open state: %w", err))
+	}
+	if err := setupDataLayout(); err != nil {
+		panic(fmt.Errorf("setup data layout: %w", err))
+	}
 
-	// Setup the Docker client and clear any existing PR containers.
-	docker, err := NewDocker()
+	closeLogs, err := setupLogging(conf)
 	if err != nil {
-		panic(fmt.Errorf("new docker: %w", err))
+		panic(fmt.Errorf("setup logging: %w", err))
 	}
-	defer docker.Close()
 
-	if err = docker.ClearContainers(); err != nil {
-		panic(fmt.Errorf("clear containers: %w", err))
+	// Subsystems are shut down in reverse order of being started once a shutdown signal is received.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	lifecycle := NewLifecycle(conf.Shutdown.Timeout)
+	lifecycle.OnShutdown("logs", closer(closeLogs))
+	// upgrade is set if prmanager is shutting down to be replaced by a new process, in which case servers are
+	// left running for the new process to take over.
+	var upgrade *upgrader
+	lifecycle.OnShutdown("state", func(context.Context) error {
+		return state.Flush()
+	})
+
+	// Export spans of API requests, Docker operations and connections if tracing is configured. Spans are
+	// flushed after all other subsystems were shut down.
+	shutdownTracing, err := setupTracing(ctx, conf)
+	if err != nil {
+		panic(fmt.Errorf("setup tracing: %w", err))
+	}
+	lifecycle.OnShutdown("tracing", shutdownTracing)
+
+	// The routes players are transferred by are shared by the listener, the router, through which they can be
+	// replaced, and the DNS records managed for them.
+	routes, err := NewRoutingTable(conf.Routing, state)
+	if err != nil {
+		panic(fmt.Errorf("new routing table: %w", err))
+	}
+	dns, err := NewDNSManager(conf, routes)
+	if err != nil {
+		panic(fmt.Errorf("new dns manager: %w", err))
+	}
+
+	// Events of pull requests, such as builds finishing and servers starting, are published on the event bus
+	// for the subsystems reacting to them. Subscriptions end once everything publishing events was shut down.
+	events := NewEventBus()
+	lifecycle.OnShutdown("events", closer(events.Close))
+	counted, _ := events.Subscribe("metrics", 256)
+	go countEvents(counted)
+
+	// Maintainers are emailed about repeated build failures and hosts hitting resource limits if configured.
+	notifier := NewNotifier(conf)
+	notified, _ := events.Subscribe("notifier", 256)
+	go notifier.HandleEvents(notified)
+	// Secrets are set through the API, encrypted with SECRETS_KEY, and injected into containers by the backend.
+	secrets, err := NewSecretStore(state)
+	if err != nil {
+		panic(fmt.Errorf("new secret store: %w", err))
+	}
+	// Private repositories are fetched when building from source with the credentials in GIT_TOKEN and GIT_SSH_KEY.
+	git, err := NewGitCredentials(conf)
+	if err != nil {
+		panic(fmt.Errorf("new git credentials: %w", err))
+	}
+	backend, puller, cluster := setupBackend(ctx, conf, state, secrets, git)
+	backend = eventBackend{Backend: backend, events: events}
+	// Builds in progress are recorded, so that builds interrupted by prmanager stopping are recovered on startup.
+	backend = buildRecordingBackend{Backend: backend, state: state, stopping: ctx}
+	// The servers that should be running are recorded, so that servers that go missing, for example because
+	// the Docker daemon restarted, are started again.
+	backend = reconcilingBackend{Backend: backend, state: state}
+	// The DNS records of PRs are created and removed as they are deployed and deleted, and verified in the
+	// background on startup.
+	backend = dnsBackend{Backend: backend, dns: dns}
+	// The aliases of PRs are removed as they are deleted.
+	backend = aliasBackend{Backend: backend, routes: routes}
+	// The settings of PRs set through the API are rendered into the config files of their servers as they start.
+	backend = settingsBackend{Backend: backend, state: state, conf: conf}
+	// The size and layers of images are recorded after every build, warning about images growing unexpectedly.
+	backend = imageReportingBackend{Backend: backend, state: state, conf: conf, events: events}
+	go dns.Sync(ctx, backend)
+	if cluster != nil {
+		lifecycle.OnShutdown("cluster", func(context.Context) error {
+			cluster.Close()
+			return nil
+		})
+	}
+
+	// Periodic jobs are run by the scheduler, which is started once all of them were added. It is shut down
+	// after the router and listener, so that no job runs while requests or connections are still handled.
+	scheduler := NewScheduler(conf)
+	lifecycle.OnShutdown("scheduler", closer(scheduler.Close))
+	if cluster != nil {
+		// Anything left behind by deleted PRs was cleaned up on startup, and is again whenever the job is triggered.
+		scheduler.Add(Job{Name: "cleanup", Run: cluster.CleanupOrphans})
+		// The container daemons of all hosts are pinged, so that outages are noticed and operations on an
+		// unreachable host fail right away until it responds again.
+		scheduler.Add(cluster.Job())
+		// The caches shared by builds are kept within Images.CacheSize.
+		scheduler.Add(Job{Name: "buildcache", Interval: buildCacheInterval, Run: cluster.PruneBuildCache})
+	}
+
+	// Verify the Dockerfiles of all profiles and pull their base images in the background, repeating it
+	// periodically.
+	prereqs := NewPrerequisites(puller, conf)
+	scheduler.Add(prereqs.Job())
+
+	// Watch the free disk space, so that builds are refused before the disk fills up.
+	disk := NewDiskGuard(conf, notifier)
+	scheduler.Add(disk.Job())
+
+	// Check the health of running servers in the background.
+	health := NewHealthChecker(backend, conf)
+	scheduler.Add(health.Job())
+
+	// Periodically back up the worlds of pull requests, if configured.
+	backups, err := NewBackupManager(backend, state, conf)
+	if err != nil {
+		panic(fmt.Errorf("new backup manager: %w", err))
+	}
+	scheduler.Add(backups.Job())
+
+	// Pull requests deleted through the API are kept for a grace period before they are purged.
+	purger := NewPurger(backend, backups, state, conf)
+	scheduler.Add(purger.Job())
+	// Pull requests deleted with players online may be drained first.
+	drainer := NewDrainer(backend, purger, health, state, conf)
+	scheduler.Add(drainer.Job())
+
+	// Servers and deployments on hosts that are unreachable are missing from listings, so nothing is deleted or
+	// started again based on them until all hosts are reachable.
+	var complete func() error
+	if cluster != nil {
+		complete = cluster.AllReachable
+	}
+	// Delete pull requests that are no longer used according to the retention policy.
+	retention := NewRetentionPolicy(backend, complete, backups, state, conf)
+	scheduler.Add(retention.Job())
+
+	// Keep the servers of environments, such as the main and plots servers, running and redeploy them on
+	// their schedule.
+	envs := NewEnvironments(backend, conf)
+	scheduler.Add(envs.Job())
+
+	// Converge the servers running with those that should be running.
+	scheduler.Add(NewReconciler(backend, complete, state, conf).Job())
+
+	if conf.Shutdown.StopServers && cluster != nil {
+		lifecycle.OnShutdown("servers", func(ctx context.Context) error {
+			if upgrade != nil {
+				return nil
+			}
+			return cluster.ClearContainers(ctx, false)
+		})
+	}
+
+	// Expose the resource usage and latency of running servers, the free disk space and the time taken to
+	// transfer players, along with their latency and the runs of periodic jobs, as metrics.
+	prometheus.MustRegister(NewContainerCollector(backend), health, disk, transferDuration, transferPhaseDuration, clientLatency, requestDuration, jobRuns, jobDuration, jobLastSuccess, eventsPublished, eventsDropped, daemonUp, NewDemandCollector(backend, state, conf))
+
+	// Sockets passed by systemd socket activation are used in place of listening on the default addresses.
+	sockets, err := inheritedSockets()
+	if err != nil {
+		panic(fmt.Errorf("socket activation: %w", err))
+	}
+	apiListener, err := sockets.listener(":8080")
+	if err != nil {
+		panic(fmt.Errorf("listen api: %w", err))
+	}
+	apiListeners := []net.Listener{apiListener}
+	if conf.API.Socket != "" {
+		// The mode was already validated when reading the config.
+		mode, _ := parseFileMode(conf.API.SocketMode)
+		socket, err := listenUnix(conf.API.Socket, mode)
+		if err != nil {
+			panic(fmt.Errorf("listen api socket: %w", err))
+		}
+		apiListeners = append(apiListeners, socket)
+	}
+	conn, err := sockets.packetConn(":19132")
+	if err != nil {
+		panic(fmt.Errorf("listen minecraft: %w", err))
+	}
+
+	// Players are issued handoff tokens signed with HANDOFF_KEY as they are transferred.
+	handoffs, err := NewHandoffs(conf)
+	if err != nil {
+		panic(fmt.Errorf("new handoffs: %w", err))
 	}
+	// The listener is created before the router, so that its state can be included in the debug state.
+	listener := NewListener(backend, conf, state, routes, events, handoffs)
+
+	// Fail over between the replicas of static routes if one of them stops responding.
+	scheduler.Add(NewReplicaChecker(routes, conf).Job())
+	scheduler.Add(listener.IdleJob())
 
 	// Create the router and start it in a goroutine.
-	router := NewRouter(docker, os.Getenv("API_KEY"))
+	router := NewRouter(conf, RouterDeps{
+		Backend:   backend,
+		State:     state,
+		Health:    health,
+		Backups:   backups,
+		Prereqs:   prereqs,
+		Disk:      disk,
+		Routes:    routes,
+		Envs:      envs,
+		Secrets:   secrets,
+		Scheduler: scheduler,
+		Events:    events,
+		Purger:    purger,
+		Drainer:   drainer,
+		Handoffs:  handoffs,
+		Git:       git,
+
+		APIKey:   os.Getenv("API_KEY"),
+		NoAuth:   noAuth,
+		ReadKey:  os.Getenv("READ_API_KEY"),
+		AdminKey: os.Getenv("ADMIN_API_KEY"),
+	})
+	router.AddDebugState("listener", listener.DebugState)
+	// Readiness probes fail until the listener and static routes were found to be publicly reachable.
+	selfCheck := NewSelfCheck(routes, conf)
+	router.AddReadyCheck(selfCheck.Ready)
+	if cluster != nil {
+		router.AddReadyCheck(cluster.Ready)
+	}
+	// Builds that were interrupted by prmanager stopping are cleaned up and started again before any new build
+	// can be started through the API.
+	router.RecoverBuilds(cluster)
 	go func() {
-		if err := router.Run(":8080"); err != nil {
-			panic(fmt.Errorf("run router: %w", err))
+		// If the API server fails, prmanager is shut down gracefully rather than crashing.
+		if err := router.Run(apiListeners...); err != nil {
+			slog.Error("API server failed, shutting down", slog.Any("error", err))
+			stop()
 		}
 	}()
+	lifecycle.OnShutdown("router", func(ctx context.Context) error {
+		// Requests in flight, such as builds, may take up half of the timeout, leaving the rest for stopping
+		// servers.
+		ctx, cancel := context.WithTimeout(ctx, conf.Shutdown.Timeout/2)
+		defer cancel()
+		return router.Shutdown(ctx)
+	})
 
-	// Gracefully handle shutdown signals.
-	c := make(chan os.Signal, 2)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-
-	// Set up the listener and start listening for connections.
-	listener := NewListener(docker)
+	// Start listening for connections, and running periodic jobs such as pausing and stopping idle servers.
+	go scheduler.Run()
 	go func() {
-		<-c
-		listener.Close()
+		if err := listener.Listen(conn); err != nil {
+			panic(fmt.Errorf("listen: %w", err))
+		}
 	}()
-	if err := listener.Listen(":19132"); err != nil {
-		panic(fmt.Errorf("listen: %w", err))
+	lifecycle.OnShutdown("listener", closer(listener.Close))
+
+	// Check that players can reach the listener and static routes through their public addresses now that
+	// the listener is running.
+	go selfCheck.Run()
+	lifecycle.OnShutdown("self-check", closer(selfCheck.Close))
+
+	// Both sockets are bound at this point, so systemd and the process replaced during an upgrade may consider
+	// prmanager started.
+	if err := notifyUpgradeReady(sockets.ready); err != nil {
+		slog.Warn("Failed to notify readiness", slog.Any("error", err))
+	}
+	go runWatchdog(ctx)
+
+	// SIGUSR2 upgrades prmanager to the executable currently on disk without closing its sockets.
+	upgradeSignal := make(chan os.Signal, 1)
+	signal.Notify(upgradeSignal, syscall.SIGUSR2)
+wait:
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Received shutdown signal")
+			break wait
+		case <-upgradeSignal:
+			if upgrade, err = newUpgrader(apiListener, conn); err != nil {
+				slog.Error("Failed to prepare upgrade", slog.Any("error", err))
+				continue
+			}
+			slog.Info("Received upgrade signal")
+			break wait
+		}
+	}
+	_ = sdNotify("STOPPING=1")
+	// A second signal terminates prmanager immediately.
+	stop()
+	signal.Stop(upgradeSignal)
+	shutdownErr := lifecycle.Shutdown()
+	if shutdownErr != nil {
+		slog.Error("Failed to shut down gracefully", slog.Any("error", shutdownErr))
+	}
+	// The new process is started even if shutting down failed, as nothing would be listening otherwise.
+	if upgrade != nil {
+		if err := upgrade.start(); err != nil {
+			slog.Error("Failed to start upgraded process", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+	if shutdownErr != nil {
+		os.Exit(1)
+	}
+}
+
+// setupBackend returns the Backend servers are managed with. Unless dry-run mode is enabled, this is a Cluster
+// of the container runtimes of all hosts, which is also returned. Any existing PR containers are cleared, and
+// anything left behind by deleted PRs is cleaned up. If prmanager replaced a previous process, its servers are
+// taken over instead.
+func setupBackend(ctx context.Context, conf Config, state *State, secrets *SecretStore, git *GitCredentials) (Backend, imagePuller, *Cluster) {
+	if conf.DryRun.Enabled {
+		slog.Warn("Running in dry-run mode, Docker operations are only simulated", slog.String("address", conf.DryRun.Address), slog.Int("port", int(conf.DryRun.Port)))
+		fake := NewFakeBackend(conf.DryRun.Address, conf.DryRun.Port, true)
+		// Simulated servers don't survive restarts.
+		if err := forgetRunningServers(state); err != nil {
+			panic(fmt.Errorf("forget running servers: %w", err))
+		}
+		return fake, fake, nil
+	}
+	// The port range is closed in the firewall of the local host before any server is started, if managed.
+	if err := NewFirewall(conf).Setup(ctx); err != nil {
+		panic(fmt.Errorf("setup firewall: %w", err))
+	}
+	cluster, err := newCluster(conf, state, secrets, git)
+	if err != nil {
+		panic(err)
+	}
+	if upgraded() {
+		if err = cluster.AdoptServers(ctx); err != nil {
+			panic(fmt.Errorf("adopt servers: %w", err))
+		}
+	} else if err = cluster.ClearContainers(ctx, false); err != nil {
+		panic(fmt.Errorf("clear containers: %w", err))
+	} else if err = forgetRunningServers(state); err != nil {
+		panic(fmt.Errorf("forget running servers: %w", err))
+	}
+	if err = cluster.CleanupOrphans(ctx); err != nil {
+		panic(fmt.Errorf("cleanup orphans: %w", err))
+	}
+	return cluster, cluster, cluster
+}
+
+// newCluster sets up the container runtimes of all configured hosts, injecting the secrets of the SecretStore
+// passed into containers and making the GitCredentials passed available to builds from source, and returns a
+// Cluster of them.
+func newCluster(conf Config, state *State, secrets *SecretStore, git *GitCredentials) (*Cluster, error) {
+	firewall := NewFirewall(conf)
+	hosts := make([]Runtime, 0, len(conf.Hosts))
+	for _, host := range conf.Hosts {
+		ports := NewPortAllocator(conf.Ports.Min, conf.Ports.Max, host, state, environmentPorts(conf), firewall)
+		runtime, err := NewRuntime(conf, host, ports, secrets, git)
+		if err != nil {
+			return nil, fmt.Errorf("new runtime for host %s: %w", host.Name, err)
+		}
+		hosts = append(hosts, runtime)
 	}
+	return NewCluster(hosts, state), nil
 }
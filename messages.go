@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/sandertv/gophertunnel/minecraft/text"
+)
+
+// The IDs of the messages shown to players, by which they are configured.
+const (
+	msgStartGameFailed    = "start_game_failed"
+	msgInvalidPullRequest = "invalid_pull_request"
+	msgInvalidAddress     = "invalid_address"
+	msgServerNotFound     = "server_not_found"
+	msgNoTargetPort       = "no_target_port"
+	msgGetPortFailed      = "get_port_failed"
+	msgStartFailed        = "start_failed"
+	msgResumeFailed       = "resume_failed"
+	msgTooManyServers     = "too_many_servers"
+	msgHostUnreachable    = "host_unreachable"
+	msgBuildFailed        = "build_failed"
+	msgServerStopped      = "server_stopped"
+	msgServerFull         = "server_full"
+	msgBuildExpired       = "build_expired"
+	msgPullRequestDeleted = "pull_request_deleted"
+	msgDraining           = "draining"
+	msgDrainWarning       = "drain_warning"
+	msgFormTitle          = "form_title"
+	msgFormDeployment     = "form_deployment"
+	msgFormEstimate       = "form_estimate"
+	msgFormRetry          = "form_retry"
+	msgFormButton         = "form_button"
+	msgSelectorTitle      = "selector_title"
+	msgSelectorContent    = "selector_content"
+	msgSelectorButton     = "selector_button"
+	msgSelectorEmpty      = "selector_empty"
+	msgSelectorClosed     = "selector_closed"
+	msgProgressTitle      = "progress_title"
+	msgProgressStarting   = "progress_starting"
+	msgProgressWaiting    = "progress_waiting"
+	msgProgressReady      = "progress_ready"
+	msgConnectingTitle    = "connecting_title"
+	msgConnectingDetails  = "connecting_details"
+)
+
+// defaultMessages holds the default text of all messages shown to players by their ID. In all messages,
+// {pr} and {address} are replaced by the number of the pull request and the address the player joined with,
+// where applicable. The form_ messages make up the form shown before players are disconnected, in which
+// {commit}, {deployed} and {duration} are replaced as well. The progress_ messages make up the title shown
+// while the server of a PR starts, in which {elapsed} is replaced by the time passed. The connecting_ messages
+// make up the toast shown when joining a PR, in which {title} and {author} are replaced by its metadata on
+// GitHub. The selector_ messages make up the form players joining directly select a PR from, in which {title}
+// is replaced by the title of the PR on GitHub, if known. The drain_warning message is broadcast on the server
+// of a PR that is drained before it is deleted, in which {duration} is replaced by the time left until it
+// stops.
+var defaultMessages = map[string]string{
+	msgStartGameFailed:    "<red>Failed to start game</red>",
+	msgInvalidPullRequest: "<red>Invalid or outdated pull request</red>",
+	msgInvalidAddress:     "<red>Invalid server address: {address}</red>",
+	msgServerNotFound:     "<red>Server not found for PR {pr}</red>",
+	msgNoTargetPort:       "<red>Failed to determine target port</red>",
+	msgGetPortFailed:      "<red>Failed to get server port</red>",
+	msgStartFailed:        "<red>Failed to start server</red>",
+	msgResumeFailed:       "<red>Failed to resume server</red>",
+	msgTooManyServers:     "<red>Too many servers are running, please try again later</red>",
+	msgHostUnreachable:    "<red>The server host is unreachable, please try again later</red>",
+	msgBuildFailed:        "<red>The server of this pull request failed to build</red>",
+	msgServerStopped:      "<red>The server stopped unexpectedly, please try again</red>",
+	msgServerFull:         "<red>The preview server of PR {pr} is full ({max} players), please try again later</red>",
+	msgBuildExpired:       "<red>The build of this pull request expired, ask its author to redeploy it</red>",
+	msgPullRequestDeleted: "<red>PR {pr} was deleted</red>",
+	msgDraining:           "<red>PR {pr} is being deleted</red>",
+	msgDrainWarning:       "<yellow>PR {pr} is being deleted, this server stops within {duration}</yellow>",
+	msgFormTitle:          "Unable to join {address}",
+	msgFormDeployment:     "Commit: {commit}\nDeployed: {deployed}",
+	msgFormEstimate:       "Servers usually start within {duration}.",
+	msgFormRetry:          "<grey>Join again to retry. If the problem persists, let the author of the pull request know.</grey>",
+	msgFormButton:         "Disconnect",
+	msgSelectorTitle:      "Select a pull request",
+	msgSelectorContent:    "Choose the pull request you want to preview.",
+	msgSelectorButton:     "PR #{pr}\n{title}",
+	msgSelectorEmpty:      "<red>No pull requests are deployed at the moment</red>",
+	msgSelectorClosed:     "<red>No pull request was selected</red>",
+	msgProgressTitle:      "<aqua>PR {pr}</aqua>",
+	msgProgressStarting:   "Starting server… {elapsed}",
+	msgProgressWaiting:    "Waiting for server… {elapsed}",
+	msgProgressReady:      "<green>Ready, transferring</green>",
+	msgConnectingTitle:    "Connecting you to PR #{pr}",
+	msgConnectingDetails:  "{title} by @{author}",
+}
+
+// MessagesConfig is the configuration of the messages shown to players.
+type MessagesConfig struct {
+	// Text overrides the text of messages by their ID. Colours may be set using tags such as <red>.
+	Text map[string]string
+	// Languages holds variants of messages for players using a language, by the language code, such as de_DE
+	// or de, and then the ID of the message. Messages without a variant for the language of a player are
+	// shown using their text.
+	Languages map[string]map[string]string
+	// Forms specifies if players are shown a form describing why they can't join, along with the status of
+	// the pull request, before they are disconnected.
+	Forms bool
+	// Progress specifies if players are shown the progress of starting the server of a pull request as a
+	// title while they wait.
+	Progress bool
+}
+
+// validate checks if all messages configured have a known ID.
+func (c MessagesConfig) validate() error {
+	for id := range c.Text {
+		if _, ok := defaultMessages[id]; !ok {
+			return fmt.Errorf("unknown message %q", id)
+		}
+	}
+	for lang, messages := range c.Languages {
+		for id := range messages {
+			if _, ok := defaultMessages[id]; !ok {
+				return fmt.Errorf("unknown message %q for language %s", id, lang)
+			}
+		}
+	}
+	return nil
+}
+
+// Messages is the catalogue of messages shown to players, such as when they are disconnected.
+type Messages struct {
+	text      map[string]string
+	languages map[string]map[string]string
+}
+
+// NewMessages creates the Messages of the message configuration passed.
+func NewMessages(conf MessagesConfig) *Messages {
+	m := &Messages{text: maps.Clone(defaultMessages), languages: make(map[string]map[string]string, len(conf.Languages))}
+	maps.Copy(m.text, conf.Text)
+	for lang, messages := range conf.Languages {
+		m.languages[strings.ToLower(lang)] = messages
+	}
+	return m
+}
+
+// Text returns the message with the ID passed in the language passed, a language code as sent by the client
+// such as en_GB, with its colour tags applied. A variant for the full language code is preferred, followed by
+// one for only the language, such as en. The values passed are pairs of the names and values of placeholders
+// in the message.
+func (m *Messages) Text(lang, id string, values ...string) string {
+	lang = strings.ToLower(lang)
+	msg, ok := m.languages[lang][id]
+	if !ok {
+		base, _, _ := strings.Cut(lang, "_")
+		if msg, ok = m.languages[base][id]; !ok {
+			msg = m.text[id]
+		}
+	}
+	for i := 0; i+1 < len(values); i += 2 {
+		msg = strings.ReplaceAll(msg, "{"+values[i]+"}", values[i+1])
+	}
+	return text.Colourf("%s", msg)
+}
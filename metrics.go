@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	containerCPUDesc = prometheus.NewDesc(
+		"prmanager_container_cpu_seconds_total",
+		"Total CPU time consumed by the server container of a pull request.",
+		[]string{"pr", "host"}, nil,
+	)
+	containerMemoryDesc = prometheus.NewDesc(
+		"prmanager_container_memory_usage_bytes",
+		"Memory used by the server container of a pull request, excluding the page cache.",
+		[]string{"pr", "host"}, nil,
+	)
+	containerMemoryLimitDesc = prometheus.NewDesc(
+		"prmanager_container_memory_limit_bytes",
+		"Memory limit of the server container of a pull request.",
+		[]string{"pr", "host"}, nil,
+	)
+	containerNetworkReceiveDesc = prometheus.NewDesc(
+		"prmanager_container_network_receive_bytes_total",
+		"Total bytes received by the server container of a pull request.",
+		[]string{"pr", "host"}, nil,
+	)
+	containerNetworkTransmitDesc = prometheus.NewDesc(
+		"prmanager_container_network_transmit_bytes_total",
+		"Total bytes transmitted by the server container of a pull request.",
+		[]string{"pr", "host"}, nil,
+	)
+)
+
+// transferBuckets are the buckets of the histograms of the time taken to transfer players, ranging from
+// transfers to running servers to cold starts close to startTimeout.
+var transferBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+
+var (
+	transferDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prmanager_transfer_duration_seconds",
+		Help:    "Time from accepting a player to transferring them, by whether the server had to be started (cold), was already running (warm) or was a static route (static).",
+		Buckets: transferBuckets,
+	}, []string{"start"})
+	clientLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "prmanager_client_latency_seconds",
+		Help:    "Latency of the connection of players to prmanager when they are transferred, half the round-trip time.",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.15, 0.25, 0.5, 1},
+	})
+	transferPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prmanager_transfer_phase_duration_seconds",
+		Help:    "Time taken by each phase of transferring a player, such as start_game, port_lookup, container_start and readiness_wait.",
+		Buckets: transferBuckets,
+	}, []string{"phase"})
+)
+
+// The phases of transferring a player that are measured by transferPhaseDuration.
+const (
+	phaseStartGame      = "start_game"
+	phaseMetadata       = "metadata"
+	phasePortLookup     = "port_lookup"
+	phaseContainerStart = "container_start"
+	phaseReadinessWait  = "readiness_wait"
+	phaseResume         = "resume"
+)
+
+// observePhase records the time passed since start as the duration of the phase of a transfer passed.
+func observePhase(phase string, start time.Time) {
+	transferPhaseDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+}
+
+// ContainerCollector is a prometheus.Collector that collects the resource usage of the server containers of
+// all running pull requests each time it is scraped.
+type ContainerCollector struct {
+	backend Backend
+}
+
+// NewContainerCollector creates a new ContainerCollector that collects stats of all servers of the Backend.
+func NewContainerCollector(backend Backend) *ContainerCollector {
+	return &ContainerCollector{backend: backend}
+}
+
+// Describe ...
+func (c *ContainerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- containerCPUDesc
+	ch <- containerMemoryDesc
+	ch <- containerMemoryLimitDesc
+	ch <- containerNetworkReceiveDesc
+	ch <- containerNetworkTransmitDesc
+}
+
+// Collect ...
+func (c *ContainerCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	servers, err := c.backend.Servers(ctx)
+	if err != nil {
+		slog.Error("Failed to list servers for metrics", slog.Any("error", err))
+		return
+	}
+	for _, srv := range servers {
+		stats, found, err := c.backend.Stats(ctx, srv.PR, false)
+		if err != nil {
+			slog.Error("Failed to get container stats for metrics", slog.String("pr", srv.PR), slog.Any("error", err))
+			continue
+		} else if !found {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(containerCPUDesc, prometheus.CounterValue, stats.CPUSeconds, srv.PR, srv.Host)
+		ch <- prometheus.MustNewConstMetric(containerMemoryDesc, prometheus.GaugeValue, float64(stats.MemoryUsage), srv.PR, srv.Host)
+		ch <- prometheus.MustNewConstMetric(containerMemoryLimitDesc, prometheus.GaugeValue, float64(stats.MemoryLimit), srv.PR, srv.Host)
+		ch <- prometheus.MustNewConstMetric(containerNetworkReceiveDesc, prometheus.CounterValue, float64(stats.NetworkReceived), srv.PR, srv.Host)
+		ch <- prometheus.MustNewConstMetric(containerNetworkTransmitDesc, prometheus.CounterValue, float64(stats.NetworkTransmitted), srv.PR, srv.Host)
+	}
+}
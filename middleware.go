@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// middleware wraps an http.Handler to add behaviour shared by many routes, such as authentication.
+type middleware func(next http.Handler) http.Handler
+
+// chain wraps the http.Handler passed in the middlewares passed, the first of which handles a request first.
+func chain(h http.Handler, middlewares ...middleware) http.Handler {
+	for _, mw := range slices.Backward(middlewares) {
+		h = mw(h)
+	}
+	return h
+}
+
+// handle registers the http.Handler passed for the pattern, wrapped in the middlewares passed.
+func (r *Router) handle(pattern string, h http.HandlerFunc, middlewares ...middleware) {
+	r.mux.Handle(pattern, chain(h, middlewares...))
+}
+
+// clientIP returns the IP address of the client that made the request passed.
+func clientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// rateLimiter limits the rate of requests made by every client, identified by its IP address, using a token
+// bucket per client.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*rate.Limiter
+	pruned  time.Time
+}
+
+// newRateLimiter creates a rateLimiter allowing every client limit requests per second on average and burst
+// requests at once. If limit is zero, requests are not limited.
+func newRateLimiter(limit float64, burst int) *rateLimiter {
+	return &rateLimiter{limit: rate.Limit(limit), burst: burst, clients: make(map[string]*rate.Limiter)}
+}
+
+// allow checks if the client passed may make another request now.
+func (l *rateLimiter) allow(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.pruned) > time.Minute {
+		// Clients whose bucket is full again are treated the same as new clients, so they can be forgotten.
+		for c, limiter := range l.clients {
+			if limiter.TokensAt(now) >= float64(l.burst) {
+				delete(l.clients, c)
+			}
+		}
+		l.pruned = now
+	}
+	limiter, ok := l.clients[client]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.clients[client] = limiter
+	}
+	return limiter.AllowN(now, 1)
+}
+
+// middleware is a middleware that answers requests of clients that exceeded their rate with 429.
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	if l.limit == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !l.allow(clientIP(request)) {
+			requestLogger(request).Warn("Rate limit exceeded", "client", clientIP(request))
+			writer.Header().Set("Retry-After", "1")
+			http.Error(writer, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// allowedOrigin checks if web pages on the origin passed may call the API from a browser.
+func (r *Router) allowedOrigin(origin string) bool {
+	origins := r.conf.API.AllowedOrigins
+	return origin != "" && (slices.Contains(origins, "*") || slices.Contains(origins, origin))
+}
+
+// corsMiddleware is a middleware that allows web pages on the origins configured in API.AllowedOrigins to
+// call the routes it wraps from a browser.
+func (r *Router) corsMiddleware(next http.Handler) http.Handler {
+	if len(r.conf.API.AllowedOrigins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Add("Vary", "Origin")
+		if origin := request.Header.Get("Origin"); r.allowedOrigin(origin) {
+			writer.Header().Set("Access-Control-Allow-Origin", origin)
+			writer.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// preflightMiddleware is a middleware that answers the CORS preflight requests of origins configured in
+// API.AllowedOrigins. Preflights are answered for any route, as browsers only let pages read the responses
+// of routes wrapped in corsMiddleware.
+func (r *Router) preflightMiddleware(next http.Handler) http.Handler {
+	if len(r.conf.API.AllowedOrigins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		origin := request.Header.Get("Origin")
+		if request.Method != http.MethodOptions || request.Header.Get("Access-Control-Request-Method") == "" || !r.allowedOrigin(origin) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		writer.Header().Add("Vary", "Origin")
+		writer.Header().Set("Access-Control-Allow-Origin", origin)
+		writer.Header().Set("Access-Control-Allow-Methods", strings.Join([]string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}, ", "))
+		writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, X-Request-ID")
+		writer.Header().Set("Access-Control-Max-Age", "600")
+		writer.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(0.001, 2)
+	for i := range 2 {
+		if !l.allow("10.0.0.1") {
+			t.Fatalf("request %d within the burst was refused", i+1)
+		}
+	}
+	if l.allow("10.0.0.1") {
+		t.Error("request exceeding the burst was allowed")
+	}
+	if !l.allow("10.0.0.2") {
+		t.Error("request of other client was refused")
+	}
+
+	next := http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		writer.WriteHeader(http.StatusNoContent)
+	})
+	request := httptest.NewRequest(http.MethodGet, "/pullrequests", nil)
+	request.RemoteAddr = "10.0.0.1:50000"
+	recorder := httptest.NewRecorder()
+	l.middleware(next).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("limited request answered with %d, want 429 with Retry-After", recorder.Code)
+	}
+
+	// Without a limit, all requests are passed on.
+	unlimited := newRateLimiter(0, 0).middleware(next)
+	for range 10 {
+		recorder = httptest.NewRecorder()
+		unlimited.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusNoContent {
+			t.Fatalf("unlimited request answered with %d, want 204", recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sandertv/go-raknet"
+	"github.com/sandertv/gophertunnel/minecraft"
+)
+
+// packetNetwork is a minecraft.Network that accepts RakNet connections on an existing packet connection, such
+// as a socket passed by systemd, rather than listening on an address itself.
+type packetNetwork struct {
+	conn net.PacketConn
+	// logins, if not nil, disconnects connections accepted that don't log in in time.
+	logins *loginGuard
+}
+
+// DialContext ...
+func (n packetNetwork) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	return raknet.DialContext(ctx, address)
+}
+
+// PingContext ...
+func (n packetNetwork) PingContext(ctx context.Context, address string) ([]byte, error) {
+	return raknet.PingContext(ctx, address)
+}
+
+// Listen ...
+func (n packetNetwork) Listen(address string) (minecraft.NetworkListener, error) {
+	listener, err := raknet.ListenConfig{UpstreamPacketListener: n}.Listen(address)
+	if err != nil || n.logins == nil {
+		return listener, err
+	}
+	return guardedListener{NetworkListener: listener, logins: n.logins}, nil
+}
+
+// ListenPacket returns the packet connection of the packetNetwork, regardless of the address passed.
+func (n packetNetwork) ListenPacket(string, string) (net.PacketConn, error) {
+	return n.conn, nil
+}
+
+// loginGuard closes connections that don't finish logging in within a timeout. minecraft.Listener only returns
+// connections from Accept once they are logged in, so without it, a client that stalls halfway through the
+// handshake would hold on to its connection until RakNet considers it dead.
+type loginGuard struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+}
+
+// newLoginGuard creates a loginGuard that closes connections that haven't logged in after the timeout passed.
+func newLoginGuard(timeout time.Duration) *loginGuard {
+	return &loginGuard{timeout: timeout, pending: make(map[string]*time.Timer)}
+}
+
+// add starts the timeout of the connection passed, which was just accepted.
+func (g *loginGuard) add(conn net.Conn) {
+	addr := conn.RemoteAddr().String()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pending[addr] = time.AfterFunc(g.timeout, func() {
+		g.mu.Lock()
+		delete(g.pending, addr)
+		g.mu.Unlock()
+		_ = conn.Close()
+	})
+}
+
+// done stops the timeout of the connection with the remote address passed, as it logged in.
+func (g *loginGuard) done(addr net.Addr) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if t, ok := g.pending[addr.String()]; ok {
+		t.Stop()
+		delete(g.pending, addr.String())
+	}
+}
+
+// guardedListener is a minecraft.NetworkListener that starts the login timeout of every connection it accepts.
+type guardedListener struct {
+	minecraft.NetworkListener
+	logins *loginGuard
+}
+
+// Accept ...
+func (l guardedListener) Accept() (net.Conn, error) {
+	conn, err := l.NetworkListener.Accept()
+	if err == nil {
+		l.logins.add(conn)
+	}
+	return conn, err
+}
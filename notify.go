@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifier emails maintainers about problems that need their attention, such as the builds of a pull request
+// failing repeatedly or the hosts running out of resources. Emails of the same kind are sent at most once per
+// Email.Cooldown, so that a persistent problem doesn't flood inboxes.
+type Notifier struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+	to       []string
+
+	buildFailures int
+	cooldown      time.Duration
+
+	mu sync.Mutex
+	// failures maps pull requests to the number of builds in a row that failed.
+	failures map[string]int
+	// sent maps the kinds of emails to the time one was last sent.
+	sent map[string]time.Time
+}
+
+// NewNotifier creates a Notifier using the email configuration passed. The SMTP password is read from the
+// SMTP_PASSWORD environment variable. If no SMTP host is configured, no emails are sent.
+func NewNotifier(conf Config) *Notifier {
+	return &Notifier{
+		host:     conf.Email.Host,
+		port:     conf.Email.Port,
+		username: conf.Email.Username,
+		password: os.Getenv("SMTP_PASSWORD"),
+		from:     conf.Email.From,
+		to:       conf.Email.To,
+
+		buildFailures: conf.Email.BuildFailures,
+		cooldown:      conf.Email.Cooldown,
+
+		failures: make(map[string]int),
+		sent:     make(map[string]time.Time),
+	}
+}
+
+// enabled checks if the Notifier sends emails at all.
+func (n *Notifier) enabled() bool {
+	return n.host != "" && len(n.to) > 0
+}
+
+// BuildFinished records the result of a build of the given PR, sending an email once Email.BuildFailures
+// builds in a row failed. Builds aborted because their request was cancelled are not counted.
+func (n *Notifier) BuildFinished(pr string, err error) {
+	if !n.enabled() || errors.Is(err, context.Canceled) {
+		return
+	}
+	n.mu.Lock()
+	if err == nil {
+		delete(n.failures, pr)
+		n.mu.Unlock()
+		return
+	}
+	n.failures[pr]++
+	failures := n.failures[pr]
+	n.mu.Unlock()
+	if failures != n.buildFailures {
+		return
+	}
+
+	body := fmt.Sprintf("The last %d builds of PR %s failed. The last build failed with:\n\n%v\n", failures, pr, err)
+	if be := (*buildError)(nil); errors.As(err, &be) {
+		body += "\nBuild log:\n\n" + be.log + "\n"
+	}
+	n.send("build "+pr, fmt.Sprintf("Builds of PR %s keep failing", pr), body)
+}
+
+// ResourceLimit sends an email that a host hit a resource limit, such as running low on disk space. The kind
+// passed identifies the limit, so that emails about the same limit are subject to the cooldown together.
+func (n *Notifier) ResourceLimit(kind, subject, body string) {
+	if !n.enabled() {
+		return
+	}
+	n.send(kind, subject, body)
+}
+
+// send sends an email with the subject and body passed in the background, unless one of the same kind was
+// sent within the cooldown.
+func (n *Notifier) send(kind, subject, body string) {
+	n.mu.Lock()
+	if last, ok := n.sent[kind]; ok && time.Since(last) < n.cooldown {
+		n.mu.Unlock()
+		slog.Debug("Not sending email within cooldown", slog.String("kind", kind), slog.String("subject", subject))
+		return
+	}
+	n.sent[kind] = time.Now()
+	n.mu.Unlock()
+
+	go func() {
+		if err := n.sendMail(subject, body); err != nil {
+			slog.Error("Failed to send email", slog.String("subject", subject), slog.Any("error", err))
+			return
+		}
+		slog.Info("Sent email", slog.String("subject", subject), slog.Int("recipients", len(n.to)))
+	}()
+}
+
+// sendMail sends a plain text email with the subject and body passed to all recipients.
+func (n *Notifier) sendMail(subject, body string) error {
+	var msg strings.Builder
+	msg.WriteString("From: " + n.from + "\r\n")
+	msg.WriteString("To: " + strings.Join(n.to, ", ") + "\r\n")
+	msg.WriteString("Subject: [prmanager] " + subject + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, n.host)
+	}
+	return smtp.SendMail(net.JoinHostPort(n.host, strconv.Itoa(n.port)), auth, n.from, n.to, []byte(msg.String()))
+}
+
+// HandleEvents reports the results of builds and servers failing to start for a lack of capacity, as received
+// from the events passed, until the channel is closed.
+func (n *Notifier) HandleEvents(events <-chan Event) {
+	for e := range events {
+		switch {
+		case e.Type == eventBuildFinished:
+			n.BuildFinished(e.PR, e.Err)
+		case e.Type == eventServerStarted && (errors.Is(e.Err, errNoHostAvailable) || errors.Is(e.Err, errPortUnavailable)):
+			n.ResourceLimit("capacity", "No capacity left to start servers", fmt.Sprintf("The server of PR %s could not be started:\n\n%v\n\nPlayers joining it are turned away until other servers stop or capacity is added.\n", e.PR, e.Err))
+		}
+	}
+}
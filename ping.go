@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sandertv/go-raknet"
+)
+
+// pingServer pings the Minecraft server at the address passed over RakNet and returns the number of players
+// that are currently online, as reported in the pong data.
+func pingServer(addr string, timeout time.Duration) (int, error) {
+	pong, err := raknet.PingTimeout(addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	// The pong data is in the format of MCPE;motd;protocol;version;online players;max players;...
+	fields := strings.Split(string(pong), ";")
+	if len(fields) < 6 {
+		return 0, fmt.Errorf("invalid pong data %q", pong)
+	}
+	online, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return 0, fmt.Errorf("invalid online player count %q: %w", fields[4], err)
+	}
+	return online, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+)
+
+// PortAllocator assigns host ports from a fixed range to the servers of pull requests on one host. Assignments
+// are stored in the State, so that a pull request keeps the same port across restarts of both its server and
+// prmanager. Every host has a PortAllocator of its own, so that servers on different hosts may use the same
+// port. The ports of servers on the local host are opened and closed in its Firewall as the servers start and
+// stop.
+type PortAllocator struct {
+	min, max uint16
+	// host is the name of the host ports are assigned on. local specifies if it is the local host, whose ports
+	// can be checked for being free by binding them.
+	host     string
+	local    bool
+	state    *State
+	firewall *Firewall
+	// fixed are the ports of servers that are always published on the same port, such as those of
+	// environments, by the ID of their server.
+	fixed map[string]uint16
+}
+
+// NewPortAllocator creates a PortAllocator that assigns ports on the host passed in the inclusive range
+// min-max. The servers in fixed are always assigned the port they map to instead.
+func NewPortAllocator(min, max uint16, host HostConfig, state *State, fixed map[string]uint16, firewall *Firewall) *PortAllocator {
+	return &PortAllocator{min: min, max: max, host: host.Name, local: host.Address == "", state: state, fixed: fixed, firewall: firewall}
+}
+
+// Allocate returns the host port to use for the server of the given PR. The port previously assigned to the PR
+// is reused if it is still within range and available. Otherwise, the lowest free port in the range is
+// assigned to the PR. Ports are only taken by the pull requests scheduled onto the same host, along with those
+// assigned before they were scheduled onto any. Only ports of the local host are checked for being bound by
+// other processes, as those of remote hosts can't be bound from here.
+func (a *PortAllocator) Allocate(pr string) (uint16, error) {
+	if port, ok := a.fixed[pr]; ok {
+		return port, nil
+	}
+	var port uint16
+	var err error
+	updateErr := a.state.Update(func(data *stateData) {
+		taken := make(map[uint16]bool, len(data.Ports))
+		for other, p := range data.Ports {
+			if host, ok := data.Hosts[other]; other != pr && (!ok || host == a.host) {
+				taken[p] = true
+			}
+		}
+		if prev, ok := data.Ports[pr]; ok {
+			if prev >= a.min && prev <= a.max && !taken[prev] && a.available(prev) {
+				port = prev
+				return
+			}
+			slog.Info("Previous port of PR is no longer usable, assigning a new one", slog.String("pr", pr), slog.String("host", a.host), slog.Int("port", int(prev)))
+		}
+		for p := int(a.min); p <= int(a.max); p++ {
+			if !taken[uint16(p)] && a.available(uint16(p)) {
+				port = uint16(p)
+				data.Ports[pr] = port
+				return
+			}
+		}
+		err = errPortUnavailable
+	})
+	if err != nil {
+		return 0, err
+	}
+	if updateErr != nil {
+		return 0, fmt.Errorf("save port assignment: %w", updateErr)
+	}
+	return port, nil
+}
+
+// Open opens the port passed, assigned to a server that started on the local host, in the firewall. Failing to
+// do so is logged rather than failing the start, as the server may still be reachable.
+func (a *PortAllocator) Open(ctx context.Context, pr string, port uint16) {
+	if err := a.firewall.Open(ctx, port); err != nil {
+		slog.ErrorContext(ctx, "Failed to open port in firewall", slog.String("pr", pr), slog.Int("port", int(port)), slog.Any("error", err))
+	}
+}
+
+// Close closes the port assigned to the given PR in the firewall once its server on the local host stopped.
+func (a *PortAllocator) Close(ctx context.Context, pr string) {
+	port, ok := a.fixed[pr]
+	if !ok {
+		a.state.View(func(data *stateData) {
+			port, ok = data.Ports[pr]
+		})
+	}
+	if !ok {
+		return
+	}
+	if err := a.firewall.Close(ctx, port); err != nil {
+		slog.WarnContext(ctx, "Failed to close port in firewall", slog.String("pr", pr), slog.Int("port", int(port)), slog.Any("error", err))
+	}
+}
+
+// Release removes the port assignment of the given PR, making the port available to other pull requests.
+func (a *PortAllocator) Release(pr string) error {
+	return a.state.Update(func(data *stateData) {
+		delete(data.Ports, pr)
+	})
+}
+
+// available checks if the port passed is free on the host of the PortAllocator. Ports of remote hosts are
+// assumed to be free unless assigned to another pull request.
+func (a *PortAllocator) available(port uint16) bool {
+	return !a.local || portAvailable(port)
+}
+
+// portAvailable checks if the UDP port passed is currently free on the host by briefly binding to it.
+func portAvailable(port uint16) bool {
+	conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(int(port)))
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestPortAllocator(t *testing.T) {
+	state, err := OpenState(filepath.Join(t.TempDir(), "state.json"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := HostConfig{Name: "remote", Address: "tcp://10.0.0.2:2375"}
+	other := HostConfig{Name: "other", Address: "tcp://10.0.0.3:2375"}
+	a := NewPortAllocator(20000, 20002, remote, state, map[string]uint16{"lobby": 19132}, NewFirewall(Config{}))
+	b := NewPortAllocator(20000, 20002, other, state, nil, NewFirewall(Config{}))
+
+	allocate := func(a *PortAllocator, pr, host string) uint16 {
+		t.Helper()
+		if err := state.Update(func(data *stateData) { data.Hosts[pr] = host }); err != nil {
+			t.Fatal(err)
+		}
+		port, err := a.Allocate(pr)
+		if err != nil {
+			t.Fatalf("allocate port of %s: %v", pr, err)
+		}
+		return port
+	}
+	if port := allocate(a, "1", "remote"); port != 20000 {
+		t.Errorf("first port = %d, want 20000", port)
+	}
+	if port := allocate(a, "2", "remote"); port != 20001 {
+		t.Errorf("second port = %d, want 20001", port)
+	}
+	if port := allocate(a, "1", "remote"); port != 20000 {
+		t.Errorf("port of reallocated PR = %d, want 20000", port)
+	}
+	if port := allocate(b, "3", "other"); port != 20000 {
+		t.Errorf("port on other host = %d, want 20000", port)
+	}
+	if port, _ := a.Allocate("lobby"); port != 19132 {
+		t.Errorf("fixed port = %d, want 19132", port)
+	}
+
+	// A PR moving to a host where its previous port is taken is assigned a new one.
+	if port := allocate(a, "3", "remote"); port != 20002 {
+		t.Errorf("port of moved PR = %d, want 20002", port)
+	}
+	if err := state.Update(func(data *stateData) { data.Hosts["4"] = "remote" }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Allocate("4"); !errors.Is(err, errPortUnavailable) {
+		t.Errorf("allocate from exhausted range: got %v, want errPortUnavailable", err)
+	}
+	if err := a.Release("2"); err != nil {
+		t.Fatal(err)
+	}
+	if port := allocate(a, "4", "remote"); port != 20001 {
+		t.Errorf("port after release = %d, want 20001", port)
+	}
+}
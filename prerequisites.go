@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNotChecked is the readiness error of Prerequisites that have not been checked yet.
+var errNotChecked = errors.New("prerequisites not checked yet")
+
+// Prerequisites verifies that everything needed to build the images of pull requests is present: the Dockerfile
+// of every profile must exist and be parseable, and its base images must be pulled on every host. This way a
+// missing prerequisite is found when prmanager starts rather than when the first pull request is uploaded.
+type Prerequisites struct {
+	puller   imagePuller
+	profiles []ProfileConfig
+	interval time.Duration
+
+	mu  sync.Mutex
+	err error
+}
+
+// imagePuller pulls images onto the hosts servers run on, such as a Cluster.
+type imagePuller interface {
+	// PullImage pulls the image with the reference passed.
+	PullImage(ctx context.Context, ref string) error
+}
+
+// NewPrerequisites creates new Prerequisites for the profiles in the configuration passed, pulling base images
+// using the imagePuller passed.
+func NewPrerequisites(puller imagePuller, conf Config) *Prerequisites {
+	return &Prerequisites{
+		puller:   puller,
+		profiles: conf.Profiles,
+		interval: conf.Images.PullInterval,
+		err:      errNotChecked,
+	}
+}
+
+// Job returns the Job checking the prerequisites once immediately and then every interval. If the interval is
+// zero, the prerequisites are only checked again when the job is triggered.
+func (p *Prerequisites) Job() Job {
+	return Job{Name: "prerequisites", Interval: p.interval, Immediate: true, Run: p.check}
+}
+
+// Ready returns an error if the prerequisites are not met, or nil if they are.
+func (p *Prerequisites) Ready() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// check verifies the Dockerfiles and pulls its base images on every host, recording the result.
+func (p *Prerequisites) check(ctx context.Context) error {
+	err := p.pull(ctx)
+	if err == nil {
+		slog.Info("Prerequisites for building images are met")
+	}
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("prerequisites for building images are not met: %w", err)
+	}
+	return nil
+}
+
+// pull parses the base images from the Dockerfiles of all profiles, including those binaries are built from
+// source with, and pulls them on every host.
+func (p *Prerequisites) pull(ctx context.Context) error {
+	for _, profile := range p.profiles {
+		dockerfiles := []string{profile.Dockerfile}
+		if profile.SourceDockerfile != "" {
+			dockerfiles = append(dockerfiles, profile.SourceDockerfile)
+		}
+		for _, dockerfile := range dockerfiles {
+			images, err := baseImages(dockerfile)
+			if err != nil {
+				return fmt.Errorf("profile %s: %s: %w", profile.Name, dockerfile, err)
+			}
+			for _, img := range images {
+				if err := p.puller.PullImage(ctx, img); err != nil {
+					return fmt.Errorf("profile %s: pull base image %s: %w", profile.Name, img, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// argRef matches references to build arguments in a Dockerfile, such as $VERSION and ${VERSION}.
+var argRef = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)}?`)
+
+// baseImages parses the Dockerfile at the path passed and returns the external images its stages are based on.
+// Build arguments declared before the first stage are substituted with their default values, while stages
+// based on earlier stages and scratch are skipped.
+func baseImages(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open Dockerfile: %w", err)
+	}
+	defer f.Close()
+
+	args := make(map[string]string)
+	stages := make(map[string]bool)
+	var images []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "ARG":
+			if len(images) > 0 || len(fields) < 2 {
+				continue
+			}
+			name, value, _ := strings.Cut(fields[1], "=")
+			args[name] = strings.Trim(value, `"'`)
+		case "FROM":
+			// Flags such as --platform may precede the image.
+			fields = fields[1:]
+			for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+				fields = fields[1:]
+			}
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("parse Dockerfile: FROM without an image")
+			}
+			var missing string
+			img := argRef.ReplaceAllStringFunc(fields[0], func(ref string) string {
+				name := argRef.FindStringSubmatch(ref)[1]
+				value, ok := args[name]
+				if !ok || value == "" {
+					missing = name
+				}
+				return value
+			})
+			if missing != "" {
+				return nil, fmt.Errorf("parse Dockerfile: base image %s uses build argument %s without a default", fields[0], missing)
+			}
+			if img != "scratch" && !stages[strings.ToLower(img)] {
+				images = append(images, img)
+			}
+			if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+				stages[strings.ToLower(fields[2])] = true
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read Dockerfile: %w", err)
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("parse Dockerfile: no base image found")
+	}
+	return images, nil
+}
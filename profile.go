@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"strings"
+)
+
+// ProfileConfig is the configuration of an image profile, which describes how the image of a pull request is
+// built and how its server is run. Profiles allow prmanager to manage servers with different layouts, such as
+// servers of different repositories. In all values, {pr} is replaced by the number of the pull request. In
+// BuildArgs, Args and Env, the metadata of the deployment, such as {title}, is replaced as well.
+type ProfileConfig struct {
+	// Name is a unique name used to select the profile when uploading a pull request.
+	Name string
+	// Dockerfile is the path of the Dockerfile the image is built from.
+	Dockerfile string
+	// BuildArgs holds additional build arguments in the format KEY=VALUE. The PR build argument is always set
+	// to the number of the pull request.
+	BuildArgs []string
+	// DataPath is the path in the container that the world data of the pull request is mounted at.
+	DataPath string
+	// Port is the UDP port the server listens on inside the container.
+	Port uint16
+	// Args are the arguments passed to the entrypoint of the image.
+	Args []string
+	// Env holds environment variables in the format KEY=VALUE that the server is run with, such as
+	// SERVER_NAME=PR #{pr} by {author}.
+	Env []string
+	// Arch is the architecture uploaded binaries must be built for, such as amd64 or arm64. It defaults to
+	// the architecture prmanager runs on.
+	Arch string
+	// VersionArgs are arguments, such as --version, that the entrypoint of a newly built image is run with in
+	// a throwaway container before the image is used. If running it fails, the image is discarded. If empty,
+	// this check is skipped.
+	VersionArgs []string
+	// ConfigFile is the path of the config file of the server relative to DataPath, into which the settings of
+	// the pull request set through the API are rendered before it starts.
+	ConfigFile string
+	// BuildNetwork specifies if the instructions of the Dockerfile run with network access while the image is
+	// built, such as to install packages. If false, they run without network access, so that a pull request
+	// can't reach the network from the build. Base images are pulled either way. If nil, it defaults to true.
+	BuildNetwork *bool
+	// CacheDirs are directories in the build container, such as /root/go/pkg/mod and /root/.cache/go-build,
+	// that are kept in a cache between the builds of a pull request. They are mounted into every RUN
+	// instruction of the Dockerfile, so that a Dockerfile compiling the server from source doesn't download and
+	// compile its dependencies again for every build of the pull request.
+	CacheDirs []string
+	// SourceDockerfile is the path of the Dockerfile the binary of a pull request uploaded as source is built
+	// with. Its build context is the source, and its last stage must hold the binary as /dragonfly. If empty,
+	// only binaries may be uploaded.
+	SourceDockerfile string
+	// Repository is the URL of the git repository git refs uploaded for pull requests are fetched from, such as
+	// https://github.com/df-mc/dragonfly. If empty, only binaries and source tarballs may be uploaded.
+	Repository string
+}
+
+// defaultProfile returns the profile used for Dragonfly servers built from the Dockerfile in this repository.
+func defaultProfile() ProfileConfig {
+	return ProfileConfig{Name: "dragonfly", Dockerfile: "Dockerfile", DataPath: "/pr-{pr}", Port: 19132, Arch: runtime.GOARCH, ConfigFile: "config.toml"}
+}
+
+// buildNetwork returns if the instructions of the Dockerfile of the profile run with network access.
+func (p ProfileConfig) buildNetwork() bool {
+	return p.BuildNetwork == nil || *p.BuildNetwork
+}
+
+// withDefaults returns the profile with all unset values set to those of the default profile.
+func (p ProfileConfig) withDefaults() ProfileConfig {
+	def := defaultProfile()
+	if p.Dockerfile == "" {
+		p.Dockerfile = def.Dockerfile
+	}
+	if p.DataPath == "" {
+		p.DataPath = def.DataPath
+	}
+	if p.Port == 0 {
+		p.Port = def.Port
+	}
+	if p.Arch == "" {
+		p.Arch = def.Arch
+	}
+	if p.ConfigFile == "" {
+		p.ConfigFile = def.ConfigFile
+	}
+	return p
+}
+
+// expand replaces {pr} in the value passed with the number of the pull request.
+func expand(value, pr string) string {
+	return strings.ReplaceAll(value, "{pr}", pr)
+}
+
+// Profile returns the profile with the name passed. If the name is empty, the first profile is returned.
+func (c Config) Profile(name string) (ProfileConfig, bool) {
+	for _, profile := range c.Profiles {
+		if name == "" || profile.Name == name {
+			return profile, true
+		}
+	}
+	return ProfileConfig{}, false
+}
+
+// expandDeployment replaces {pr} in the value passed with the number of the pull request of the deployment,
+// and {title}, {author}, {build}, {commit} and {profile} with its metadata. Metadata that is unknown is
+// replaced by an empty string.
+func expandDeployment(value string, deployment Deployment) string {
+	return strings.NewReplacer(
+		"{pr}", deployment.PR,
+		"{title}", deployment.Title,
+		"{author}", deployment.Author,
+		"{build}", deployment.Build,
+		"{commit}", deployment.Commit,
+		"{profile}", deployment.Profile,
+	).Replace(value)
+}
+
+// expandDeploymentAll replaces the placeholders of expandDeployment in all values passed.
+func expandDeploymentAll(values []string, deployment Deployment) []string {
+	expanded := make([]string, len(values))
+	for i, value := range values {
+		expanded[i] = expandDeployment(value, deployment)
+	}
+	return expanded
+}
+
+// profile returns the profile the image of the given PR was built with and its deployment, as recorded in its
+// labels. Images built before profiles were recorded use the first profile.
+func (d *Docker) profile(ctx context.Context, pr string) (ProfileConfig, Deployment) {
+	deployment := Deployment{PR: pr}
+	if parsed, ok, err := d.Deployment(ctx, pr); err == nil && ok {
+		deployment = parsed
+	}
+	if profile, ok := d.conf.Profile(deployment.Profile); ok {
+		return profile, deployment
+	}
+	profile, _ := d.conf.Profile("")
+	return profile, deployment
+}
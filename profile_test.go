@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestExpandDeployment(t *testing.T) {
+	deployment := Deployment{PR: "123", Title: "Add {pr} support", Author: "alice", Build: "7", Commit: "abc123", Profile: "vanilla"}
+	tests := []struct {
+		value, want string
+	}{
+		{"pr-{pr}", "pr-123"},
+		{"{title} by {author}", "Add {pr} support by alice"},
+		{"{profile}-{build}-{commit}", "vanilla-7-abc123"},
+		{"{unknown}", "{unknown}"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := expandDeployment(tt.value, deployment); got != tt.want {
+			t.Errorf("expandDeployment(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+	// Metadata that is unknown is replaced by an empty string.
+	if got := expandDeployment("{pr}:{title}:{commit}", Deployment{PR: "1"}); got != "1::" {
+		t.Errorf("expandDeployment with unknown metadata = %q, want 1::", got)
+	}
+}
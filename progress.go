@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+)
+
+// readyTimeout is the time a server that was just started is given to respond to pings before the player is
+// transferred to it regardless.
+const readyTimeout = time.Second * 30
+
+// startProgress shows the progress of starting the server of a PR to a player as a title, which is updated
+// every second with the current phase and the time passed, so that the player isn't left waiting in silence.
+type startProgress struct {
+	l   *Listener
+	c   *minecraft.Conn
+	pr  string
+	lng string
+
+	mu      sync.Mutex
+	phase   string
+	started time.Time
+
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// showProgress starts showing the progress of starting the server of the given PR to the player, starting
+// with the phase with the message ID passed. If progress updates are disabled, nothing is shown. The progress
+// must be stopped once the player is transferred or disconnected.
+func (l *Listener) showProgress(c *minecraft.Conn, pr, phase string) *startProgress {
+	p := &startProgress{l: l, c: c, pr: pr, lng: c.ClientData().LanguageCode, phase: phase, started: time.Now(), done: make(chan struct{}), stopped: make(chan struct{})}
+	if !l.conf.Messages.Progress {
+		close(p.done)
+		return p
+	}
+	// The title remains a little longer than the interval it is updated at, so that it doesn't flicker.
+	_ = c.WritePacket(&packet.SetTitle{ActionType: packet.TitleActionSetDurations, RemainDuration: 30, FadeOutDuration: 10})
+	go p.run()
+	return p
+}
+
+// run sends the current phase to the player every second until the progress is stopped.
+func (p *startProgress) run() {
+	defer close(p.stopped)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		p.send()
+		select {
+		case <-t.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// send sends the current phase and the time passed since the progress was started to the player.
+func (p *startProgress) send() {
+	p.mu.Lock()
+	phase, elapsed := p.phase, time.Since(p.started).Truncate(time.Second)
+	p.mu.Unlock()
+	_ = p.c.WritePacket(&packet.SetTitle{ActionType: packet.TitleActionSetSubtitle, Text: p.l.messages.Text(p.lng, phase, "pr", p.pr, "elapsed", elapsed.String())})
+	_ = p.c.WritePacket(&packet.SetTitle{ActionType: packet.TitleActionSetTitle, Text: p.l.messages.Text(p.lng, msgProgressTitle, "pr", p.pr)})
+}
+
+// set moves the progress to the phase with the message ID passed, showing it right away.
+func (p *startProgress) set(phase string) {
+	p.mu.Lock()
+	p.phase = phase
+	p.mu.Unlock()
+	select {
+	case <-p.done:
+	default:
+		p.send()
+	}
+}
+
+// stop stops updating the progress. If ready is true, the player is told they are being transferred,
+// otherwise the title is cleared.
+func (p *startProgress) stop(ready bool) {
+	p.once.Do(func() {
+		select {
+		case <-p.done:
+			// Progress updates are disabled.
+			return
+		default:
+		}
+		close(p.done)
+		// The last title is sent only once the goroutine updating it has stopped, so that it isn't overwritten.
+		<-p.stopped
+		if ready {
+			p.mu.Lock()
+			p.phase = msgProgressReady
+			p.mu.Unlock()
+			p.send()
+			return
+		}
+		_ = p.c.WritePacket(&packet.SetTitle{ActionType: packet.TitleActionClear})
+	})
+}
+
+// waitReady waits until the server at the address and port passed responds to pings, so that players aren't
+// transferred to a server that hasn't finished starting. It gives up once the context passed is cancelled or
+// readyTimeout passes, in which case the player is transferred regardless.
+func waitReady(ctx context.Context, address string, port uint16) bool {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	addr := fmt.Sprintf("%s:%d", address, port)
+	for {
+		if _, err := pingServer(addr, time.Second); err == nil {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Millisecond * 500):
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"github.com/sandertv/gophertunnel/minecraft/text"
+)
+
+// ProtocolConfig is a protocol version accepted by the Listener besides the one of the version of gophertunnel
+// prmanager is built with. Players only spawn in the stub world of the Listener before they are transferred,
+// so a client of a Minecraft version encoding the few packets involved in the same way can be accepted by
+// speaking the current protocol under its ID. This keeps players able to join when a Minecraft update is
+// released before prmanager is rebuilt with a gophertunnel supporting it, or when testers are on an older one.
+type ProtocolConfig struct {
+	// ID is the protocol version of the client, such as 766.
+	ID int32
+	// Version is the Minecraft version the protocol version belongs to, such as 1.21.50.
+	Version string
+	// PlainText specifies if formatting codes are stripped from the text shown to players, for clients that
+	// render them literally.
+	PlainText bool
+}
+
+// validateProtocols checks that the protocols passed have a version and are distinct from each other and the
+// current protocol.
+func validateProtocols(protocols []ProtocolConfig) error {
+	seen := map[int32]bool{protocol.CurrentProtocol: true}
+	for _, p := range protocols {
+		if p.ID <= 0 || p.Version == "" {
+			return fmt.Errorf("protocol %d must have a positive ID and a version", p.ID)
+		}
+		if seen[p.ID] {
+			return fmt.Errorf("protocol %d is accepted more than once", p.ID)
+		}
+		seen[p.ID] = true
+	}
+	return nil
+}
+
+// acceptedProtocols returns the protocols accepted by the Listener besides the current one.
+func acceptedProtocols(protocols []ProtocolConfig) []minecraft.Protocol {
+	accepted := make([]minecraft.Protocol, 0, len(protocols))
+	for _, p := range protocols {
+		accepted = append(accepted, aliasProtocol{Protocol: minecraft.DefaultProtocol, conf: p})
+	}
+	return accepted
+}
+
+// aliasProtocol is a minecraft.Protocol speaking the current protocol under the ID and version of another.
+type aliasProtocol struct {
+	minecraft.Protocol
+	conf ProtocolConfig
+}
+
+// ID ...
+func (p aliasProtocol) ID() int32 {
+	return p.conf.ID
+}
+
+// Ver ...
+func (p aliasProtocol) Ver() string {
+	return p.conf.Version
+}
+
+// ConvertFromLatest strips formatting codes from the text of the packets sent if the protocol has the plain
+// text quirk.
+func (p aliasProtocol) ConvertFromLatest(pk packet.Packet, _ *minecraft.Conn) []packet.Packet {
+	if !p.conf.PlainText {
+		return []packet.Packet{pk}
+	}
+	switch pk := pk.(type) {
+	case *packet.Disconnect:
+		pk.Message = text.Clean(pk.Message)
+	case *packet.ToastRequest:
+		pk.Title, pk.Message = text.Clean(pk.Title), text.Clean(pk.Message)
+	case *packet.SetTitle:
+		pk.Text = text.Clean(pk.Text)
+	case *packet.ModalFormRequest:
+		// Formatting codes only occur in the strings of the JSON of forms, so they can be stripped as a whole.
+		pk.FormData = []byte(text.Clean(string(pk.FormData)))
+	}
+	return []packet.Packet{pk}
+}
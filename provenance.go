@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// provenanceFile is the name of the file holding the Provenance of an image at the root of the image. Previous
+// versions also kept it in the world directory of its pull request.
+const provenanceFile = "provenance.json"
+
+// provenancePath returns the path the Provenance of the current image of the given PR is kept at. It is kept
+// outside the world directory, so that the server of the PR can't change it.
+func provenancePath(pr string) string {
+	return filepath.Join("provenance", "pr-"+pr+".json")
+}
+
+// Provenance records what exactly an image of a pull request was built from, so that it can still be told
+// what a server ran long after it was deployed.
+type Provenance struct {
+	PR      string `json:"pr"`
+	Build   string `json:"build,omitempty"`
+	Commit  string `json:"commit,omitempty"`
+	Profile string `json:"profile,omitempty"`
+	// Built is the time the image was built.
+	Built time.Time `json:"built"`
+	// BinarySHA256 is the hex encoded SHA-256 hash of the binary the image was built with.
+	BinarySHA256 string `json:"binary_sha256"`
+	BinarySize   int64  `json:"binary_size"`
+	// Prmanager is the version of prmanager that built the image.
+	Prmanager string `json:"prmanager"`
+}
+
+// newProvenance creates the Provenance of an image of the PR of the deployment passed built now from the
+// binary currently uploaded for it.
+func newProvenance(deployment Deployment) (Provenance, error) {
+	size, sum, err := hashFile(binaryPath(deployment.PR))
+	if err != nil {
+		return Provenance{}, fmt.Errorf("hash binary: %w", err)
+	}
+	return Provenance{
+		PR:           deployment.PR,
+		Build:        deployment.Build,
+		Commit:       deployment.Commit,
+		Profile:      deployment.Profile,
+		Built:        time.Now(),
+		BinarySHA256: sum,
+		BinarySize:   size,
+		Prmanager:    prmanagerVersion(),
+	}, nil
+}
+
+// writeProvenance writes the Provenance passed to the file at the path passed, creating its directory if needed.
+func writeProvenance(path string, p Provenance) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// readProvenance reads the Provenance of the current image of the given PR, or returns false if it has none,
+// such as when the image was built before provenance was recorded outside its world directory.
+func readProvenance(pr string) (Provenance, bool) {
+	data, err := os.ReadFile(provenancePath(pr))
+	if err != nil {
+		return Provenance{}, false
+	}
+	var p Provenance
+	if err := json.Unmarshal(data, &p); err != nil {
+		return Provenance{}, false
+	}
+	return p, true
+}
+
+// prmanagerVersion returns the version of the running prmanager binary, along with the commit it was built
+// from if it is known.
+func prmanagerVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			version += " (" + setting.Value + ")"
+		}
+	}
+	return version
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProvenanceOutsideWorld(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll(worldDir("1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Provenance written into the world directory, as by the server itself or previous versions, is ignored.
+	if err := writeProvenance(filepath.Join(worldDir("1"), provenanceFile), Provenance{PR: "1", Commit: "forged"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readProvenance("1"); ok {
+		t.Fatal("provenance read from world directory")
+	}
+	if err := writeProvenance(provenancePath("1"), Provenance{PR: "1", Commit: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	p, ok := readProvenance("1")
+	if !ok || p.Commit != "abc" {
+		t.Fatalf("got %+v, %v, expected commit abc", p, ok)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies are the reverse proxies, such as nginx or Cloudflare, whose X-Forwarded-For header is trusted
+// to hold the address of the client they forward a request for.
+type trustedProxies struct {
+	prefixes []netip.Prefix
+	// unix specifies if clients connecting through the Unix domain socket of the API are trusted.
+	unix bool
+}
+
+// parseTrustedProxies parses the trusted proxies passed, each an IP address, a CIDR range such as
+// 173.245.48.0/20, or unix for clients of the Unix domain socket of the API.
+func parseTrustedProxies(entries []string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, entry := range entries {
+		if entry == "unix" {
+			proxies.unix = true
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return trustedProxies{}, fmt.Errorf("invalid trusted proxy %q: must be an IP address, CIDR range or unix", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		proxies.prefixes = append(proxies.prefixes, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// contains checks if the address passed is that of a trusted proxy.
+func (p trustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client a request was made by if it was forwarded by a trusted proxy.
+// The X-Forwarded-For header is walked from the proxy closest to prmanager outward, stopping at the first
+// address that isn't a trusted proxy, so that clients can't spoof their address by sending the header
+// themselves.
+func (p trustedProxies) clientAddr(request *http.Request) (netip.Addr, bool) {
+	var current netip.Addr
+	if local, ok := request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && local.Network() == "unix" {
+		if !p.unix {
+			return netip.Addr{}, false
+		}
+	} else {
+		peer, err := netip.ParseAddrPort(request.RemoteAddr)
+		if err != nil || !p.contains(peer.Addr()) {
+			return netip.Addr{}, false
+		}
+		current = peer.Addr().Unmap()
+	}
+	hops := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		current = addr.Unmap()
+		if !p.contains(current) {
+			break
+		}
+	}
+	return current, current.IsValid()
+}
+
+// proxyMiddleware is a middleware that replaces the remote address of requests forwarded by a trusted proxy
+// with that of the client, so that rate limiting, bans and logs apply to the client rather than the proxy.
+func (r *Router) proxyMiddleware(next http.Handler) http.Handler {
+	if len(r.proxies.prefixes) == 0 && !r.proxies.unix {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if addr, ok := r.proxies.clientAddr(request); ok {
+			request = request.WithContext(request.Context())
+			request.RemoteAddr = netip.AddrPortFrom(addr, 0).String()
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxiesClientAddr(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		unix      bool
+		want      string
+	}{
+		{"untrusted peer", "203.0.113.1:5000", []string{"198.51.100.1"}, false, ""},
+		{"trusted peer without header", "10.0.0.1:5000", nil, false, "10.0.0.1"},
+		{"trusted peer", "10.0.0.1:5000", []string{"198.51.100.1"}, false, "198.51.100.1"},
+		{"single trusted address", "192.168.1.1:5000", []string{"198.51.100.1"}, false, "198.51.100.1"},
+		{"spoofed hops", "10.0.0.1:5000", []string{"1.2.3.4, 198.51.100.1"}, false, "198.51.100.1"},
+		{"chain of proxies", "10.0.0.1:5000", []string{"198.51.100.1, 10.0.0.2"}, false, "198.51.100.1"},
+		{"multiple headers", "10.0.0.1:5000", []string{"198.51.100.1", "10.0.0.2"}, false, "198.51.100.1"},
+		{"invalid hop", "10.0.0.1:5000", []string{"198.51.100.1, garbage"}, false, "10.0.0.1"},
+		{"mapped peer", "[::ffff:10.0.0.1]:5000", []string{"198.51.100.1"}, false, "198.51.100.1"},
+		{"unix socket", "@", []string{"198.51.100.1"}, true, "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.RemoteAddr = tt.remote
+			for _, v := range tt.forwarded {
+				request.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.unix {
+				local := &net.UnixAddr{Name: "/run/prmanager.sock", Net: "unix"}
+				request = request.WithContext(context.WithValue(request.Context(), http.LocalAddrContextKey, local))
+			}
+			addr, ok := proxies.clientAddr(request)
+			if tt.want == "" {
+				if ok {
+					t.Errorf("clientAddr = %s, want none", addr)
+				}
+				return
+			}
+			if !ok || addr.String() != tt.want {
+				t.Errorf("clientAddr = %s, %v, want %s", addr, ok, tt.want)
+			}
+		})
+	}
+
+	// Clients of the Unix domain socket are not trusted unless configured.
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("X-Forwarded-For", "198.51.100.1")
+	request = request.WithContext(context.WithValue(request.Context(), http.LocalAddrContextKey, &net.UnixAddr{Net: "unix"}))
+	if addr, ok := (trustedProxies{}).clientAddr(request); ok {
+		t.Errorf("clientAddr of untrusted unix client = %s, want none", addr)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, entry := range []string{"10.0.0.1", "10.0.0.0/8", "2001:db8::/32", "unix"} {
+		if _, err := parseTrustedProxies([]string{entry}); err != nil {
+			t.Errorf("parse %q: %v", entry, err)
+		}
+	}
+	for _, entry := range []string{"", "localhost", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("parse %q: expected error", entry)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// purgeInterval is how often pull requests whose grace period has passed are purged.
+const purgeInterval = time.Minute * 5
+
+// errNotDeleted is returned when restoring a pull request that was not deleted.
+var errNotDeleted = errors.New("pull request is not deleted")
+
+// Purger deletes pull requests in two phases. Deleting a pull request through the API only stops its server
+// and marks it deleted, keeping its image, binary and world. Once the grace period has passed, the pull request
+// is purged. Until then it can be restored, so that a preview someone is using isn't lost to an accidental
+// deletion, for example by CI.
+type Purger struct {
+	backend Backend
+	backups *BackupManager
+	state   *State
+	grace   time.Duration
+}
+
+// NewPurger creates a Purger with the grace period configured. Worlds of purged pull requests are backed up
+// using the BackupManager passed.
+func NewPurger(backend Backend, backups *BackupManager, state *State, conf Config) *Purger {
+	return &Purger{backend: backend, backups: backups, state: state, grace: conf.Delete.GracePeriod}
+}
+
+// Job returns the Job purging the pull requests whose grace period has passed. If there is no grace period,
+// pull requests are purged as they are deleted, so the job only runs when triggered.
+func (p *Purger) Job() Job {
+	job := Job{Name: "purge", Run: p.purge}
+	if p.grace > 0 {
+		job.Interval = purgeInterval
+	}
+	return job
+}
+
+// Delete deletes the given PR. If there is a grace period, its server is stopped and it is marked deleted, and
+// the time it is purged at is returned. Otherwise it is purged right away and a zero time is returned.
+func (p *Purger) Delete(ctx context.Context, pr string) (time.Time, error) {
+	if p.grace == 0 {
+		return time.Time{}, p.Purge(ctx, pr)
+	}
+	// The PR is marked deleted before its server is stopped, so that a player joining in the meantime doesn't
+	// start it again.
+	// The instances of the PR are deleted and restored along with it.
+	ids := append([]string{pr}, instances(pr)...)
+	deleted := time.Now()
+	if err := p.state.Update(func(data *stateData) {
+		for _, id := range ids {
+			data.Deleted[id] = deleted
+		}
+	}); err != nil {
+		return time.Time{}, fmt.Errorf("mark deleted: %w", err)
+	}
+	for _, id := range ids {
+		if _, err := p.backend.StopServer(ctx, id); err != nil {
+			slog.WarnContext(ctx, "Failed to stop server of deleted PR", slog.String("pr", id), slog.Any("error", err))
+		}
+	}
+	return deleted.Add(p.grace), nil
+}
+
+// Purge deletes the server, image and files of the given PR right away, regardless of the grace period.
+func (p *Purger) Purge(ctx context.Context, pr string) error {
+	deletePullRequest(ctx, p.backend, p.backups, pr)
+	return p.forget(pr)
+}
+
+// Restore restores the given PR if it was deleted and has not been purged yet, or cancels its deletion if it is
+// being drained. Its server is started again the next time a player joins. An error satisfying
+// errors.Is(err, errNotDeleted) is returned if it wasn't deleted.
+func (p *Purger) Restore(pr string) error {
+	var found bool
+	if err := p.state.Update(func(data *stateData) {
+		_, deleted := data.Deleted[pr]
+		_, draining := data.Draining[pr]
+		if found = deleted || draining; found {
+			delete(data.Deleted, pr)
+			delete(data.Draining, pr)
+			for _, id := range instances(pr) {
+				delete(data.Deleted, id)
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	if !found {
+		return errNotDeleted
+	}
+	return nil
+}
+
+// forget removes the mark of the given PR being deleted or drained, once it was purged or deployed again.
+func (p *Purger) forget(pr string) error {
+	return p.state.Update(func(data *stateData) {
+		delete(data.Deleted, pr)
+		delete(data.Draining, pr)
+	})
+}
+
+// purge purges all deleted pull requests whose grace period has passed. Marks of pull requests that were
+// removed otherwise in the meantime, such as by the retention policy, are removed.
+func (p *Purger) purge(ctx context.Context) error {
+	var due []string
+	p.state.View(func(data *stateData) {
+		for _, pr := range slices.Sorted(maps.Keys(data.Deleted)) {
+			if time.Since(data.Deleted[pr]) >= p.grace || !pullRequestExists(pr) {
+				due = append(due, pr)
+			}
+		}
+	})
+	var errs []error
+	for _, pr := range due {
+		if pullRequestExists(pr) {
+			slog.Info("Purging deleted PR", slog.String("pr", pr))
+			deletePullRequest(ctx, p.backend, p.backups, pr)
+		}
+		if err := p.forget(pr); err != nil {
+			errs = append(errs, fmt.Errorf("forget %s: %w", pr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deletedAt returns the time the given PR was deleted through the API, or false if it isn't deleted.
+func deletedAt(state *State, pr string) (time.Time, bool) {
+	var deleted time.Time
+	var ok bool
+	state.View(func(data *stateData) {
+		deleted, ok = data.Deleted[pr]
+	})
+	return deleted, ok
+}
+
+// deleteResponse is the body of the response to deleting a pull request that is kept for a grace period.
+type deleteResponse struct {
+	// PurgeAt is the time the pull request is purged at unless it is restored.
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+// handleRestorePullRequest handles restoring a pull request that was deleted and has not been purged yet.
+func (r *Router) handleRestorePullRequest(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	if !pullRequestExists(pr) {
+		logger.Warn("PR not found", "pr", pr)
+		http.Error(writer, "PR not found", http.StatusNotFound)
+		return
+	}
+	err := r.purger.Restore(pr)
+	if errors.Is(err, errNotDeleted) {
+		http.Error(writer, "PR is not deleted", http.StatusConflict)
+		return
+	} else if err != nil {
+		logger.Error("Failed to restore PR", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to restore PR", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Restored PR", "pr", pr)
+	writer.WriteHeader(http.StatusNoContent)
+}
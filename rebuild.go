@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultRebuildConcurrency is the number of images rebuilt at the same time by a rebuild job if the request
+// starting it doesn't specify it.
+const defaultRebuildConcurrency = 2
+
+// rebuildResult is the result of rebuilding the image of a single pull request in a rebuild job.
+type rebuildResult struct {
+	// Status is the status of the rebuild: pending, running, succeeded or failed.
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// rebuildJob rebuilds the images of many pull requests in the background, such as after the base image or
+// Dockerfile they share changed, recording the result for every pull request.
+type rebuildJob struct {
+	mu          sync.Mutex
+	Started     time.Time                 `json:"started"`
+	Finished    *time.Time                `json:"finished,omitempty"`
+	Concurrency int                       `json:"concurrency"`
+	Results     map[string]*rebuildResult `json:"results"`
+}
+
+// MarshalJSON ...
+func (j *rebuildJob) MarshalJSON() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	type job rebuildJob
+	return json.Marshal((*job)(j))
+}
+
+// set updates the result of the given PR.
+func (j *rebuildJob) set(pr string, f func(result *rebuildResult)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f(j.Results[pr])
+}
+
+// running checks if the job is still rebuilding images.
+func (j *rebuildJob) running() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Finished == nil
+}
+
+// rebuild rebuilds the image of the PR of the deployment passed from the binary already uploaded for it,
+// keeping the metadata of the deployment.
+func (r *Router) rebuild(ctx context.Context, deployment Deployment) error {
+	done := r.trackBuild(deployment.PR)
+	defer done()
+	return r.backend.BuildImage(ctx, deployment.PR, deployment)
+}
+
+// runRebuildJob rebuilds the images of the deployments passed in the job, at most job.Concurrency at a time.
+func (r *Router) runRebuildJob(job *rebuildJob, deployments []Deployment) {
+	sem := make(chan struct{}, job.Concurrency)
+	var wg sync.WaitGroup
+	for _, deployment := range deployments {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			pr := deployment.PR
+			started := time.Now()
+			job.set(pr, func(result *rebuildResult) {
+				result.Status, result.Started = "running", &started
+			})
+			err := r.rebuild(r.ctx, deployment)
+			finished := time.Now()
+			job.set(pr, func(result *rebuildResult) {
+				result.Status, result.Finished = "succeeded", &finished
+				if err != nil {
+					result.Status, result.Error = "failed", err.Error()
+				}
+			})
+			if err != nil {
+				slog.Error("Failed to rebuild image", "pr", pr, slog.Any("error", err))
+			} else {
+				slog.Info("Rebuilt image", "pr", pr)
+			}
+		}()
+	}
+	wg.Wait()
+	finished := time.Now()
+	job.mu.Lock()
+	job.Finished = &finished
+	job.mu.Unlock()
+	slog.Info("Finished rebuilding images", slog.Int("images", len(deployments)), slog.Duration("duration", finished.Sub(job.Started)))
+}
+
+// rebuildRequest is the body of a request starting a rebuild job.
+type rebuildRequest struct {
+	// PRs are the pull requests rebuilt. If empty, all pull requests are rebuilt.
+	PRs []string `json:"prs"`
+	// Concurrency is the number of images built at the same time. If zero, defaultRebuildConcurrency is used.
+	Concurrency int `json:"concurrency"`
+}
+
+// handleStartRebuild handles starting a job that rebuilds the images of all or selected pull requests from
+// the binaries already uploaded for them in the background. Only one job runs at a time.
+func (r *Router) handleStartRebuild(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	var req rebuildRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		logger.Warn("Failed to decode rebuild request", slog.Any("error", err))
+		http.Error(writer, "Failed to decode rebuild request", http.StatusBadRequest)
+		return
+	}
+	if req.Concurrency < 0 {
+		http.Error(writer, "Concurrency must not be negative", http.StatusBadRequest)
+		return
+	} else if req.Concurrency == 0 {
+		req.Concurrency = defaultRebuildConcurrency
+	}
+	if err := r.disk.Check(); err != nil {
+		logger.Error("Refusing rebuild", slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Refusing rebuild: %v", err), errorStatus(err))
+		return
+	}
+	deployments, err := r.backend.Deployments(request.Context())
+	if err != nil {
+		logger.Error("Failed to list pull requests", slog.Any("error", err))
+		http.Error(writer, "Failed to list pull requests", errorStatus(err))
+		return
+	}
+	// Environments are restarted when they are rebuilt, so they are redeployed through their own endpoint.
+	deployments = slices.DeleteFunc(deployments, func(deployment Deployment) bool {
+		return !validPullRequest(deployment.PR) || (len(req.PRs) > 0 && !slices.Contains(req.PRs, deployment.PR))
+	})
+	for _, pr := range req.PRs {
+		if !slices.ContainsFunc(deployments, func(deployment Deployment) bool { return deployment.PR == pr }) {
+			logger.Warn("PR not found", "pr", pr)
+			http.Error(writer, fmt.Sprintf("PR %s not found", pr), http.StatusNotFound)
+			return
+		}
+	}
+
+	job := &rebuildJob{Started: time.Now(), Concurrency: req.Concurrency, Results: make(map[string]*rebuildResult, len(deployments))}
+	for _, deployment := range deployments {
+		job.Results[deployment.PR] = &rebuildResult{Status: "pending"}
+	}
+	r.mu.Lock()
+	if r.rebuildJob != nil && r.rebuildJob.running() {
+		r.mu.Unlock()
+		logger.Warn("Rebuild already in progress")
+		http.Error(writer, "Rebuild already in progress", http.StatusConflict)
+		return
+	}
+	r.rebuildJob = job
+	r.mu.Unlock()
+
+	logger.Info("Rebuilding images", slog.Int("images", len(deployments)), slog.Int("concurrency", job.Concurrency))
+	go r.runRebuildJob(job, deployments)
+	writeJSON(writer, http.StatusAccepted, job)
+}
+
+// handleGetRebuild handles retrieving the progress and per-PR results of the last rebuild job.
+func (r *Router) handleGetRebuild(writer http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	job := r.rebuildJob
+	r.mu.Unlock()
+	if job == nil {
+		http.Error(writer, "No rebuild started", http.StatusNotFound)
+		return
+	}
+	writeJSON(writer, http.StatusOK, job)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Reconciler periodically compares the servers that should be running, as recorded in the State whenever a
+// server is started or stopped, with those actually running, and converges them: servers that are missing,
+// for example because the Docker daemon was restarted, are started again, and containers of pull requests that
+// are no longer deployed are stopped. Servers running without being recorded, such as one that is still
+// stopping, are left alone, as they are stopped once idle anyway.
+type Reconciler struct {
+	backend Backend
+	// complete returns an error while the servers and deployments listed by the backend are incomplete, as the
+	// container daemon of a host is unreachable. It is nil if they are always complete.
+	complete func() error
+	state    *State
+	conf     Config
+	interval time.Duration
+}
+
+// NewReconciler creates a Reconciler for the servers of the Backend passed, which must be wrapped in a
+// reconcilingBackend recording the servers that should be running in the State passed. Servers aren't
+// reconciled while complete, if not nil, returns an error, as the servers of an unreachable host would otherwise
+// be started again elsewhere.
+func NewReconciler(backend Backend, complete func() error, state *State, conf Config) *Reconciler {
+	return &Reconciler{backend: backend, complete: complete, state: state, conf: conf, interval: conf.Reconcile.Interval}
+}
+
+// Job returns the Job reconciling the servers every interval. If the interval is zero, servers are only
+// reconciled when the job is triggered.
+func (r *Reconciler) Job() Job {
+	return Job{Name: "reconcile", Interval: r.interval, Run: r.reconcile}
+}
+
+// reconcile converges the servers running with the servers that should be running once.
+func (r *Reconciler) reconcile(ctx context.Context) error {
+	if r.complete != nil {
+		if err := r.complete(); err != nil {
+			return fmt.Errorf("servers may be missing: %w", err)
+		}
+	}
+	// Servers are listed before the servers that should be running are read, so that a server stopped in
+	// the meantime isn't mistaken for one that went missing.
+	listCtx, cancel := context.WithTimeout(ctx, apiTimeout)
+	deployments, err := r.backend.Deployments(listCtx)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("list deployments: %w", err)
+	}
+	servers, err := r.backend.Servers(listCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("list servers: %w", err)
+	}
+	deployed := make(map[string]bool, len(deployments))
+	for _, d := range deployments {
+		deployed[d.PR] = true
+	}
+	running := make(map[string]bool, len(servers))
+	for _, srv := range servers {
+		running[srv.PR] = true
+	}
+
+	var unknown, missing []string
+	if err := r.state.Update(func(data *stateData) {
+		for pr := range running {
+			if !deployed[pr] {
+				unknown = append(unknown, pr)
+			}
+		}
+		for pr := range data.Running {
+			if !deployed[pr] {
+				delete(data.Running, pr)
+				continue
+			}
+			if _, ok := r.conf.Environment(pr); ok {
+				// The servers of environments are kept running by Environments.
+				continue
+			}
+			if !running[pr] {
+				missing = append(missing, pr)
+			}
+		}
+	}); err != nil {
+		return fmt.Errorf("update state: %w", err)
+	}
+
+	var errs []error
+	for _, pr := range unknown {
+		slog.Warn("Stopping server of PR that is not deployed", slog.String("pr", pr))
+		if _, err := r.backend.StopServer(ctx, pr); err != nil {
+			errs = append(errs, fmt.Errorf("stop server of %s: %w", pr, err))
+		}
+	}
+	for _, pr := range missing {
+		slog.Warn("Restarting server that should be running", slog.String("pr", pr))
+		startCtx, cancel := context.WithTimeout(ctx, startTimeout)
+		_, _, _, err := r.backend.StartServer(startCtx, pr)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("restart server of %s: %w", pr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// forgetRunningServers forgets which servers should be running, after all containers were cleared on startup.
+func forgetRunningServers(state *State) error {
+	return state.Update(func(data *stateData) {
+		clear(data.Running)
+	})
+}
+
+// reconcilingBackend is a Backend that records the servers that should be running in the State, for a
+// Reconciler to converge the servers actually running with.
+type reconcilingBackend struct {
+	Backend
+	state *State
+}
+
+// setRunning records whether the server of the given PR should be running.
+func (b reconcilingBackend) setRunning(ctx context.Context, pr string, running bool) {
+	if err := b.state.Update(func(data *stateData) {
+		if running {
+			data.Running[pr] = true
+		} else {
+			delete(data.Running, pr)
+		}
+	}); err != nil {
+		slog.WarnContext(ctx, "Failed to record if server should be running", slog.String("pr", pr), slog.Any("error", err))
+	}
+}
+
+// StartServer ...
+func (b reconcilingBackend) StartServer(ctx context.Context, pr string) (string, uint16, bool, error) {
+	addr, port, ok, err := b.Backend.StartServer(ctx, pr)
+	if err == nil {
+		b.setRunning(ctx, pr, true)
+	}
+	return addr, port, ok, err
+}
+
+// StopServer ...
+func (b reconcilingBackend) StopServer(ctx context.Context, pr string) (StopResult, error) {
+	// The server is recorded as stopped before stopping it, so that it isn't restarted while it is stopping.
+	b.setRunning(ctx, pr, false)
+	return b.Backend.StopServer(ctx, pr)
+}
+
+// DeleteServer ...
+func (b reconcilingBackend) DeleteServer(ctx context.Context, pr string) {
+	b.setRunning(ctx, pr, false)
+	b.Backend.DeleteServer(ctx, pr)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverMiddleware is a middleware that recovers from panics in handlers, logging the panic with its stack
+// trace and answering with a 500 JSON error rather than leaving the client without a response.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		w := &recordingWriter{ResponseWriter: writer}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				// ErrAbortHandler is used to deliberately abort a response and must reach net/http.
+				panic(v)
+			}
+			requestLogger(request).Error("Recovered from panic in handler", slog.Any("panic", v), slog.String("stack", string(debug.Stack())))
+			if w.wroteHeader {
+				// It's too late to change the response, so the connection is closed instead.
+				panic(http.ErrAbortHandler)
+			}
+			writeJSON(w, http.StatusInternalServerError, map[string]string{
+				"error":      "internal server error",
+				"request_id": requestID(request.Context()),
+			})
+		}()
+		next.ServeHTTP(w, request)
+	})
+}
+
+// recordingWriter is an http.ResponseWriter that records if the header of the response was written, along
+// with the status code and the number of bytes of the body written.
+type recordingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	status      int
+	written     int64
+}
+
+// WriteHeader ...
+func (w *recordingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write ...
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.status = http.StatusOK
+	}
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush ...
+func (w *recordingWriter) Flush() {
+	if !w.wroteHeader {
+		w.status = http.StatusOK
+	}
+	w.wroteHeader = true
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack ...
+func (w *recordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if !w.wroteHeader {
+		// The response is written to the connection directly, such as when upgrading to a WebSocket.
+		w.status = http.StatusSwitchingProtocols
+	}
+	w.wroteHeader = true
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the http.ResponseWriter wrapped, for use by http.ResponseController.
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// errBuildInterrupted is the error builds interrupted by prmanager stopping are reported as failed with if they
+// are not requeued.
+var errBuildInterrupted = errors.New("build was interrupted by prmanager stopping")
+
+// InFlightBuild is a build of the image of a pull request that is in progress, as persisted in the State.
+type InFlightBuild struct {
+	// Deployment is the deployment the image is built for.
+	Deployment Deployment `json:"deployment"`
+	Started    time.Time  `json:"started"`
+}
+
+// buildRecordingBackend is a Backend that records the builds of images in progress in the State, so that builds
+// interrupted by prmanager stopping can be recovered once it starts again.
+type buildRecordingBackend struct {
+	Backend
+	state *State
+	// stopping is cancelled as soon as prmanager starts stopping. Builds cancelled before then were abandoned
+	// and are not recovered.
+	stopping context.Context
+}
+
+// BuildImage ...
+func (b buildRecordingBackend) BuildImage(ctx context.Context, pr string, deployment Deployment) error {
+	if err := b.state.Update(func(data *stateData) {
+		data.Building[pr] = InFlightBuild{Deployment: deployment, Started: time.Now()}
+	}); err != nil {
+		slog.WarnContext(ctx, "Failed to record build in progress", slog.String("pr", pr), slog.Any("error", err))
+	}
+	err := b.Backend.BuildImage(ctx, pr, deployment)
+	if err != nil && ctx.Err() != nil && b.stopping.Err() != nil {
+		// The build was cancelled because prmanager is stopping rather than failing on its own, so it is left
+		// to be recovered.
+		return err
+	}
+	if err := b.state.Update(func(data *stateData) {
+		delete(data.Building, pr)
+	}); err != nil {
+		slog.WarnContext(ctx, "Failed to record build finished", slog.String("pr", pr), slog.Any("error", err))
+	}
+	return err
+}
+
+// CleanupBuild removes what an interrupted build of the image of the given PR left behind on the host: the
+// candidate image built before its version is checked and the containers checking it.
+func (d *Docker) CleanupBuild(ctx context.Context, pr string) error {
+	candidate := "pr-" + pr + ":candidate"
+	containers, err := d.client.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("ancestor", candidate)),
+	})
+	if err != nil {
+		return fmt.Errorf("list containers: %w", dockerError(err))
+	}
+	for _, c := range containers {
+		if err := d.client.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
+			return fmt.Errorf("remove container %s: %w", c.ID, dockerError(err))
+		}
+	}
+	// The candidate doesn't exist if the build was interrupted before it finished or the version was already
+	// checked.
+	_ = d.command(ctx, "image", "rm", candidate).Run()
+	return nil
+}
+
+// RecoverBuilds recovers the builds that were still in progress when prmanager last stopped. Their build
+// contexts, and anything they left behind on the hosts of the Cluster passed, are removed. The builds are then
+// started again, or reported as failed if Images.RequeueInterrupted is false or the binary they were built from
+// is gone. The Cluster is nil in dry-run mode. RecoverBuilds must be called before the Router serves requests,
+// so that builds started through the API aren't mistaken for interrupted ones.
+func (r *Router) RecoverBuilds(cluster *Cluster) {
+	var builds map[string]InFlightBuild
+	if err := r.state.Update(func(data *stateData) {
+		builds = maps.Clone(data.Building)
+		clear(data.Building)
+	}); err != nil {
+		slog.Error("Failed to read builds in progress", slog.Any("error", err))
+		return
+	}
+	if len(builds) == 0 {
+		return
+	}
+	for _, pr := range slices.Sorted(maps.Keys(builds)) {
+		removeBuildContext(pr)
+		if cluster != nil {
+			if err := cluster.CleanupBuild(r.ctx, pr); err != nil {
+				slog.Warn("Failed to clean up interrupted build", slog.String("pr", pr), slog.Any("error", err))
+			}
+		}
+	}
+
+	// Builds are started again in the background, so that they don't delay startup.
+	go func() {
+		for _, pr := range slices.Sorted(maps.Keys(builds)) {
+			r.recoverBuild(pr, builds[pr])
+		}
+	}()
+}
+
+// recoverBuild starts the interrupted build passed again, or reports it as failed if it can't be. If the build
+// was of a binary uploaded rather than a rebuild, the binary is kept and recorded in the build history once
+// built, as the upload would have.
+func (r *Router) recoverBuild(pr string, build InFlightBuild) {
+	logger := slog.With(slog.String("pr", pr), slog.Time("started", build.Started))
+	deployment := build.Deployment
+	_, err := os.Stat(binaryPath(pr))
+	if err != nil || !r.conf.Images.RequeueInterrupted {
+		if err != nil {
+			logger.Warn("Binary of interrupted build is gone", slog.Any("error", err))
+		}
+		logger.Error("Build of image was interrupted", slog.Any("error", errBuildInterrupted))
+		r.events.Publish(Event{Type: eventBuildFinished, PR: pr, Build: deployment.Build, Err: errBuildInterrupted})
+		return
+	}
+
+	logger.Info("Restarting interrupted build of image")
+	done := r.trackBuild(pr)
+	err = r.backend.BuildImage(r.ctx, pr, deployment)
+	done()
+	if err != nil {
+		logger.Error("Failed to restart interrupted build of image", slog.Any("error", err))
+		return
+	}
+	var recorded bool
+	r.state.View(func(data *stateData) {
+		// Rebuilds keep the time the binary was uploaded, which is only stored in the labels of images to the
+		// second.
+		recorded = slices.ContainsFunc(data.Builds[pr], func(record BuildRecord) bool {
+			return record.Uploaded.Truncate(time.Second).Equal(deployment.Deployed.Truncate(time.Second))
+		})
+	})
+	if !recorded {
+		artifact, err := keepBinary(pr, deployment.Build, r.conf.Artifacts.Keep)
+		if err != nil {
+			logger.Warn("Failed to keep binary", slog.Any("error", err))
+		}
+		if err := r.recordBuild(deployment, artifact.Build); err != nil {
+			logger.Warn("Failed to record build", slog.Any("error", err))
+		}
+	}
+	logger.Info("Finished interrupted build of image")
+}
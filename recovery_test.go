@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// cancelledBackend is a Backend whose builds fail with the error of their context.
+type cancelledBackend struct {
+	Backend
+}
+
+// BuildImage ...
+func (cancelledBackend) BuildImage(ctx context.Context, _ string, _ Deployment) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestBuildRecordingBackendCancelled(t *testing.T) {
+	state, err := OpenState(filepath.Join(t.TempDir(), "state.json"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	building := func() bool {
+		var ok bool
+		state.View(func(data *stateData) { _, ok = data.Building["1"] })
+		return ok
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Builds cancelled while prmanager keeps running were abandoned, so they are forgotten.
+	b := buildRecordingBackend{Backend: cancelledBackend{}, state: state, stopping: context.Background()}
+	if err := b.BuildImage(ctx, "1", Deployment{PR: "1"}); err == nil {
+		t.Fatal("cancelled build succeeded")
+	}
+	if building() {
+		t.Error("abandoned build still recorded in progress")
+	}
+
+	// Builds cancelled by prmanager stopping are left to be recovered.
+	b.stopping = ctx
+	_ = b.BuildImage(ctx, "1", Deployment{PR: "1"})
+	if !building() {
+		t.Error("build interrupted by stopping not recorded in progress")
+	}
+}
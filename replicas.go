@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// ReplicaChecker periodically pings the replicas of static routes over RakNet. Replicas that fail too many pings
+// in a row are marked down in the RoutingTable, so that players are sent to the other replicas instead, for
+// example while the main server restarts. Replicas are marked up again as soon as they respond.
+type ReplicaChecker struct {
+	routes *RoutingTable
+
+	interval time.Duration
+	failures int
+	// failed holds the number of pings in a row every replica has failed. It is only accessed by check, which
+	// the Scheduler never runs concurrently.
+	failed map[string]int
+}
+
+// NewReplicaChecker creates a new ReplicaChecker for the replicas of the RoutingTable passed, using the
+// interval and failure threshold of the health check configuration passed.
+func NewReplicaChecker(routes *RoutingTable, conf Config) *ReplicaChecker {
+	return &ReplicaChecker{
+		routes: routes,
+
+		interval: conf.Health.Interval,
+		failures: conf.Health.Failures,
+		failed:   make(map[string]int),
+	}
+}
+
+// Job returns the Job checking the replicas every interval.
+func (c *ReplicaChecker) Job() Job {
+	return Job{Name: "replicas", Interval: c.interval, Run: c.check}
+}
+
+// check pings every replica once and updates the replicas that are down in the RoutingTable.
+func (c *ReplicaChecker) check(context.Context) error {
+	addrs := c.routes.replicas()
+	failed := make(map[string]int, len(addrs))
+	down := make(map[string]bool)
+	for _, addr := range addrs {
+		if _, ok := failed[addr]; ok {
+			// Replicas shared by multiple routes are only pinged once.
+			continue
+		}
+		if _, err := pingServer(addr, time.Second*5); err != nil {
+			failed[addr] = c.failed[addr] + 1
+			if failed[addr] == c.failures {
+				slog.Warn("Replica of static route is down", slog.String("address", addr), slog.Any("error", err))
+			}
+		} else {
+			failed[addr] = 0
+			if c.failed[addr] >= c.failures {
+				slog.Info("Replica of static route is up again", slog.String("address", addr))
+			}
+		}
+		down[addr] = failed[addr] >= c.failures
+	}
+	c.failed = failed
+	c.routes.setDown(down)
+	return nil
+}
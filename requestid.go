@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+// requestIDKey is the context key of the ID of the API request or player connection an operation is performed
+// for.
+type requestIDKey struct{}
+
+// newRequestID returns a new random ID for an API request or player connection.
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestID returns a copy of the context passed carrying the request ID passed. Records logged with the
+// context, or any context derived from it, include the ID, so that all log lines of one request can be found.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the request ID carried by the context passed, or an empty string if there is none.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDAttr returns the attribute added to records logged for the request ID passed.
+func requestIDAttr(id string) slog.Attr {
+	return slog.String("request_id", id)
+}
+
+// validRequestID checks if a request ID passed by a client is short and printable enough to be logged.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware is a middleware that assigns an ID to every request, taken from the X-Request-ID header
+// if the client passed a valid one. The ID is carried by the context of the request and returned in the
+// X-Request-ID header of the response.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		writer.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(writer, request.WithContext(withRequestID(request.Context(), id)))
+	})
+}
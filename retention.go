@@ -0,0 +1,196 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// RetentionPolicy periodically deletes pull requests that are no longer used, so that stale environments don't
+// pile up on the hosts. Pull requests are deleted once they are older than the maximum age, once nobody joined
+// them for the maximum idle time, or if more pull requests are deployed than allowed. Pinned pull requests are
+// never deleted, and environments are not subject to the policy at all.
+type RetentionPolicy struct {
+	backend Backend
+	// complete returns an error while the servers and deployments listed by the backend are incomplete, as the
+	// container daemon of a host is unreachable. It is nil if they are always complete.
+	complete func() error
+	backups  *BackupManager
+	state    *State
+
+	interval time.Duration
+	maxAge   time.Duration
+	maxIdle  time.Duration
+	max      int
+	pinned   map[string]bool
+	// environments are the names of environments, which are never deleted and don't count towards the
+	// maximum.
+	environments map[string]bool
+}
+
+// NewRetentionPolicy creates a new RetentionPolicy from the retention configuration passed. Worlds of deleted
+// pull requests are backed up using the BackupManager passed, and the times players last joined are read from
+// the State passed. The policy isn't evaluated while complete, if not nil, returns an error, as pull requests
+// running on an unreachable host would otherwise be considered idle.
+func NewRetentionPolicy(backend Backend, complete func() error, backups *BackupManager, state *State, conf Config) *RetentionPolicy {
+	pinned := make(map[string]bool, len(conf.Retention.Pinned))
+	for _, pr := range conf.Retention.Pinned {
+		pinned[pr] = true
+	}
+	environments := make(map[string]bool, len(conf.Environments))
+	for _, env := range conf.Environments {
+		environments[env.Name] = true
+	}
+	return &RetentionPolicy{
+		backend:  backend,
+		complete: complete,
+		backups:  backups,
+		state:    state,
+
+		interval: conf.Retention.Interval,
+		maxAge:   conf.Retention.MaxAge,
+		maxIdle:  conf.Retention.MaxIdle,
+		max:      conf.Retention.MaxPullRequests,
+		pinned:   pinned,
+
+		environments: environments,
+	}
+}
+
+// Job returns the Job evaluating the policy every interval. If no limits are configured, the job only runs
+// when triggered, and deletes nothing.
+func (p *RetentionPolicy) Job() Job {
+	job := Job{Name: "retention", Run: p.evaluate}
+	if p.maxAge > 0 || p.maxIdle > 0 || p.max > 0 {
+		job.Interval = p.interval
+	}
+	return job
+}
+
+// retentionCandidate is a deployed pull request the retention policy is evaluated for.
+type retentionCandidate struct {
+	deployment Deployment
+	// lastUsed is the last time the pull request was uploaded, joined or seen running.
+	lastUsed time.Time
+}
+
+// evaluate deletes all pull requests that violate the policy.
+func (p *RetentionPolicy) evaluate(ctx context.Context) error {
+	if p.complete != nil {
+		if err := p.complete(); err != nil {
+			return fmt.Errorf("pull requests may be missing: %w", err)
+		}
+	}
+	listCtx, cancel := context.WithTimeout(ctx, apiTimeout)
+	deployments, err := p.backend.Deployments(listCtx)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("list deployments: %w", err)
+	}
+	servers, err := p.backend.Servers(listCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("list servers: %w", err)
+	}
+	running := make(map[string]bool, len(servers))
+	for _, srv := range servers {
+		running[srv.PR] = true
+	}
+
+	// Servers are stopped once they are idle, so one that is running is still being used.
+	now := time.Now()
+	candidates := make([]retentionCandidate, 0, len(deployments))
+	p.state.View(func(data *stateData) {
+		for _, d := range deployments {
+			_, deleted := data.Deleted[d.PR]
+			_, draining := data.Draining[d.PR]
+			if p.environments[d.PR] || deleted || draining {
+				// Deleted pull requests are purged once their grace period has passed or they are drained.
+				continue
+			}
+			c := retentionCandidate{deployment: d, lastUsed: d.Deployed}
+			if joined := data.Joins[d.PR]; joined.After(c.lastUsed) {
+				c.lastUsed = joined
+			}
+			if running[d.PR] {
+				c.lastUsed = now
+			}
+			candidates = append(candidates, c)
+		}
+	})
+
+	kept := 0
+	var remaining []retentionCandidate
+	for _, c := range candidates {
+		switch pr := c.deployment.PR; {
+		case p.pinned[pr]:
+			kept++
+		case p.maxAge > 0 && now.Sub(c.deployment.Deployed) > p.maxAge:
+			p.delete(ctx, pr, "uploaded too long ago")
+		case p.maxIdle > 0 && now.Sub(c.lastUsed) > p.maxIdle:
+			p.delete(ctx, pr, "idle for too long")
+		default:
+			remaining = append(remaining, c)
+		}
+	}
+	// Pinned pull requests count towards the maximum, but only unpinned ones are deleted to stay below it,
+	// starting with those used the least recently.
+	if p.max > 0 && kept+len(remaining) > p.max {
+		slices.SortFunc(remaining, func(a, b retentionCandidate) int {
+			return cmp.Compare(a.lastUsed.UnixNano(), b.lastUsed.UnixNano())
+		})
+		excess := min(kept+len(remaining)-p.max, len(remaining))
+		for _, c := range remaining[:excess] {
+			p.delete(ctx, c.deployment.PR, "too many pull requests deployed")
+		}
+	}
+	p.forgetJoins(deployments)
+	return nil
+}
+
+// delete deletes the given PR for the reason passed.
+func (p *RetentionPolicy) delete(ctx context.Context, pr, reason string) {
+	slog.Info("Deleting PR because of retention policy", slog.String("pr", pr), slog.String("reason", reason))
+	deletePullRequest(ctx, p.backend, p.backups, pr)
+}
+
+// forgetJoins removes the join times, demand, build history and canary routing of pull requests that are no longer
+// deployed from the State.
+func (p *RetentionPolicy) forgetJoins(deployments []Deployment) {
+	deployed := make(map[string]bool, len(deployments))
+	for _, d := range deployments {
+		deployed[d.PR] = true
+	}
+	if err := p.state.Update(func(data *stateData) {
+		for pr := range data.Joins {
+			if !deployed[pr] {
+				delete(data.Joins, pr)
+			}
+		}
+		for pr := range data.Demand {
+			if !deployed[pr] {
+				delete(data.Demand, pr)
+			}
+		}
+		for pr := range data.Builds {
+			if !deployed[pr] {
+				delete(data.Builds, pr)
+			}
+		}
+		for pr := range data.Images {
+			if !deployed[pr] {
+				delete(data.Images, pr)
+			}
+		}
+		for pr := range data.Canaries {
+			if !deployed[pr] {
+				delete(data.Canaries, pr)
+			}
+		}
+	}); err != nil {
+		slog.Warn("Failed to forget join times", slog.Any("error", err))
+	}
+}
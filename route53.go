@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// route53Endpoint is the endpoint of the Route53 API, which is only available in the us-east-1 region.
+const route53Endpoint = "https://route53.amazonaws.com"
+
+// route53Client is a dnsProvider managing the DNS records of a hosted zone on Route53. Like s3Client, it signs
+// requests with AWS Signature Version 4 rather than depending on the AWS SDK.
+type route53Client struct {
+	zone      string
+	accessKey string
+	secretKey string
+	http      *http.Client
+}
+
+// newRoute53Client creates a route53Client for the hosted zone with the ID passed, such as Z0123456789ABC.
+func newRoute53Client(zone, accessKey, secretKey string) *route53Client {
+	return &route53Client{
+		zone:      strings.TrimPrefix(zone, "/hostedzone/"),
+		accessKey: accessKey,
+		secretKey: secretKey,
+		http:      &http.Client{Timeout: time.Second * 30},
+	}
+}
+
+// route53ChangeRequest is the body of a ChangeResourceRecordSets request with a single change.
+type route53ChangeRequest struct {
+	XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Action  string   `xml:"ChangeBatch>Changes>Change>Action"`
+	Name    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Name"`
+	Type    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Type"`
+	TTL     int      `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>TTL"`
+	Value   string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+// upsert ...
+func (c *route53Client) upsert(ctx context.Context, record dnsRecord) error {
+	return c.change(ctx, "UPSERT", record)
+}
+
+// remove ...
+func (c *route53Client) remove(ctx context.Context, record dnsRecord) error {
+	err := c.change(ctx, "DELETE", record)
+	if err != nil && strings.Contains(err.Error(), "not found") {
+		// Route53 refuses to delete records that don't exist.
+		return nil
+	}
+	return err
+}
+
+// change applies a change with the action passed to the record passed.
+func (c *route53Client) change(ctx context.Context, action string, record dnsRecord) error {
+	body, err := xml.Marshal(route53ChangeRequest{Action: action, Name: record.Name, Type: record.Type, TTL: record.TTL, Value: record.Value})
+	if err != nil {
+		return fmt.Errorf("encode request: %w", err)
+	}
+	body = append([]byte(xml.Header), body...)
+	sum := sha256.Sum256(body)
+
+	path := "/2013-04-01/hostedzone/" + c.zone + "/rrset"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, route53Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	signV4(req, awsEscape(path, false), hex.EncodeToString(sum[:]), "us-east-1", "route53", c.accessKey, c.secretKey, time.Now().UTC())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", action, record.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Message string `xml:"Error>Message"`
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if xml.Unmarshal(msg, &e) == nil && e.Message != "" {
+			return fmt.Errorf("%s %s: %s: %s", action, record.Name, resp.Status, e.Message)
+		}
+		return fmt.Errorf("%s %s: %s: %s", action, record.Name, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
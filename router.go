@@ -1,70 +1,395 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/websocket"
 )
 
 // Router is the HTTP router for handling API requests related to pull requests and Docker operations.
 type Router struct {
-	docker *Docker
-	apiKey string
+	backend Backend
+	conf    Config
+	health  *HealthChecker
+	backups *BackupManager
+	prereqs *Prerequisites
+	disk    *DiskGuard
+	routes  *RoutingTable
+	envs    *Environments
+	secrets *SecretStore
+	state   *State
+	github  *gitHubClient
+	apiKey  string
+	// noAuth specifies if the API is served without authentication because no API key is set.
+	noAuth bool
+	// readKey is an API key that only grants access to the endpoints listing pull requests and their status,
+	// such as for a public status page. If empty, those endpoints only accept the API key.
+	readKey string
+	// signingKeys are the keys uploaded binaries must be signed with. If empty, signatures are not verified.
+	signingKeys []minisignKey
+	// adminKey is the API key required for the debug endpoints. If empty, they are disabled.
+	adminKey   string
+	debugState map[string]func(ctx context.Context) any
+	// readyChecks are checks of subsystems besides the prerequisites that must pass for /readyz to succeed.
+	readyChecks []func() error
+	// scheduler runs the periodic jobs listed and triggered through the admin endpoints.
+	scheduler *Scheduler
+	// events are the events of pull requests streamed through GET /events.
+	events *EventBus
+	// purger deletes pull requests after their grace period, unless they are restored.
+	purger *Purger
+	// drainer drains pull requests players are online on before they are deleted.
+	drainer *Drainer
+	// handoffs holds the handoff tokens issued to players as they are transferred.
+	handoffs *Handoffs
+	// git holds the credentials private repositories are fetched with when building from source.
+	git *GitCredentials
+
+	mu     sync.Mutex
+	builds map[string]time.Time
+	// limiter limits the rate of requests of every client, as configured in API.RateLimit.
+	limiter *rateLimiter
+	// guard bans clients that fail to authenticate too often, as configured in API.MaxAuthFailures.
+	guard *authGuard
+	// proxies are the reverse proxies trusted to forward the address of clients, as configured in
+	// API.TrustedProxies.
+	proxies trustedProxies
+	// rebuildJob is the last job started to rebuild the images of many pull requests, if any.
+	rebuildJob *rebuildJob
 
-	mux *http.ServeMux
+	mux    *http.ServeMux
+	server *http.Server
+	// ctx is the base context of all requests, which is cancelled to abort requests in flight on shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// streams is cancelled as soon as the Router starts shutting down, ending event streams, which would
+	// otherwise keep Shutdown waiting for them.
+	streams     context.Context
+	stopStreams context.CancelFunc
 }
 
-// NewRouter creates a new Router instance with the provided Docker client and API key. If the API key is
-// empty, it will not enforce API key authentication for the routes.
-func NewRouter(docker *Docker, apiKey string) *Router {
-	return &Router{
-		docker: docker,
-		apiKey: apiKey,
+// RouterDeps holds the subsystems a Router serves the API of and the API keys it accepts.
+type RouterDeps struct {
+	Backend   Backend
+	State     *State
+	Health    *HealthChecker
+	Backups   *BackupManager
+	Prereqs   *Prerequisites
+	Disk      *DiskGuard
+	Routes    *RoutingTable
+	Envs      *Environments
+	Secrets   *SecretStore
+	Scheduler *Scheduler
+	Events    *EventBus
+	Purger    *Purger
+	Drainer   *Drainer
+	Handoffs  *Handoffs
+	Git       *GitCredentials
+
+	// APIKey is the API key granting access to all routes besides the admin endpoints. If empty, the routes
+	// only accept API keys created through the admin endpoints, unless NoAuth is true, in which case they are
+	// served without authentication.
+	APIKey string
+	NoAuth bool
+	// ReadKey is an API key that only grants access to the status endpoints.
+	ReadKey string
+	// AdminKey is the API key required for the debug, routing, environment and job endpoints, which are only
+	// served if it is set.
+	AdminKey string
+}
+
+// NewRouter creates a new Router serving the API of the subsystems in the RouterDeps passed. The build history
+// of pull requests is recorded in their State.
+func NewRouter(conf Config, deps RouterDeps) *Router {
+	ctx, cancel := context.WithCancel(context.Background())
+	streams, stopStreams := context.WithCancel(context.Background())
+	// The keys were already validated when reading the config.
+	signingKeys, _ := parseMinisignKeys(conf.Signing.PublicKeys)
+	proxies, _ := parseTrustedProxies(conf.API.TrustedProxies)
+	r := &Router{
+		backend: deps.Backend,
+		conf:    conf,
+		health:  deps.Health,
+		backups: deps.Backups,
+		prereqs: deps.Prereqs,
+		disk:    deps.Disk,
+		routes:  deps.Routes,
+		envs:    deps.Envs,
+		secrets: deps.Secrets,
+		state:   deps.State,
+		github:  newGitHubClient(conf),
+		apiKey:  deps.APIKey,
+		noAuth:  deps.NoAuth && deps.APIKey == "",
+		readKey: deps.ReadKey,
+
+		signingKeys: signingKeys,
+
+		adminKey:   deps.AdminKey,
+		debugState: make(map[string]func(ctx context.Context) any),
+		builds:     make(map[string]time.Time),
+		limiter:    newRateLimiter(conf.API.RateLimit, conf.API.RateBurst),
+		guard:      newAuthGuard(conf.API.MaxAuthFailures, conf.API.AuthBanDuration),
+		proxies:    proxies,
+		scheduler:  deps.Scheduler,
+		events:     deps.Events,
+		purger:     deps.Purger,
+		drainer:    deps.Drainer,
+		handoffs:   deps.Handoffs,
+		git:        deps.Git,
 
-		mux: http.NewServeMux(),
+		mux:    http.NewServeMux(),
+		ctx:    ctx,
+		cancel: cancel,
+
+		streams:     streams,
+		stopStreams: stopStreams,
+	}
+	// The server and its routes are set up here rather than in Run, so that Shutdown may be called at any time.
+	r.server = &http.Server{
+		Handler:     chain(r.mux, requestIDMiddleware, r.proxyMiddleware, traceHandler, r.accessLogMiddleware, recoverMiddleware, r.preflightMiddleware),
+		BaseContext: func(net.Listener) context.Context { return r.ctx },
 	}
+	r.server.RegisterOnShutdown(r.stopStreams)
+	r.registerRoutes()
+	return r
 }
 
-// Run starts the HTTP server on the specified address. It sets up the routes for creating and deleting
-// pull requests, applying the API key middleware if an API key is provided.
-func (r *Router) Run(addr string) error {
-	slog.Info("Starting API server", "addr", addr)
-	r.mux.Handle("POST /pullrequest", r.apiKeyMiddleware(http.HandlerFunc(r.handleCreatePullRequest)))
-	r.mux.Handle("DELETE /pullrequest/{pr}", r.apiKeyMiddleware(http.HandlerFunc(r.handleDeletePullRequest)))
-	return http.ListenAndServe(addr, r.mux)
+// registerRoutes registers the routes for creating, deleting and inspecting pull requests, each wrapped in the
+// middlewares of the access it requires.
+func (r *Router) registerRoutes() {
+	limit := r.limiter.middleware
+	var (
+		public  = []middleware{limit}
+		read    = []middleware{r.corsMiddleware, limit, r.readKeyMiddleware}
+		api     = []middleware{r.corsMiddleware, limit, r.apiKeyMiddleware}
+		admin   = []middleware{limit, r.adminKeyMiddleware}
+		backend = []middleware{limit, r.handoffKeyMiddleware}
+	)
+	r.handle("GET /pullrequest", r.handleListPullRequests, read...)
+	r.handle("GET /pullrequest/{pr}", r.handleGetPullRequest, read...)
+	r.handle("GET /pullrequest/{pr}/stats", r.handleGetPullRequestStats, read...)
+	r.handle("GET /pullrequest/{pr}/logs", r.handleGetPullRequestLogs, api...)
+	r.handle("GET /pullrequest/{pr}/console", r.handleConsole, api...)
+	r.handle("GET /pullrequest/{pr}/binary", r.handleDownloadBinary, api...)
+	r.handle("GET /pullrequest/{pr}/binaries", r.handleListBinaries, api...)
+	r.handle("GET /pullrequest/{pr}/builds", r.handleListBuilds, api...)
+	r.handle("GET /events", r.handleEvents, api...)
+	r.handle("PUT /pullrequest/{pr}/canary", r.handlePutCanary, api...)
+	r.handle("DELETE /pullrequest/{pr}/canary", r.handleDeleteCanary, api...)
+	r.handle("POST /pullrequest/{pr}/rebuild", r.handleRebuildPullRequest, api...)
+	r.handle("POST /pullrequest/{pr}/clone", r.handleClonePullRequest, api...)
+	r.handle("GET /pullrequest/{pr}/snapshots", r.handleListSnapshots, api...)
+	r.handle("POST /pullrequest/{pr}/snapshots", r.handleCreateSnapshot, api...)
+	r.handle("POST /pullrequest/{pr}/snapshots/{id}/restore", r.handleRestoreSnapshot, api...)
+	r.handle("/pullrequest/{pr}/ports/{port}", r.handleProxyPortRoot, api...)
+	r.handle("/pullrequest/{pr}/ports/{port}/{path...}", r.handleProxyPort, api...)
+	// Probes and scrapers are exempt from rate limiting, as they must keep working while clients are limited.
+	r.handle("GET /readyz", r.handleReady)
+	if r.conf.StatusPage.Enabled {
+		r.handle("GET /status", r.handleStatusPage, public...)
+	}
+	// The public key handoff tokens are verified with is no secret, but the tokens themselves are.
+	r.handle("GET /handoffs/key", r.handleGetHandoffKey, public...)
+	r.handle("GET /handoffs/{xuid}", r.handleGetHandoff, backend...)
+	r.handle("GET /metrics", promhttp.Handler().ServeHTTP, r.apiKeyMiddleware)
+	r.handle("POST /pullrequest", r.handleCreatePullRequest, api...)
+	r.handle("DELETE /pullrequest/{pr}", r.handleDeletePullRequest, api...)
+	r.handle("POST /pullrequest/{pr}/restore", r.handleRestorePullRequest, api...)
+	r.handle("GET /pullrequest/{pr}/secrets", r.handleListSecrets, api...)
+	r.handle("PUT /pullrequest/{pr}/secrets/{name}", r.handlePutSecret, api...)
+	r.handle("DELETE /pullrequest/{pr}/secrets/{name}", r.handleDeleteSecret, api...)
+	r.handle("GET /pullrequest/{pr}/settings", r.handleGetSettings, api...)
+	r.handle("PUT /pullrequest/{pr}/settings", r.handlePutSettings, api...)
+	r.handle("DELETE /pullrequest/{pr}/settings", r.handleDeleteSettings, api...)
+	r.handle("GET /demand", r.handleGetDemand, read...)
+	r.handle("GET /aliases", r.handleListAliases, read...)
+	r.handle("PUT /aliases/{host}", r.handlePutAlias, api...)
+	r.handle("DELETE /aliases/{host}", r.handleDeleteAlias, api...)
+	if r.adminKey != "" {
+		r.registerDebugRoutes(admin)
+		r.handle("GET /routes", r.handleGetRoutes, admin...)
+		r.handle("PUT /routes", r.handlePutRoutes, admin...)
+		r.handle("GET /backends", r.handleListBackends, admin...)
+		r.handle("PUT /backends/{name}", r.handlePutBackend, admin...)
+		r.handle("DELETE /backends/{name}", r.handleDeleteBackend, admin...)
+		r.handle("GET /rebuilds", r.handleGetRebuild, admin...)
+		r.handle("POST /rebuilds", r.handleStartRebuild, admin...)
+		r.handle("GET /apikeys", r.handleListAPIKeys, admin...)
+		r.handle("POST /apikeys", r.handleCreateAPIKey, admin...)
+		r.handle("POST /apikeys/{id}/rotate", r.handleRotateAPIKey, admin...)
+		r.handle("DELETE /apikeys/{id}", r.handleDeleteAPIKey, admin...)
+		r.handle("GET /secrets", r.handleListSecrets, admin...)
+		r.handle("PUT /secrets/{name}", r.handlePutSecret, admin...)
+		r.handle("DELETE /secrets/{name}", r.handleDeleteSecret, admin...)
+		r.handle("GET /jobs", r.handleListJobs, admin...)
+		r.handle("POST /jobs/{name}/run", r.handleRunJob, admin...)
+		r.handle("GET /environments", r.handleListEnvironments, admin...)
+		r.handle("POST /environments/{name}", r.handleDeployEnvironment, admin...)
+		r.handle("POST /environments/{name}/redeploy", r.handleRedeployEnvironment, admin...)
+	}
+}
+
+// Run starts the HTTP server on the listeners passed, blocking until it is shut down or one of the listeners
+// fails.
+func (r *Router) Run(listeners ...net.Listener) error {
+	for _, l := range listeners {
+		slog.Info("Starting API server", "addr", l.Addr())
+	}
+	if r.noAuth {
+		slog.Warn("Authentication is disabled, anyone reaching the API can deploy and remove pull requests")
+	} else if r.apiKey == "" {
+		slog.Warn("API_KEY is not set, the API only accepts API keys created through the admin endpoints", "admin_endpoints", r.adminKey != "")
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			errs <- r.server.Serve(l)
+		}()
+	}
+	// Once one listener fails, the others are closed as well, as Serve only returns on Shutdown otherwise.
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		_ = r.server.Close()
+		return err
+	}
+	return nil
+}
+
+// listenUnix listens on a Unix domain socket at the path passed with the file permissions passed. A socket
+// file left behind at the path, such as by a process that crashed, is removed first.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == os.ModeSocket {
+		_ = os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("chmod socket: %w", err)
+	}
+	return l, nil
+}
+
+// Shutdown stops accepting new requests and waits for requests in flight to complete. If they haven't
+// completed once the context passed expires, they are aborted by cancelling their contexts.
+func (r *Router) Shutdown(ctx context.Context) error {
+	err := r.server.Shutdown(ctx)
+	if err != nil {
+		r.cancel()
+		_ = r.server.Close()
+	}
+	return err
+}
+
+// buildContext returns the context builds started by the request passed run with. It holds the values of the
+// request, but is only cancelled when the Router is aborting requests on shutdown rather than when the client
+// disconnects, so that a client giving up on a slow build doesn't leave a half built image or instance behind.
+// The request itself only waits for the result of the build. The function returned must be called once the
+// build is done.
+func (r *Router) buildContext(request *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(request.Context()))
+	stop := context.AfterFunc(r.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
 }
 
 // apiKeyMiddleware is a middleware that checks for the presence of a valid API key in the request headers.
 func (r *Router) apiKeyMiddleware(next http.Handler) http.Handler {
+	if r.noAuth {
+		return next
+	}
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		apiKey := request.Header.Get("X-API-Key")
-		if apiKey != r.apiKey {
-			slog.Warn("Invalid API key", "provided_key", apiKey)
-			http.Error(writer, "Unauthorized", http.StatusUnauthorized)
-			return
+		if r.authorize(writer, request, []string{scopeAPI}, r.apiKey) {
+			next.ServeHTTP(writer, request)
+		}
+	})
+}
+
+// readKeyMiddleware is a middleware that checks for the presence of either the API key or the read key in the
+// request headers. It guards the endpoints that only report the status of pull requests.
+func (r *Router) readKeyMiddleware(next http.Handler) http.Handler {
+	if r.noAuth {
+		return next
+	}
+	keys := []string{r.apiKey}
+	if r.readKey != "" {
+		keys = append(keys, r.readKey)
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if r.authorize(writer, request, []string{scopeAPI, scopeRead}, keys...) {
+			next.ServeHTTP(writer, request)
+		}
+	})
+}
+
+// handoffKeyMiddleware is a middleware that checks for the presence of the API key, the read key or an API key
+// with the backend scope in the request headers. It guards fetching the handoff tokens of players.
+func (r *Router) handoffKeyMiddleware(next http.Handler) http.Handler {
+	if r.noAuth {
+		return next
+	}
+	keys := []string{r.apiKey}
+	if r.readKey != "" {
+		keys = append(keys, r.readKey)
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if r.authorize(writer, request, []string{scopeAPI, scopeRead, scopeBackend}, keys...) {
+			next.ServeHTTP(writer, request)
 		}
-		next.ServeHTTP(writer, request)
 	})
 }
 
+// AddReadyCheck registers a function returning an error if a subsystem is not ready, in which case readiness
+// probes fail with the error. It must be called before Run.
+func (r *Router) AddReadyCheck(f func() error) {
+	r.readyChecks = append(r.readyChecks, f)
+}
+
+// handleReady handles readiness probes. It responds with 503 if the prerequisites for building the images of
+// pull requests are not met or another ready check fails. It does not require an API key, so that it can be
+// used by orchestrators.
+func (r *Router) handleReady(writer http.ResponseWriter, _ *http.Request) {
+	if err := r.prereqs.Ready(); err != nil {
+		http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	for _, check := range r.readyChecks {
+		if err := check(); err != nil {
+			http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	_, _ = io.WriteString(writer, "ok\n")
+}
+
 // handleCreatePullRequest handles the creation of a new pull request by uploading a binary file and building
 // a Docker image.
 func (r *Router) handleCreatePullRequest(writer http.ResponseWriter, request *http.Request) {
-	logger := slog.Default().With(slog.Group(
-		"request",
-		slog.String("method", request.Method),
-		slog.String("url", request.URL.String()),
-	))
+	logger := requestLogger(request)
 
 	// Try to parse the multipart form data from the request to extract the PR number and binary file.
-	if err := request.ParseMultipartForm(10 << 20); err != nil {
-		logger.Warn("Failed to parse form", slog.Any("error", err))
-		http.Error(writer, "Failed to parse form", http.StatusBadRequest)
+	if !r.parseUpload(writer, request, logger) {
 		return
 	}
 	pr := request.FormValue("pr")
@@ -73,72 +398,975 @@ func (r *Router) handleCreatePullRequest(writer http.ResponseWriter, request *ht
 		http.Error(writer, "Invalid PR number", http.StatusBadRequest)
 		return
 	}
-	file, _, err := request.FormFile("binary")
-	if err != nil {
-		logger.Warn("Failed to get file from form", slog.Any("error", err))
-		http.Error(writer, "Failed to get file from form", http.StatusBadRequest)
+	profile, ok := r.conf.Profile(request.FormValue("profile"))
+	if !ok {
+		logger.Warn("Unknown profile", "pr", pr, "profile", request.FormValue("profile"))
+		http.Error(writer, "Unknown profile", http.StatusBadRequest)
+		return
+	}
+	// The player limit of the configuration applies to PRs uploaded without one.
+	maxPlayers := 0
+	if v := request.FormValue("max_players"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			logger.Warn("Invalid player limit", "pr", pr, "max_players", v)
+			http.Error(writer, "Invalid player limit", http.StatusBadRequest)
+			return
+		}
+		maxPlayers = n
+	}
+	// Additional instances of the server are deployed from the same binary, for tests that need more than one.
+	instances := 0
+	if v := request.FormValue("instances"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxInstances {
+			logger.Warn("Invalid number of instances", "pr", pr, "instances", v)
+			http.Error(writer, fmt.Sprintf("Number of instances must be between 0 and %d", maxInstances), http.StatusBadRequest)
+			return
+		}
+		instances = n
+	}
+	var ports []uint16
+	if v := request.FormValue("ports"); v != "" {
+		var err error
+		if ports, err = parseExtraPorts(v); err != nil {
+			logger.Warn("Invalid ports", "pr", pr, "ports", v, slog.Any("error", err))
+			http.Error(writer, fmt.Sprintf("Invalid ports: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	// The binary is either uploaded itself, or built from source uploaded as a tarball or fetched from a git ref.
+	file, _, _ := request.FormFile("binary")
+	source, _, _ := request.FormFile("source")
+	ref := request.FormValue("ref")
+	if (file != nil) == (source != nil || ref != "") || (source != nil && ref != "") {
+		logger.Warn("Upload must have exactly one of binary, source and ref", "pr", pr)
+		http.Error(writer, "Exactly one of binary, source and ref must be set", http.StatusBadRequest)
 		return
 	}
+	// If signing keys are configured, the binary or source must be accompanied by a minisign signature. Git
+	// refs can't be signed, so they are refused when building from source.
+	var signature []byte
+	if ref == "" {
+		if signature, ok = r.uploadSignature(writer, request, logger); !ok {
+			return
+		}
+	}
+
+	ctx, cancel := r.buildContext(request)
+	defer cancel()
+
+	// A canary build is uploaded into a sandbox of the PR, which some of the players joining the PR are
+	// routed to. It starts off with a copy of the world of the PR.
+	if request.FormValue("canary") == "true" {
+		if instances > 0 {
+			logger.Warn("Canary builds can't have instances", "pr", pr)
+			http.Error(writer, "Canary builds can't have instances", http.StatusBadRequest)
+			return
+		}
+		if !pullRequestExists(pr) {
+			logger.Warn("PR not found", "pr", pr)
+			http.Error(writer, "PR not found", http.StatusNotFound)
+			return
+		}
+		if err := prepareCanary(ctx, r.backend, pr); err != nil {
+			logger.Error("Failed to prepare canary", "pr", pr, slog.Any("error", err))
+			http.Error(writer, fmt.Sprintf("Failed to prepare canary: %v", err), errorStatus(err))
+			return
+		}
+		pr = canaryID(pr)
+	}
 
-	// Upload the binary file and build the Docker image for the PR.
-	if err = uploadBinary(pr, file); err != nil {
+	// Upload the binary file, building it from source first if needed, and build the Docker image for the PR.
+	var commit string
+	var err error
+	if file != nil {
+		err = uploadBinary(pr, file, profile, signature, r.signingKeys)
+	} else {
+		// Building the binary takes as long as building an image, so it is reported as a build in progress too.
+		done := r.trackBuild(pr)
+		commit, err = buildFromSource(ctx, r.backend, r.git, pr, profile, source, ref, signature, r.signingKeys)
+		done()
+	}
+	if err != nil {
 		logger.Error("Failed to upload binary", "pr", pr, slog.Any("error", err))
-		http.Error(writer, fmt.Sprintf("Failed to upload binary: %v", err), http.StatusInternalServerError)
+		http.Error(writer, buildErrorMessage("Failed to upload binary", err), errorStatus(err))
 		return
 	}
-	if err = r.docker.BuildImage(pr); err != nil {
+	// A compose file describing auxiliary services for the PR may optionally be included.
+	if stack, _, err := request.FormFile("compose"); err == nil {
+		err = saveStack(pr, stack)
+		_ = stack.Close()
+		if err != nil {
+			logger.Error("Failed to save stack", "pr", pr, slog.Any("error", err))
+			http.Error(writer, fmt.Sprintf("Failed to save stack: %v", err), errorStatus(err))
+			return
+		}
+	}
+	deployment := Deployment{
+		PR:         pr,
+		Profile:    profile.Name,
+		Build:      request.FormValue("build"),
+		Commit:     cmp.Or(request.FormValue("commit"), commit),
+		Deployed:   time.Now(),
+		Deployer:   apiKeyID(request.Header.Get("X-API-Key")),
+		MaxPlayers: maxPlayers,
+		Instances:  instances,
+		Ports:      ports,
+	}
+	// The title and author of the PR are recorded, so that they can be used in the environment and arguments
+	// of its server.
+	if info, ok := r.github.PullRequest(request.Context(), pr); ok {
+		deployment.Title, deployment.Author = info.Title, info.Author
+	}
+	// Only the instances recorded in the previous deployment of the PR are taken over or deleted. Canary builds
+	// and sandboxes have no instances.
+	var previous Deployment
+	if basePullRequest(pr) == pr {
+		if previous, _, err = r.backend.Deployment(ctx, pr); err != nil {
+			logger.Error("Failed to look up previous deployment", "pr", pr, slog.Any("error", err))
+			http.Error(writer, "Failed to look up previous deployment", errorStatus(err))
+			return
+		}
+	}
+	r.events.Publish(Event{Type: eventDeployRequested, PR: pr, Build: deployment.Build})
+	// The binary is kept, so that it can still be downloaded once it has been replaced by a newer upload.
+	if err := r.deployUpload(ctx, logger, deployment, true, r.backend.BuildImage); err != nil {
 		logger.Error("Failed to build image", "pr", pr, slog.Any("error", err))
-		http.Error(writer, fmt.Sprintf("Failed to build image: %v", err), http.StatusInternalServerError)
+		http.Error(writer, buildErrorMessage("Failed to build image", err), errorStatus(err))
 		return
 	}
+	// Uploading a PR that was deleted but not purged yet deploys it again.
+	if err := r.purger.forget(pr); err != nil {
+		logger.Warn("Failed to forget deleted PR", "pr", pr, slog.Any("error", err))
+	}
+	// Only the PR itself has instances, not its sandboxes.
+	if basePullRequest(pr) == pr {
+		if err := r.deployInstances(ctx, deployment, previous.Instances); err != nil {
+			logger.Error("Failed to deploy instances", "pr", pr, slog.Any("error", err))
+			http.Error(writer, buildErrorMessage("Failed to deploy instances", err), errorStatus(err))
+			return
+		}
+	}
 
 	logger.Info("Successfully uploaded PR", "pr", pr)
 	writer.WriteHeader(http.StatusCreated)
 }
 
+// parseUpload parses the multipart form of an upload. Uploads are refused early if the disk is running full, as
+// the build would likely fail halfway. False is returned if the upload can't proceed, in which case the
+// error was already written.
+func (r *Router) parseUpload(writer http.ResponseWriter, request *http.Request, logger *slog.Logger) bool {
+	if err := r.disk.Check(); err != nil {
+		logger.Error("Refusing upload", slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Refusing upload: %v", err), errorStatus(err))
+		return false
+	}
+	if err := request.ParseMultipartForm(10 << 20); err != nil {
+		logger.Warn("Failed to parse form", slog.Any("error", err))
+		http.Error(writer, "Failed to parse form", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// uploadSignature returns the minisign signature of the binary or source of an upload. If signing keys are
+// configured, uploads without one are refused and false is returned after writing the error.
+func (r *Router) uploadSignature(writer http.ResponseWriter, request *http.Request, logger *slog.Logger) ([]byte, bool) {
+	if len(r.signingKeys) == 0 {
+		return nil, true
+	}
+	signature, err := formFile(request, "signature")
+	if err != nil {
+		logger.Warn("Missing signature", slog.Any("error", err))
+		http.Error(writer, "Binary must be signed", http.StatusForbidden)
+		return nil, false
+	}
+	return signature, true
+}
+
+// deployUpload deploys the binary uploaded for the deployment passed using deploy, such as by building its
+// image, and records it in the build history once deployed. If keep is true, the binary is also kept as an
+// artifact.
+func (r *Router) deployUpload(ctx context.Context, logger *slog.Logger, deployment Deployment, keep bool, deploy func(context.Context, string, Deployment) error) error {
+	done := r.trackBuild(deployment.PR)
+	err := deploy(ctx, deployment.PR, deployment)
+	done()
+	if err != nil {
+		return err
+	}
+	var artifact Artifact
+	if keep {
+		if artifact, err = keepBinary(deployment.PR, deployment.Build, r.conf.Artifacts.Keep); err != nil {
+			logger.Warn("Failed to keep binary", "pr", deployment.PR, slog.Any("error", err))
+		} else {
+			logger.Debug("Kept binary", "pr", deployment.PR, "build", artifact.Build)
+		}
+	}
+	if err := r.recordBuild(deployment, artifact.Build); err != nil {
+		logger.Warn("Failed to record build", "pr", deployment.PR, slog.Any("error", err))
+	}
+	return nil
+}
+
+// handleRebuildPullRequest handles rebuilding the image of a pull request from the binary already uploaded for
+// it, for example after the Dockerfile of its profile or its base image changed. The metadata of the
+// deployment is kept, and the server is restarted with the new image when the next player joins.
+func (r *Router) handleRebuildPullRequest(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	if err := r.disk.Check(); err != nil {
+		logger.Error("Refusing rebuild", "pr", pr, slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Refusing rebuild: %v", err), errorStatus(err))
+		return
+	}
+	deployments, err := r.backend.Deployments(request.Context())
+	if err != nil {
+		logger.Error("Failed to list pull requests", slog.Any("error", err))
+		http.Error(writer, "Failed to list pull requests", errorStatus(err))
+		return
+	}
+	i := slices.IndexFunc(deployments, func(deployment Deployment) bool { return deployment.PR == pr })
+	expired := i == -1 && slices.Contains(r.expired(deployments), pr)
+	if _, err := artifactPath(pr, ""); (i == -1 && !expired) || err != nil {
+		logger.Warn("PR not found", "pr", pr)
+		http.Error(writer, "PR not found", http.StatusNotFound)
+		return
+	}
+	var deployment Deployment
+	if expired {
+		// The image of an expired PR is gone, so it is rebuilt with the deployment in its build history.
+		deployment = r.lastDeployment(pr)
+	} else {
+		deployment = deployments[i]
+	}
+
+	ctx, cancel := r.buildContext(request)
+	defer cancel()
+	if err := r.rebuild(ctx, deployment); err != nil {
+		logger.Error("Failed to rebuild image", "pr", pr, slog.Any("error", err))
+		http.Error(writer, buildErrorMessage("Failed to rebuild image", err), errorStatus(err))
+		return
+	}
+	logger.Info("Successfully rebuilt PR", "pr", pr)
+	writer.WriteHeader(http.StatusNoContent)
+}
+
 // handleDeletePullRequest handles the deletion of a pull request by removing the associated files and
 // stopping the Docker container.
 func (r *Router) handleDeletePullRequest(writer http.ResponseWriter, request *http.Request) {
-	logger := slog.Default().With(slog.Group(
-		"request",
-		slog.String("method", request.Method),
-		slog.String("url", request.URL.String()),
-	))
+	logger := requestLogger(request)
 
 	// Extract the PR number from the request path.
-	pr := request.PathValue("pr")
-	if _, err := strconv.Atoi(pr); err != nil {
-		logger.Warn("Invalid PR number", "pr", pr, slog.Any("error", err))
-		http.Error(writer, "Invalid PR number", http.StatusBadRequest)
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
 		return
 	}
 
 	// Check if the PR actually exists before attempting to delete it.
-	name := "pr-" + pr
-	_, err := os.Stat(name)
+	_, err := os.Stat(worldDir(pr))
 	if errors.Is(err, os.ErrNotExist) {
 		logger.Warn("PR not found", "pr", pr)
 		http.Error(writer, "PR not found", http.StatusNotFound)
 		return
 	}
 
-	// Delete the server from Docker and remove the associated files.
-	r.docker.DeleteServer(pr)
-	_ = os.RemoveAll("pr-" + pr)
-	_ = os.Remove("binaries/pr-" + pr)
+	// A PR that is deleted only halfway can't be deployed again cleanly, so deleting it continues even if the
+	// client disconnects.
+	ctx := context.WithoutCancel(request.Context())
+
+	query := request.URL.Query()
+	purge := query.Get("purge") == "true"
+	if query.Get("drain") == "true" {
+		// Players online are given time to leave before the PR is deleted.
+		until, draining, err := r.drainer.Drain(ctx, pr, purge)
+		if err != nil {
+			logger.Error("Failed to drain PR", "pr", pr, slog.Any("error", err))
+			http.Error(writer, "Failed to drain PR", errorStatus(err))
+			return
+		} else if draining {
+			logger.Info("Draining PR before deleting it", "pr", pr, "drain_until", until)
+			writeJSON(writer, http.StatusAccepted, drainResponse{DrainUntil: until})
+			return
+		}
+	}
+	// Unless purging is requested, the PR is only marked deleted and kept for the grace period, during which
+	// it may be restored.
+	if purge {
+		if err := r.purger.Purge(ctx, pr); err != nil {
+			logger.Warn("Failed to forget deleted PR", "pr", pr, slog.Any("error", err))
+		}
+		logger.Info("Successfully deleted PR", "pr", pr)
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	purgeAt, err := r.purger.Delete(ctx, pr)
+	if err != nil {
+		logger.Error("Failed to delete PR", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to delete PR", http.StatusInternalServerError)
+		return
+	} else if purgeAt.IsZero() {
+		logger.Info("Successfully deleted PR", "pr", pr)
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	logger.Info("Marked PR deleted", "pr", pr, "purge_at", purgeAt)
+	writeJSON(writer, http.StatusAccepted, deleteResponse{PurgeAt: purgeAt})
+}
+
+// handleClonePullRequest handles cloning a pull request into a sandbox named by the to query parameter. The
+// sandbox gets a copy of the image and world of the pull request and is deployed independently of it, so that
+// it can be joined, snapshotted and deleted like any other pull request using its ID.
+func (r *Router) handleClonePullRequest(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	name := request.URL.Query().Get("to")
+	// The canary sandbox and the sandboxes of instances are reserved for the builds uploaded for the PR.
+	if !sandboxNamePattern.MatchString(name) || name == canarySandbox || isInstanceName(name) {
+		logger.Warn("Invalid sandbox name", "pr", pr, "to", name)
+		http.Error(writer, "Invalid sandbox name", http.StatusBadRequest)
+		return
+	}
+	to := sandboxID(pr, name)
+	if err := r.disk.Check(); err != nil {
+		logger.Error("Refusing clone", "pr", pr, slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Refusing clone: %v", err), errorStatus(err))
+		return
+	}
+	deployments, err := r.backend.Deployments(request.Context())
+	if err != nil {
+		logger.Error("Failed to list pull requests", slog.Any("error", err))
+		http.Error(writer, "Failed to list pull requests", errorStatus(err))
+		return
+	}
+	i := slices.IndexFunc(deployments, func(deployment Deployment) bool { return deployment.PR == pr })
+	if i == -1 || !pullRequestExists(pr) {
+		logger.Warn("PR not found", "pr", pr)
+		http.Error(writer, "PR not found", http.StatusNotFound)
+		return
+	}
+	// The clone keeps the build, commit and profile of the PR, but is deployed now by the caller.
+	deployment := deployments[i]
+	deployment.PR, deployment.Deployed, deployment.Deployer = to, time.Now(), apiKeyID(request.Header.Get("X-API-Key"))
+	deployment.Instances = 0
+
+	ctx, cancel := r.buildContext(request)
+	defer cancel()
+	done := r.trackBuild(to)
+	err = clonePullRequest(ctx, r.backend, pr, deployment)
+	done()
+	if errors.Is(err, errSandboxExists) {
+		logger.Warn("Sandbox already exists", "pr", pr, "sandbox", to)
+		http.Error(writer, "Sandbox already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		logger.Error("Failed to clone PR", "pr", pr, "sandbox", to, slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Failed to clone PR: %v", err), errorStatus(err))
+		return
+	}
+	if err := r.recordBuild(deployment, ""); err != nil {
+		logger.Warn("Failed to record build", "pr", to, slog.Any("error", err))
+	}
+	logger.Info("Cloned PR", "pr", pr, "sandbox", to)
+	writeJSON(writer, http.StatusCreated, map[string]string{"pr": to})
+}
+
+// The states of a pull request as returned by the API.
+const (
+	// statusRunning is the state of a pull request whose server is running.
+	statusRunning = "running"
+	// statusStopped is the state of a pull request whose server is stopped, which is started when a player
+	// joins.
+	statusStopped = "stopped"
+	// statusDraining is the state of a pull request that is drained before it is deleted.
+	statusDraining = "draining"
+	// statusDeleted is the state of a pull request that was deleted and is purged once its grace period passed.
+	statusDeleted = "deleted"
+	// statusExpired is the state of a pull request whose world is kept but whose image no longer exists, so
+	// its server can't be started until it is redeployed.
+	statusExpired = "expired"
+)
+
+// pullRequestStatus is the status of a pull request as returned by the API.
+type pullRequestStatus struct {
+	PR      string   `json:"pr"`
+	State   string   `json:"state"`
+	Running bool     `json:"running"`
+	Address string   `json:"address,omitempty"`
+	Port    uint16   `json:"port,omitempty"`
+	Health  string   `json:"health,omitempty"`
+	Latency *latency `json:"latency,omitempty"`
+	Canary  *Canary  `json:"canary,omitempty"`
+	Aliases []string `json:"aliases,omitempty"`
+	// Ports are the extra ports the running server exposes.
+	Ports      []extraPortStatus `json:"ports,omitempty"`
+	Deployment Deployment        `json:"deployment"`
+	// Deleted is set while the pull request is kept for the grace period after it was deleted.
+	Deleted *time.Time `json:"deleted,omitempty"`
+	// Draining is the time the pull request is deleted at while it is drained.
+	Draining *time.Time `json:"draining,omitempty"`
+	// Provenance is only included when retrieving a single pull request.
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+// latency is the latency of the server of a pull request as returned by the API, in milliseconds.
+type latency struct {
+	RTT    float64 `json:"rtt_ms"`
+	Jitter float64 `json:"jitter_ms"`
+}
+
+// status returns the current status of the pull request of the deployment passed.
+func (r *Router) status(ctx context.Context, deployment Deployment) (pullRequestStatus, error) {
+	addr, port, running, err := r.backend.ServerAddress(ctx, deployment.PR)
+	if err != nil {
+		return pullRequestStatus{}, err
+	}
+	status := pullRequestStatus{PR: deployment.PR, State: statusStopped, Running: running, Address: addr, Port: port, Deployment: deployment}
+	status.Aliases = r.routes.AliasesOf(deployment.PR)
+	if running {
+		status.State = statusRunning
+		status.Health = r.health.Health(deployment.PR)
+		if l, ok := r.health.Latency(deployment.PR); ok {
+			status.Latency = &latency{RTT: milliseconds(l.RTT), Jitter: milliseconds(l.Jitter)}
+		}
+		if len(deployment.Ports) > 0 {
+			servers, err := r.backend.Servers(ctx)
+			if err != nil {
+				return pullRequestStatus{}, err
+			}
+			if i := slices.IndexFunc(servers, func(srv Server) bool { return srv.PR == deployment.PR }); i != -1 {
+				status.Ports = extraPortStatuses(servers[i])
+			}
+		}
+	}
+	r.state.View(func(data *stateData) {
+		if canary, ok := data.Canaries[deployment.PR]; ok {
+			status.Canary = &canary
+		}
+		if deleted, ok := data.Deleted[deployment.PR]; ok {
+			status.State, status.Deleted = statusDeleted, &deleted
+		}
+		if drain, ok := data.Draining[deployment.PR]; ok {
+			status.State, status.Draining = statusDraining, &drain.Until
+		}
+	})
+	return status, nil
+}
+
+// expired returns the pull requests known on the host that lack an image, for example because it was removed
+// by pruning images, so that they can be listed as expired. Pull requests whose image is being built are not
+// expired.
+func (r *Router) expired(deployments []Deployment) []string {
+	known, err := knownPullRequests()
+	if err != nil {
+		return nil
+	}
+	for _, deployment := range deployments {
+		delete(known, deployment.PR)
+	}
+	r.mu.Lock()
+	for pr := range r.builds {
+		delete(known, pr)
+	}
+	r.mu.Unlock()
+	r.state.View(func(data *stateData) {
+		for pr := range data.Building {
+			delete(known, pr)
+		}
+	})
+	return slices.Sorted(maps.Keys(known))
+}
+
+// expiredStatus returns the status of the given PR, which lacks an image.
+func (r *Router) expiredStatus(pr string) pullRequestStatus {
+	return pullRequestStatus{PR: pr, State: statusExpired, Deployment: r.lastDeployment(pr)}
+}
+
+// lastDeployment returns the deployment of the given PR as recorded in its build history, for PRs whose image,
+// which holds the metadata of their deployment, no longer exists. Metadata not kept in the build history, such
+// as the title of the PR, is lost.
+func (r *Router) lastDeployment(pr string) Deployment {
+	deployment := Deployment{PR: pr}
+	r.state.View(func(data *stateData) {
+		if builds := data.Builds[pr]; len(builds) > 0 {
+			record := builds[len(builds)-1]
+			deployment.Build, deployment.Commit, deployment.Deployed = record.Build, record.Commit, record.Uploaded
+			deployment.Deployer, deployment.Profile = record.Deployer, record.Profile
+		}
+	})
+	return deployment
+}
+
+// milliseconds returns the duration passed in milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// handleListPullRequests handles listing the status of all deployed pull requests.
+func (r *Router) handleListPullRequests(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	deployments, err := r.backend.Deployments(request.Context())
+	if err != nil {
+		logger.Error("Failed to list pull requests", slog.Any("error", err))
+		http.Error(writer, "Failed to list pull requests", errorStatus(err))
+		return
+	}
+	statuses := make([]pullRequestStatus, 0, len(deployments))
+	for _, deployment := range deployments {
+		if !validPullRequest(deployment.PR) {
+			// Environments are listed by GET /environments.
+			continue
+		}
+		status, err := r.status(request.Context(), deployment)
+		if err != nil {
+			logger.Error("Failed to get PR status", "pr", deployment.PR, slog.Any("error", err))
+			http.Error(writer, "Failed to get PR status", errorStatus(err))
+			return
+		}
+		statuses = append(statuses, status)
+	}
+	for _, pr := range r.expired(deployments) {
+		if validPullRequest(pr) {
+			statuses = append(statuses, r.expiredStatus(pr))
+		}
+	}
+	writeJSON(writer, http.StatusOK, statuses)
+}
+
+// handleGetPullRequest handles retrieving the status of a single pull request.
+func (r *Router) handleGetPullRequest(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	deployments, err := r.backend.Deployments(request.Context())
+	if err != nil {
+		logger.Error("Failed to list pull requests", slog.Any("error", err))
+		http.Error(writer, "Failed to list pull requests", errorStatus(err))
+		return
+	}
+	i := slices.IndexFunc(deployments, func(deployment Deployment) bool { return deployment.PR == pr })
+	if i == -1 && slices.Contains(r.expired(deployments), pr) {
+		writeJSON(writer, http.StatusOK, r.expiredStatus(pr))
+		return
+	} else if i == -1 {
+		logger.Warn("PR not found", "pr", pr)
+		http.Error(writer, "PR not found", http.StatusNotFound)
+		return
+	}
+	status, err := r.status(request.Context(), deployments[i])
+	if err != nil {
+		logger.Error("Failed to get PR status", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to get PR status", errorStatus(err))
+		return
+	}
+	if provenance, ok := readProvenance(pr); ok {
+		status.Provenance = &provenance
+	}
+	writeJSON(writer, http.StatusOK, status)
+}
+
+// handleGetPullRequestStats handles retrieving the resource usage of the server of a pull request.
+func (r *Router) handleGetPullRequestStats(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	stats, found, err := r.backend.Stats(request.Context(), pr, true)
+	if err != nil {
+		logger.Error("Failed to get PR stats", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to get PR stats", errorStatus(err))
+		return
+	} else if !found {
+		http.Error(writer, "PR server not running", http.StatusNotFound)
+		return
+	}
+	writeJSON(writer, http.StatusOK, stats)
+}
+
+// handleGetPullRequestLogs handles downloading the current log file of the server of a pull request. The file
+// outlives the container, so it is available even if the server has since stopped.
+func (r *Router) handleGetPullRequestLogs(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	logs, err := r.backend.Logs(pr)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(writer, "No logs found for PR", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logger.Error("Failed to open PR logs", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to open PR logs", http.StatusInternalServerError)
+		return
+	}
+	defer logs.Close()
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.Copy(writer, logs)
+}
+
+// handleConsole handles opening an interactive console into the server of a pull request. The connection is
+// upgraded to a WebSocket, over which every message received is written to the standard input of the server
+// and its output is sent back as text messages.
+func (r *Router) handleConsole(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	if origin := request.Header.Get("Origin"); !r.consoleOrigin(origin, request.Host) {
+		logger.Warn("Refused console from foreign origin", "pr", pr, "origin", origin)
+		http.Error(writer, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	conn, err := r.backend.Attach(request.Context(), pr)
+	if errors.Is(err, errContainerNotFound) {
+		http.Error(writer, "PR server not running", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logger.Error("Failed to attach to server console", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to attach to server console", errorStatus(err))
+		return
+	}
+	defer conn.Close()
+
+	server := websocket.Server{
+		// The origin was already checked by consoleOrigin, which unlike the default check allows clients that
+		// aren't browsers and send no origin.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			logger.Info("Opened server console", "pr", pr)
+			go func() {
+				_, _ = io.Copy(conn, ws)
+				_ = conn.Close()
+			}()
+			_, _ = io.Copy(ws, conn)
+			logger.Info("Closed server console", "pr", pr)
+		},
+	}
+	server.ServeHTTP(writer, request)
+}
+
+// consoleOrigin checks if a WebSocket console may be opened from the origin passed, so that pages of other
+// sites can't open consoles in the browsers of users holding an API key. Clients that aren't browsers send no
+// origin and are allowed, as are pages served from the host of the API itself and origins allowed by
+// API.AllowedOrigins.
+func (r *Router) consoleOrigin(origin, host string) bool {
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, host) || r.allowedOrigin(origin)
+}
+
+// handleDownloadBinary handles downloading the binary of a pull request. If the build query parameter is set,
+// the binary kept of that build is downloaded, otherwise the binary currently uploaded.
+func (r *Router) handleDownloadBinary(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	build := request.URL.Query().Get("build")
+	path, err := artifactPath(pr, build)
+	if err != nil {
+		logger.Warn("Binary not found", "pr", pr, "build", build)
+		http.Error(writer, "Binary not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		logger.Error("Failed to open binary", "pr", pr, "build", build, slog.Any("error", err))
+		http.Error(writer, "Failed to open binary", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		logger.Error("Failed to stat binary", "pr", pr, "build", build, slog.Any("error", err))
+		http.Error(writer, "Failed to open binary", http.StatusInternalServerError)
+		return
+	}
+	name := "dragonfly-pr-" + pr
+	if build != "" {
+		name += "-" + build
+	}
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(writer, request, name, info.ModTime(), f)
+}
 
-	logger.Info("Successfully deleted PR", "pr", pr)
+// handleListBinaries handles listing the binaries kept of a pull request.
+func (r *Router) handleListBinaries(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	artifacts, err := listArtifacts(pr)
+	if err != nil {
+		logger.Error("Failed to list binaries", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to list binaries", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(writer, http.StatusOK, artifacts)
+}
+
+// buildHistory is the build history of a pull request as returned by the API.
+type buildHistory struct {
+	PR string `json:"pr"`
+	// Head is the commit SHA of the head of the pull request on GitHub, if it could be fetched.
+	Head string `json:"head,omitempty"`
+	// Stale specifies if the current build was built from a commit other than the head of the pull request.
+	// It is only set if both are known.
+	Stale  *bool        `json:"stale,omitempty"`
+	Builds []buildEntry `json:"builds"`
+}
+
+// buildEntry is a build in the buildHistory of a pull request.
+type buildEntry struct {
+	BuildRecord
+	// Current specifies if the build is the one the image of the pull request is currently built from.
+	Current bool `json:"current"`
+	// Downloadable specifies if the binary of the build is still kept.
+	Downloadable bool `json:"downloadable"`
+}
+
+// handleListBuilds handles listing the build history of a pull request, from oldest to newest, along with
+// whether the current build is behind the head of the pull request on GitHub.
+func (r *Router) handleListBuilds(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	var records []BuildRecord
+	r.state.View(func(data *stateData) {
+		records = slices.Clone(data.Builds[pr])
+	})
+	artifacts, err := listArtifacts(pr)
+	if err != nil {
+		logger.Error("Failed to list binaries", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to list binaries", http.StatusInternalServerError)
+		return
+	}
+	kept := make(map[string]bool, len(artifacts))
+	for _, a := range artifacts {
+		kept[a.Build] = true
+	}
+
+	history := buildHistory{PR: pr, Builds: make([]buildEntry, 0, len(records))}
+	for i, record := range records {
+		history.Builds = append(history.Builds, buildEntry{
+			BuildRecord:  record,
+			Current:      i == len(records)-1,
+			Downloadable: record.Artifact != "" && kept[record.Artifact],
+		})
+	}
+	if info, ok := r.github.PullRequest(request.Context(), pr); ok && info.Head != "" {
+		history.Head = info.Head
+		if len(records) > 0 && records[len(records)-1].Commit != "" {
+			stale := !strings.HasPrefix(info.Head, records[len(records)-1].Commit)
+			history.Stale = &stale
+		}
+	}
+	writeJSON(writer, http.StatusOK, history)
+}
+
+// handleListSnapshots handles listing the world snapshots of a pull request.
+func (r *Router) handleListSnapshots(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	snapshots, err := listSnapshots(pr)
+	if err != nil {
+		logger.Error("Failed to list snapshots", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to list snapshots", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(writer, http.StatusOK, snapshots)
+}
+
+// handleCreateSnapshot handles taking a snapshot of the world of a pull request. If the server of the pull
+// request is running, it is paused while the snapshot is taken, so that the world is not written to halfway.
+func (r *Router) handleCreateSnapshot(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	if !pullRequestExists(pr) {
+		logger.Warn("PR not found", "pr", pr)
+		http.Error(writer, "PR not found", http.StatusNotFound)
+		return
+	}
+	// The world of PRs on remote hosts isn't in their world directory, so a snapshot of it would be empty.
+	if err := localWorld(r.state, r.conf, pr); err != nil {
+		logger.Warn("Refused to snapshot world", "pr", pr, slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Failed to create snapshot: %v", err), errorStatus(err))
+		return
+	}
+
+	var snapshot Snapshot
+	err := withServerPaused(request.Context(), r.backend, pr, func() (err error) {
+		snapshot, err = createSnapshot(pr)
+		return err
+	})
+	if err != nil {
+		logger.Error("Failed to create snapshot", "pr", pr, slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Failed to create snapshot: %v", err), errorStatus(err))
+		return
+	}
+	logger.Info("Created snapshot", "pr", pr, "snapshot", snapshot.ID)
+	writeJSON(writer, http.StatusCreated, snapshot)
+}
+
+// handleRestoreSnapshot handles restoring the world of a pull request from one of its snapshots. The server of
+// the pull request is stopped first and starts with the restored world when the next player joins.
+func (r *Router) handleRestoreSnapshot(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	id := request.PathValue("id")
+	if !pullRequestExists(pr) {
+		logger.Warn("PR not found", "pr", pr)
+		http.Error(writer, "PR not found", http.StatusNotFound)
+		return
+	}
+	if err := localWorld(r.state, r.conf, pr); err != nil {
+		logger.Warn("Refused to restore snapshot", "pr", pr, slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Failed to restore snapshot: %v", err), errorStatus(err))
+		return
+	}
+	if _, err := r.backend.StopServer(request.Context(), pr); err != nil {
+		logger.Error("Failed to stop server for restore", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to stop server", errorStatus(err))
+		return
+	}
+	if err := restoreSnapshot(pr, id); errors.Is(err, errSnapshotNotFound) {
+		http.Error(writer, "Snapshot not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logger.Error("Failed to restore snapshot", "pr", pr, "snapshot", id, slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Failed to restore snapshot: %v", err), http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Restored snapshot", "pr", pr, "snapshot", id)
 	writer.WriteHeader(http.StatusNoContent)
 }
 
-// uploadBinary uploads the binary file for the specified pull request (PR) number. It creates a directory for
-// the PR server's save data to later mount to.
-func uploadBinary(pr string, file multipart.File) error {
-	_ = os.Mkdir("pr-"+pr, 0755)
-	out, err := os.Create("binaries/pr-" + pr)
+// pullRequestExists checks if the given pull request is known on the host.
+func pullRequestExists(pr string) bool {
+	info, err := os.Stat(worldDir(pr))
+	return err == nil && info.IsDir()
+}
+
+// requestLogger returns the default logger with the method and URL of the request passed attached.
+func requestLogger(request *http.Request) *slog.Logger {
+	return slog.Default().With(slog.Group(
+		"request",
+		slog.String("method", request.Method),
+		slog.String("url", request.URL.String()),
+	), requestIDAttr(requestID(request.Context())))
+}
+
+// pathPullRequest extracts the PR number, or the ID of a sandbox, from the path of the request passed. If it is
+// invalid, an error is written to the response and false is returned.
+func pathPullRequest(writer http.ResponseWriter, request *http.Request, logger *slog.Logger) (string, bool) {
+	pr := request.PathValue("pr")
+	if !validPullRequest(pr) {
+		logger.Warn("Invalid PR number", "pr", pr)
+		http.Error(writer, "Invalid PR number", http.StatusBadRequest)
+		return "", false
+	}
+	return pr, true
+}
+
+// writeJSON writes the value passed to the response as JSON with the status code passed.
+func writeJSON(writer http.ResponseWriter, code int, v any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	_ = json.NewEncoder(writer).Encode(v)
+}
+
+// deletePullRequest deletes the server, image and files of the given PR, backing up its world first.
+func deletePullRequest(ctx context.Context, backend Backend, backups *BackupManager, pr string) {
+	// Back up the world before it is lost. A failed backup shouldn't keep the PR from being deleted.
+	if err := backups.Backup(ctx, pr); err != nil {
+		slog.ErrorContext(ctx, "Failed to back up world", "pr", pr, slog.Any("error", err))
+	}
+	backups.Forget(pr)
+
+	// Delete the server from Docker and remove the associated files.
+	backend.DeleteServer(ctx, pr)
+	_ = os.RemoveAll(worldDir(pr))
+	_ = os.Remove(binaryPath(pr))
+	_ = os.Remove(provenancePath(pr))
+	removeLogs(pr)
+	removeSnapshots(pr)
+	removeArtifacts(pr)
+
+	// The canary build of a PR is only reached through the PR, so it is deleted along with it.
+	if basePullRequest(pr) == pr && pullRequestExists(canaryID(pr)) {
+		deletePullRequest(ctx, backend, backups, canaryID(pr))
+	}
+	// The instances of a PR are managed along with it, so they are deleted along with it too.
+	for _, id := range instances(pr) {
+		deletePullRequest(ctx, backend, backups, id)
+	}
+}
+
+// formFile reads the contents of the file with the name passed from a multipart form.
+func formFile(request *http.Request, name string) ([]byte, error) {
+	f, _, err := request.FormFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// uploadBinary uploads the binary file for the specified pull request (PR) number, after validating that it
+// can be run by servers of the profile passed and, if any keys are passed, that the signature passed is a
+// valid signature over it. An invalid binary does not replace the previous binary of the PR. It creates a
+// directory for the PR server's save data to later mount to.
+func uploadBinary(pr string, file multipart.File, profile ProfileConfig, signature []byte, keys []minisignKey) error {
+	path := binaryPath(pr)
+	out, err := os.Create(path + ".upload")
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
+	defer os.Remove(out.Name())
 	defer out.Close()
 	if _, err := file.Seek(0, 0); err != nil {
 		return fmt.Errorf("failed to seek file: %w", err)
@@ -146,5 +1374,20 @@ func uploadBinary(pr string, file multipart.File) error {
 	if _, err := io.Copy(out, file); err != nil {
 		return fmt.Errorf("failed to copy file: %w", err)
 	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if len(keys) > 0 {
+		if err := verifyMinisign(out.Name(), signature, keys); err != nil {
+			return err
+		}
+	}
+	if err := validateBinary(out.Name(), profile.Arch); err != nil {
+		return err
+	}
+	if err := os.Rename(out.Name(), path); err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	_ = os.Mkdir(worldDir(pr), 0755)
 	return nil
 }
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestConsoleOrigin(t *testing.T) {
+	var r Router
+	r.conf.API.AllowedOrigins = []string{"https://dashboard.example.com"}
+	tests := []struct {
+		origin, host string
+		allowed      bool
+	}{
+		{"", "prmanager.example.com", true},
+		{"https://prmanager.example.com", "prmanager.example.com", true},
+		{"http://PRManager.example.com:8080", "prmanager.example.com:8080", true},
+		{"https://dashboard.example.com", "prmanager.example.com", true},
+		{"https://evil.example.com", "prmanager.example.com", false},
+		{"https://prmanager.example.com.evil.com", "prmanager.example.com", false},
+		{"null", "prmanager.example.com", false},
+		{"://", "prmanager.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := r.consoleOrigin(tt.origin, tt.host); got != tt.allowed {
+			t.Errorf("consoleOrigin(%q, %q) = %v, want %v", tt.origin, tt.host, got, tt.allowed)
+		}
+	}
+}
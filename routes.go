@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Routes are the rules the Listener uses to decide where players are transferred based on the address they
+// joined with.
+type Routes struct {
+	// Static are the routes of servers that are not pull requests, such as the main and plots servers.
+	Static []StaticRoute `json:"static"`
+	// PullRequests is a regular expression matching the addresses of pull requests, of which the first
+	// submatch is the number of the pull request or the ID of a sandbox cloned from one.
+	PullRequests string `json:"pull_requests"`
+	// Fallback is the address and port, such as df-mc.dev:19133, that players joining with any other address
+	// are transferred to. If empty, they are disconnected instead.
+	Fallback string `json:"fallback,omitempty"`
+	// Direct is where players joining with an IP address rather than a host name, or without an address as
+	// some console clients do, are transferred to if no static route matches: either an address and port, or
+	// "selector" to let them select the pull request to join from a form. If empty, they are routed like any
+	// other address.
+	Direct string `json:"direct,omitempty"`
+}
+
+// routeSelector is the value of Routes.Direct letting players joining directly select the pull request to join.
+const routeSelector = "selector"
+
+// StaticRoute routes players joining with an address to a fixed server, which may have multiple replicas.
+type StaticRoute struct {
+	// Host is the address players join with, such as plots.df-mc.dev.
+	Host string `json:"host"`
+	// Addresses are the addresses and ports of the replicas of the server players are transferred to, such as
+	// df-mc.dev:19134. Players are distributed across replicas that respond to pings in turn.
+	Addresses []string `json:"addresses"`
+}
+
+// defaultRoutes returns the routes of the official servers and pull requests on df-mc.dev.
+func defaultRoutes() Routes {
+	return Routes{
+		Static: []StaticRoute{
+			{Host: "df-mc.dev", Addresses: []string{"df-mc.dev:19133"}},
+			{Host: "188.166.78.44", Addresses: []string{"df-mc.dev:19133"}},
+			{Host: "plots.df-mc.dev", Addresses: []string{"df-mc.dev:19134"}},
+		},
+		PullRequests: `^(\d+(?:-[a-z0-9]+)?)\.df-mc\.dev$`,
+	}
+}
+
+// validate checks if the routes are well-formed, returning the compiled pattern of pull request addresses.
+func (r Routes) validate() (*regexp.Regexp, error) {
+	pattern, err := regexp.Compile(r.PullRequests)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pull request pattern: %w", err)
+	} else if pattern.NumSubexp() < 1 {
+		return nil, fmt.Errorf("pull request pattern must capture the PR number")
+	}
+	hosts := make(map[string]bool, len(r.Static))
+	for _, route := range r.Static {
+		if route.Host == "" || hosts[serverHost(route.Host)] {
+			return nil, fmt.Errorf("static routes must have a unique host")
+		}
+		hosts[serverHost(route.Host)] = true
+		if len(route.Addresses) == 0 {
+			return nil, fmt.Errorf("static route %s must have at least one address", route.Host)
+		}
+		for _, addr := range route.Addresses {
+			if _, _, err := splitAddress(addr); err != nil {
+				return nil, fmt.Errorf("static route %s: %w", route.Host, err)
+			}
+		}
+	}
+	if r.Fallback != "" {
+		if _, _, err := splitAddress(r.Fallback); err != nil {
+			return nil, fmt.Errorf("fallback: %w", err)
+		}
+	}
+	if r.Direct != "" && r.Direct != routeSelector {
+		if _, _, err := splitAddress(r.Direct); err != nil {
+			return nil, fmt.Errorf("direct: %w", err)
+		}
+	}
+	return pattern, nil
+}
+
+// splitAddress splits an address in the format host:port into its host and port.
+func splitAddress(addr string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 || host == "" {
+		return "", 0, fmt.Errorf("invalid address %q", addr)
+	}
+	return host, uint16(port), nil
+}
+
+// StaticBackend is a named server that is not a pull request, such as a lobby or a test realm, registered
+// through the API. Static backends are persisted in the State, so they survive restarts.
+type StaticBackend struct {
+	// Name is the unique name the backend is registered under.
+	Name string `json:"name"`
+	// Host is a pattern matching the addresses players join the backend with, such as lobby.df-mc.dev or
+	// *.test.df-mc.dev, in the syntax of path.Match.
+	Host string `json:"host"`
+	// Address is the address and port players are transferred to, such as 10.0.0.5:19132.
+	Address string `json:"address"`
+}
+
+// backendName matches valid names of static backends.
+var backendName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// validate checks if the static backend is well-formed.
+func (b StaticBackend) validate() error {
+	if !backendName.MatchString(b.Name) {
+		return fmt.Errorf("name must consist of lowercase letters, digits and dashes")
+	}
+	if _, err := path.Match(b.Host, ""); err != nil || b.Host == "" {
+		return fmt.Errorf("invalid host pattern %q", b.Host)
+	}
+	if _, _, err := splitAddress(b.Address); err != nil {
+		return err
+	}
+	return nil
+}
+
+// matches checks if the pattern of the static backend matches the host passed, as returned by serverHost.
+func (b StaticBackend) matches(host string) bool {
+	ok, _ := path.Match(strings.ToLower(strings.TrimSuffix(b.Host, ".")), host)
+	return ok
+}
+
+// route is the destination of a player, as resolved by a RoutingTable.
+type route struct {
+	// PR is the number of the pull request the player is joining, if any. If set, the address and port are
+	// those of the server of the pull request and must be looked up separately.
+	PR string
+	// Address and Port are the address of the server that players are transferred to if PR is empty.
+	Address string
+	Port    uint16
+	// Select specifies if the player selects the pull request to join from a form, in which case the other
+	// fields are empty.
+	Select bool
+}
+
+// serverHost returns the host of the server address a client joined with, such as 123.df-mc.dev:19132 or
+// [::1]:19132, normalised so that clients formatting the address oddly are routed like any other: surrounding
+// whitespace, the port, the brackets of IPv6 addresses and the trailing dot of a fully qualified name are
+// removed, and the host is lowercased.
+func serverHost(addr string) string {
+	host := strings.TrimSpace(addr)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+}
+
+// directHost checks if the host passed, as joined with by a player, is an IP address or missing rather than
+// a host name.
+func directHost(host string) bool {
+	return host == "" || net.ParseIP(host) != nil
+}
+
+// RoutingTable holds the Routes of the Listener, which may be replaced at runtime through the API, and the
+// static backends registered through the API.
+type RoutingTable struct {
+	state *State
+
+	mu       sync.RWMutex
+	routes   Routes
+	pattern  *regexp.Regexp
+	backends []StaticBackend
+	// aliases maps the hosts of aliases to the pull requests they route to.
+	aliases map[string]string
+	// down holds the addresses of replicas of static routes that failed their health checks.
+	down map[string]bool
+	// next holds the index of the replica the next player joining a static route is sent to, by its host.
+	next map[string]*atomic.Uint32
+}
+
+// NewRoutingTable creates a new RoutingTable with the routes passed, which must be valid. Static backends are
+// read from and persisted to the State passed.
+func NewRoutingTable(routes Routes, state *State) (*RoutingTable, error) {
+	t := &RoutingTable{state: state, down: make(map[string]bool)}
+	if err := t.Set(routes); err != nil {
+		return nil, err
+	}
+	state.View(func(data *stateData) {
+		t.backends = sortedBackends(data.Backends)
+		t.aliases = maps.Clone(data.Aliases)
+	})
+	return t, nil
+}
+
+// sortedBackends returns the static backends passed sorted by their name, which is the order they are matched
+// in.
+func sortedBackends(backends map[string]StaticBackend) []StaticBackend {
+	sorted := slices.Collect(maps.Values(backends))
+	slices.SortFunc(sorted, func(a, b StaticBackend) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return sorted
+}
+
+// Backends returns all static backends registered, sorted by their name.
+func (t *RoutingTable) Backends() []StaticBackend {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return slices.Clone(t.backends)
+}
+
+// RegisterBackend registers the static backend passed, replacing any backend registered under the same name,
+// and persists it in the State.
+func (t *RoutingTable) RegisterBackend(backend StaticBackend) error {
+	if err := backend.validate(); err != nil {
+		return err
+	}
+	return t.updateBackends(func(backends map[string]StaticBackend) {
+		backends[backend.Name] = backend
+	})
+}
+
+// RemoveBackend removes the static backend with the name passed. If no such backend is registered, false is
+// returned.
+func (t *RoutingTable) RemoveBackend(name string) (bool, error) {
+	found := false
+	err := t.updateBackends(func(backends map[string]StaticBackend) {
+		_, found = backends[name]
+		delete(backends, name)
+	})
+	return found, err
+}
+
+// updateBackends calls the function passed with the static backends persisted in the State, allowing them to
+// be modified, and updates the backends routed to accordingly.
+func (t *RoutingTable) updateBackends(f func(backends map[string]StaticBackend)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var backends []StaticBackend
+	if err := t.state.Update(func(data *stateData) {
+		f(data.Backends)
+		backends = sortedBackends(data.Backends)
+	}); err != nil {
+		return fmt.Errorf("save backends: %w", err)
+	}
+	t.backends = backends
+	return nil
+}
+
+// Routes returns the current routes of the RoutingTable.
+func (t *RoutingTable) Routes() Routes {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.routes
+}
+
+// Set replaces the routes of the RoutingTable. If the routes passed are invalid, an error is returned and the
+// current routes are kept.
+func (t *RoutingTable) Set(routes Routes) error {
+	pattern, err := routes.validate()
+	if err != nil {
+		return err
+	}
+	next := make(map[string]*atomic.Uint32, len(routes.Static))
+	for _, static := range routes.Static {
+		next[static.Host] = new(atomic.Uint32)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes, t.pattern, t.next = routes, pattern, next
+	return nil
+}
+
+// Resolve returns the destination of a player joining with the host passed, as returned by serverHost. Hosts of
+// static routes and backends are matched regardless of case and trailing dots. Static routes take precedence
+// over static backends, which in turn take precedence over aliases and then pull requests. Players joining
+// with an IP address or without an address are routed to the direct route, if configured. If no route matches
+// and no fallback is configured, false is returned.
+func (t *RoutingTable) Resolve(host string) (route, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, static := range t.routes.Static {
+		if serverHost(static.Host) == host {
+			// Addresses were validated when setting the routes.
+			addr, port, _ := splitAddress(t.replica(static))
+			return route{Address: addr, Port: port}, true
+		}
+	}
+	if backend, ok := t.backend(host); ok {
+		addr, port, _ := splitAddress(backend.Address)
+		return route{Address: addr, Port: port}, true
+	}
+	if pr, ok := t.aliases[host]; ok {
+		return route{PR: pr}, true
+	}
+	// A loose pattern may capture more than the ID of a pull request from a crafted address, which would
+	// otherwise end up in the paths of the PR, so addresses capturing anything else don't match.
+	if matches := t.pattern.FindStringSubmatch(host); len(matches) > 1 && validPullRequest(matches[1]) {
+		return route{PR: matches[1]}, true
+	}
+	if t.routes.Direct != "" && directHost(host) {
+		if t.routes.Direct == routeSelector {
+			return route{Select: true}, true
+		}
+		addr, port, _ := splitAddress(t.routes.Direct)
+		return route{Address: addr, Port: port}, true
+	}
+	if t.routes.Fallback != "" {
+		addr, port, _ := splitAddress(t.routes.Fallback)
+		return route{Address: addr, Port: port}, true
+	}
+	return route{}, false
+}
+
+// backend returns the first static backend whose pattern matches the host passed. t.mu must be held.
+func (t *RoutingTable) backend(host string) (StaticBackend, bool) {
+	for _, backend := range t.backends {
+		if backend.matches(host) {
+			return backend, true
+		}
+	}
+	return StaticBackend{}, false
+}
+
+// replica selects the replica of the static route passed that the next player is sent to, taking turns
+// between the replicas that are up. If all replicas are down, they are taken turns between regardless, so
+// that players are still sent somewhere once they come back up. t.mu must be held.
+func (t *RoutingTable) replica(static StaticRoute) string {
+	if len(static.Addresses) == 1 {
+		return static.Addresses[0]
+	}
+	up := make([]string, 0, len(static.Addresses))
+	for _, addr := range static.Addresses {
+		if !t.down[addr] {
+			up = append(up, addr)
+		}
+	}
+	if len(up) == 0 {
+		up = static.Addresses
+	}
+	n := t.next[static.Host].Add(1) - 1
+	return up[int(n%uint32(len(up)))]
+}
+
+// replicas returns the addresses of all replicas of static routes that have more than one replica. Routes with
+// only one replica are not health checked, as there is nothing to fail over to.
+func (t *RoutingTable) replicas() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var addrs []string
+	for _, static := range t.routes.Static {
+		if len(static.Addresses) > 1 {
+			addrs = append(addrs, static.Addresses...)
+		}
+	}
+	return addrs
+}
+
+// staticAddresses returns the addresses of the replicas of all static routes and of all static backends, each
+// listed once.
+func (t *RoutingTable) staticAddresses() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var addrs []string
+	for _, static := range t.routes.Static {
+		addrs = append(addrs, static.Addresses...)
+	}
+	for _, backend := range t.backends {
+		addrs = append(addrs, backend.Address)
+	}
+	slices.Sort(addrs)
+	return slices.Compact(addrs)
+}
+
+// setDown replaces the addresses of replicas that failed their health checks.
+func (t *RoutingTable) setDown(down map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.down = down
+}
+
+// handleGetRoutes handles retrieving the current routes of the Listener.
+func (r *Router) handleGetRoutes(writer http.ResponseWriter, _ *http.Request) {
+	writeJSON(writer, http.StatusOK, r.routes.Routes())
+}
+
+// handlePutRoutes handles replacing the routes of the Listener. The new routes apply to players joining from
+// then on, but are not persisted, so the configured routes are used again after a restart.
+func (r *Router) handlePutRoutes(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	var routes Routes
+	if err := json.NewDecoder(request.Body).Decode(&routes); err != nil {
+		logger.Warn("Failed to decode routes", slog.Any("error", err))
+		http.Error(writer, "Failed to decode routes", http.StatusBadRequest)
+		return
+	}
+	if err := r.routes.Set(routes); err != nil {
+		logger.Warn("Invalid routes", slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Invalid routes: %v", err), http.StatusBadRequest)
+		return
+	}
+	logger.Info("Updated routes", slog.Int("static", len(routes.Static)), slog.String("pull_requests", routes.PullRequests), slog.String("fallback", routes.Fallback))
+	writeJSON(writer, http.StatusOK, routes)
+}
+
+// handleListBackends handles listing the static backends registered.
+func (r *Router) handleListBackends(writer http.ResponseWriter, _ *http.Request) {
+	writeJSON(writer, http.StatusOK, r.routes.Backends())
+}
+
+// handlePutBackend handles registering a static backend under the name in the path of the request, replacing
+// any backend previously registered under it.
+func (r *Router) handlePutBackend(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	var backend StaticBackend
+	if err := json.NewDecoder(request.Body).Decode(&backend); err != nil {
+		logger.Warn("Failed to decode backend", slog.Any("error", err))
+		http.Error(writer, "Failed to decode backend", http.StatusBadRequest)
+		return
+	}
+	backend.Name = request.PathValue("name")
+	if err := backend.validate(); err != nil {
+		logger.Warn("Invalid backend", slog.String("backend", backend.Name), slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Invalid backend: %v", err), http.StatusBadRequest)
+		return
+	}
+	// Static backends take precedence over aliases, so they may not match the host of one.
+	if host, ok := r.routes.backendConflict(backend); ok {
+		http.Error(writer, fmt.Sprintf("Host pattern matches alias %s", host), http.StatusConflict)
+		return
+	}
+	if err := r.routes.RegisterBackend(backend); err != nil {
+		logger.Error("Failed to register backend", slog.String("backend", backend.Name), slog.Any("error", err))
+		http.Error(writer, "Failed to register backend", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Registered static backend", slog.String("backend", backend.Name), slog.String("host", backend.Host), slog.String("address", backend.Address))
+	writeJSON(writer, http.StatusOK, backend)
+}
+
+// handleDeleteBackend handles removing the static backend with the name in the path of the request.
+func (r *Router) handleDeleteBackend(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	name := request.PathValue("name")
+	found, err := r.routes.RemoveBackend(name)
+	if err != nil {
+		logger.Error("Failed to remove backend", slog.String("backend", name), slog.Any("error", err))
+		http.Error(writer, "Failed to remove backend", http.StatusInternalServerError)
+		return
+	} else if !found {
+		http.Error(writer, "Backend not found", http.StatusNotFound)
+		return
+	}
+	logger.Info("Removed static backend", slog.String("backend", name))
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// debugRoutes returns the static routes of the RoutingTable and the addresses of all running servers of pull
+// requests, for inclusion in the debug state of the Listener.
+func (t *RoutingTable) debugRoutes(ctx context.Context, backend Backend) map[string]string {
+	routes := t.Routes()
+	debug := make(map[string]string, len(routes.Static))
+	t.mu.RLock()
+	for _, static := range routes.Static {
+		addrs := make([]string, 0, len(static.Addresses))
+		for _, addr := range static.Addresses {
+			if t.down[addr] {
+				addr += " (down)"
+			}
+			addrs = append(addrs, addr)
+		}
+		debug[static.Host] = strings.Join(addrs, ", ")
+	}
+	t.mu.RUnlock()
+	for _, backend := range t.Backends() {
+		debug[backend.Host] = backend.Address
+	}
+	if routes.Fallback != "" {
+		debug["*"] = routes.Fallback
+	}
+
+	if servers, err := backend.Servers(ctx); err == nil {
+		for _, srv := range servers {
+			debug["pr-"+srv.PR] = fmt.Sprintf("%s:%d", srv.Address, srv.Port)
+		}
+	}
+	return debug
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestServerHost(t *testing.T) {
+	tests := map[string]string{
+		"123.df-mc.dev":          "123.df-mc.dev",
+		"123.df-mc.dev:19132":    "123.df-mc.dev",
+		"123.DF-MC.dev.":         "123.df-mc.dev",
+		"123.df-mc.dev.:19132":   "123.df-mc.dev",
+		" 123.df-mc.dev ":        "123.df-mc.dev",
+		"188.166.78.44:19132":    "188.166.78.44",
+		"[::1]:19132":            "::1",
+		"[2001:DB8::1]":          "2001:db8::1",
+		"2001:db8::1":            "2001:db8::1",
+		"":                       "",
+		"fall-damage.df-mc.dev.": "fall-damage.df-mc.dev",
+	}
+	for addr, expected := range tests {
+		if host := serverHost(addr); host != expected {
+			t.Errorf("serverHost(%q) = %q, expected %q", addr, host, expected)
+		}
+	}
+}
+
+func TestRoutingTableResolve(t *testing.T) {
+	state, err := OpenState(filepath.Join(t.TempDir(), "state.json"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := defaultRoutes()
+	routes.Static = append(routes.Static, StaticRoute{Host: "Lobby.DF-MC.dev.", Addresses: []string{"10.0.0.1:19132"}})
+	routes.Fallback = "df-mc.dev:19135"
+	table, err := NewRoutingTable(routes, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.RegisterBackend(StaticBackend{Name: "test", Host: "*.test.df-mc.dev", Address: "10.0.0.2:19132"}); err != nil {
+		t.Fatal(err)
+	}
+	// Static routes and backends take precedence over aliases with the same host.
+	for _, alias := range []Alias{{Host: "fall-damage.df-mc.dev", PR: "123"}, {Host: "plots.df-mc.dev", PR: "5"}, {Host: "realm.test.df-mc.dev", PR: "5"}} {
+		if err := table.RegisterAlias(alias); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		addr  string
+		route route
+	}{
+		{addr: "df-mc.dev", route: route{Address: "df-mc.dev", Port: 19133}},
+		{addr: "DF-MC.dev.:19132", route: route{Address: "df-mc.dev", Port: 19133}},
+		{addr: "188.166.78.44:19132", route: route{Address: "df-mc.dev", Port: 19133}},
+		{addr: "lobby.df-mc.dev", route: route{Address: "10.0.0.1", Port: 19132}},
+		{addr: "plots.df-mc.dev", route: route{Address: "df-mc.dev", Port: 19134}},
+		{addr: "123.df-mc.dev", route: route{PR: "123"}},
+		{addr: "123.DF-MC.DEV.:19132", route: route{PR: "123"}},
+		{addr: "123-copy.df-mc.dev", route: route{PR: "123-copy"}},
+		{addr: "fall-damage.df-mc.dev", route: route{PR: "123"}},
+		{addr: "Fall-Damage.df-mc.dev.", route: route{PR: "123"}},
+		{addr: "realm.test.df-mc.dev", route: route{Address: "10.0.0.2", Port: 19132}},
+		{addr: "[::1]:19132", route: route{Address: "df-mc.dev", Port: 19135}},
+		{addr: "unknown.example.com", route: route{Address: "df-mc.dev", Port: 19135}},
+	}
+	for _, test := range tests {
+		if r, ok := table.Resolve(serverHost(test.addr)); !ok || r != test.route {
+			t.Errorf("Resolve(%q) = %+v, %v, expected %+v", test.addr, r, ok, test.route)
+		}
+	}
+
+	// Hosts routed otherwise can't be registered as aliases.
+	for host, conflict := range map[string]bool{"plots.df-mc.dev": true, "other.test.df-mc.dev": true, "124.df-mc.dev": true, "new.df-mc.dev": false} {
+		if reason := table.aliasConflict(host); (reason != "") != conflict {
+			t.Errorf("aliasConflict(%q) = %q, expected conflict %v", host, reason, conflict)
+		}
+	}
+	if host, ok := table.backendConflict(StaticBackend{Host: "fall-*.df-mc.dev"}); !ok || host != "fall-damage.df-mc.dev" {
+		t.Errorf("backendConflict = %q, %v, expected fall-damage.df-mc.dev", host, ok)
+	}
+	// The aliases of deleted PRs are removed.
+	if err := table.RemoveAliasesOf("123"); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := table.Resolve("fall-damage.df-mc.dev"); r.PR != "" {
+		t.Errorf("alias of deleted PR still routes to PR %s", r.PR)
+	}
+
+	// Addresses are only routed to PRs if the pattern captures a valid PR ID, however loose it is.
+	routes.PullRequests = `^(.+)\.df-mc\.dev$`
+	routes.Fallback = ""
+	routes.Direct = "selector"
+	if err := table.Set(routes); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"..%2f..%2fetc.df-mc.dev", "a.b.df-mc.dev", "-1.df-mc.dev"} {
+		if r, ok := table.Resolve(serverHost(addr)); ok {
+			t.Errorf("Resolve(%q) = %+v, expected no route", addr, r)
+		}
+	}
+	for _, addr := range []string{"", "188.166.78.45:19132", "[2001:db8::1]:19132"} {
+		if r, ok := table.Resolve(serverHost(addr)); !ok || !r.Select {
+			t.Errorf("Resolve(%q) = %+v, %v, expected the selector", addr, r, ok)
+		}
+	}
+}
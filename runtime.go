@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Runtime is a container runtime on a single host that the servers of pull requests can be run on. Runtimes
+// are combined into a Cluster, which schedules servers across them.
+type Runtime interface {
+	// Name returns the name of the host the Runtime runs on.
+	Name() string
+	// Host returns the configuration of the host the Runtime runs on.
+	Host() HostConfig
+	// BuildImage builds the image of the given PR, labelling it with the deployment passed.
+	BuildImage(ctx context.Context, pr string, deployment Deployment) error
+	// BuildBinary builds the binary of the given PR from source, exporting the last stage into dest.
+	BuildBinary(ctx context.Context, pr string, profile ProfileConfig, source, dest string) error
+	// ImageReport returns the size and layers of the image of the given PR.
+	ImageReport(ctx context.Context, pr string) (ImageReport, error)
+	// PullImage pulls the image with the reference passed.
+	PullImage(ctx context.Context, ref string) error
+	// Deployments returns the deployments of all pull requests that have an image on the host.
+	Deployments(ctx context.Context) ([]Deployment, error)
+	// Deployment returns the deployment of the given PR, or false if it has no image on the host.
+	Deployment(ctx context.Context, pr string) (Deployment, bool, error)
+	// ServerPort returns the public port of the server of the given PR, or false if it is not running.
+	ServerPort(ctx context.Context, pr string) (uint16, bool, error)
+	// StartServer starts the server of the given PR and returns its public port.
+	StartServer(ctx context.Context, pr string) (uint16, bool, error)
+	// StopServer stops the server of the given PR.
+	StopServer(ctx context.Context, pr string) (StopResult, error)
+	// PauseServer pauses the server of the given PR.
+	PauseServer(ctx context.Context, pr string) error
+	// UnpauseServer resumes the server of the given PR if it is paused.
+	UnpauseServer(ctx context.Context, pr string) error
+	// DeleteServer removes the server, image and data of the given PR.
+	DeleteServer(ctx context.Context, pr string)
+	// Servers returns all servers that are currently running.
+	Servers(ctx context.Context) ([]Server, error)
+	// Stats returns the resource usage of the server of the given PR, or false if it is not running.
+	Stats(ctx context.Context, pr string, sample bool) (ContainerStats, bool, error)
+	// Attach attaches to the standard input and output of the server of the given PR.
+	Attach(ctx context.Context, pr string) (io.ReadWriteCloser, error)
+	// ClearContainers removes all containers belonging to pull requests.
+	ClearContainers(ctx context.Context, removeImages bool) error
+	// AdoptServers takes over the servers left running by a previous prmanager process.
+	AdoptServers(ctx context.Context) error
+	// CleanupOrphans removes anything left behind by pull requests that have been deleted.
+	CleanupOrphans(ctx context.Context) error
+	// CleanupBuild removes anything left behind by an interrupted build of the image of the given PR.
+	CleanupBuild(ctx context.Context, pr string) error
+	// PruneBuildCache prunes the caches of the CacheDirs of profiles down to Images.CacheSize.
+	PruneBuildCache(ctx context.Context) error
+	// Ping checks that the container daemon of the host can be reached.
+	Ping(ctx context.Context) error
+	// Close releases any resources held by the Runtime.
+	Close()
+}
+
+// NewRuntime creates the Runtime configured for the host passed.
+func NewRuntime(conf Config, host HostConfig, ports *PortAllocator, secrets *SecretStore, git *GitCredentials) (Runtime, error) {
+	switch host.Runtime {
+	case "", "docker":
+		return NewDocker(conf, host, ports, secrets, git)
+	case "podman":
+		return NewPodman(conf, host, ports, secrets, git)
+	}
+	return nil, fmt.Errorf("unknown runtime %q", host.Runtime)
+}
+
+// Podman is a Runtime for hosts running Podman, which is commonly run rootless. It uses the Docker-compatible
+// API of Podman and the podman CLI, which accepts the same arguments as the docker CLI for all operations
+// performed. Podman enforces resource limits passed to its build command, so no dedicated builder is used.
+type Podman struct {
+	*Docker
+}
+
+// NewPodman creates a new Podman runtime for the host passed. If the host has no address, the API socket of
+// the local Podman service is used: the system socket when running as root, or the socket of the current user
+// otherwise.
+func NewPodman(conf Config, host HostConfig, ports *PortAllocator, secrets *SecretStore, git *GitCredentials) (*Podman, error) {
+	d := &Docker{conf: conf, host: host, ports: ports, secrets: secrets, git: git, cli: "podman", hostFlag: "--url", addr: host.Address}
+	addr := host.Address
+	if addr == "" {
+		addr = "unix:///run/podman/podman.sock"
+		if os.Geteuid() != 0 {
+			addr = "unix://" + filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), "podman", "podman.sock")
+		}
+		// Mounting disk images requires root, so rootless Podman bind mounts the world directory of each PR
+		// without a size limit, like rootless Docker.
+		d.localData, d.diskImages = true, os.Geteuid() == 0
+	}
+	if err := d.connect(addr); err != nil {
+		return nil, err
+	}
+	return &Podman{Docker: d}, nil
+}
+
+// PruneBuildCache does nothing, as Podman keeps cache mounts in a directory of its own that can't be pruned
+// by size through its CLI.
+func (p *Podman) PruneBuildCache(context.Context) error {
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Job is a task run periodically by a Scheduler, such as checking the health of servers or backing up worlds.
+type Job struct {
+	// Name uniquely identifies the job, such as backups.
+	Name string
+	// Interval is the time between the end of a run and the start of the next. If zero, the job is only run
+	// on startup if Immediate is set, or when triggered through the API.
+	Interval time.Duration
+	// Immediate specifies if the job is run as soon as the Scheduler starts, rather than after the first
+	// interval.
+	Immediate bool
+	// Run runs the job once. The context passed is cancelled when the Scheduler is closed.
+	Run func(ctx context.Context) error
+}
+
+var (
+	jobRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prmanager_job_runs_total",
+		Help: "Number of runs of periodic jobs, by the job and whether the run succeeded or failed.",
+	}, []string{"job", "result"})
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prmanager_job_duration_seconds",
+		Help:    "Time taken by runs of periodic jobs, by the job.",
+		Buckets: []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900},
+	}, []string{"job"})
+	jobLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prmanager_job_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful run of periodic jobs, by the job.",
+	}, []string{"job"})
+)
+
+// scheduledJob is a Job added to a Scheduler along with the results of its runs.
+type scheduledJob struct {
+	Job
+	// trigger receives a value when the job is triggered through the API. It is buffered, so that a job
+	// triggered while it runs is run once more after.
+	trigger chan struct{}
+
+	// The fields below are guarded by the mutex of the Scheduler.
+	running      bool
+	runs         int
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastErr      error
+	nextRun      time.Time
+}
+
+// Scheduler runs the periodic jobs of prmanager, each in a goroutine of its own so that a slow job doesn't
+// delay the others, and never more than one run of a job at a time. A random jitter is added to every
+// interval, so that jobs with the same interval don't all run at once.
+type Scheduler struct {
+	// jitter is the maximum jitter added to intervals, as a fraction of the interval.
+	jitter float64
+
+	mu   sync.Mutex
+	jobs []*scheduledJob
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewScheduler creates a Scheduler with the jitter configured. Jobs must be added using Add before Run is
+// called.
+func NewScheduler(conf Config) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{jitter: conf.Jobs.Jitter, ctx: ctx, cancel: cancel}
+}
+
+// Add adds the job passed to the Scheduler. It must be called before Run.
+func (s *Scheduler) Add(job Job) {
+	s.jobs = append(s.jobs, &scheduledJob{Job: job, trigger: make(chan struct{}, 1)})
+}
+
+// Run starts running all jobs and blocks until Close is called.
+func (s *Scheduler) Run() {
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(job)
+	}
+	<-s.ctx.Done()
+}
+
+// loop runs the job passed every interval, and whenever it is triggered, until the Scheduler is closed.
+func (s *Scheduler) loop(job *scheduledJob) {
+	defer s.wg.Done()
+	if job.Immediate {
+		s.run(job)
+	}
+	for {
+		// Jobs without an interval wait for a trigger only, as receiving from a nil channel blocks forever.
+		var timer *time.Timer
+		var tick <-chan time.Time
+		if job.Interval > 0 {
+			delay := job.Interval + time.Duration(rand.Float64()*s.jitter*float64(job.Interval))
+			s.mu.Lock()
+			job.nextRun = time.Now().Add(delay)
+			s.mu.Unlock()
+			timer = time.NewTimer(delay)
+			tick = timer.C
+		}
+		select {
+		case <-tick:
+		case <-job.trigger:
+		case <-s.ctx.Done():
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		s.run(job)
+	}
+}
+
+// run runs the job passed once, recording its result. A job that panics is recorded as failed rather than
+// crashing prmanager.
+func (s *Scheduler) run(job *scheduledJob) {
+	s.mu.Lock()
+	job.running = true
+	s.mu.Unlock()
+
+	start := time.Now()
+	err := func() (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = fmt.Errorf("panic: %v", v)
+			}
+		}()
+		return job.Run(s.ctx)
+	}()
+	duration := time.Since(start)
+
+	s.mu.Lock()
+	job.running = false
+	job.runs++
+	job.lastRun, job.lastDuration, job.lastErr = start, duration, err
+	s.mu.Unlock()
+
+	jobDuration.WithLabelValues(job.Name).Observe(duration.Seconds())
+	if err != nil {
+		jobRuns.WithLabelValues(job.Name, "failed").Inc()
+		if !errors.Is(err, context.Canceled) {
+			slog.Error("Job failed", slog.String("job", job.Name), slog.Duration("duration", duration), slog.Any("error", err))
+		}
+		return
+	}
+	jobRuns.WithLabelValues(job.Name, "succeeded").Inc()
+	jobLastSuccess.WithLabelValues(job.Name).Set(float64(time.Now().Unix()))
+	slog.Debug("Ran job", slog.String("job", job.Name), slog.Duration("duration", duration))
+}
+
+// Trigger runs the job with the name passed as soon as possible, or once more after its current run if it is
+// running. False is returned if no such job exists.
+func (s *Scheduler) Trigger(name string) bool {
+	i := slices.IndexFunc(s.jobs, func(job *scheduledJob) bool { return job.Name == name })
+	if i == -1 {
+		return false
+	}
+	select {
+	case s.jobs[i].trigger <- struct{}{}:
+	default:
+		// The job was already triggered and will run soon.
+	}
+	return true
+}
+
+// Close stops running jobs, cancelling the context of runs in progress and waiting for them to return.
+func (s *Scheduler) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// jobStatus is the status of a job, as listed through the API.
+type jobStatus struct {
+	Name string `json:"name"`
+	// Interval is the interval of the job, such as 1m0s, or empty if it only runs on startup or when triggered.
+	Interval     string     `json:"interval,omitempty"`
+	Running      bool       `json:"running"`
+	Runs         int        `json:"runs"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+}
+
+// Status returns the status of all jobs, sorted by their name.
+func (s *Scheduler) Status() []jobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]jobStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		status := jobStatus{Name: job.Name, Running: job.running, Runs: job.runs}
+		if job.Interval > 0 {
+			status.Interval = job.Interval.String()
+			next := job.nextRun
+			status.NextRun = &next
+		}
+		if job.runs > 0 {
+			last := job.lastRun
+			status.LastRun, status.LastDuration = &last, job.lastDuration.Round(time.Millisecond).String()
+		}
+		if job.lastErr != nil {
+			status.LastError = job.lastErr.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	slices.SortFunc(statuses, func(a, b jobStatus) int { return cmp.Compare(a.Name, b.Name) })
+	return statuses
+}
+
+// handleListJobs handles listing the periodic jobs and the results of their last runs.
+func (r *Router) handleListJobs(writer http.ResponseWriter, _ *http.Request) {
+	writeJSON(writer, http.StatusOK, r.scheduler.Status())
+}
+
+// handleRunJob handles triggering the job with the name in the path of the request. The job runs in the
+// background, so the response doesn't wait for it to finish.
+func (r *Router) handleRunJob(writer http.ResponseWriter, request *http.Request) {
+	name := request.PathValue("name")
+	if !r.scheduler.Trigger(name) {
+		http.Error(writer, "Job not found", http.StatusNotFound)
+		return
+	}
+	requestLogger(request).Info("Triggered job", slog.String("job", name))
+	writer.WriteHeader(http.StatusAccepted)
+}
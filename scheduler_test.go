@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor waits until the condition passed holds, failing the test if it doesn't within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	s := NewScheduler(Config{})
+	var immediate, triggered, failing atomic.Int32
+	s.Add(Job{Name: "immediate", Immediate: true, Run: func(context.Context) error {
+		immediate.Add(1)
+		return nil
+	}})
+	s.Add(Job{Name: "triggered", Run: func(context.Context) error {
+		triggered.Add(1)
+		return nil
+	}})
+	s.Add(Job{Name: "failing", Interval: 10 * time.Millisecond, Run: func(context.Context) error {
+		if failing.Add(1) == 1 {
+			panic("job panicked")
+		}
+		return errors.New("job failed")
+	}})
+	cancelled := make(chan error, 1)
+	s.Add(Job{Name: "blocking", Immediate: true, Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return ctx.Err()
+	}})
+	go s.Run()
+
+	waitFor(t, "immediate job", func() bool { return immediate.Load() == 1 })
+	if triggered.Load() != 0 {
+		t.Error("job without interval ran before being triggered")
+	}
+	if !s.Trigger("triggered") {
+		t.Fatal("trigger existing job: not found")
+	}
+	waitFor(t, "triggered job", func() bool { return triggered.Load() == 1 })
+	if s.Trigger("unknown") {
+		t.Error("trigger unknown job: found")
+	}
+	// A job that panics is recorded as failed and keeps running every interval.
+	waitFor(t, "failing job to run again", func() bool { return failing.Load() >= 3 })
+
+	statuses := s.Status()
+	names := make([]string, len(statuses))
+	for i, status := range statuses {
+		names[i] = status.Name
+		if status.Name == "failing" && (status.LastError == "" || status.Interval == "" || status.NextRun == nil) {
+			t.Errorf("status of failing job = %+v, want error, interval and next run", status)
+		}
+		if status.Name == "blocking" && !status.Running {
+			t.Error("status of blocking job isn't running")
+		}
+	}
+	if want := []string{"blocking", "failing", "immediate", "triggered"}; !slices.Equal(names, want) {
+		t.Errorf("status names = %v, want %v", names, want)
+	}
+
+	// Closing the Scheduler cancels runs in progress and waits for them.
+	s.Close()
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("context of blocking job ended with %v, want context.Canceled", err)
+		}
+	default:
+		t.Error("Close returned before the blocking job")
+	}
+}
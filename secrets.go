@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// secretName matches valid names of secrets, which are the names of the environment variables they are
+// injected as.
+var secretName = regexp.MustCompile(`^[A-Z_][A-Z0-9_]{0,63}$`)
+
+// reservedSecretPrefixes and reservedSecretNames are the names of environment variables secrets may not be
+// named, as they configure the container CLI, docker compose or the dynamic linker rather than the server.
+var (
+	reservedSecretPrefixes = []string{"DOCKER_", "COMPOSE_", "BUILDKIT_", "BUILDX_", "CONTAINER_", "PODMAN_", "LD_"}
+	reservedSecretNames    = []string{"PATH", "HOME", "SHELL", "TMPDIR"}
+)
+
+// reservedSecretName checks if the name passed is reserved and may not be used for a secret.
+func reservedSecretName(name string) bool {
+	return slices.Contains(reservedSecretNames, name) || slices.ContainsFunc(reservedSecretPrefixes, func(prefix string) bool {
+		return strings.HasPrefix(name, prefix)
+	})
+}
+
+// Secret is a value injected into the containers of pull requests, such as the token of a test account or the
+// password of a database in a stack. Only the encrypted value is stored.
+type Secret struct {
+	// Value is the value encrypted with AES-256-GCM, base64 encoded with the nonce prepended.
+	Value   string    `json:"value"`
+	Updated time.Time `json:"updated"`
+}
+
+// SecretStore stores secrets in the State, encrypted with the key in the SECRETS_KEY environment variable, and
+// decrypts them to be injected into containers. Secrets are never returned in plaintext through the API.
+type SecretStore struct {
+	state *State
+	// aead encrypts and decrypts secrets. It is nil if no SECRETS_KEY is set, in which case secrets can't be
+	// set or injected.
+	aead cipher.AEAD
+}
+
+// NewSecretStore creates a SecretStore for the secrets in the State passed. SECRETS_KEY must hold 32 hex encoded
+// bytes, such as generated by `openssl rand -hex 32`, or be empty to disable secrets.
+func NewSecretStore(state *State) (*SecretStore, error) {
+	s := &SecretStore{state: state}
+	env := os.Getenv("SECRETS_KEY")
+	if env == "" {
+		return s, nil
+	}
+	key, err := hex.DecodeString(env)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("SECRETS_KEY must be 32 hex encoded bytes")
+	}
+	block, _ := aes.NewCipher(key)
+	s.aead, _ = cipher.NewGCM(block)
+	return s, nil
+}
+
+// Set encrypts the value passed and stores it as the secret with the name passed, injected into the given PR,
+// or into all PRs if pr is empty.
+func (s *SecretStore) Set(pr, name, value string) error {
+	if s.aead == nil {
+		return errSecretsDisabled
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	// The scope and name are authenticated along with the value, so that a secret can't be moved to another
+	// PR or name by editing the state.
+	sealed := s.aead.Seal(nonce, nonce, []byte(value), []byte(pr+"/"+name))
+	return s.state.Update(func(data *stateData) {
+		if data.Secrets[pr] == nil {
+			data.Secrets[pr] = make(map[string]Secret)
+		}
+		data.Secrets[pr][name] = Secret{Value: base64.StdEncoding.EncodeToString(sealed), Updated: time.Now()}
+	})
+}
+
+// Delete removes the secret with the name passed of the given PR, or of all PRs if pr is empty. False is
+// returned if no such secret exists.
+func (s *SecretStore) Delete(pr, name string) (bool, error) {
+	var found bool
+	err := s.state.Update(func(data *stateData) {
+		if _, found = data.Secrets[pr][name]; found {
+			delete(data.Secrets[pr], name)
+			if len(data.Secrets[pr]) == 0 {
+				delete(data.Secrets, pr)
+			}
+		}
+	})
+	return found, err
+}
+
+// Forget removes all secrets of the given PR, once it has been deleted.
+func (s *SecretStore) Forget(pr string) error {
+	if pr == "" {
+		return nil
+	}
+	return s.state.Update(func(data *stateData) {
+		delete(data.Secrets, pr)
+	})
+}
+
+// secretInfo describes a secret without its value, as listed through the API.
+type secretInfo struct {
+	Name    string    `json:"name"`
+	Updated time.Time `json:"updated"`
+}
+
+// List returns the names of the secrets of the given PR, or of all PRs if pr is empty, sorted by name.
+func (s *SecretStore) List(pr string) []secretInfo {
+	var infos []secretInfo
+	s.state.View(func(data *stateData) {
+		infos = make([]secretInfo, 0, len(data.Secrets[pr]))
+		for _, name := range slices.Sorted(maps.Keys(data.Secrets[pr])) {
+			infos = append(infos, secretInfo{Name: name, Updated: data.Secrets[pr][name].Updated})
+		}
+	})
+	return infos
+}
+
+// Env returns the decrypted secrets injected into the given PR as environment variables in the form
+// NAME=value. Secrets of the PR take precedence over those of all PRs with the same name.
+func (s *SecretStore) Env(pr string) ([]string, error) {
+	secrets := make(map[string]Secret)
+	aad := make(map[string]string)
+	s.state.View(func(data *stateData) {
+		for _, scope := range []string{"", pr} {
+			for name, secret := range data.Secrets[scope] {
+				secrets[name], aad[name] = secret, scope+"/"+name
+			}
+		}
+	})
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+	if s.aead == nil {
+		return nil, errSecretsDisabled
+	}
+	env := make([]string, 0, len(secrets))
+	for _, name := range slices.Sorted(maps.Keys(secrets)) {
+		sealed, err := base64.StdEncoding.DecodeString(secrets[name].Value)
+		if err != nil || len(sealed) < s.aead.NonceSize() {
+			return nil, fmt.Errorf("decrypt secret %s: invalid value", name)
+		}
+		value, err := s.aead.Open(nil, sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():], []byte(aad[name]))
+		if err != nil {
+			return nil, fmt.Errorf("decrypt secret %s: %w", name, err)
+		}
+		env = append(env, name+"="+string(value))
+	}
+	return env, nil
+}
+
+// EnvFile writes the decrypted secrets injected into the given PR to a temporary file in the format read by the
+// --env-file flags of docker run and docker compose. The file is only readable by prmanager, so that the values
+// don't have to be passed in the environment or arguments of the CLI, where other processes could read them. The
+// function returned removes the file. If the PR has no secrets, the path returned is empty.
+func (s *SecretStore) EnvFile(pr string) (string, func(), error) {
+	env, err := s.Env(pr)
+	if err != nil || len(env) == 0 {
+		return "", func() {}, err
+	}
+	var data []byte
+	for _, e := range env {
+		// Env files hold one variable per line, so values can't span lines. They are refused when set.
+		if strings.ContainsAny(e, "\r\n") {
+			return "", func() {}, fmt.Errorf("secret %s contains a line break", e[:strings.IndexByte(e, '=')])
+		}
+		data = append(append(data, e...), '\n')
+	}
+	// Temporary files are created with mode 0600.
+	f, err := os.CreateTemp("", "prmanager-env-*")
+	if err != nil {
+		return "", func() {}, fmt.Errorf("create env file: %w", err)
+	}
+	remove := func() { _ = os.Remove(f.Name()) }
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return "", func() {}, fmt.Errorf("write env file: %w", err)
+	}
+	return f.Name(), remove, nil
+}
+
+// secretRequest is the body of a request setting a secret.
+type secretRequest struct {
+	Value string `json:"value"`
+}
+
+// secretScope returns the PR in the path of the request passed, or an empty string for requests to the secrets
+// of all PRs. Secrets may be set for PRs that are not deployed yet, so that they are present on the first start.
+func secretScope(writer http.ResponseWriter, request *http.Request, logger *slog.Logger) (string, bool) {
+	if request.PathValue("pr") == "" {
+		return "", true
+	}
+	return pathPullRequest(writer, request, logger)
+}
+
+// handleListSecrets handles listing the names of the secrets of the PR in the path of the request, or of all
+// PRs if the path has no PR. Values are never returned.
+func (r *Router) handleListSecrets(writer http.ResponseWriter, request *http.Request) {
+	pr, ok := secretScope(writer, request, requestLogger(request))
+	if !ok {
+		return
+	}
+	writeJSON(writer, http.StatusOK, r.secrets.List(pr))
+}
+
+// handlePutSecret handles setting the secret with the name in the path of the request to the value in its
+// body. Secrets take effect the next time the server or stack of a PR is started.
+func (r *Router) handlePutSecret(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := secretScope(writer, request, logger)
+	if !ok {
+		return
+	}
+	name := request.PathValue("name")
+	if !secretName.MatchString(name) {
+		http.Error(writer, "Name must be an environment variable name of up to 64 uppercase letters, digits and underscores", http.StatusBadRequest)
+		return
+	}
+	if reservedSecretName(name) {
+		http.Error(writer, fmt.Sprintf("Name %s is reserved", name), http.StatusBadRequest)
+		return
+	}
+	var req secretRequest
+	if err := json.NewDecoder(io.LimitReader(request.Body, 64<<10)).Decode(&req); err != nil {
+		logger.Warn("Failed to decode secret", slog.Any("error", err))
+		http.Error(writer, "Failed to decode secret", http.StatusBadRequest)
+		return
+	}
+	if strings.ContainsAny(req.Value, "\r\n") {
+		http.Error(writer, "Value may not contain line breaks", http.StatusBadRequest)
+		return
+	}
+	if err := r.secrets.Set(pr, name, req.Value); err != nil {
+		logger.Error("Failed to save secret", slog.String("pr", pr), slog.String("name", name), slog.Any("error", err))
+		http.Error(writer, fmt.Sprintf("Failed to save secret: %v", err), errorStatus(err))
+		return
+	}
+	logger.Info("Set secret", slog.String("pr", pr), slog.String("name", name))
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeleteSecret handles removing the secret with the name in the path of the request.
+func (r *Router) handleDeleteSecret(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := secretScope(writer, request, logger)
+	if !ok {
+		return
+	}
+	name := request.PathValue("name")
+	found, err := r.secrets.Delete(pr, name)
+	if err != nil {
+		logger.Error("Failed to remove secret", slog.String("pr", pr), slog.String("name", name), slog.Any("error", err))
+		http.Error(writer, "Failed to remove secret", http.StatusInternalServerError)
+		return
+	} else if !found {
+		http.Error(writer, "Secret not found", http.StatusNotFound)
+		return
+	}
+	logger.Info("Removed secret", slog.String("pr", pr), slog.String("name", name))
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReservedSecretName(t *testing.T) {
+	for _, name := range []string{"DOCKER_HOST", "DOCKER_CONFIG", "COMPOSE_FILE", "COMPOSE_PROJECT_NAME", "LD_PRELOAD", "PATH", "HOME"} {
+		if !reservedSecretName(name) {
+			t.Errorf("%s is not reserved", name)
+		}
+	}
+	for _, name := range []string{"DB_PASSWORD", "TOKEN", "MY_DOCKER_HOST", "PATHS"} {
+		if reservedSecretName(name) {
+			t.Errorf("%s is reserved", name)
+		}
+	}
+}
+
+func TestSecretStoreEnvFile(t *testing.T) {
+	t.Setenv("SECRETS_KEY", strings.Repeat("ab", 32))
+	state, err := OpenState(filepath.Join(t.TempDir(), "state.json"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := NewSecretStore(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path, remove, err := secrets.EnvFile("1"); err != nil || path != "" {
+		t.Fatalf("EnvFile without secrets = %q, %v, expected no file", path, err)
+	} else {
+		remove()
+	}
+
+	// Secrets of the PR take precedence over those of all PRs.
+	for _, s := range []struct{ pr, name, value string }{{"", "TOKEN", "global"}, {"", "DB_PASSWORD", "a=b"}, {"1", "TOKEN", "pr"}} {
+		if err := secrets.Set(s.pr, s.name, s.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path, remove, err := secrets.EnvFile("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("env file has mode %o, expected 600", mode)
+	}
+	data, _ := os.ReadFile(path)
+	if expected := "DB_PASSWORD=a=b\nTOKEN=pr\n"; string(data) != expected {
+		t.Errorf("env file holds %q, expected %q", data, expected)
+	}
+	remove()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("env file not removed: %v", err)
+	}
+
+	// Values spanning lines can't be written to env files.
+	if err := secrets.Set("1", "KEY", "line\nbreak"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := secrets.EnvFile("1"); err == nil {
+		t.Error("EnvFile with line break in value succeeded")
+	}
+}
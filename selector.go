@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+)
+
+// selectorFormID is the ID of the form players joining directly select the pull request to join from.
+const selectorFormID = 2
+
+// maxSelectorButtons is the maximum number of pull requests listed in the selector form. Only the most recently
+// deployed pull requests are listed.
+const maxSelectorButtons = 30
+
+// selectPullRequest shows the player a form listing the pull requests deployed and returns the one they
+// selected. If there are none to select from, or the player closes the form or doesn't respond in time, they
+// are disconnected and false is returned.
+func (l *Listener) selectPullRequest(ctx context.Context, c *minecraft.Conn, logger *slog.Logger) (string, bool) {
+	listCtx, cancel := context.WithTimeout(ctx, apiTimeout)
+	deployments, err := l.backend.Deployments(listCtx)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to list pull requests to select from", slog.Any("error", err))
+		l.disconnect(c, playerMessage(err, msgHostUnreachable))
+		return "", false
+	}
+	deployments = l.selectable(deployments)
+	if len(deployments) == 0 {
+		l.disconnect(c, msgSelectorEmpty)
+		return "", false
+	}
+
+	lang := c.ClientData().LanguageCode
+	form := menuForm{
+		Type:    "form",
+		Title:   l.messages.Text(lang, msgSelectorTitle),
+		Content: l.messages.Text(lang, msgSelectorContent),
+		Buttons: make([]formButton, 0, len(deployments)),
+	}
+	for _, deployment := range deployments {
+		text := l.messages.Text(lang, msgSelectorButton, "pr", deployment.PR, "title", deployment.Title)
+		form.Buttons = append(form.Buttons, formButton{Text: strings.TrimSpace(text)})
+	}
+	data, _ := json.Marshal(form)
+	if err := c.WritePacket(&packet.ModalFormRequest{FormID: selectorFormID, FormData: data}); err != nil {
+		return "", false
+	}
+
+	stop := time.AfterFunc(formTimeout, func() { _ = c.Close() })
+	defer stop.Stop()
+	for {
+		pk, err := c.ReadPacket()
+		if err != nil {
+			return "", false
+		}
+		resp, ok := pk.(*packet.ModalFormResponse)
+		if !ok || resp.FormID != selectorFormID {
+			continue
+		}
+		// The response of a menu form is the index of the button pressed, which is absent if it was closed.
+		var i int
+		if data, ok := resp.ResponseData.Value(); !ok || json.Unmarshal(data, &i) != nil || i < 0 || i >= len(deployments) {
+			l.disconnect(c, msgSelectorClosed)
+			return "", false
+		}
+		logger.Info("Player selected pull request", slog.String("pr", deployments[i].PR))
+		return deployments[i].PR, true
+	}
+}
+
+// selectable returns the deployments of the pull requests players may select from the deployments passed, the
+// most recently deployed first. Environments, sandboxes and pull requests being deleted are left out.
+func (l *Listener) selectable(deployments []Deployment) []Deployment {
+	var selectable []Deployment
+	l.state.View(func(data *stateData) {
+		for _, deployment := range deployments {
+			_, deleted := data.Deleted[deployment.PR]
+			_, draining := data.Draining[deployment.PR]
+			if validPullRequest(deployment.PR) && basePullRequest(deployment.PR) == deployment.PR && !deleted && !draining {
+				selectable = append(selectable, deployment)
+			}
+		}
+	})
+	slices.SortFunc(selectable, func(a, b Deployment) int {
+		return b.Deployed.Compare(a.Deployed)
+	})
+	return selectable[:min(len(selectable), maxSelectorButtons)]
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errSelfCheckPending is the readiness error of a SelfCheck that has not finished its first check yet.
+var errSelfCheckPending = errors.New("public reachability not checked yet")
+
+// SelfCheck verifies that players can reach prmanager: on startup, the Minecraft listener and the replicas of
+// static routes are pinged over RakNet through their public addresses, so that a misconfigured firewall, port
+// forward or DNS record is found before testers run into it. Addresses that can't be reached are checked
+// again every interval until they respond.
+type SelfCheck struct {
+	enabled  bool
+	addr     string
+	routes   *RoutingTable
+	timeout  time.Duration
+	interval time.Duration
+
+	mu  sync.Mutex
+	err error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewSelfCheck creates a SelfCheck of the Minecraft listener and the static routes of the RoutingTable passed.
+func NewSelfCheck(routes *RoutingTable, conf Config) *SelfCheck {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &SelfCheck{
+		enabled:  conf.SelfCheck.Enabled,
+		addr:     net.JoinHostPort(selfCheckAddress(conf), "19132"),
+		routes:   routes,
+		timeout:  conf.SelfCheck.Timeout,
+		interval: conf.Health.Interval,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	if c.enabled {
+		c.err = errSelfCheckPending
+	}
+	return c
+}
+
+// selfCheckAddress returns the public address the Minecraft listener is pinged at: SelfCheck.Address if set,
+// or the public address of the local host otherwise.
+func selfCheckAddress(conf Config) string {
+	if conf.SelfCheck.Address != "" {
+		return conf.SelfCheck.Address
+	}
+	return localPublicAddress(conf)
+}
+
+// Run checks the reachability of all addresses once immediately and then rechecks those that could not be
+// reached every interval, until all of them respond or Close is called.
+func (c *SelfCheck) Run() {
+	if !c.enabled {
+		return
+	}
+	addrs := append([]string{c.addr}, c.routes.staticAddresses()...)
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		addrs = c.check(addrs)
+		if len(addrs) == 0 {
+			slog.Info("Listener and static routes are publicly reachable")
+			return
+		}
+		select {
+		case <-t.C:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// check pings the addresses passed, which are logged the first time they can't be reached. The addresses that
+// could not be reached are returned.
+func (c *SelfCheck) check(addrs []string) []string {
+	var unreachable []string
+	c.mu.Lock()
+	first := errors.Is(c.err, errSelfCheckPending)
+	c.mu.Unlock()
+	for _, addr := range addrs {
+		if _, err := pingServer(addr, c.timeout); err != nil {
+			if first {
+				slog.Error("Address is not publicly reachable", slog.String("address", addr), slog.Any("error", err))
+			}
+			unreachable = append(unreachable, addr)
+		} else if !first {
+			slog.Info("Address is publicly reachable again", slog.String("address", addr))
+		}
+	}
+	var err error
+	if len(unreachable) > 0 {
+		err = fmt.Errorf("not publicly reachable: %s", strings.Join(unreachable, ", "))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+	return unreachable
+}
+
+// Ready returns an error listing the addresses that could not be reached, or nil if all of them responded or
+// the check is disabled.
+func (c *SelfCheck) Ready() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close stops rechecking unreachable addresses.
+func (c *SelfCheck) Close() {
+	c.cancel()
+}
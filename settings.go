@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// settingKey matches valid keys of settings: the dotted path of the key in the config file, such as
+// Server.Name or World.SaveData.
+var settingKey = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+
+// maxSettings is the maximum number of settings a single pull request may have.
+const maxSettings = 64
+
+// settingValue decodes the value of a setting as stored in the State into a value written to the config file.
+// Values must be strings, booleans or numbers. Numbers written without a fraction or exponent are integers, so
+// that they aren't written as floats.
+func settingValue(raw json.RawMessage) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case string, bool:
+		return v, nil
+	case json.Number:
+		if !strings.ContainsAny(v.String(), ".eE") {
+			return v.Int64()
+		}
+		return v.Float64()
+	default:
+		return nil, fmt.Errorf("must be a string, boolean or number")
+	}
+}
+
+// validateSettings checks that the settings passed have valid keys and values.
+func validateSettings(settings map[string]json.RawMessage) error {
+	if len(settings) > maxSettings {
+		return fmt.Errorf("at most %d settings may be set", maxSettings)
+	}
+	for _, key := range slices.Sorted(maps.Keys(settings)) {
+		if !settingKey.MatchString(key) {
+			return fmt.Errorf("key %q must be a dotted path of letters, digits and underscores", key)
+		}
+		// A key may not also be a table holding other keys, as it can't be both in the config file.
+		for other := range settings {
+			if strings.HasPrefix(other, key+".") {
+				return fmt.Errorf("key %q conflicts with %q", key, other)
+			}
+		}
+		if _, err := settingValue(settings[key]); err != nil {
+			return fmt.Errorf("value of %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// configPath returns the path on the local host of the config file of the given PR described by the profile
+// passed, or false if the profile has no config file.
+func configPath(pr string, profile ProfileConfig) (string, bool) {
+	if profile.ConfigFile == "" {
+		return "", false
+	}
+	return filepath.Join(worldDir(pr), expand(profile.ConfigFile, pr)), true
+}
+
+// editConfig loads the config file of the given PR, passes it to the function passed and writes it back. If the
+// file doesn't exist yet, it is created, so that the server fills in the remaining values the first time it
+// starts.
+func editConfig(pr string, profile ProfileConfig, f func(tree *toml.Tree) error) error {
+	path, ok := configPath(pr, profile)
+	if !ok {
+		return fmt.Errorf("profile %s has no config file", profile.Name)
+	}
+	// The world data, and so the config file, may be on a disk image that is only mounted while the server runs.
+	if err := ensureDiskImageMounted(pr); err != nil {
+		return err
+	}
+	tree, err := toml.TreeFromMap(map[string]any{})
+	if err != nil {
+		return err
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		if tree, err = toml.LoadBytes(data); err != nil {
+			return fmt.Errorf("parse config: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read config: %w", err)
+	}
+	if err := f(tree); err != nil {
+		return err
+	}
+	data, err := tree.Marshal()
+	if err != nil {
+		return fmt.Errorf("encode config: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("create config directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+	return nil
+}
+
+// renderSettings writes the settings passed into the config file of the given PR described by the profile
+// passed, overwriting the values of the same keys.
+func renderSettings(pr string, profile ProfileConfig, settings map[string]json.RawMessage) error {
+	return editConfig(pr, profile, func(tree *toml.Tree) error {
+		for _, key := range slices.Sorted(maps.Keys(settings)) {
+			value, err := settingValue(settings[key])
+			if err != nil {
+				return fmt.Errorf("value of %s: %w", key, err)
+			}
+			// Setting a key below a value that isn't a table would panic, so that value is replaced.
+			path := strings.Split(key, ".")
+			for i := 1; i < len(path); i++ {
+				parent := strings.Join(path[:i], ".")
+				if v := tree.Get(parent); v != nil {
+					if _, ok := v.(*toml.Tree); !ok {
+						_ = tree.Delete(parent)
+					}
+				}
+			}
+			if _, ok := tree.Get(key).(*toml.Tree); ok {
+				_ = tree.Delete(key)
+			}
+			tree.Set(key, value)
+		}
+		return nil
+	})
+}
+
+// removeSettings removes the keys passed from the config file of the given PR described by the profile passed,
+// so that the server falls back to its defaults for them. Keys that aren't in the file are ignored.
+func removeSettings(pr string, profile ProfileConfig, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	path, ok := configPath(pr, profile)
+	if !ok {
+		return nil
+	}
+	if err := ensureDiskImageMounted(pr); err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return editConfig(pr, profile, func(tree *toml.Tree) error {
+		for _, key := range keys {
+			if tree.Has(key) {
+				_ = tree.Delete(key)
+			}
+		}
+		return nil
+	})
+}
+
+// settingsOf returns the settings of the given PR.
+func settingsOf(state *State, pr string) map[string]json.RawMessage {
+	var settings map[string]json.RawMessage
+	state.View(func(data *stateData) {
+		settings = maps.Clone(data.Settings[pr])
+	})
+	return settings
+}
+
+// deploymentProfile returns the profile the given PR is deployed with. PRs that aren't deployed, or whose
+// profile no longer exists, use the first profile.
+func deploymentProfile(ctx context.Context, backend Backend, conf Config, pr string) ProfileConfig {
+	if deployments, err := backend.Deployments(ctx); err == nil {
+		for _, deployment := range deployments {
+			if deployment.PR != pr {
+				continue
+			}
+			if profile, ok := conf.Profile(deployment.Profile); ok {
+				return profile
+			}
+		}
+	}
+	profile, _ := conf.Profile("")
+	return profile
+}
+
+// settingsBackend is a Backend that renders the settings of pull requests set through the API into the config
+// files of their servers before they are started. Only the servers whose world data is on the local host are
+// affected, as the config file can't be written otherwise.
+type settingsBackend struct {
+	Backend
+	state *State
+	conf  Config
+}
+
+// StartServer ...
+func (b settingsBackend) StartServer(ctx context.Context, pr string) (string, uint16, bool, error) {
+	if settings := settingsOf(b.state, pr); len(settings) > 0 {
+		if err := renderSettings(pr, deploymentProfile(ctx, b.Backend, b.conf, pr), settings); err != nil {
+			// The server is still started, as testers would otherwise be locked out by a setting gone wrong.
+			slog.WarnContext(ctx, "Failed to render settings", slog.String("pr", pr), slog.Any("error", err))
+		}
+	}
+	return b.Backend.StartServer(ctx, pr)
+}
+
+// DeleteServer ...
+func (b settingsBackend) DeleteServer(ctx context.Context, pr string) {
+	b.Backend.DeleteServer(ctx, pr)
+	if err := b.state.Update(func(data *stateData) {
+		delete(data.Settings, pr)
+	}); err != nil {
+		slog.WarnContext(ctx, "Failed to remove settings", slog.String("pr", pr), slog.Any("error", err))
+	}
+}
+
+// handleGetSettings handles listing the settings of a pull request.
+func (r *Router) handleGetSettings(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	if !pullRequestExists(pr) {
+		logger.Warn("PR not found", "pr", pr)
+		http.Error(writer, "PR not found", http.StatusNotFound)
+		return
+	}
+	settings := settingsOf(r.state, pr)
+	if settings == nil {
+		settings = map[string]json.RawMessage{}
+	}
+	writeJSON(writer, http.StatusOK, settings)
+}
+
+// handlePutSettings handles replacing the settings of a pull request with those in the body of the request. If
+// its server is running, it is stopped, so that the settings take effect the next time a player joins.
+func (r *Router) handlePutSettings(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	var settings map[string]json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(request.Body, 64<<10)).Decode(&settings); err != nil {
+		logger.Warn("Failed to decode settings", slog.Any("error", err))
+		http.Error(writer, "Failed to decode settings", http.StatusBadRequest)
+		return
+	}
+	if err := validateSettings(settings); err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid settings: %v", err), http.StatusBadRequest)
+		return
+	}
+	r.replaceSettings(writer, request, logger, pr, settings)
+}
+
+// handleDeleteSettings handles removing all settings of a pull request. If its server is running, it is
+// stopped, so that it falls back to its defaults the next time a player joins.
+func (r *Router) handleDeleteSettings(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	pr, ok := pathPullRequest(writer, request, logger)
+	if !ok {
+		return
+	}
+	r.replaceSettings(writer, request, logger, pr, nil)
+}
+
+// replaceSettings replaces the settings of the given PR with those passed. The keys no longer set are removed
+// from its config file right away.
+func (r *Router) replaceSettings(writer http.ResponseWriter, request *http.Request, logger *slog.Logger, pr string, settings map[string]json.RawMessage) {
+	if !pullRequestExists(pr) {
+		logger.Warn("PR not found", "pr", pr)
+		http.Error(writer, "PR not found", http.StatusNotFound)
+		return
+	}
+	profile := deploymentProfile(request.Context(), r.backend, r.conf, pr)
+	if _, ok := configPath(pr, profile); !ok && len(settings) > 0 {
+		http.Error(writer, fmt.Sprintf("Profile %s has no config file", profile.Name), http.StatusBadRequest)
+		return
+	}
+	if _, err := r.backend.StopServer(request.Context(), pr); err != nil {
+		logger.Error("Failed to stop server for settings", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to stop server", errorStatus(err))
+		return
+	}
+	var removed []string
+	if err := r.state.Update(func(data *stateData) {
+		for key := range data.Settings[pr] {
+			if _, ok := settings[key]; !ok {
+				removed = append(removed, key)
+			}
+		}
+		if len(settings) == 0 {
+			delete(data.Settings, pr)
+		} else {
+			data.Settings[pr] = settings
+		}
+	}); err != nil {
+		logger.Error("Failed to save settings", "pr", pr, slog.Any("error", err))
+		http.Error(writer, "Failed to save settings", http.StatusInternalServerError)
+		return
+	}
+	if err := removeSettings(pr, profile, removed); err != nil {
+		logger.Warn("Failed to remove settings from config", "pr", pr, slog.Any("error", err))
+	}
+	logger.Info("Set settings", "pr", pr, "settings", len(settings))
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]json.RawMessage
+		valid    bool
+	}{
+		{"values", map[string]json.RawMessage{"server.name": json.RawMessage(`"PR"`), "players.max": json.RawMessage(`10`), "world.save": json.RawMessage(`true`)}, true},
+		{"empty", nil, true},
+		{"invalid key", map[string]json.RawMessage{"server.na me": json.RawMessage(`"PR"`)}, false},
+		{"empty segment", map[string]json.RawMessage{"server..name": json.RawMessage(`"PR"`)}, false},
+		{"quoted key", map[string]json.RawMessage{`server."name"`: json.RawMessage(`"PR"`)}, false},
+		{"table and key", map[string]json.RawMessage{"server": json.RawMessage(`"PR"`), "server.name": json.RawMessage(`"PR"`)}, false},
+		{"object value", map[string]json.RawMessage{"server": json.RawMessage(`{"name": "PR"}`)}, false},
+		{"array value", map[string]json.RawMessage{"server.name": json.RawMessage(`["PR"]`)}, false},
+		{"null value", map[string]json.RawMessage{"server.name": json.RawMessage(`null`)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSettings(tt.settings); (err == nil) != tt.valid {
+				t.Errorf("validateSettings: got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+
+	many := make(map[string]json.RawMessage)
+	for i := range maxSettings + 1 {
+		many["key"+strings.Repeat("a", i)] = json.RawMessage(`1`)
+	}
+	if err := validateSettings(many); err == nil {
+		t.Errorf("validateSettings with %d settings: expected error", len(many))
+	}
+}
+
+func TestRenderSettings(t *testing.T) {
+	t.Chdir(t.TempDir())
+	profile := ProfileConfig{Name: "dragonfly", ConfigFile: "config.toml"}
+	path := filepath.Join(worldDir("1"), "config.toml")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	existing := "[Server]\nName = \"Dragonfly\"\nAuthEnabled = true\n\n[Players]\nMaxCount = 0\n"
+	if err := os.WriteFile(path, []byte(existing), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := renderSettings("1", profile, map[string]json.RawMessage{
+		"Server.Name":      json.RawMessage(`"PR 1"`),
+		"Players.MaxCount": json.RawMessage(`20`),
+		"Players.Rate":     json.RawMessage(`0.5`),
+		"World.Generator":  json.RawMessage(`"flat"`),
+	})
+	if err != nil {
+		t.Fatalf("render settings: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`Name = "PR 1"`, "AuthEnabled = true", "MaxCount = 20", "Rate = 0.5", "[World]", `Generator = "flat"`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("rendered config doesn't contain %q:\n%s", want, data)
+		}
+	}
+
+	// A key below a value that isn't a table replaces the value with one.
+	if err := renderSettings("1", profile, map[string]json.RawMessage{"Server.Name.First": json.RawMessage(`"PR"`)}); err != nil {
+		t.Fatalf("render nested setting: %v", err)
+	}
+	if err := removeSettings("1", profile, []string{"Players.MaxCount", "Unknown.Key"}); err != nil {
+		t.Fatalf("remove settings: %v", err)
+	}
+	data, _ = os.ReadFile(path)
+	if !strings.Contains(string(data), `First = "PR"`) || strings.Contains(string(data), "MaxCount") {
+		t.Errorf("config after nesting and removing settings:\n%s", data)
+	}
+
+	if err := renderSettings("1", ProfileConfig{Name: "none"}, map[string]json.RawMessage{"a": json.RawMessage(`1`)}); err == nil {
+		t.Error("render settings of profile without config file: expected error")
+	}
+}
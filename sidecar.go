@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// SidecarConfig is the configuration of a sidecar container, which is started alongside the server of every
+// pull request.
+type SidecarConfig struct {
+	// Name is the name of the sidecar. The container of the sidecar is named pr-<number>-<name>.
+	Name string
+	// Image is the image the sidecar container is created from.
+	Image string
+	// Args are the arguments passed to the entrypoint of the image.
+	Args []string
+	// Env holds additional environment variables in the format KEY=VALUE. The PR environment variable is
+	// always set to the number of the pull request.
+	Env []string
+}
+
+// startSidecars starts all configured sidecars for the server of the given PR. Sidecars share the network
+// namespace of the server container, so that they can reach the server on localhost, for example to export
+// metrics or capture packets.
+func (d *Docker) startSidecars(ctx context.Context, pr string) error {
+	for _, sidecar := range d.conf.Sidecars {
+		args := []string{
+			"run", "-d", "--rm",
+			"--name", "pr-" + pr + "-" + sidecar.Name,
+			"--label", "pr-sidecar=" + pr,
+			"--network", "container:pr-" + pr,
+			"-e", "PR=" + pr,
+		}
+		for _, env := range sidecar.Env {
+			args = append(args, "-e", env)
+		}
+		args = append(append(args, sidecar.Image), sidecar.Args...)
+		cmd := d.command(ctx, args...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("run sidecar %s: %w: %s", sidecar.Name, err, out)
+		}
+		slog.InfoContext(ctx, "Started sidecar for PR", slog.String("pr", pr), slog.String("sidecar", sidecar.Name))
+	}
+	return nil
+}
+
+// removeSidecars forcefully removes all sidecar containers of the given PR. If pr is empty, the sidecars of
+// all pull requests are removed.
+func (d *Docker) removeSidecars(ctx context.Context, pr string) error {
+	label := "pr-sidecar"
+	if pr != "" {
+		label += "=" + pr
+	}
+	containers, err := d.client.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", label)),
+	})
+	if err != nil {
+		return fmt.Errorf("list sidecars: %w", err)
+	}
+	for _, c := range containers {
+		err := d.client.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true})
+		if err != nil && !cerrdefs.IsNotFound(err) && !cerrdefs.IsConflict(err) {
+			return fmt.Errorf("remove sidecar %s: %w", c.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignKey is an Ed25519 public key in the format of minisign, which binaries uploaded by CI are signed
+// with.
+type minisignKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// parseMinisignKey parses a minisign public key. Both the base64 encoded key alone and the contents of a
+// minisign .pub file, which start with an untrusted comment, are accepted.
+func parseMinisignKey(s string) (minisignKey, error) {
+	var k minisignKey
+	line := lastLine(s)
+	b, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return k, fmt.Errorf("decode public key: %w", err)
+	}
+	if len(b) != 2+8+ed25519.PublicKeySize || string(b[:2]) != "Ed" {
+		return k, fmt.Errorf("public key is not a minisign Ed25519 key")
+	}
+	copy(k.id[:], b[2:10])
+	k.key = ed25519.PublicKey(b[10:])
+	return k, nil
+}
+
+// parseMinisignKeys parses all minisign public keys passed.
+func parseMinisignKeys(keys []string) ([]minisignKey, error) {
+	parsed := make([]minisignKey, 0, len(keys))
+	for _, s := range keys {
+		k, err := parseMinisignKey(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, k)
+	}
+	return parsed, nil
+}
+
+// verifyMinisign verifies that the minisign signature passed is a valid signature over the file at the path
+// passed by one of the keys passed. Both legacy and prehashed signatures are supported, and the trusted
+// comment of the signature must be signed as well.
+func verifyMinisign(path string, signature []byte, keys []minisignKey) error {
+	lines := strings.Split(strings.TrimSpace(strings.ReplaceAll(string(signature), "\r\n", "\n")), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "untrusted comment:") || !strings.HasPrefix(lines[2], "trusted comment:") {
+		return fmt.Errorf("%w: malformed minisign signature", errInvalidSignature)
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("%w: malformed minisign signature", errInvalidSignature)
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: malformed trusted comment signature", errInvalidSignature)
+	}
+	alg, id, sum := string(sig[:2]), sig[2:10], sig[10:]
+
+	var key *minisignKey
+	for i := range keys {
+		if bytes.Equal(keys[i].id[:], id) {
+			key = &keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("%w: signed by unknown key %s", errInvalidSignature, strings.ToUpper(hex.EncodeToString(reverse(id))))
+	}
+
+	message, err := signedMessage(path, alg)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key.key, message, sum) {
+		return fmt.Errorf("%w: signature does not match binary", errInvalidSignature)
+	}
+	trusted := strings.TrimPrefix(lines[2], "trusted comment:")
+	trusted = strings.TrimPrefix(trusted, " ")
+	if !ed25519.Verify(key.key, append(bytes.Clone(sum), trusted...), globalSig) {
+		return fmt.Errorf("%w: trusted comment signature does not match", errInvalidSignature)
+	}
+	return nil
+}
+
+// signedMessage returns the message minisign signs for the file at the path passed with the signature
+// algorithm passed: the contents of the file for legacy signatures, or its BLAKE2b-512 hash for prehashed
+// signatures.
+func signedMessage(path, alg string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	switch alg {
+	case "Ed":
+		return io.ReadAll(f)
+	case "ED":
+		h, _ := blake2b.New512(nil)
+		if _, err := io.Copy(h, f); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+	return nil, fmt.Errorf("%w: unsupported signature algorithm %q", errInvalidSignature, alg)
+}
+
+// lastLine returns the last non-empty line of the string passed, with surrounding whitespace removed.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// reverse returns a reversed copy of the bytes passed. minisign displays key IDs in little-endian order.
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i, c := range b {
+		r[len(b)-1-i] = c
+	}
+	return r
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignSigner signs files the way minisign does, for testing verifyMinisign.
+type minisignSigner struct {
+	id   [8]byte
+	priv ed25519.PrivateKey
+}
+
+func newMinisignSigner(t *testing.T, id byte) (minisignSigner, minisignKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := minisignSigner{id: [8]byte{id}, priv: priv}
+	encoded := base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), s.id[:]...), pub...))
+	key, err := parseMinisignKey("untrusted comment: minisign public key\n" + encoded + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, key
+}
+
+// sign returns a signature over the data passed, prehashed if alg is ED, with the trusted comment passed.
+func (s minisignSigner) sign(data []byte, alg, trusted string) []byte {
+	message := data
+	if alg == "ED" {
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	}
+	sig := ed25519.Sign(s.priv, message)
+	global := ed25519.Sign(s.priv, append(append([]byte(nil), sig...), trusted...))
+	return []byte("untrusted comment: signature\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte(alg), s.id[:]...), sig...)) + "\n" +
+		"trusted comment: " + trusted + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	signer, key := newMinisignSigner(t, 1)
+	other, otherKey := newMinisignSigner(t, 2)
+	path := filepath.Join(t.TempDir(), "binary")
+	data := []byte("binary contents")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tampered := signer.sign(data, "ED", "timestamp:1")
+	tampered = []byte(strings.Replace(string(tampered), "timestamp:1", "timestamp:2", 1))
+
+	tests := []struct {
+		name      string
+		signature []byte
+		keys      []minisignKey
+		valid     bool
+	}{
+		{"prehashed", signer.sign(data, "ED", "timestamp:1"), []minisignKey{key}, true},
+		{"legacy", signer.sign(data, "Ed", "timestamp:1"), []minisignKey{key}, true},
+		{"second key", other.sign(data, "ED", "timestamp:1"), []minisignKey{key, otherKey}, true},
+		{"unknown key", other.sign(data, "ED", "timestamp:1"), []minisignKey{key}, false},
+		{"other file", signer.sign([]byte("other contents"), "ED", "timestamp:1"), []minisignKey{key}, false},
+		{"tampered trusted comment", tampered, []minisignKey{key}, false},
+		{"unsupported algorithm", signer.sign(data, "XX", "timestamp:1"), []minisignKey{key}, false},
+		{"malformed", []byte("untrusted comment: signature\nnot base64\n"), []minisignKey{key}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyMinisign(path, tt.signature, tt.keys)
+			if tt.valid && err != nil {
+				t.Errorf("expected valid signature, got %v", err)
+			}
+			if !tt.valid && !errors.Is(err, errInvalidSignature) {
+				t.Errorf("expected errInvalidSignature, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseMinisignKey(t *testing.T) {
+	if _, err := parseMinisignKey("RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3"); err != nil {
+		t.Errorf("parse valid key: %v", err)
+	}
+	for _, s := range []string{"", "not base64", base64.StdEncoding.EncodeToString([]byte("Ed short"))} {
+		if _, err := parseMinisignKey(s); err == nil {
+			t.Errorf("parse %q: expected error", s)
+		}
+	}
+}
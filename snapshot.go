@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// errSnapshotNotFound is returned when restoring a snapshot that doesn't exist.
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+// Snapshot is an archive of the world directory of a pull request taken at a specific time.
+type Snapshot struct {
+	// ID uniquely identifies the snapshot among the snapshots of the same pull request. It is derived from
+	// the time the snapshot was taken, down to the millisecond.
+	ID string `json:"id"`
+	// Created is the time the snapshot was taken.
+	Created time.Time `json:"created"`
+	// Size is the size of the compressed archive in bytes.
+	Size int64 `json:"size"`
+}
+
+// snapshotIDFormat is the time format used for the IDs of snapshots, which sorts chronologically. IDs are
+// formatted with milliseconds appended, so that snapshots taken within the same second don't collide, which
+// time.Parse accepts with this format too. IDs of snapshots taken by earlier versions have no milliseconds.
+const snapshotIDFormat = "20060102-150405"
+
+// snapshotDir returns the directory the snapshots of the given PR are stored in.
+func snapshotDir(pr string) string {
+	return filepath.Join("snapshots", "pr-"+pr)
+}
+
+// createSnapshot archives the world directory of the given PR into a new snapshot. The caller is responsible
+// for making sure the world is not written to while the snapshot is taken, and that the world of the PR is
+// stored locally, as checked by localWorld.
+func createSnapshot(pr string) (Snapshot, error) {
+	if err := ensureDiskImageMounted(pr); err != nil {
+		return Snapshot{}, err
+	}
+	if err := os.MkdirAll(snapshotDir(pr), 0755); err != nil {
+		return Snapshot{}, fmt.Errorf("create snapshot directory: %w", err)
+	}
+	now := time.Now()
+	id := now.Format(snapshotIDFormat + ".000")
+	path := filepath.Join(snapshotDir(pr), id+".tar.gz")
+	if _, err := os.Stat(path); err == nil {
+		return Snapshot{}, fmt.Errorf("snapshot %s already exists", id)
+	}
+	if err := writeArchive(path, worldDir(pr)); err != nil {
+		_ = os.Remove(path)
+		return Snapshot{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("stat snapshot: %w", err)
+	}
+	return Snapshot{ID: id, Created: now, Size: info.Size()}, nil
+}
+
+// listSnapshots returns all snapshots of the given PR, from oldest to newest.
+func listSnapshots(pr string) ([]Snapshot, error) {
+	matches, err := filepath.Glob(filepath.Join(snapshotDir(pr), "*.tar.gz"))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(matches)
+	snapshots := make([]Snapshot, 0, len(matches))
+	for _, path := range matches {
+		id := strings.TrimSuffix(filepath.Base(path), ".tar.gz")
+		created, err := time.ParseInLocation(snapshotIDFormat, id, time.Local)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{ID: id, Created: created, Size: info.Size()})
+	}
+	return snapshots, nil
+}
+
+// restoreSnapshot replaces the contents of the world directory of the given PR with the contents of the snapshot
+// with the ID passed. The server of the PR must not be running, and its world must be stored locally.
+func restoreSnapshot(pr, id string) error {
+	if _, err := time.Parse(snapshotIDFormat, id); err != nil {
+		return errSnapshotNotFound
+	}
+	path := filepath.Join(snapshotDir(pr), id+".tar.gz")
+	if _, err := os.Stat(path); err != nil {
+		return errSnapshotNotFound
+	}
+	if err := ensureDiskImageMounted(pr); err != nil {
+		return err
+	}
+
+	// The world directory may be the mount point of a disk image, so only its contents are removed.
+	dir := worldDir(pr)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("read world directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == "lost+found" || entry.Name() == provenanceFile {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return fmt.Errorf("clear world directory: %w", err)
+		}
+	}
+	return extractArchive(path, dir)
+}
+
+// withServerPaused calls f while the server of the given PR is paused, so that its world is not written to
+// while f reads it. If the server is not running or already paused, f is called directly.
+func withServerPaused(ctx context.Context, backend Backend, pr string, f func() error) error {
+	servers, err := backend.Servers(ctx)
+	if err != nil {
+		return fmt.Errorf("list servers: %w", err)
+	}
+	for _, srv := range servers {
+		if srv.PR != pr || srv.Paused {
+			continue
+		}
+		if err := backend.PauseServer(ctx, pr); err != nil {
+			return fmt.Errorf("pause server: %w", err)
+		}
+		defer func() {
+			// The server must be resumed even if the context was cancelled while f was running.
+			if err := backend.UnpauseServer(context.WithoutCancel(ctx), pr); err != nil {
+				slog.Error("Failed to unpause server", "pr", pr, slog.Any("error", err))
+			}
+		}()
+	}
+	return f()
+}
+
+// removeSnapshots removes all snapshots of the given PR.
+func removeSnapshots(pr string) {
+	_ = os.RemoveAll(snapshotDir(pr))
+}
+
+// writeArchive writes a gzip compressed tar archive of the directory dir to the file at path.
+func writeArchive(path, dir string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create archive: %w", err)
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	err = filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." || rel == "lost+found" {
+			if entry.IsDir() && rel == "lost+found" {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if rel == provenanceFile {
+			// Worlds may still hold the provenance of an image written by previous versions, which belongs to
+			// the image rather than the world.
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			// Skip symlinks, sockets and other special files, which a world never contains.
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("archive %s: %w", dir, err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("close archive: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("close archive: %w", err)
+	}
+	return f.Close()
+}
+
+// extractArchive extracts the gzip compressed tar archive at path into the directory dir. Entries that would
+// be extracted outside dir are rejected.
+func extractArchive(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open archive: %w", err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("read archive: %w", err)
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read archive: %w", err)
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("archive entry %q is outside of the target directory", hdr.Name)
+		}
+		target := filepath.Join(dir, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("create directory: %w", err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("create directory: %w", err)
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return fmt.Errorf("create file: %w", err)
+			}
+			_, err = io.Copy(out, tr)
+			_ = out.Close()
+			if err != nil {
+				return fmt.Errorf("extract file: %w", err)
+			}
+		}
+	}
+}
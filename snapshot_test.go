@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateSnapshotWithinSecond(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll(worldDir("1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(worldDir("1"), "level.dat"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A snapshot taken by an earlier version, whose ID has no milliseconds.
+	if err := os.MkdirAll(snapshotDir("1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeArchive(filepath.Join(snapshotDir("1"), "20250101-120000.tar.gz"), worldDir("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]bool)
+	for range 3 {
+		snapshot, err := createSnapshot("1")
+		if err != nil {
+			t.Fatalf("create snapshot: %v", err)
+		}
+		if ids[snapshot.ID] {
+			t.Fatalf("snapshot ID %s was taken twice", snapshot.ID)
+		}
+		ids[snapshot.ID] = true
+		time.Sleep(time.Millisecond)
+	}
+	snapshots, err := listSnapshots("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 4 || snapshots[0].ID != "20250101-120000" {
+		t.Fatalf("expected the old snapshot and 3 new ones, got %+v", snapshots)
+	}
+	for _, snapshot := range snapshots {
+		if err := restoreSnapshot("1", snapshot.ID); err != nil {
+			t.Errorf("restore snapshot %s: %v", snapshot.ID, err)
+		}
+	}
+}
+
+func TestLocalWorld(t *testing.T) {
+	state, err := OpenState(filepath.Join(t.TempDir(), "state.json"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = state.Update(func(data *stateData) {
+		data.Hosts["1"] = "local"
+		data.Hosts["2"] = "remote"
+	})
+	var conf Config
+	conf.Hosts = []HostConfig{{Name: "local"}, {Name: "remote", Address: "tcp://10.0.0.2:2375"}}
+	for pr, local := range map[string]bool{"1": true, "2": false, "3": true} {
+		if err := localWorld(state, conf, pr); (err == nil) != local {
+			t.Errorf("PR %s: expected local %v, got %v", pr, local, err)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime/multipart"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// maxSourceSize is the maximum total size of the files extracted from a source tarball, so that a small
+	// tarball can't fill the disk once decompressed.
+	maxSourceSize = 1 << 30
+	// fetchTimeout is the time fetching a git ref from the repository of a profile may take.
+	fetchTimeout = time.Minute * 5
+)
+
+// gitRef matches valid git refs uploaded for pull requests, such as a commit SHA, main or refs/pull/123/head.
+// Refs may not start with a dash, so that they can't be mistaken for options of git.
+var gitRef = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_./-]*$`)
+
+// sourceDir returns the directory the source of the given PR is prepared in before its binary is built.
+func sourceDir(pr string) string {
+	return filepath.Join("builds", "source-pr-"+pr)
+}
+
+// removeSource removes the source of the given PR and everything built from it.
+func removeSource(pr string) {
+	_ = os.RemoveAll(sourceDir(pr))
+	_ = os.RemoveAll(sourceDir(pr) + ".out")
+	_ = os.Remove(sourceDir(pr) + ".Dockerfile")
+	_ = os.Remove(sourceDir(pr) + ".tar.gz")
+	_ = os.Remove(sourceDir(pr) + ".gitconfig")
+}
+
+// saveTarball saves the uploaded tarball passed at the path passed.
+func saveTarball(tarball multipart.File, path string) error {
+	if _, err := tarball.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek tarball: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("create build directory: %w", err)
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create tarball: %w", err)
+	}
+	if _, err := io.Copy(out, tarball); err != nil {
+		_ = out.Close()
+		return fmt.Errorf("save tarball: %w", err)
+	}
+	return out.Close()
+}
+
+// extractSource extracts the gzip compressed tarball passed into the directory passed. Only regular files and
+// directories are extracted, and all of them are created within the directory, so that a tarball can't write
+// anywhere else through links or paths such as ../.
+func extractSource(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create source directory: %w", err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return fmt.Errorf("open source directory: %w", err)
+	}
+	defer root.Close()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: not a gzip compressed tarball: %v", errInvalidSource, err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	var size int64
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%w: read tarball: %v", errInvalidSource, err)
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+		if name == "." {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := root.MkdirAll(name, 0755); err != nil {
+				return fmt.Errorf("%w: create %s: %v", errInvalidSource, name, err)
+			}
+		case tar.TypeReg:
+			if size += header.Size; size > maxSourceSize {
+				return fmt.Errorf("%w: source is larger than %d MB", errInvalidSource, maxSourceSize>>20)
+			}
+			if err := root.MkdirAll(path.Dir(name), 0755); err != nil {
+				return fmt.Errorf("%w: create %s: %v", errInvalidSource, path.Dir(name), err)
+			}
+			if err := extractFile(root, name, fs.FileMode(header.Mode).Perm(), tr); err != nil {
+				return fmt.Errorf("%w: extract %s: %v", errInvalidSource, name, err)
+			}
+		default:
+			slog.Debug("Skipping entry of source tarball", slog.String("name", name), slog.Any("type", header.Typeflag))
+		}
+	}
+}
+
+// extractFile writes the file with the name passed within the root passed from the reader passed.
+func extractFile(root *os.Root, name string, perm fs.FileMode, r io.Reader) error {
+	f, err := root.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// fetchSource fetches the git ref passed from the repository passed into the directory passed, authenticating
+// with the GitCredentials passed, and returns the commit it points to. Only the commit itself is fetched, and
+// the git metadata is removed afterwards, so that only the files of the commit are sent to the build.
+func fetchSource(ctx context.Context, creds *GitCredentials, repository, ref, dir string) (string, error) {
+	if !gitRef.MatchString(ref) || strings.Contains(ref, "..") {
+		return "", fmt.Errorf("%w: invalid git ref %q", errInvalidSource, ref)
+	}
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+	git := func(args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(), creds.env()...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("create source directory: %w", err)
+	}
+	if _, err := git("init", "-q"); err != nil {
+		return "", err
+	}
+	if _, err := git("fetch", "-q", "--depth", "1", "--", repository, ref); err != nil {
+		return "", fmt.Errorf("%w: fetch %s from %s: %v", errInvalidSource, ref, repository, err)
+	}
+	if _, err := git("checkout", "-q", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+	commit, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(filepath.Join(dir, ".git")); err != nil {
+		return "", fmt.Errorf("remove git metadata: %w", err)
+	}
+	return commit, nil
+}
+
+// buildFromSource builds the binary of the given PR from source, either from the tarball passed or, if it is nil,
+// from the git ref passed fetched from the Repository of the profile with the GitCredentials passed, and uploads
+// it as if it was uploaded directly. If keys are passed, the signature passed must be a valid signature over the
+// tarball, and git refs are refused, as nothing could vouch for them. If the source was fetched from git, the
+// commit it points to is returned.
+func buildFromSource(ctx context.Context, backend Backend, creds *GitCredentials, pr string, profile ProfileConfig, tarball multipart.File, ref string, signature []byte, keys []minisignKey) (string, error) {
+	if profile.SourceDockerfile == "" {
+		return "", fmt.Errorf("%w: profile %s can't be built from source", errInvalidSource, profile.Name)
+	}
+	dir := sourceDir(pr)
+	removeSource(pr)
+	defer removeSource(pr)
+
+	var commit string
+	if tarball != nil {
+		// The tarball is saved first, as signatures are verified over files.
+		if err := saveTarball(tarball, dir+".tar.gz"); err != nil {
+			return "", err
+		}
+		if len(keys) > 0 {
+			if err := verifyMinisign(dir+".tar.gz", signature, keys); err != nil {
+				return "", err
+			}
+		}
+		f, err := os.Open(dir + ".tar.gz")
+		if err != nil {
+			return "", err
+		}
+		err = extractSource(f, dir)
+		_ = f.Close()
+		if err != nil {
+			return "", err
+		}
+	} else {
+		if len(keys) > 0 {
+			return "", fmt.Errorf("%w: git refs can't be signed, upload a signed binary or tarball instead", errInvalidSignature)
+		}
+		if profile.Repository == "" {
+			return "", fmt.Errorf("%w: profile %s has no repository to fetch git refs from", errInvalidSource, profile.Name)
+		}
+		var err error
+		if commit, err = fetchSource(ctx, creds, profile.Repository, ref, dir); err != nil {
+			return "", err
+		}
+	}
+
+	out := dir + ".out"
+	if err := backend.BuildBinary(ctx, pr, profile, dir, out); err != nil {
+		return "", err
+	}
+	binary, err := os.Open(filepath.Join(out, "dragonfly"))
+	if err != nil {
+		return "", fmt.Errorf("%w: the last stage of %s has no /dragonfly", errInvalidBinary, profile.SourceDockerfile)
+	}
+	defer binary.Close()
+	return commit, uploadBinary(pr, binary, profile, nil, nil)
+}
+
+// BuildBinary builds the binary of the given PR from the source in the directory passed with the
+// SourceDockerfile of the profile passed, in the same sandbox as images and with access to the GitCredentials
+// of the Docker instance, and exports the last stage of the build into the directory dest.
+func (d *Docker) BuildBinary(ctx context.Context, pr string, profile ProfileConfig, source, dest string) error {
+	dockerfile, err := os.ReadFile(profile.SourceDockerfile)
+	if err != nil {
+		return fmt.Errorf("read source Dockerfile: %w", err)
+	}
+	// The Dockerfile is kept outside the build context, so that it isn't copied along with the source.
+	path := source + ".Dockerfile"
+	if err := os.WriteFile(path, withCacheMounts(dockerfile, profile, pr), 0644); err != nil {
+		return fmt.Errorf("write source Dockerfile: %w", err)
+	}
+	args := []string{"build", "--force-rm", "--build-arg", "PR=" + pr, "-f", path, "--output", "type=local,dest=" + dest}
+	sandbox, err := d.sandboxArgs(ctx, profile)
+	if err != nil {
+		return err
+	}
+	args = append(args, sandbox...)
+	credentials, err := d.git.buildArgs(source + ".gitconfig")
+	if err != nil {
+		return err
+	}
+	args = append(args, credentials...)
+	slog.InfoContext(ctx, "Building binary from source", slog.String("pr", pr), slog.String("host", d.Name()), slog.String("profile", profile.Name))
+	if out, err := d.command(ctx, append(args, source)...).CombinedOutput(); err != nil {
+		return newBuildError(err, out)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sourceTarball returns a gzip compressed tarball holding the entries passed.
+func sourceTarball(t *testing.T, entries ...tar.Header) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, header := range entries {
+		body := header.Linkname
+		if header.Typeflag == tar.TypeReg {
+			header.Size, header.Linkname = int64(len(body)), ""
+		}
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// sourceFile returns the header of a regular file with the contents passed. The contents are carried in the
+// Linkname, which sourceTarball writes as the body of the file.
+func sourceFile(name, contents string) tar.Header {
+	return tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Linkname: contents}
+}
+
+func TestExtractSource(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "source")
+	tarball := sourceTarball(t,
+		tar.Header{Name: "cmd/", Typeflag: tar.TypeDir, Mode: 0755},
+		sourceFile("cmd/main.go", "package main"),
+		sourceFile("/go.mod", "module example"),
+		tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"},
+		sourceFile("link", "written through link"),
+	)
+	if err := extractSource(tarball, dir); err != nil {
+		t.Fatalf("extract source: %v", err)
+	}
+	for name, want := range map[string]string{"cmd/main.go": "package main", "go.mod": "module example", "link": "written through link"} {
+		if data, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if info, err := os.Lstat(filepath.Join(dir, "link")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("link extracted as %v, %v, want regular file", info.Mode(), err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "hardlink")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("hard link was extracted")
+	}
+}
+
+func TestExtractSourceInvalid(t *testing.T) {
+	if err := extractSource(strings.NewReader("not gzip"), t.TempDir()); !errors.Is(err, errInvalidSource) {
+		t.Errorf("extract non-gzip tarball: got %v, want errInvalidSource", err)
+	}
+
+	// Files may not be written outside the source directory through their path.
+	for _, name := range []string{"../escaped", "cmd/../../escaped"} {
+		base := t.TempDir()
+		err := extractSource(sourceTarball(t, sourceFile(name, "escaped")), filepath.Join(base, "source"))
+		if !errors.Is(err, errInvalidSource) {
+			t.Errorf("extract %s: got %v, want errInvalidSource", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(base, "escaped")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s was written outside the source directory", name)
+		}
+	}
+
+	// Files may not be written through symlinks to directories outside the source directory.
+	outside := t.TempDir()
+	dir := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "out")); err != nil {
+		t.Fatal(err)
+	}
+	err := extractSource(sourceTarball(t, sourceFile("out/file", "escaped")), dir)
+	if !errors.Is(err, errInvalidSource) {
+		t.Errorf("extract through symlink: got %v, want errInvalidSource", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "file")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("file was written through symlink outside the source directory")
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	_ = tw.WriteHeader(&tar.Header{Name: "large", Typeflag: tar.TypeReg, Mode: 0644, Size: maxSourceSize + 1})
+	_ = gz.Close()
+	if err := extractSource(&buf, t.TempDir()); !errors.Is(err, errInvalidSource) {
+		t.Errorf("extract oversized tarball: got %v, want errInvalidSource", err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxStackSize is the maximum size of a compose file uploaded for a pull request.
+const maxStackSize = 1 << 20
+
+// errInvalidStack is returned when the compose file uploaded for a pull request can't be parsed or uses
+// options that would give its services access to the host.
+var errInvalidStack = errors.New("invalid compose file")
+
+// forbiddenServiceKeys are the options of services in a compose file that would give them access to the host
+// prmanager runs on, publish their ports on it, or that reference files on it. They are refused regardless of
+// their value, as the values may be interpolated from the environment.
+var forbiddenServiceKeys = []string{
+	"privileged", "network_mode", "pid", "ipc", "uts", "userns_mode", "cgroup", "cgroup_parent", "cap_add",
+	"devices", "device_cgroup_rules", "security_opt", "sysctls", "ports", "extends", "env_file", "build",
+	"configs", "secrets", "volumes_from",
+}
+
+// forbiddenResourceKeys are the options of top-level volumes and networks in a compose file that are refused.
+// The local volume driver can bind mount any path of the host through its options, other drivers may attach to
+// the network of the host, and external resources or resources with an explicit name may be those of other
+// PRs or of the host rather than ones scoped to the stack.
+var forbiddenResourceKeys = []string{"driver", "driver_opts", "external", "name"}
+
+// namedVolume matches the source of a volume mount that is a named volume rather than a path on the host.
+var namedVolume = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// stackPath returns the path of the compose file describing the auxiliary services of the given PR.
+func stackPath(pr string) string {
+	return filepath.Join("stacks", "pr-"+pr, "compose.yml")
+}
+
+// hasStack checks if the given PR has a compose file describing auxiliary services, such as a database, that
+// must be running alongside its server.
+func hasStack(pr string) bool {
+	_, err := os.Stat(stackPath(pr))
+	return err == nil
+}
+
+// stackNetwork returns the name of the default network Docker Compose creates for the stack of the given PR.
+// The server of the PR joins this network so that it can reach the services of the stack by name.
+func stackNetwork(pr string) string {
+	return "pr-" + pr + "_default"
+}
+
+// saveStack stores the compose file passed as the stack of the given PR, replacing any existing one. A compose
+// file that fails validateStack is refused with an error satisfying errors.Is(err, errInvalidStack).
+func saveStack(pr string, file io.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(file, maxStackSize+1))
+	if err != nil {
+		return fmt.Errorf("read compose file: %w", err)
+	} else if len(data) > maxStackSize {
+		return fmt.Errorf("%w: larger than %d KB", errInvalidStack, maxStackSize>>10)
+	}
+	if err := validateStack(data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(stackPath(pr)), 0755); err != nil {
+		return fmt.Errorf("create stack directory: %w", err)
+	}
+	if err := os.WriteFile(stackPath(pr), data, 0644); err != nil {
+		return fmt.Errorf("write compose file: %w", err)
+	}
+	return nil
+}
+
+// validateStack checks that the services of the compose file passed stay within their containers: they may
+// not be privileged, share the network, PID or IPC namespace of the host, gain capabilities or devices, or
+// mount paths of the host. Files other than the compose file itself, such as through include or extends,
+// can't be referenced either, as they would be read from the host.
+func validateStack(data []byte) error {
+	var file struct {
+		Include  any                       `yaml:"include"`
+		Services map[string]map[string]any `yaml:"services"`
+		Volumes  map[string]map[string]any `yaml:"volumes"`
+		Networks map[string]map[string]any `yaml:"networks"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidStack, err)
+	}
+	if file.Include != nil {
+		return fmt.Errorf("%w: include is not allowed", errInvalidStack)
+	}
+	for name, service := range file.Services {
+		for _, key := range forbiddenServiceKeys {
+			if _, ok := service[key]; ok {
+				return fmt.Errorf("%w: service %s: %s is not allowed", errInvalidStack, name, key)
+			}
+		}
+		volumes, _ := service["volumes"].([]any)
+		for _, volume := range volumes {
+			if err := validateVolumeMount(volume); err != nil {
+				return fmt.Errorf("%w: service %s: %v", errInvalidStack, name, err)
+			}
+		}
+	}
+	for name, volume := range file.Volumes {
+		for _, key := range forbiddenResourceKeys {
+			if _, ok := volume[key]; ok {
+				return fmt.Errorf("%w: volume %s: %s is not allowed", errInvalidStack, name, key)
+			}
+		}
+	}
+	for name, network := range file.Networks {
+		for _, key := range forbiddenResourceKeys {
+			if _, ok := network[key]; ok {
+				return fmt.Errorf("%w: network %s: %s is not allowed", errInvalidStack, name, key)
+			}
+		}
+	}
+	return nil
+}
+
+// validateVolumeMount checks that the volume mount of a service passed, in either its short or long syntax,
+// mounts a named volume or a tmpfs rather than a path of the host.
+func validateVolumeMount(volume any) error {
+	switch v := volume.(type) {
+	case string:
+		source, _, found := strings.Cut(v, ":")
+		if found && !namedVolume.MatchString(source) {
+			return fmt.Errorf("bind mount %s is not allowed", source)
+		}
+	case map[string]any:
+		if t, _ := v["type"].(string); t != "volume" && t != "tmpfs" {
+			return fmt.Errorf("mounts of type %v are not allowed", v["type"])
+		}
+		if source, ok := v["source"].(string); ok && !namedVolume.MatchString(source) {
+			return fmt.Errorf("volume %s is not allowed", source)
+		}
+	default:
+		return fmt.Errorf("invalid volume %v", volume)
+	}
+	return nil
+}
+
+// compose runs a docker compose command for the stack of the given PR. The secrets of the PR are passed in its
+// env file, so that the compose file can refer to them, such as ${DB_PASSWORD}.
+func (d *Docker) compose(ctx context.Context, pr string, args ...string) error {
+	envFile, removeEnvFile, err := d.secrets.EnvFile(pr)
+	if err != nil {
+		return fmt.Errorf("inject secrets: %w", err)
+	}
+	defer removeEnvFile()
+	flags := []string{"compose", "-p", "pr-" + pr, "-f", stackPath(pr)}
+	if envFile != "" {
+		flags = append(flags, "--env-file", envFile)
+	}
+	cmd := d.command(ctx, append(flags, args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("run command '%s': %w: %s", cmd.String(), err, out)
+	}
+	return nil
+}
+
+// startStack starts all services in the stack of the given PR, if it has one.
+func (d *Docker) startStack(ctx context.Context, pr string) error {
+	if !hasStack(pr) {
+		return nil
+	}
+	// Compose files saved before they were validated are checked again before they are started.
+	data, err := os.ReadFile(stackPath(pr))
+	if err != nil {
+		return fmt.Errorf("read compose file: %w", err)
+	}
+	if err := validateStack(data); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Starting stack for PR", slog.String("pr", pr))
+	return d.compose(ctx, pr, "up", "-d", "--remove-orphans")
+}
+
+// stopStack stops all services in the stack of the given PR, if it has one, keeping their data so that they
+// can be started again later.
+func (d *Docker) stopStack(ctx context.Context, pr string) {
+	if !hasStack(pr) {
+		return
+	}
+	if err := d.compose(ctx, pr, "stop"); err != nil {
+		slog.WarnContext(ctx, "Failed to stop stack", slog.String("pr", pr), slog.Any("error", err))
+	}
+}
+
+// removeStack tears down the stack of the given PR, if it has one, removing its containers, networks and
+// volumes as well as the compose file.
+func (d *Docker) removeStack(ctx context.Context, pr string) {
+	if !hasStack(pr) {
+		return
+	}
+	if err := d.compose(ctx, pr, "down", "-v", "--remove-orphans"); err != nil {
+		slog.WarnContext(ctx, "Failed to remove stack", slog.String("pr", pr), slog.Any("error", err))
+	}
+	_ = os.RemoveAll(filepath.Dir(stackPath(pr)))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateStack(t *testing.T) {
+	tests := []struct {
+		name    string
+		compose string
+		valid   bool
+	}{
+		{"named volume", "services:\n  db:\n    image: mysql\n    volumes:\n      - data:/var/lib/mysql\nvolumes:\n  data: {}\n", true},
+		{"anonymous volume", "services:\n  db:\n    image: mysql\n    volumes:\n      - /var/lib/mysql\n", true},
+		{"long volume", "services:\n  db:\n    image: mysql\n    volumes:\n      - type: volume\n        source: data\n        target: /data\n", true},
+		{"tmpfs", "services:\n  db:\n    image: mysql\n    volumes:\n      - type: tmpfs\n        target: /tmp\n", true},
+		{"privileged", "services:\n  db:\n    image: mysql\n    privileged: false\n", false},
+		{"host network", "services:\n  db:\n    image: mysql\n    network_mode: host\n", false},
+		{"host pid", "services:\n  db:\n    image: mysql\n    pid: host\n", false},
+		{"capabilities", "services:\n  db:\n    image: mysql\n    cap_add: [SYS_ADMIN]\n", false},
+		{"bind mount", "services:\n  db:\n    image: mysql\n    volumes:\n      - /:/host\n", false},
+		{"relative bind mount", "services:\n  db:\n    image: mysql\n    volumes:\n      - ./data:/data\n", false},
+		{"interpolated bind mount", "services:\n  db:\n    image: mysql\n    volumes:\n      - ${HOME}:/home\n", false},
+		{"long bind mount", "services:\n  db:\n    image: mysql\n    volumes:\n      - type: bind\n        source: /etc\n        target: /etc\n", false},
+		{"include", "include:\n  - /etc/compose.yml\nservices: {}\n", false},
+		{"extends", "services:\n  db:\n    extends:\n      file: /etc/compose.yml\n      service: db\n", false},
+		{"volume driver options", "services: {}\nvolumes:\n  data:\n    driver_opts:\n      type: none\n      o: bind\n      device: /etc\n", false},
+		{"ports", "services:\n  db:\n    image: mysql\n    ports:\n      - 3306:3306\n", false},
+		{"external volume", "services: {}\nvolumes:\n  data:\n    external: true\n", false},
+		{"named volume resource", "services: {}\nvolumes:\n  data:\n    name: pr-1_data\n", false},
+		{"external network", "services: {}\nnetworks:\n  default:\n    external: true\n", false},
+		{"named network", "services: {}\nnetworks:\n  default:\n    name: bridge\n", false},
+		{"network", "services: {}\nnetworks:\n  backend: {}\n", true},
+		{"invalid yaml", "services: [", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateStack([]byte(test.compose))
+			if test.valid && err != nil {
+				t.Fatalf("expected compose file to be valid, got %v", err)
+			} else if !test.valid && !errors.Is(err, errInvalidStack) {
+				t.Fatalf("expected errInvalidStack, got %v", err)
+			}
+		})
+	}
+}
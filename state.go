@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// State is a persistent store for data that must survive restarts of prmanager, such as the host ports that
+// have been assigned to pull requests. It is stored as JSON in a single file.
+type State struct {
+	path string
+
+	mu   sync.Mutex
+	data stateData
+}
+
+// stateVersion is the version of the format of stateData. It is incremented whenever the format changes in a
+// way that requires existing state to be migrated, with a migration added to stateMigrations.
+const stateVersion = 1
+
+// stateData is the data held by a State, as it is encoded to disk.
+type stateData struct {
+	// Version is the version of the format the data is stored in.
+	Version int `json:"version"`
+	// Ports maps pull request numbers to the host port last assigned to their server.
+	Ports map[string]uint16 `json:"ports"`
+	// Hosts maps pull request numbers to the name of the host their server was last scheduled on.
+	Hosts map[string]string `json:"hosts"`
+	// Joins maps pull request numbers to the time a player last joined their server.
+	Joins map[string]time.Time `json:"joins,omitempty"`
+	// Demand maps pull request numbers to their joins per hour within Demand.Window, from oldest to newest.
+	Demand map[string][]DemandBucket `json:"demand,omitempty"`
+	// Backends maps the names of static backends registered through the API to the backends.
+	Backends map[string]StaticBackend `json:"backends,omitempty"`
+	// Aliases maps the hosts of aliases registered through the API to the pull requests they route to.
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// Builds maps pull request numbers to their build history, from oldest to newest.
+	Builds map[string][]BuildRecord `json:"builds,omitempty"`
+	// Images maps pull request numbers to the report of the image last built for them.
+	Images map[string]ImageReport `json:"images,omitempty"`
+	// Canaries maps pull request numbers to the routing of players to their canary build.
+	Canaries map[string]Canary `json:"canaries,omitempty"`
+	// APIKeys maps the IDs of API keys created through the API to the keys.
+	APIKeys map[string]APIKey `json:"api_keys,omitempty"`
+	// Secrets maps the PRs secrets are injected into to the secrets by their name. Secrets injected into all
+	// PRs are stored under the empty string.
+	Secrets map[string]map[string]Secret `json:"secrets,omitempty"`
+	// Settings maps pull requests to the settings rendered into the config files of their servers, by the
+	// dotted path of their keys.
+	Settings map[string]map[string]json.RawMessage `json:"settings,omitempty"`
+	// Running is the set of pull requests whose servers should be running, as they were started and not
+	// stopped since. It is reconciled with the servers actually running by the Reconciler.
+	Running map[string]bool `json:"running,omitempty"`
+	// Building maps pull requests to the builds of their images in progress, so that builds interrupted by
+	// prmanager stopping can be recovered once it starts again.
+	Building map[string]InFlightBuild `json:"building,omitempty"`
+	// Deleted maps pull requests deleted through the API to the time they were deleted, until they are purged
+	// after the grace period or restored.
+	Deleted map[string]time.Time `json:"deleted,omitempty"`
+	// Draining maps pull requests deleted while players were online to their drains, until they are deleted.
+	Draining map[string]Drain `json:"draining,omitempty"`
+}
+
+// OpenState opens the State stored at the path passed. If no file exists at the path yet, an empty State is
+// returned that will create the file once it is first updated. State stored at an older version is migrated
+// to the current version first, keeping the original file with a .bak suffix.
+func OpenState(path string, conf Config) (*State, error) {
+	s, err := readState(path)
+	if err != nil {
+		return nil, err
+	}
+	if from := s.data.Version; from != stateVersion {
+		if err := s.migrate(conf); err != nil {
+			return nil, err
+		}
+		slog.Info("Migrated state", slog.Int("from", from), slog.Int("to", stateVersion), slog.String("backup", path+".bak"))
+	}
+	return s, nil
+}
+
+// readState reads the State stored at the path passed without checking its version.
+func readState(path string) (*State, error) {
+	s := &State{path: path, data: stateData{Version: stateVersion}}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read state: %w", err)
+	} else if err == nil {
+		// Files written before the version was added are at version 0.
+		s.data.Version = 0
+		if err := json.Unmarshal(data, &s.data); err != nil {
+			return nil, fmt.Errorf("decode state: %w", err)
+		}
+	}
+	if s.data.Ports == nil {
+		s.data.Ports = make(map[string]uint16)
+	}
+	if s.data.Hosts == nil {
+		s.data.Hosts = make(map[string]string)
+	}
+	if s.data.Joins == nil {
+		s.data.Joins = make(map[string]time.Time)
+	}
+	if s.data.Demand == nil {
+		s.data.Demand = make(map[string][]DemandBucket)
+	}
+	if s.data.Backends == nil {
+		s.data.Backends = make(map[string]StaticBackend)
+	}
+	if s.data.Aliases == nil {
+		s.data.Aliases = make(map[string]string)
+	}
+	if s.data.Builds == nil {
+		s.data.Builds = make(map[string][]BuildRecord)
+	}
+	if s.data.Images == nil {
+		s.data.Images = make(map[string]ImageReport)
+	}
+	if s.data.Canaries == nil {
+		s.data.Canaries = make(map[string]Canary)
+	}
+	if s.data.APIKeys == nil {
+		s.data.APIKeys = make(map[string]APIKey)
+	}
+	if s.data.Secrets == nil {
+		s.data.Secrets = make(map[string]map[string]Secret)
+	}
+	if s.data.Settings == nil {
+		s.data.Settings = make(map[string]map[string]json.RawMessage)
+	}
+	if s.data.Running == nil {
+		s.data.Running = make(map[string]bool)
+	}
+	if s.data.Building == nil {
+		s.data.Building = make(map[string]InFlightBuild)
+	}
+	if s.data.Deleted == nil {
+		s.data.Deleted = make(map[string]time.Time)
+	}
+	if s.data.Draining == nil {
+		s.data.Draining = make(map[string]Drain)
+	}
+	return s, nil
+}
+
+// View calls the function passed with the current data of the State. The data must not be retained or
+// modified after the function returns.
+func (s *State) View(f func(data *stateData)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.data)
+}
+
+// Update calls the function passed with the current data of the State, allowing it to be modified, and saves
+// the result to disk.
+func (s *State) Update(f func(data *stateData)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.data)
+	return s.save()
+}
+
+// Flush writes the data of the State to disk, for example before prmanager exits.
+func (s *State) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+// save writes the data of the State to disk. It first writes to a temporary file which is then renamed, so
+// that a crash while writing never leaves a corrupted state file behind. s.mu must be held.
+func (s *State) save() error {
+	data, err := json.MarshalIndent(s.data, "", "\t")
+	if err != nil {
+		return fmt.Errorf("encode state: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("rename state: %w", err)
+	}
+	return nil
+}
+
+// stateMigrations holds the migrations of stateData, where the migration at index i migrates data at version i
+// to version i+1.
+var stateMigrations = []func(data *stateData, conf Config){
+	// Before servers could be scheduled onto multiple hosts, all of them ran on the first configured host.
+	func(data *stateData, conf Config) {
+		for pr := range data.Ports {
+			if _, ok := data.Hosts[pr]; !ok {
+				data.Hosts[pr] = conf.Hosts[0].Name
+			}
+		}
+	},
+}
+
+// MigrateState migrates the State stored at the path passed to the current version, returning the version it
+// was migrated from. The original file is kept with a .bak suffix. If the State is already at the current
+// version, it is left untouched.
+func MigrateState(path string, conf Config) (int, error) {
+	s, err := readState(path)
+	if err != nil {
+		return 0, err
+	}
+	from := s.data.Version
+	if from == stateVersion {
+		return from, nil
+	}
+	return from, s.migrate(conf)
+}
+
+// migrate migrates the data of the State to the current version and saves it, after copying the original file
+// to its path with a .bak suffix. State at a version newer than the current one can't be migrated.
+func (s *State) migrate(conf Config) error {
+	from := s.data.Version
+	if from > stateVersion {
+		return fmt.Errorf("state version %d is newer than the supported version %d", from, stateVersion)
+	}
+	original, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("read state: %w", err)
+	}
+	if err := os.WriteFile(s.path+".bak", original, 0644); err != nil {
+		return fmt.Errorf("back up state: %w", err)
+	}
+	for _, migrate := range stateMigrations[from:] {
+		migrate(&s.data, conf)
+	}
+	s.data.Version = stateVersion
+	return s.Flush()
+}
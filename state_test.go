@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenStateMigrates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	original := []byte(`{"ports": {"1": 20000}}`)
+	if err := os.WriteFile(path, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err := OpenState(path, Config{Hosts: []HostConfig{{Name: "local"}}})
+	if err != nil {
+		t.Fatalf("open state at version 0: %v", err)
+	}
+	state.View(func(data *stateData) {
+		if data.Version != stateVersion || data.Hosts["1"] != "local" {
+			t.Errorf("migrated state has version %d and hosts %v, want version %d with PR 1 on local", data.Version, data.Hosts, stateVersion)
+		}
+	})
+	if backup, err := os.ReadFile(path + ".bak"); err != nil || string(backup) != string(original) {
+		t.Errorf("backup = %q, %v, want original state", backup, err)
+	}
+	if _, err := OpenState(path, Config{}); err != nil {
+		t.Fatalf("reopen migrated state: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"version": 99}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenState(path, Config{}); err == nil {
+		t.Error("open state of a newer version: expected error")
+	}
+}
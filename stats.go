@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+)
+
+// ContainerStats holds resource usage statistics of the container running the server of a pull request.
+type ContainerStats struct {
+	// CPUPercent is the CPU usage of the container over the last sample period, where 100% equals a single
+	// core being fully utilised.
+	CPUPercent float64 `json:"cpu_percent"`
+	// CPUSeconds is the total CPU time consumed by the container since it was started.
+	CPUSeconds float64 `json:"cpu_seconds"`
+	// MemoryUsage is the memory used by the container in bytes, excluding the page cache.
+	MemoryUsage uint64 `json:"memory_usage_bytes"`
+	// MemoryLimit is the memory limit of the container in bytes.
+	MemoryLimit uint64 `json:"memory_limit_bytes"`
+	// NetworkReceived and NetworkTransmitted are the total bytes received and transmitted over all networks.
+	NetworkReceived    uint64 `json:"network_rx_bytes"`
+	NetworkTransmitted uint64 `json:"network_tx_bytes"`
+}
+
+// Stats retrieves the resource usage statistics of the server container of the given PR. If sample is true,
+// the Docker daemon waits for a second sample so that the current CPU usage can be calculated, which takes
+// around a second. If the server is not running, false is returned.
+func (d *Docker) Stats(ctx context.Context, pr string, sample bool) (ContainerStats, bool, error) {
+	var (
+		resp container.StatsResponseReader
+		err  error
+	)
+	if sample {
+		resp, err = d.client.ContainerStats(ctx, "pr-"+pr, false)
+	} else {
+		resp, err = d.client.ContainerStatsOneShot(ctx, "pr-"+pr)
+	}
+	if cerrdefs.IsNotFound(err) {
+		return ContainerStats{}, false, nil
+	} else if err != nil {
+		return ContainerStats{}, false, fmt.Errorf("container stats: %w", dockerError(err))
+	}
+	defer resp.Body.Close()
+
+	var s container.StatsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return ContainerStats{}, false, fmt.Errorf("decode stats: %w", err)
+	}
+	if s.Read.IsZero() || s.CPUStats.CPUUsage.TotalUsage == 0 {
+		// The container exists but is not running, so no stats are available.
+		return ContainerStats{}, false, nil
+	}
+
+	stats := ContainerStats{
+		CPUSeconds:  float64(s.CPUStats.CPUUsage.TotalUsage) / 1e9,
+		MemoryUsage: s.MemoryStats.Usage,
+		MemoryLimit: s.MemoryStats.Limit,
+	}
+	// The Docker CLI excludes inactive page cache from the memory usage, so we do the same for consistent
+	// numbers. The key differs between cgroup v1 and v2.
+	if cache, ok := s.MemoryStats.Stats["total_inactive_file"]; ok && cache < stats.MemoryUsage {
+		stats.MemoryUsage -= cache
+	} else if cache, ok := s.MemoryStats.Stats["inactive_file"]; ok && cache < stats.MemoryUsage {
+		stats.MemoryUsage -= cache
+	}
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+	if s.PreCPUStats.SystemUsage != 0 && systemDelta > 0 && cpuDelta > 0 {
+		stats.CPUPercent = cpuDelta / systemDelta * float64(s.CPUStats.OnlineCPUs) * 100
+	}
+	for _, n := range s.Networks {
+		stats.NetworkReceived += n.RxBytes
+		stats.NetworkTransmitted += n.TxBytes
+	}
+	return stats, true, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// statusPageTemplate is the template of the public status page, executed with a statusPage.
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Dragonfly PR previews</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: .5em; text-align: left; }
+code { background: #f3f3f3; padding: .1em .3em; }
+</style>
+</head>
+<body>
+<h1>Dragonfly PR previews</h1>
+{{if .PullRequests}}
+<table>
+<tr><th>PR</th><th>Title</th><th>Join address</th><th>Players online</th></tr>
+{{range .PullRequests}}
+<tr>
+<td>{{if $.Repository}}<a href="https://github.com/{{$.Repository}}/pull/{{.PR}}">#{{.PR}}</a>{{else}}#{{.PR}}{{end}}</td>
+<td>{{.Title}}{{if .Author}} by {{.Author}}{{end}}</td>
+<td><code>{{.JoinAddress}}</code></td>
+<td>{{if .Running}}{{.Players}}{{else}}offline{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No PR previews are active right now.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// statusPage holds the data the public status page is rendered with.
+type statusPage struct {
+	// Repository is the GitHub repository the pull requests are linked to, if configured.
+	Repository   string
+	PullRequests []statusPagePullRequest
+}
+
+// statusPagePullRequest is a pull request as listed on the public status page.
+type statusPagePullRequest struct {
+	PR, Title, Author string
+	JoinAddress       string
+	// Running specifies if the server of the pull request is running. Servers that aren't running are started
+	// when the first player joins.
+	Running bool
+	Players int
+}
+
+// handleStatusPage handles serving the public status page, an HTML page listing the previews of all deployed
+// pull requests with their title, the address to join them with and the number of players online. The
+// number of players is that of the last health check, so that serving the page never pings servers.
+func (r *Router) handleStatusPage(writer http.ResponseWriter, request *http.Request) {
+	logger := requestLogger(request)
+
+	deployments, err := r.backend.Deployments(request.Context())
+	if err != nil {
+		logger.Error("Failed to list pull requests", slog.Any("error", err))
+		http.Error(writer, "Failed to list pull requests", errorStatus(err))
+		return
+	}
+	page := statusPage{Repository: r.conf.GitHub.Repository}
+	for _, deployment := range deployments {
+		// Environments and sandboxes, such as canaries, aren't previews of their own.
+		if !validPullRequest(deployment.PR) || basePullRequest(deployment.PR) != deployment.PR {
+			continue
+		}
+		_, _, running, err := r.backend.ServerAddress(request.Context(), deployment.PR)
+		if err != nil {
+			logger.Error("Failed to get PR status", "pr", deployment.PR, slog.Any("error", err))
+			http.Error(writer, "Failed to get PR status", errorStatus(err))
+			return
+		}
+		players, _ := r.health.Players(deployment.PR)
+		page.PullRequests = append(page.PullRequests, statusPagePullRequest{
+			PR:          deployment.PR,
+			Title:       deployment.Title,
+			Author:      deployment.Author,
+			JoinAddress: expand(r.conf.StatusPage.JoinAddress, deployment.PR),
+			Running:     running,
+			Players:     players,
+		})
+	}
+	// The newest pull requests are listed first.
+	slices.Reverse(page.PullRequests)
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPageTemplate.Execute(writer, page); err != nil {
+		logger.Error("Failed to render status page", slog.Any("error", err))
+	}
+}
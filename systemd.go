@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// sdNotify sends a state notification, such as READY=1, to systemd. If prmanager was not started by systemd
+// with Type=notify, sdNotify does nothing.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// Abstract sockets are prefixed with a null byte rather than @.
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("dial notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("write notify socket: %w", err)
+	}
+	return nil
+}
+
+// watchdogInterval returns the interval at which systemd expects watchdog pings, or false if the watchdog is
+// not enabled for prmanager.
+func watchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// runWatchdog pings the systemd watchdog at half the interval it expects until the context passed is
+// cancelled. If the watchdog is not enabled, runWatchdog returns immediately.
+func runWatchdog(ctx context.Context) {
+	interval, ok := watchdogInterval()
+	if !ok {
+		return
+	}
+	slog.Info("Pinging systemd watchdog", slog.Duration("interval", interval/2))
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("Failed to ping systemd watchdog", slog.Any("error", err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation.
+const listenFDsStart = 3
+
+// activatedSockets holds the sockets passed to prmanager by systemd socket activation or by the prmanager
+// process it replaced during an upgrade.
+type activatedSockets struct {
+	listeners []net.Listener
+	conns     []net.PacketConn
+	// ready is the pipe the prmanager process replaced during an upgrade waits on for this process to be
+	// ready, or nil if prmanager wasn't upgraded.
+	ready *os.File
+}
+
+// inheritedSockets returns the sockets passed to prmanager by systemd socket activation or by the process it
+// replaced during an upgrade. Stream sockets are returned as listeners and datagram sockets as packet
+// connections. If no sockets were passed, none are returned.
+func inheritedSockets() (activatedSockets, error) {
+	var sockets activatedSockets
+	if fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv)); err == nil && upgraded() {
+		syscall.CloseOnExec(fd)
+		sockets.ready = os.NewFile(uintptr(fd), "ready")
+	}
+	n, err := inheritedFDs()
+	if err != nil {
+		return sockets, err
+	}
+
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+		if err != nil {
+			return sockets, fmt.Errorf("socket type of fd %d: %w", fd, err)
+		}
+		switch typ {
+		case syscall.SOCK_STREAM:
+			l, err := net.FileListener(f)
+			if err != nil {
+				return sockets, fmt.Errorf("listener of fd %d: %w", fd, err)
+			}
+			sockets.listeners = append(sockets.listeners, l)
+		case syscall.SOCK_DGRAM:
+			conn, err := net.FilePacketConn(f)
+			if err != nil {
+				return sockets, fmt.Errorf("packet conn of fd %d: %w", fd, err)
+			}
+			sockets.conns = append(sockets.conns, conn)
+		default:
+			return sockets, fmt.Errorf("fd %d has unsupported socket type %d", fd, typ)
+		}
+		// The net package duplicates the descriptor, so the original can be closed.
+		_ = f.Close()
+	}
+	return sockets, nil
+}
+
+// inheritedFDs returns the number of sockets passed to prmanager, starting at listenFDsStart.
+func inheritedFDs() (int, error) {
+	// The variables must not be inherited by the processes prmanager starts.
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+		_ = os.Unsetenv(upgradeFDsEnv)
+		_ = os.Unsetenv(upgradeReadyEnv)
+	}()
+	name := upgradeFDsEnv
+	if os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		name = "LISTEN_FDS"
+	} else if os.Getenv(upgradeFDsEnv) == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", name, err)
+	}
+	return n, nil
+}
+
+// listener returns the first activated stream socket, or listens on the TCP address passed if there is none.
+func (s activatedSockets) listener(addr string) (net.Listener, error) {
+	if len(s.listeners) > 0 {
+		slog.Info("Using socket activated listener", "addr", s.listeners[0].Addr())
+		return s.listeners[0], nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// packetConn returns the first activated datagram socket, or listens on the UDP address passed if there is
+// none.
+func (s activatedSockets) packetConn(addr string) (net.PacketConn, error) {
+	if len(s.conns) > 0 {
+		slog.Info("Using socket activated packet connection", "addr", s.conns[0].LocalAddr())
+		return s.conns[0], nil
+	}
+	return net.ListenPacket("udp", addr)
+}
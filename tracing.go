@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of prmanager. Until tracing is set up, or if it is disabled, spans are not recorded.
+var tracer = otel.Tracer("github.com/df-mc/prmanager")
+
+// setupTracing sets up exporting spans to the OTLP endpoint in the configuration passed. The function returned
+// flushes any spans not yet exported and stops exporting. If no endpoint is configured, tracing is disabled.
+func setupTracing(ctx context.Context, conf Config) (func(ctx context.Context) error, error) {
+	if conf.Tracing.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(conf.Tracing.Endpoint)}
+	if conf.Tracing.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("create exporter: %w", err)
+	}
+	res, err := resource.New(ctx, resource.WithAttributes(semconv.ServiceName("prmanager")), resource.WithHost(), resource.WithFromEnv())
+	if err != nil {
+		return nil, fmt.Errorf("create resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// traceHandler wraps the http.Handler passed so that a span is recorded for every request it handles, named
+// after the method and route of the request.
+func traceHandler(h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, "api", otelhttp.WithSpanNameFormatter(func(operation string, request *http.Request) string {
+		if request.Pattern == "" {
+			return operation + " " + request.Method
+		}
+		return request.Pattern
+	}))
+}
+
+// startSpan starts a span with the name passed as a child of any span in the context passed. The PR passed is
+// recorded as an attribute of the span if not empty.
+func startSpan(ctx context.Context, name, pr string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if pr != "" {
+		attrs = append(attrs, attribute.String("pr", pr))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// spanError records the error passed on the span, marking it as failed, and returns the error. If the error is
+// nil, the span is left untouched.
+func spanError(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// upgradeFDsEnv is the environment variable holding the number of sockets passed to a prmanager process
+	// that replaces the running one during an upgrade.
+	upgradeFDsEnv = "PRMANAGER_LISTEN_FDS"
+	// upgradeReadyEnv is the environment variable holding the file descriptor of the pipe a prmanager process
+	// replacing the running one during an upgrade reports being ready on.
+	upgradeReadyEnv = "PRMANAGER_READY_FD"
+	// upgradeReadyTimeout is the time the new process is given to report being ready during an upgrade.
+	upgradeReadyTimeout = 5 * time.Minute
+)
+
+// upgraded checks if prmanager was started by a previous prmanager process that it replaces. It must be called
+// before inheritedSockets clears the environment.
+func upgraded() bool {
+	return os.Getenv(upgradeFDsEnv) != ""
+}
+
+// filer is implemented by network sockets that can return a duplicate of their file descriptor.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// socketFiles returns duplicates of the file descriptors of the listener and packet connection passed, so
+// that they may be passed to a new process.
+func socketFiles(l net.Listener, conn net.PacketConn) ([]*os.File, error) {
+	var files []*os.File
+	for _, s := range []any{l, conn} {
+		f, ok := s.(filer)
+		if !ok {
+			return nil, fmt.Errorf("socket %T has no file descriptor", s)
+		}
+		file, err := f.File()
+		if err != nil {
+			return nil, fmt.Errorf("socket file: %w", err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// upgrader replaces the running prmanager process with a new one started from the executable on disk,
+// passing the sockets it listens on so that they are never closed in the meantime.
+type upgrader struct {
+	executable string
+	files      []*os.File
+}
+
+// newUpgrader prepares an upgrade of prmanager, duplicating the sockets of the listener and packet connection
+// passed. The sockets are duplicated before prmanager shuts down, as shutting down closes the originals.
+func newUpgrader(l net.Listener, conn net.PacketConn) (*upgrader, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("find executable: %w", err)
+	}
+	if _, err := os.Stat(executable); err != nil {
+		return nil, fmt.Errorf("stat executable: %w", err)
+	}
+	files, err := socketFiles(l, conn)
+	if err != nil {
+		return nil, err
+	}
+	return &upgrader{executable: executable, files: files}, nil
+}
+
+// start starts the new prmanager process with the same arguments, passing it the sockets of the upgrader. It
+// waits for the new process to report being ready, only releasing the sockets once it has, so that they stay
+// open as long as either process may still be using them.
+func (u *upgrader) start() error {
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("create ready pipe: %w", err)
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(u.executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// The watchdog is pinged by the new process once it is the main process of the service.
+	cmd.Env = slices.DeleteFunc(os.Environ(), func(v string) bool { return strings.HasPrefix(v, "WATCHDOG_PID=") })
+	cmd.Env = append(cmd.Env, upgradeFDsEnv+"="+strconv.Itoa(len(u.files)), upgradeReadyEnv+"="+strconv.Itoa(listenFDsStart+len(u.files)))
+	cmd.ExtraFiles = append(slices.Clone(u.files), readyW)
+	err = cmd.Start()
+	_ = readyW.Close()
+	if err != nil {
+		return fmt.Errorf("start %s: %w", u.executable, err)
+	}
+	slog.Info("Started upgraded prmanager process, waiting for it to be ready", slog.Int("pid", cmd.Process.Pid))
+
+	// The new process writes a byte once it is ready. If it exits first, the pipe is closed without one.
+	_ = ready.SetReadDeadline(time.Now().Add(upgradeReadyTimeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("wait for upgraded process %d to be ready: %w", cmd.Process.Pid, err)
+	}
+	slog.Info("Upgraded prmanager process is ready", slog.Int("pid", cmd.Process.Pid))
+	for _, f := range u.files {
+		_ = f.Close()
+	}
+	return cmd.Process.Release()
+}
+
+// notifyUpgradeReady reports that this process, which replaced a previous prmanager process during an upgrade,
+// is ready. systemd is told that it is the main process of the service now, as the previous process exits,
+// after which the previous process is told through the ready pipe passed, so that it releases its sockets. If
+// prmanager wasn't upgraded, the pipe is nil and only readiness is signalled to systemd.
+func notifyUpgradeReady(ready *os.File) error {
+	if ready == nil {
+		return sdNotify("READY=1")
+	}
+	defer ready.Close()
+	if err := sdNotify("MAINPID=" + strconv.Itoa(os.Getpid()) + "\nREADY=1"); err != nil {
+		slog.Warn("Failed to notify systemd of new main process", slog.Any("error", err))
+	}
+	if _, err := ready.Write([]byte{1}); err != nil {
+		return fmt.Errorf("notify previous process: %w", err)
+	}
+	return nil
+}